@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+)
+
+func main() {
+	// Parse command line flags
+	prefix := flag.String("prefix", "recordings/", "Only look at uploads of keys starting with this")
+	abort := flag.Bool("abort", false, "Abort the listed uploads, deleting their parts")
+	olderThan := flag.Duration("older-than", 24*time.Hour, "With -abort, only abort uploads started longer ago than this")
+	resume := flag.String("resume", "", "Finish the incomplete upload of this key from -file")
+	file := flag.String("file", "", "Local copy of the file being uploaded, for -resume")
+	dryRun := flag.Bool("dry-run", false, "List the uploads that would be aborted or resumed without changing anything")
+	timeout := flag.Duration("timeout", time.Hour, "Give up if the run takes longer than this")
+	flag.Parse()
+
+	if *resume != "" && *file == "" {
+		log.Printf("[UPLOADS] ERROR: -resume needs -file")
+		os.Exit(1)
+	}
+	if *resume != "" && *abort {
+		log.Printf("[UPLOADS] ERROR: Use either -resume or -abort")
+		os.Exit(1)
+	}
+
+	// Load environment variables from .env file
+	log.Printf("[UPLOADS] Loading environment variables...")
+	if err := godotenv.Load("../../.env"); err != nil {
+		log.Printf("[UPLOADS] WARNING: Could not load .env file: %v", err)
+		log.Printf("[UPLOADS] Will attempt to use environment variables directly")
+	}
+
+	log.Printf("[UPLOADS] Initializing bucket client...")
+	storage, err := bucket.NewStorage()
+	if err != nil {
+		log.Printf("[UPLOADS] ERROR: Failed to create bucket client: %v", err)
+		log.Printf("[UPLOADS] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY are set")
+		os.Exit(1)
+	}
+	uploads, ok := storage.(bucket.Uploads)
+	if !ok {
+		log.Printf("[UPLOADS] Bucket %s stores uploads in one piece, so none can be incomplete", storage.BucketName())
+		return
+	}
+
+	// Stop cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	listPrefix := *prefix
+	if *resume != "" {
+		listPrefix = *resume
+	}
+	incomplete, err := uploads.ListIncompleteUploadsWithContext(ctx, listPrefix)
+	if err != nil {
+		log.Printf("[UPLOADS] ERROR: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("[UPLOADS] Found %d incomplete uploads under %s", len(incomplete), listPrefix)
+	for _, upload := range incomplete {
+		log.Printf("[UPLOADS] - %s (started %s, upload %s)", upload.Key, upload.Initiated.Format(time.RFC3339), upload.UploadID)
+	}
+
+	switch {
+	case *resume != "":
+		if err := resumeUpload(ctx, uploads, incomplete, *resume, *file, *dryRun); err != nil {
+			log.Printf("[UPLOADS] ERROR: %v", err)
+			os.Exit(1)
+		}
+	case *abort:
+		if failed := abortUploads(ctx, uploads, incomplete, time.Now().Add(-*olderThan), *dryRun); failed > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// resumeUpload finishes the most recent incomplete upload of key from a local file
+func resumeUpload(ctx context.Context, uploads bucket.Uploads, incomplete []bucket.IncompleteUpload, key, path string, dryRun bool) error {
+	var latest *bucket.IncompleteUpload
+	for i, upload := range incomplete {
+		if upload.Key == key && (latest == nil || upload.Initiated.After(latest.Initiated)) {
+			latest = &incomplete[i]
+		}
+	}
+	if latest == nil {
+		log.Printf("[UPLOADS] No incomplete upload of %s to resume", key)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		log.Printf("[UPLOADS] DRY RUN: Would resume upload %s of %s from %s (%d bytes)", latest.UploadID, key, path, stat.Size())
+		return nil
+	}
+	log.Printf("[UPLOADS] Resuming upload %s of %s from %s (%d bytes)", latest.UploadID, key, path, stat.Size())
+	opts := bucket.UploadOptions{LeavePartsOnError: true}
+	if err := uploads.ResumeUploadWithContext(ctx, *latest, f, stat.Size(), opts); err != nil {
+		return err
+	}
+	log.Printf("[UPLOADS] Finished upload of %s", key)
+	return nil
+}
+
+// abortUploads aborts the uploads started before cutoff, returning how many
+// couldn't be aborted
+func abortUploads(ctx context.Context, uploads bucket.Uploads, incomplete []bucket.IncompleteUpload, cutoff time.Time, dryRun bool) int {
+	var aborted, skipped, failed int
+	for _, upload := range incomplete {
+		if upload.Initiated.After(cutoff) {
+			// It may still be in progress
+			skipped++
+			continue
+		}
+		if dryRun {
+			log.Printf("[UPLOADS] DRY RUN: Would abort upload %s of %s", upload.UploadID, upload.Key)
+			aborted++
+			continue
+		}
+		if err := uploads.AbortUploadWithContext(ctx, upload); err != nil {
+			log.Printf("[UPLOADS] ERROR: Failed to abort upload %s of %s: %v", upload.UploadID, upload.Key, err)
+			failed++
+			continue
+		}
+		log.Printf("[UPLOADS] Aborted upload %s of %s", upload.UploadID, upload.Key)
+		aborted++
+	}
+	log.Printf("[UPLOADS] %s %d uploads, skipped %d started since %s, %d failed",
+		map[bool]string{true: "Would abort", false: "Aborted"}[dryRun], aborted, skipped, cutoff.Format(time.RFC3339), failed)
+	return failed
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/trellis/internal/fragments"
+)
+
+func main() {
+	// Parse command line flags
+	dryRun := flag.Bool("dry-run", false, "List the fragments that would be merged without changing anything")
+	timeout := flag.Duration("timeout", time.Hour, "Give up if the run takes longer than this")
+	owner := flag.String("owner", "", "Only merge recordings uploaded by this user")
+	date := flag.String("date", "", "Only merge recordings from this date (YYYY-MM-DD)")
+	flag.Parse()
+
+	if *date != "" {
+		if _, err := time.Parse("2006-01-02", *date); err != nil {
+			log.Printf("[MERGE] ERROR: Invalid -date %q, expected YYYY-MM-DD", *date)
+			os.Exit(1)
+		}
+	}
+
+	if *dryRun {
+		log.Printf("[MERGE] 🔍 Starting fragment merge (DRY RUN)")
+	} else {
+		log.Printf("[MERGE] 🧩 Starting fragment merge")
+	}
+
+	// Load environment variables from .env file
+	log.Printf("[MERGE] Loading environment variables...")
+	if err := godotenv.Load("../../.env"); err != nil {
+		log.Printf("[MERGE] WARNING: Could not load .env file: %v", err)
+		log.Printf("[MERGE] Will attempt to use environment variables directly")
+	} else {
+		log.Printf("[MERGE] Successfully loaded .env file")
+	}
+
+	log.Printf("[MERGE] Initializing bucket client...")
+	bucketClient, err := bucket.NewStorage()
+	if err != nil {
+		log.Printf("[MERGE] ERROR: Failed to create bucket client: %v", err)
+		log.Printf("[MERGE] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY (or BUCKET_LOCAL_DIR) are set")
+		os.Exit(1)
+	}
+
+	// Stop cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	filter := fragments.Filter{Owner: *owner, Date: *date}
+	if err := fragments.MergeFragments(ctx, bucketClient, *dryRun, filter); err != nil {
+		log.Printf("[MERGE] ERROR: %v", err)
+		os.Exit(1)
+	}
+
+	if *dryRun {
+		log.Printf("[MERGE] 🎯 Dry run complete - no changes were made")
+	} else {
+		log.Printf("[MERGE] 🎉 Fragment merge complete!")
+	}
+}
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
 	"cabbage.town/trellis/internal/posts"
+	"cabbage.town/trellis/trellis"
 )
 
 func main() {
 	// Parse command line flags
 	dryRun := flag.Bool("dry-run", false, "Perform a dry run without making changes")
+	timeout := flag.Duration("timeout", time.Hour, "Give up if the run takes longer than this")
 	flag.Parse()
 
 	if *dryRun {
@@ -34,14 +40,20 @@ func main() {
 
 	// Initialize bucket client
 	log.Printf("[UPDATE_POSTS] Initializing bucket client...")
-	bucketClient, err := bucket.NewClient()
+	bucketClient, err := bucket.NewStorage()
 	if err != nil {
 		log.Printf("[UPDATE_POSTS] ERROR: Failed to create bucket client: %v", err)
-		log.Printf("[UPDATE_POSTS] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY are set")
+		log.Printf("[UPDATE_POSTS] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY (or BUCKET_LOCAL_DIR) are set")
 		os.Exit(1)
 	}
 	log.Printf("[UPDATE_POSTS] Successfully created bucket client")
 
+	// Stop cleanly on Ctrl-C or when the workflow runner cancels the job
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
 	if *dryRun {
 		log.Printf("[UPDATE_POSTS] DRY RUN: Would generate static post pages and posts.json")
 		log.Printf("[UPDATE_POSTS] 🎯 Dry run complete - no changes were made")
@@ -58,10 +70,26 @@ func main() {
 	}
 
 	log.Printf("[UPDATE_POSTS] Generating static post pages...")
-	if err := posts.Run(config); err != nil {
+	if err := posts.Run(ctx, config); err != nil {
 		log.Printf("[UPDATE_POSTS] ERROR: Failed to generate posts: %v", err)
 		os.Exit(1)
 	}
 
+	// Podcast and archive feeds, served from the site root
+	log.Printf("[UPDATE_POSTS] Generating feeds...")
+	feedConfig := trellis.Config{
+		BucketClient:     bucketClient,
+		OutputDir:        playlistsDir,
+		RSSFile:          "feed.xml",
+		ShowFeedsDir:     "feeds",
+		JSONFeedFile:     "feed.json",
+		AtomFile:         "atom.xml",
+		PodcastNamespace: true,
+	}
+	if err := trellis.Run(ctx, feedConfig); err != nil {
+		log.Printf("[UPDATE_POSTS] ERROR: Failed to generate feeds: %v", err)
+		os.Exit(1)
+	}
+
 	log.Printf("[UPDATE_POSTS] 🎉 Post update complete!")
 }
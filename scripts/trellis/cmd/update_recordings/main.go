@@ -1,23 +1,34 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
 	"cabbage.town/trellis/internal/acls"
+	"cabbage.town/trellis/internal/analysis"
 	"cabbage.town/trellis/internal/metadata"
+	"cabbage.town/trellis/internal/state"
 )
 
 func main() {
 	// Parse command line flags
 	dryRun := flag.Bool("dry-run", false, "Perform a dry run without making changes")
+	timeout := flag.Duration("timeout", time.Hour, "Give up if the run takes longer than this")
 	skipACL := flag.Bool("skip-acl", false, "Skip ACL updates")
+	skipAnalysis := flag.Bool("skip-analysis", false, "Skip loudness, waveform and silence analysis")
+	analysisBudget := flag.Duration("analysis-budget", 30*time.Minute, "Leave recordings for the next run once analysis has taken this long (0 for no limit)")
 	skipMetadata := flag.Bool("skip-metadata", false, "Skip ID3 metadata processing")
+	retagAll := flag.Bool("retag-all", false, "Re-tag every recording, even ones whose tags are up to date")
 	flag.Parse()
 
 	// Get subcommand from args
@@ -32,17 +43,23 @@ func main() {
 	case "", "all":
 		// Run all steps (default behavior)
 	case "acls":
+		*skipAnalysis = true
+		*skipMetadata = true
+	case "analysis":
+		*skipACL = true
 		*skipMetadata = true
 	case "metadata":
 		*skipACL = true
+		*skipAnalysis = true
 	default:
 		fmt.Printf("Error: Unknown subcommand '%s'\n", subcommand)
 		fmt.Println("Usage: update_recordings [OPTIONS] [SUBCOMMAND]")
 		fmt.Println("")
 		fmt.Println("Subcommands:")
 		fmt.Println("  all        Run all steps (default)")
-		fmt.Println("  acls       Update ACLs for recent recordings only")
-		fmt.Println("  metadata   Add ID3 metadata to recent recordings only")
+		fmt.Println("  acls       Update ACLs for new or changed recordings only")
+		fmt.Println("  analysis   Measure loudness, draw waveforms and find dead air in new recordings only")
+		fmt.Println("  metadata   Update ID3 metadata of recordings whose tags are out of date only")
 		fmt.Println("")
 		fmt.Println("Options:")
 		flag.PrintDefaults()
@@ -63,7 +80,9 @@ func main() {
 	log.Printf("[WORKFLOW] - Subcommand: %s", subcommand)
 	log.Printf("[WORKFLOW] - Dry run: %v", *dryRun)
 	log.Printf("[WORKFLOW] - Skip ACL: %v", *skipACL)
+	log.Printf("[WORKFLOW] - Skip analysis: %v", *skipAnalysis)
 	log.Printf("[WORKFLOW] - Skip metadata: %v", *skipMetadata)
+	log.Printf("[WORKFLOW] - Re-tag all: %v", *retagAll)
 
 	// Load environment variables from .env file
 	log.Printf("[WORKFLOW] Loading environment variables...")
@@ -76,18 +95,79 @@ func main() {
 
 	// Initialize shared bucket client
 	log.Printf("[WORKFLOW] Initializing shared bucket client...")
-	bucketClient, err := bucket.NewClient()
+	bucketClient, err := bucket.NewStorage()
 	if err != nil {
 		log.Printf("[WORKFLOW] ERROR: Failed to create bucket client: %v", err)
-		log.Printf("[WORKFLOW] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY are set")
+		log.Printf("[WORKFLOW] Please ensure DO_ACCESS_KEY_ID and DO_SECRET_ACCESS_KEY (or BUCKET_LOCAL_DIR) are set")
 		os.Exit(1)
 	}
 	log.Printf("[WORKFLOW] Successfully created shared bucket client")
 
-	// Step 1: Update ACLs for recent recordings
+	// Stop cleanly on Ctrl-C or when the workflow runner cancels the job
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	// Each step works on the recordings that changed since it last handled them
+	log.Printf("[WORKFLOW] Loading sync state from %s...", state.Key)
+	st, err := state.Load(ctx, bucketClient)
+	if err != nil {
+		log.Printf("[WORKFLOW] ERROR: Failed to load sync state: %v", err)
+		os.Exit(1)
+	}
+	if st.Fresh() {
+		log.Printf("[WORKFLOW] No sync state yet, starting a new one")
+	} else {
+		log.Printf("[WORKFLOW] Sync state last saved %s", st.UpdatedAt.Format(time.RFC3339))
+	}
+
+	// saveState keeps what each step did, even if a later step fails or the
+	// run times out
+	saveState := func() {
+		if *dryRun {
+			return
+		}
+		saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if manifest, err := catalog.NewStore(bucketClient).Sync(saveCtx); err != nil {
+			log.Printf("[WORKFLOW] WARNING: Failed to sync catalog, keeping state of deleted recordings: %v", err)
+		} else {
+			keys := make(map[string]bool, len(manifest.Recordings))
+			for key := range manifest.Recordings {
+				keys[key] = true
+			}
+			if n := st.Prune(keys); n > 0 {
+				log.Printf("[WORKFLOW] Forgot %d recordings that no longer exist", n)
+			}
+		}
+		if err := st.Save(saveCtx, bucketClient); err != nil {
+			log.Printf("[WORKFLOW] ERROR: Failed to save sync state: %v", err)
+			os.Exit(1)
+		}
+		summary := st.Summary()
+		for _, step := range []string{state.StepACL, state.StepAnalysis, state.StepMetadata} {
+			counts, ok := summary[step]
+			if !ok {
+				continue
+			}
+			log.Printf("[WORKFLOW] Sync state for %s: %d done, %d skipped, %d failed", step, counts[state.Done], counts[state.Skipped], counts[state.Failed])
+			stuck := st.Stuck(step)
+			if len(stuck) == 0 {
+				continue
+			}
+			log.Printf("[WORKFLOW] WARNING: %s gave up on %d recordings after %d failures in a row, until they change:", step, len(stuck), state.MaxFailures)
+			for _, key := range stuck {
+				log.Printf("[WORKFLOW]   %s: %s", key, st.Get(step, key).Error)
+			}
+		}
+	}
+
+	// Step 1: Update ACLs for new or changed recordings
 	if !*skipACL {
-		log.Printf("[WORKFLOW] 📋 Step 1: Updating ACLs for recent recordings...")
-		err := acls.UpdateACLs(*dryRun)
+		log.Printf("[WORKFLOW] 📋 Step 1: Updating ACLs for new or changed recordings...")
+		err := acls.UpdateACLs(ctx, bucketClient, st, *dryRun)
+		saveState()
 		if err != nil {
 			log.Printf("[WORKFLOW] ERROR: Step 1 failed: %v", err)
 			os.Exit(1)
@@ -97,17 +177,32 @@ func main() {
 		log.Printf("[WORKFLOW] ⏭️  Step 1: Skipping ACL updates")
 	}
 
-	// Step 2: Add ID3 metadata to recent recordings
-	if !*skipMetadata {
-		log.Printf("[WORKFLOW] 🏷️  Step 2: Adding ID3 metadata to recent recordings...")
-		err := metadata.UpdateMetadata(bucketClient, *dryRun)
+	// Step 2: Analyze audio, before tagging so the ReplayGain tags can be written
+	if !*skipAnalysis {
+		log.Printf("[WORKFLOW] 🔊 Step 2: Analyzing new recordings...")
+		err := analysis.AnalyzeRecordings(ctx, bucketClient, st, *dryRun, *analysisBudget)
+		saveState()
 		if err != nil {
 			log.Printf("[WORKFLOW] ERROR: Step 2 failed: %v", err)
 			os.Exit(1)
 		}
 		log.Printf("[WORKFLOW] ✅ Step 2 completed successfully")
 	} else {
-		log.Printf("[WORKFLOW] ⏭️  Step 2: Skipping metadata updates")
+		log.Printf("[WORKFLOW] ⏭️  Step 2: Skipping analysis")
+	}
+
+	// Step 3: Add ID3 metadata to recordings whose tags are out of date
+	if !*skipMetadata {
+		log.Printf("[WORKFLOW] 🏷️  Step 3: Updating ID3 metadata of out-of-date recordings...")
+		err := metadata.UpdateMetadata(ctx, bucketClient, st, *dryRun, *retagAll)
+		saveState()
+		if err != nil {
+			log.Printf("[WORKFLOW] ERROR: Step 3 failed: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("[WORKFLOW] ✅ Step 3 completed successfully")
+	} else {
+		log.Printf("[WORKFLOW] ⏭️  Step 3: Skipping metadata updates")
 	}
 
 	if *dryRun {
@@ -8,11 +8,14 @@ require (
 	cabbage.town/shed.cabbage.town v0.0.0
 	github.com/aws/aws-sdk-go v1.50.35
 	github.com/joho/godotenv v1.5.1
+	github.com/yuin/goldmark v1.7.8
 )
 
 replace cabbage.town/shed.cabbage.town => ../../shed.cabbage.town
 
 require (
+	github.com/hajimehoshi/go-mp3 v0.3.4 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/time v0.12.0 // indirect
 )
@@ -0,0 +1,249 @@
+package acls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+	"cabbage.town/trellis/internal/state"
+)
+
+const (
+	newRecording      = "recordings/ted/stream_20240101-200000.mp3"
+	privatedRecording = "recordings/ted/stream_20240102-200000.mp3"
+	oldRecording      = "recordings/brennan/stream_20200101-200000.mp3"
+)
+
+var errInjected = errors.New("injected failure")
+
+// newBucket returns a bucket with a private recording of ted's, one ted made
+// private in shed, and a private recording of brennan's last modified years
+// ago
+func newBucket(t *testing.T) *bucket.MemoryClient {
+	t.Helper()
+	storage := bucket.NewMemoryClient("test")
+	put := func(key string, metadata map[string]*string) {
+		body := bytes.NewReader(mp3test.Silence(10, false))
+		if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", metadata, "private"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(newRecording, nil)
+	put(privatedRecording, map[string]*string{"Manually-Privated": aws.String("true")})
+	put(oldRecording, nil)
+	if err := storage.SetLastModified(oldRecording, time.Now().AddDate(-4, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func isPublic(t *testing.T, storage bucket.Storage, key string) bool {
+	t.Helper()
+	acl, err := storage.GetObjectACL(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket.IsPublic(acl)
+}
+
+// loadedState returns an empty state that isn't Fresh, as after any run
+// since the state was introduced
+func loadedState(t *testing.T) *state.State {
+	t.Helper()
+	storage := bucket.NewMemoryClient("state")
+	if err := state.New().Save(context.Background(), storage); err != nil {
+		t.Fatal(err)
+	}
+	st, err := state.Load(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestUpdateACLs(t *testing.T) {
+	tests := []struct {
+		name        string
+		fresh       bool
+		dryRun      bool
+		fault       *bucket.Fault
+		wantPublic  map[string]bool
+		wantOutcome map[string]state.Outcome
+	}{
+		{
+			name:        "publishes everything not made private",
+			wantPublic:  map[string]bool{newRecording: true, privatedRecording: false, oldRecording: true},
+			wantOutcome: map[string]state.Outcome{newRecording: state.Done, privatedRecording: state.Skipped, oldRecording: state.Done},
+		},
+		{
+			name:        "first run leaves old recordings alone",
+			fresh:       true,
+			wantPublic:  map[string]bool{newRecording: true, privatedRecording: false, oldRecording: false},
+			wantOutcome: map[string]state.Outcome{newRecording: state.Done, privatedRecording: state.Skipped, oldRecording: state.Skipped},
+		},
+		{
+			name:        "dry run changes nothing",
+			dryRun:      true,
+			wantPublic:  map[string]bool{newRecording: false, privatedRecording: false, oldRecording: false},
+			wantOutcome: map[string]state.Outcome{newRecording: state.Done, privatedRecording: state.Skipped, oldRecording: state.Done},
+		},
+		{
+			name:        "ACL can't be read",
+			fault:       &bucket.Fault{Op: bucket.OpGetObjectACL, Key: newRecording, Err: errInjected},
+			wantPublic:  map[string]bool{newRecording: false, privatedRecording: false, oldRecording: true},
+			wantOutcome: map[string]state.Outcome{newRecording: state.Failed, privatedRecording: state.Skipped, oldRecording: state.Done},
+		},
+		{
+			name:        "ACL can't be set",
+			fault:       &bucket.Fault{Op: bucket.OpPutObjectACL, Key: "recordings/brennan/*", Err: errInjected},
+			wantPublic:  map[string]bool{newRecording: true, privatedRecording: false, oldRecording: false},
+			wantOutcome: map[string]state.Outcome{newRecording: state.Done, privatedRecording: state.Skipped, oldRecording: state.Failed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newBucket(t)
+			st := state.New()
+			if !tt.fresh {
+				st = loadedState(t)
+			}
+			if tt.fault != nil {
+				storage.Inject(*tt.fault)
+			}
+
+			if err := UpdateACLs(context.Background(), storage, st, tt.dryRun); err != nil {
+				t.Fatal(err)
+			}
+
+			storage.ClearFaults()
+			for key, want := range tt.wantPublic {
+				if got := isPublic(t, storage, key); got != want {
+					t.Errorf("%s public = %v, want %v", key, got, want)
+				}
+			}
+			for key, want := range tt.wantOutcome {
+				r := st.Get(state.StepACL, key)
+				if r == nil {
+					t.Errorf("%s has no record, want %s", key, want)
+				} else if r.Outcome != want {
+					t.Errorf("%s outcome = %s, want %s", key, r.Outcome, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateACLsSkipsHandledRecordings(t *testing.T) {
+	storage := newBucket(t)
+	st := loadedState(t)
+	ctx := context.Background()
+	if err := UpdateACLs(ctx, storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DJ making a recording private again doesn't change its audio, so
+	// the next run leaves it private
+	if err := storage.PutObjectACL(newRecording, "private"); err != nil {
+		t.Fatal(err)
+	}
+	before := storage.Calls(bucket.OpGetObjectACL)
+	if err := UpdateACLs(ctx, storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpGetObjectACL) - before; calls != 0 {
+		t.Errorf("checked %d ACLs, want none", calls)
+	}
+	if isPublic(t, storage, newRecording) {
+		t.Errorf("%s was published again", newRecording)
+	}
+}
+
+func TestUpdateACLsRetriesFailures(t *testing.T) {
+	storage := newBucket(t)
+	st := loadedState(t)
+	ctx := context.Background()
+
+	storage.Inject(bucket.Fault{Op: bucket.OpPutObjectACL, Key: newRecording, Err: errInjected, Times: 1})
+	if err := UpdateACLs(ctx, storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	if isPublic(t, storage, newRecording) {
+		t.Fatalf("%s is public despite the failure", newRecording)
+	}
+
+	if err := UpdateACLs(ctx, storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	if !isPublic(t, storage, newRecording) {
+		t.Errorf("%s wasn't published on the next run", newRecording)
+	}
+}
+
+func TestUpdateACLsListingFails(t *testing.T) {
+	storage := newBucket(t)
+	st := loadedState(t)
+	storage.Inject(bucket.Fault{Op: bucket.OpListObjects, Key: "recordings/ted/", Err: errInjected})
+
+	// One DJ's listing failing doesn't hold up the others
+	if err := UpdateACLs(context.Background(), storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	storage.ClearFaults()
+	if isPublic(t, storage, newRecording) {
+		t.Errorf("%s is public, though its listing failed", newRecording)
+	}
+	if !isPublic(t, storage, oldRecording) {
+		t.Errorf("%s isn't public", oldRecording)
+	}
+}
+
+func TestUpdateACLsOnlyPublishesOptedInShows(t *testing.T) {
+	storage := newBucket(t)
+	// katherine's show is in the built-in registry, but without autoPublish
+	const key = "recordings/katherine/stream_20240101-200000.mp3"
+	body := bytes.NewReader(mp3test.Silence(10, false))
+	if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := loadedState(t)
+	if err := UpdateACLs(context.Background(), storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	if isPublic(t, storage, key) {
+		t.Errorf("%s was published", key)
+	}
+	if !isPublic(t, storage, newRecording) {
+		t.Errorf("%s wasn't published", newRecording)
+	}
+}
+
+func TestUpdateACLsGivesUpOnStuckRecordings(t *testing.T) {
+	storage := newBucket(t)
+	st := loadedState(t)
+	ctx := context.Background()
+
+	storage.Inject(bucket.Fault{Op: bucket.OpPutObjectACL, Key: newRecording, Err: errInjected})
+	for i := 0; i < state.MaxFailures; i++ {
+		if err := UpdateACLs(ctx, storage, st, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := st.Get(state.StepACL, newRecording); r == nil || !r.Stuck() {
+		t.Fatalf("record = %+v, want stuck after %d failures", r, state.MaxFailures)
+	}
+
+	before := storage.Calls(bucket.OpPutObjectACL)
+	if err := UpdateACLs(ctx, storage, st, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutObjectACL) - before; calls != 0 {
+		t.Errorf("set %d ACLs, want none", calls)
+	}
+}
@@ -0,0 +1,308 @@
+// Package analysis decodes recordings and stores what it measures in their
+// object metadata, where the tagging step, the site data and shed pick it up:
+// loudness for ReplayGain, waveform peaks for the web player, and dead air
+// for DJs to trim.
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/audio"
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/trellis/internal/state"
+	"cabbage.town/trellis/trellis"
+)
+
+// Waveform resolutions: the detailed waveform has this many pixels per
+// second of audio, and the overview at most overviewPixels in all
+const (
+	waveformPixelsPerSecond = 10
+	overviewPixels          = 1000
+)
+
+// Dead air is audio whose peak stays below silenceThreshold dBFS for at least
+// minSilence, which is long enough that it isn't just a pause between tracks
+const (
+	silenceThreshold = -50.0
+	minSilence       = 10 * time.Second
+)
+
+// analysisVersion is the input the analysis step records for each recording.
+// Bump it when what's measured changes, so recordings handled before are
+// checked for missing results again: version 2 redoes loudness measured
+// without the channel count.
+const analysisVersion = "2"
+
+// AnalyzeRecordings decodes every recording that's new or changed since the
+// analysis step last handled it and is missing its loudness, waveform or
+// silence check, newest first, and stores whatever is missing. Decoding is slow,
+// so once budget has been spent the remaining recordings are left for the
+// next run; a zero budget means no limit.
+func AnalyzeRecordings(ctx context.Context, bucketClient bucket.Storage, st *state.State, dryRun bool, budget time.Duration) error {
+	if dryRun {
+		log.Printf("[ANALYSIS] Starting recording analysis (DRY RUN)")
+	} else {
+		log.Printf("[ANALYSIS] Starting recording analysis")
+	}
+
+	config := trellis.Config{
+		BucketClient: bucketClient,
+		DryRun:       dryRun,
+	}
+
+	log.Printf("[ANALYSIS] Listing all recordings...")
+	recordings, err := trellis.ListRecordings(ctx, config)
+	if err != nil {
+		log.Printf("[ANALYSIS] ERROR: Listing recordings: %v", err)
+		return fmt.Errorf("error listing recordings: %v", err)
+	}
+
+	var pending []catalog.Recording
+	var unchanged int
+	for _, recording := range recordings {
+		if !st.Pending(state.StepAnalysis, recording.Key, recording.ETag, analysisVersion) {
+			unchanged++
+			continue
+		}
+		if needsLoudness(recording) || needsWaveform(recording) || needsSilence(recording) {
+			pending = append(pending, recording)
+		} else {
+			st.Handled(state.StepAnalysis, recording.Key, recording.ETag, analysisVersion, state.Skipped)
+		}
+	}
+	log.Printf("[ANALYSIS] %d of %d recordings need analysis (%d unchanged since they were last handled)", len(pending), len(recordings), unchanged)
+
+	stepCtx := ctx
+	if budget > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
+	var analyzed, failed int
+	for i, recording := range pending {
+		if err := ctx.Err(); err != nil {
+			log.Printf("[ANALYSIS] Stopping early: %v", err)
+			return err
+		}
+		if stepCtx.Err() != nil {
+			log.Printf("[ANALYSIS] Time budget of %v used, leaving %d recordings for the next run", budget, len(pending)-i)
+			break
+		}
+
+		log.Printf("[ANALYSIS] Analyzing recording %d/%d: %s", i+1, len(pending), recording.Key)
+		if err := analyzeRecording(stepCtx, recording, bucketClient, dryRun); err != nil {
+			if stepCtx.Err() != nil && ctx.Err() == nil {
+				log.Printf("[ANALYSIS] Time budget of %v used during %s, leaving %d recordings for the next run", budget, recording.Key, len(pending)-i)
+				break
+			}
+			log.Printf("[ANALYSIS] ERROR: Failed to analyze %s: %v", recording.Key, err)
+			st.Failed(state.StepAnalysis, recording.Key, recording.ETag, analysisVersion, err)
+			failed++
+			continue
+		}
+		st.Handled(state.StepAnalysis, recording.Key, recording.ETag, analysisVersion, state.Done)
+		if !dryRun {
+			// Copying a multipart upload onto itself gives it a new ETag
+			if err := st.Wrote(ctx, bucketClient, recording.Key, recording.ETag); err != nil {
+				log.Printf("[ANALYSIS] WARNING: %v", err)
+			}
+		}
+		analyzed++
+	}
+
+	log.Printf("[ANALYSIS] Summary:")
+	log.Printf("[ANALYSIS] - Recordings needing analysis: %d", len(pending))
+	log.Printf("[ANALYSIS] - Analyzed: %d", analyzed)
+	log.Printf("[ANALYSIS] - Failed: %d", failed)
+	log.Printf("[ANALYSIS] Recording analysis complete")
+	return nil
+}
+
+func needsLoudness(recording catalog.Recording) bool {
+	return recording.Loudness == nil
+}
+
+func needsWaveform(recording catalog.Recording) bool {
+	return recording.Metadata[catalog.MetaWaveform] == ""
+}
+
+func needsSilence(recording catalog.Recording) bool {
+	return recording.Silence == nil
+}
+
+func analyzeRecording(ctx context.Context, recording catalog.Recording, bucketClient bucket.Storage, dryRun bool) error {
+	key := recording.Key
+
+	// The ETag guards the update, so results are never stored against
+	// audio that was replaced while it was being decoded
+	head, err := bucketClient.HeadObjectWithContext(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get object metadata: %v", err)
+	}
+
+	obj, err := bucketClient.GetObjectWithContext(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get object: %v", err)
+	}
+	defer obj.Body.Close()
+
+	// Every analysis shares one pass over the decoded audio
+	start := time.Now()
+	decoder, err := audio.NewDecoder(contextReader{ctx: ctx, reader: obj.Body})
+	if err != nil {
+		return err
+	}
+	sampleRate := decoder.SampleRate()
+	meter := audio.NewLoudnessMeter(sampleRate, decoder.Channels())
+	waveform := audio.NewWaveformBuilder(sampleRate, sampleRate/waveformPixelsPerSecond)
+	silence := audio.NewSilenceDetector(sampleRate, silenceThreshold, minSilence)
+	if err := decoder.Run(meter, waveform, silence); err != nil {
+		return err
+	}
+	log.Printf("[ANALYSIS] Decoded %s in %v", key, time.Since(start).Round(time.Second))
+
+	metadata := make(map[string]*string)
+	if needsLoudness(recording) {
+		loudness := measuredLoudness(key, meter.Result(), decoder.Channels())
+		for k, v := range catalog.LoudnessMetadata(loudness) {
+			metadata[k] = v
+		}
+	}
+	if needsSilence(recording) {
+		for k, v := range catalog.SilenceMetadata(detectedSilence(key, silence)) {
+			metadata[k] = v
+		}
+	}
+	if needsWaveform(recording) {
+		detailKey, err := storeWaveform(ctx, key, waveform.Waveform(), bucketClient, dryRun)
+		if err != nil {
+			return err
+		}
+		metadata[catalog.MetaWaveform] = aws.String(detailKey)
+	}
+
+	if dryRun {
+		log.Printf("[ANALYSIS] DRY RUN: Would store %d metadata fields on %s", len(metadata), key)
+		return nil
+	}
+
+	err = bucketClient.UpdateObjectMetadataWithContext(ctx, key, bucket.MetadataUpdate{
+		Set:     metadata,
+		IfMatch: aws.StringValue(head.ETag),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store analysis: %v", err)
+	}
+	log.Printf("[ANALYSIS] Stored analysis for %s", key)
+	return nil
+}
+
+// measuredLoudness converts a meter's result for storage, logging it
+func measuredLoudness(key string, result audio.Loudness, channels int) catalog.Loudness {
+	loudness := catalog.Loudness{
+		Integrated: result.Integrated,
+		TruePeak:   result.TruePeak,
+		TrackGain:  result.TrackGain(),
+		TrackPeak:  result.Peak,
+		Channels:   channels,
+	}
+	if math.IsInf(loudness.Integrated, 0) {
+		log.Printf("[ANALYSIS] WARNING: %s is silent, no gain will be stored", key)
+	} else {
+		log.Printf("[ANALYSIS] - Integrated loudness: %.2f LUFS", loudness.Integrated)
+		log.Printf("[ANALYSIS] - True peak: %.2f dBTP", loudness.TruePeak)
+		log.Printf("[ANALYSIS] - ReplayGain track gain: %.2f dB, peak %.6f", loudness.TrackGain, loudness.TrackPeak)
+	}
+	return loudness
+}
+
+// detectedSilence sorts a detector's silent stretches into leading, trailing
+// and gaps in between, logging them. A recording that's silent throughout
+// counts as all leading silence.
+func detectedSilence(key string, detector *audio.SilenceDetector) catalog.Silence {
+	spans, length := detector.Silences()
+
+	var silence catalog.Silence
+	for _, span := range spans {
+		switch {
+		case span.Start == 0:
+			silence.Leading = span.End
+		case span.End == length:
+			silence.Trailing = span.Length()
+		default:
+			silence.Gaps = append(silence.Gaps, catalog.Gap{Start: span.Start, End: span.End})
+		}
+	}
+	silence.GapCount = len(silence.Gaps)
+
+	if !silence.Any() {
+		log.Printf("[ANALYSIS] - No dead air")
+		return silence
+	}
+	log.Printf("[ANALYSIS] WARNING: %s has dead air:", key)
+	if silence.Leading > 0 {
+		log.Printf("[ANALYSIS] - %v of silence at the start", silence.Leading.Round(time.Second))
+	}
+	if silence.Trailing > 0 {
+		log.Printf("[ANALYSIS] - %v of silence at the end", silence.Trailing.Round(time.Second))
+	}
+	for _, gap := range silence.Gaps {
+		log.Printf("[ANALYSIS] - %v of silence from %v", (gap.End - gap.Start).Round(time.Second), gap.Start.Round(time.Second))
+	}
+	return silence
+}
+
+// storeWaveform uploads the detailed waveform and its overview as public
+// JSON, returning the detailed waveform's key
+func storeWaveform(ctx context.Context, key string, waveform *audio.Waveform, bucketClient bucket.Storage, dryRun bool) (string, error) {
+	detailKey, overviewKey := catalog.WaveformKeys(key)
+	files := []struct {
+		key      string
+		waveform *audio.Waveform
+	}{
+		{detailKey, waveform},
+		{overviewKey, waveform.Downsample(overviewPixels)},
+	}
+
+	for _, file := range files {
+		data, err := json.Marshal(file.waveform)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal waveform: %v", err)
+		}
+		if dryRun {
+			log.Printf("[ANALYSIS] DRY RUN: Would upload %d-pixel waveform (%d bytes) to %s", file.waveform.Length, len(data), file.key)
+			continue
+		}
+		err = bucketClient.PutObjectWithMetadataWithContext(ctx, file.key, bytes.NewReader(data), "application/json", nil, "public-read")
+		if err != nil {
+			return "", fmt.Errorf("failed to upload waveform %s: %v", file.key, err)
+		}
+		log.Printf("[ANALYSIS] Uploaded %d-pixel waveform (%d bytes) to %s", file.waveform.Length, len(data), file.key)
+	}
+	return detailKey, nil
+}
+
+// contextReader stops decoding once ctx is done, whether or not the
+// storage backend notices cancellation itself
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,74 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/audio"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+)
+
+func TestDetectedSilence(t *testing.T) {
+	// seconds returns that much audio at 1kHz, silent or not
+	seconds := func(silent bool, n int) []audio.Frame {
+		frames := make([]audio.Frame, n*1000)
+		if !silent {
+			for i := range frames {
+				frames[i] = audio.Frame{0.5, 0.5}
+			}
+		}
+		return frames
+	}
+	tests := []struct {
+		name string
+		// parts alternate silence and sound, starting with silence
+		parts []int
+		want  catalog.Silence
+	}{
+		{
+			name:  "no dead air",
+			parts: []int{0, 60},
+		},
+		{
+			name:  "leading and trailing",
+			parts: []int{15, 60, 20},
+			want:  catalog.Silence{Leading: 15 * time.Second, Trailing: 20 * time.Second},
+		},
+		{
+			name:  "gaps in order",
+			parts: []int{0, 30, 12, 30, 25, 30, 5, 30},
+			want: catalog.Silence{
+				Gaps:     []catalog.Gap{{Start: 30 * time.Second, End: 42 * time.Second}, {Start: 72 * time.Second, End: 97 * time.Second}},
+				GapCount: 2,
+			},
+		},
+		{
+			name:  "everything",
+			parts: []int{11, 30, 12, 30, 13},
+			want: catalog.Silence{
+				Leading:  11 * time.Second,
+				Trailing: 13 * time.Second,
+				Gaps:     []catalog.Gap{{Start: 41 * time.Second, End: 53 * time.Second}},
+				GapCount: 1,
+			},
+		},
+		{
+			// A recording of nothing is all lead-in, not a lead-in and a tail
+			name:  "all silent",
+			parts: []int{40},
+			want:  catalog.Silence{Leading: 40 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := audio.NewSilenceDetector(1000, silenceThreshold, minSilence)
+			for i, n := range tt.parts {
+				detector.Write(seconds(i%2 == 0, n))
+			}
+			if got := detectedSilence("recordings/ted/stream_20240101-200000.mp3", detector); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("detectedSilence() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package fragments merges recordings that a dropped stream split into
+// several files, so feeds and playlists show one episode per show and date.
+package fragments
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/edit"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+	"cabbage.town/trellis/trellis"
+)
+
+// Filter limits which fragments are merged. Empty fields match everything.
+type Filter struct {
+	Owner string
+	// Date is YYYY-MM-DD
+	Date string
+}
+
+func (f Filter) matches(group []string) bool {
+	info, err := catalog.ParseKey(group[0])
+	if err != nil {
+		return false
+	}
+	if f.Owner != "" && info.Owner != f.Owner {
+		return false
+	}
+	return f.Date == "" || info.Recorded.Format("2006-01-02") == f.Date
+}
+
+// MergeFragments finds the recordings split into fragments and merges each
+// show's fragments into one recording, moving the fragments to the trash
+func MergeFragments(ctx context.Context, bucketClient bucket.Storage, dryRun bool, filter Filter) error {
+	if dryRun {
+		log.Printf("[FRAGMENTS] Starting fragment merge (DRY RUN)")
+	} else {
+		log.Printf("[FRAGMENTS] Starting fragment merge")
+	}
+
+	config := trellis.Config{
+		BucketClient: bucketClient,
+		DryRun:       dryRun,
+	}
+
+	log.Printf("[FRAGMENTS] Listing all recordings...")
+	recordings, err := trellis.ListRecordings(ctx, config)
+	if err != nil {
+		log.Printf("[FRAGMENTS] ERROR: Listing recordings: %v", err)
+		return fmt.Errorf("error listing recordings: %v", err)
+	}
+	keys := make([]string, len(recordings))
+	for i, recording := range recordings {
+		keys[i] = recording.Key
+	}
+	durations, err := fragmentDurations(ctx, bucketClient, recordings)
+	if err != nil {
+		return err
+	}
+
+	var groups [][]string
+	for _, group := range edit.Fragments(keys, durations) {
+		if filter.matches(group) {
+			groups = append(groups, group)
+		}
+	}
+	log.Printf("[FRAGMENTS] Found %d recordings split into fragments", len(groups))
+
+	var merged, failed int
+	for i, group := range groups {
+		if err := ctx.Err(); err != nil {
+			log.Printf("[FRAGMENTS] Stopping early: %v", err)
+			return err
+		}
+
+		log.Printf("[FRAGMENTS] Recording %d/%d: %d fragments", i+1, len(groups), len(group))
+		for _, key := range group {
+			log.Printf("[FRAGMENTS] - %s", key)
+		}
+		if dryRun {
+			log.Printf("[FRAGMENTS] DRY RUN: Would merge into %s and move the fragments to %s", group[0], edit.TrashPrefix)
+			continue
+		}
+
+		result, err := edit.Merge(ctx, bucketClient, group)
+		if err != nil {
+			log.Printf("[FRAGMENTS] ERROR: Failed to merge %s: %v", group[0], err)
+			failed++
+			continue
+		}
+		log.Printf("[FRAGMENTS] Merged into %s (%v)", result.Key, result.Info.Duration.Round(time.Second))
+		merged++
+	}
+
+	log.Printf("[FRAGMENTS] Summary:")
+	log.Printf("[FRAGMENTS] - Fragmented recordings: %d", len(groups))
+	log.Printf("[FRAGMENTS] - Merged: %d", merged)
+	log.Printf("[FRAGMENTS] - Failed: %d", failed)
+	log.Printf("[FRAGMENTS] Fragment merge complete")
+	if failed > 0 {
+		return fmt.Errorf("failed to merge %d recordings", failed)
+	}
+	return nil
+}
+
+// fragmentDurations returns the length of every recording, measuring the
+// ones that haven't been yet if another stream recording was made by the same
+// DJ that day, since edit.Fragments needs them to check the gaps
+func fragmentDurations(ctx context.Context, bucketClient bucket.Storage, recordings []catalog.Recording) (map[string]time.Duration, error) {
+	streams := make(map[string]int)
+	day := func(recording catalog.Recording) string {
+		info, err := catalog.ParseKey(recording.Key)
+		if err != nil || !strings.HasPrefix(info.Filename, "stream_") {
+			return ""
+		}
+		return info.Owner + "/" + info.Recorded.Format("2006-01-02")
+	}
+	for _, recording := range recordings {
+		if d := day(recording); d != "" {
+			streams[d]++
+		}
+	}
+
+	durations := make(map[string]time.Duration, len(recordings))
+	for _, recording := range recordings {
+		durations[recording.Key] = recording.Duration
+		if recording.Duration > 0 || streams[day(recording)] < 2 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		log.Printf("[FRAGMENTS] Measuring %s", recording.Key)
+		obj, err := bucketClient.GetObjectWithContext(ctx, recording.Key)
+		if err != nil {
+			log.Printf("[FRAGMENTS] WARNING: Failed to measure %s: %v", recording.Key, err)
+			continue
+		}
+		info, err := mp3.Probe(obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			log.Printf("[FRAGMENTS] WARNING: Failed to measure %s: %v", recording.Key, err)
+			continue
+		}
+		durations[recording.Key] = info.Duration
+	}
+	return durations, nil
+}
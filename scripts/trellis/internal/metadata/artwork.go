@@ -0,0 +1,164 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/artwork"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+	"cabbage.town/trellis/trellis"
+)
+
+// sitePublicDir is the site's public directory relative to scripts/trellis,
+// where the workflow runs. Site paths are read from here before trying the
+// live site, so new artwork can be used before it's deployed.
+var sitePublicDir = filepath.Join("..", "..", "site", "public")
+
+// maxImageBytes caps how much of a cover image is downloaded
+const maxImageBytes = 20 << 20
+
+// coverSources lists the images that could be a recording's cover, best
+// first: the linked post's cover, then the show's artwork, then the station's
+func coverSources(recording catalog.Recording, post *posts.Post, registry *shows.Registry) []string {
+	var sources []string
+	if post != nil && post.Metadata.Podcast.Cover != "" {
+		sources = append(sources, post.Metadata.Podcast.Cover)
+	}
+	if show, ok := registry.BySlug(recording.ShowSlug); ok && show.Artwork != "" {
+		sources = append(sources, show.Artwork)
+	}
+	return append(sources, trellis.StationArtwork)
+}
+
+// errNoImage marks a source that doesn't exist or isn't a usable image, so
+// the next source is tried. Any other failure may be temporary.
+var errNoImage = errors.New("no usable image")
+
+// coverImage is a cover prepared for embedding
+type coverImage struct {
+	Data []byte
+	// Source is where it came from and Hash the SHA-256 of the source file,
+	// which identify the cover in fingerprints without depending on how the
+	// image was re-encoded
+	Source string
+	Hash   string
+}
+
+// coverCache prepares each cover image once per run, since most recordings
+// share their show's artwork
+type coverCache struct {
+	client *http.Client
+	images map[string]coverImage
+	errors map[string]error
+}
+
+func newCoverCache() *coverCache {
+	return &coverCache{
+		client: &http.Client{Timeout: 30 * time.Second},
+		images: make(map[string]coverImage),
+		errors: make(map[string]error),
+	}
+}
+
+// cover returns the first of sources that can be loaded. Sources without a
+// usable image are passed over, but any other failure is returned rather
+// than falling back, so a temporary outage doesn't change a recording's cover.
+func (c *coverCache) cover(ctx context.Context, sources []string) (coverImage, error) {
+	for _, source := range sources {
+		image, err := c.get(ctx, source)
+		if err == nil {
+			return image, nil
+		}
+		if !errors.Is(err, errNoImage) {
+			return coverImage{}, fmt.Errorf("failed to load cover art %s: %v", source, err)
+		}
+		log.Printf("[METADATA] WARNING: Could not load cover art %s: %v", source, err)
+	}
+	return coverImage{}, errors.New("no cover art could be loaded")
+}
+
+// get returns the prepared image for a site path or full URL
+func (c *coverCache) get(ctx context.Context, source string) (coverImage, error) {
+	if image, ok := c.images[source]; ok {
+		return image, nil
+	}
+	if err, ok := c.errors[source]; ok {
+		return coverImage{}, err
+	}
+
+	image, err := c.load(ctx, source)
+	if err != nil {
+		// Don't remember failures caused by the run being cancelled
+		if ctx.Err() == nil {
+			c.errors[source] = err
+		}
+		return coverImage{}, err
+	}
+	c.images[source] = image
+	return image, nil
+}
+
+func (c *coverCache) load(ctx context.Context, source string) (coverImage, error) {
+	body, err := c.open(ctx, source)
+	if err != nil {
+		return coverImage{}, err
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(io.LimitReader(body, maxImageBytes))
+	if err != nil {
+		return coverImage{}, err
+	}
+
+	data, err := artwork.Prepare(bytes.NewReader(raw))
+	if err != nil {
+		return coverImage{}, fmt.Errorf("%w: %v", errNoImage, err)
+	}
+	sum := sha256.Sum256(raw)
+	return coverImage{Data: data, Source: source, Hash: hex.EncodeToString(sum[:])}, nil
+}
+
+// open reads a site path from the local checkout if it's there, and anything
+// else from the web
+func (c *coverCache) open(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		local := filepath.Join(sitePublicDir, filepath.FromSlash(strings.TrimPrefix(source, "/")))
+		file, err := os.Open(local)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trellis.AbsoluteURL(source), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errNoImage, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -1,25 +1,43 @@
 package metadata
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/id3"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+	"cabbage.town/trellis/internal/state"
 	"cabbage.town/trellis/trellis"
 )
 
-func UpdateMetadata(bucketClient *bucket.Client, dryRun bool) error {
+// errUpToDate is returned by addID3Metadata for a file whose tags already match
+var errUpToDate = errors.New("tags already up to date")
+
+// UpdateMetadata tags every recording whose tags differ from the ones it
+// should have, judged by the fingerprint stored in its metadata. Recordings
+// the metadata step handled with the same audio and fingerprint before are
+// skipped. With force set, every recording is re-tagged.
+func UpdateMetadata(ctx context.Context, bucketClient bucket.Storage, st *state.State, dryRun, force bool) error {
 	if dryRun {
 		log.Printf("[METADATA] Starting ID3 metadata update process (DRY RUN)")
 	} else {
 		log.Printf("[METADATA] Starting ID3 metadata update process")
 	}
+	if force {
+		log.Printf("[METADATA] Forcing a re-tag of every recording")
+	}
 
 	// Assume .env has already been loaded by the calling workflow
 	log.Printf("[METADATA] Using environment variables (loaded by workflow)")
@@ -29,52 +47,104 @@ func UpdateMetadata(bucketClient *bucket.Client, dryRun bool) error {
 
 	config := trellis.Config{
 		BucketClient: bucketClient,
+		DryRun:       dryRun,
 	}
 
 	log.Printf("[METADATA] Listing all recordings...")
-	allRecordings, err := trellis.ListRecordings(config)
+	allRecordings, err := trellis.ListRecordings(ctx, config)
 	if err != nil {
 		log.Printf("[METADATA] ERROR: Listing recordings: %v", err)
 		return fmt.Errorf("error listing recordings: %v", err)
 	}
 	log.Printf("[METADATA] Found %d total recordings", len(allRecordings))
 
-	// Filter to only recent recordings for metadata processing
-	log.Printf("[METADATA] Filtering to recent recordings (last 72 hours)...")
-	recentRecordings := trellis.FilterRecentRecordings(allRecordings)
-	log.Printf("[METADATA] Found %d recent recordings (last 72 hours) out of %d total", len(recentRecordings), len(allRecordings))
+	// Most tags come from linked posts and the show registry
+	registry, err := shows.Load(ctx, bucketClient)
+	if err != nil {
+		log.Printf("[METADATA] ERROR: Loading shows: %v", err)
+		return fmt.Errorf("error loading shows: %v", err)
+	}
+	published, err := posts.ListPosts(ctx, bucketClient)
+	if err != nil {
+		log.Printf("[METADATA] ERROR: Listing posts: %v", err)
+		return fmt.Errorf("error listing posts: %v", err)
+	}
+	linked := trellis.PostsByRecording(published)
+	episodes := trellis.EpisodeNumbers(allRecordings, linked)
+	covers := newCoverCache()
+
+	var processed, upToDate, unchanged, failed int
+	for i, recording := range allRecordings {
+		if err := ctx.Err(); err != nil {
+			log.Printf("[METADATA] Stopping early: %v", err)
+			return err
+		}
+
+		var post *posts.Post
+		if p, ok := linked[recording.Key]; ok {
+			post = &p
+		}
+		// Without its cover the tags can't be compared, and tagging without
+		// one would change the file again once the cover is back
+		cover, err := covers.cover(ctx, coverSources(recording, post, registry))
+		if err != nil {
+			log.Printf("[METADATA] ERROR: Skipping %s, will retry next run: %v", recording.Key, err)
+			failed++
+			continue
+		}
+		show, _ := registry.BySlug(recording.ShowSlug)
+		tags := desiredTags(recording, show, post, episodes[recording.Key], cover)
+
+		fingerprint := tags.fingerprint()
+		if !force && !st.Pending(state.StepMetadata, recording.Key, recording.ETag, fingerprint) {
+			unchanged++
+			continue
+		}
+
+		// The catalog's copy of the metadata saves a HEAD for files that are current
+		if !force && recording.Metadata[MetaFingerprint] == fingerprint {
+			st.Handled(state.StepMetadata, recording.Key, recording.ETag, fingerprint, state.Skipped)
+			upToDate++
+			continue
+		}
 
-	var processed, skipped, failed int
-	for i, recording := range recentRecordings {
-		log.Printf("[METADATA] Processing recording %d/%d: %s", i+1, len(recentRecordings), recording.Key)
-		err := addID3Metadata(recording, bucketClient, dryRun)
+		log.Printf("[METADATA] Processing recording %d/%d: %s", i+1, len(allRecordings), recording.Key)
+		err = addID3Metadata(ctx, recording, tags, force, bucketClient, dryRun)
 		if err != nil {
-			if err.Error() == "SKIP_ALREADY_PROCESSED" {
-				skipped++
+			if err == errUpToDate {
+				st.Handled(state.StepMetadata, recording.Key, recording.ETag, fingerprint, state.Skipped)
+				upToDate++
 				continue
 			}
 			log.Printf("[METADATA] ERROR: Failed to add metadata to %s: %v", recording.URL, err)
+			st.Failed(state.StepMetadata, recording.Key, recording.ETag, fingerprint, err)
 			failed++
 			continue
 		}
+		st.Handled(state.StepMetadata, recording.Key, recording.ETag, fingerprint, state.Done)
 		if dryRun {
 			log.Printf("[METADATA] DRY RUN: Would add metadata to %s", recording.URL)
 		} else {
 			log.Printf("[METADATA] Successfully added metadata to %s", recording.URL)
+			// The re-tagged file isn't a change the other steps need to see
+			if err := st.Wrote(ctx, bucketClient, recording.Key, recording.ETag); err != nil {
+				log.Printf("[METADATA] WARNING: %v", err)
+			}
 		}
 		processed++
 	}
 
 	log.Printf("[METADATA] Summary:")
-	log.Printf("[METADATA] - Total recent recordings: %d", len(recentRecordings))
+	log.Printf("[METADATA] - Total recordings: %d", len(allRecordings))
 	log.Printf("[METADATA] - Successfully processed: %d", processed)
 	log.Printf("[METADATA] - Failed: %d", failed)
-	log.Printf("[METADATA] - Skipped (already processed): %d", skipped)
+	log.Printf("[METADATA] - Skipped (tags up to date): %d", upToDate)
+	log.Printf("[METADATA] - Skipped (unchanged since last handled): %d", unchanged)
 	log.Printf("[METADATA] ID3 metadata processing complete")
 	return nil
 }
 
-func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dryRun bool) error {
+func addID3Metadata(ctx context.Context, recording catalog.Recording, tags tagSet, force bool, bucketClient bucket.Storage, dryRun bool) error {
 	log.Printf("[METADATA] Processing file: %s", recording.Key)
 
 	// Create temporary directory
@@ -86,15 +156,10 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 	}
 	log.Printf("[METADATA] Created temp directory: %s", tempDir)
 
-	// Only clean up temp dir if not in dry run mode
-	if !dryRun {
-		defer func() {
-			log.Printf("[METADATA] Cleaning up temp directory: %s", tempDir)
-			os.RemoveAll(tempDir)
-		}()
-	} else {
-		log.Printf("[METADATA] DRY RUN: Temp directory will be preserved: %s", tempDir)
-	}
+	defer func() {
+		log.Printf("[METADATA] Cleaning up temp directory: %s", tempDir)
+		os.RemoveAll(tempDir)
+	}()
 
 	// Use stored key from listing
 	key := recording.Key
@@ -104,22 +169,23 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 
 	// Get existing object metadata and ACL
 	log.Printf("[METADATA] Getting object metadata for: %s", key)
-	headOutput, err := bucketClient.HeadObject(key)
+	headOutput, err := bucketClient.HeadObjectWithContext(ctx, key)
 	if err != nil {
 		log.Printf("[METADATA] ERROR: Getting object metadata: %v", err)
 		return fmt.Errorf("failed to get object metadata: %v", err)
 	}
 	log.Printf("[METADATA] Retrieved metadata, found %d metadata fields", len(headOutput.Metadata))
 
-	// Check if already processed
-	if processed, exists := headOutput.Metadata["Id3-Processed"]; exists && *processed == "true" {
-		log.Printf("[METADATA] File already processed, skipping: %s", key)
-		return fmt.Errorf("SKIP_ALREADY_PROCESSED")
+	// Check the live metadata too, in case the catalog is behind
+	fingerprint := tags.fingerprint()
+	if existing, ok := headOutput.Metadata[MetaFingerprint]; !force && ok && aws.StringValue(existing) == fingerprint {
+		log.Printf("[METADATA] File tags already up to date, skipping: %s", key)
+		return errUpToDate
 	}
-	log.Printf("[METADATA] File not yet processed, proceeding with ID3 metadata addition")
+	log.Printf("[METADATA] File tags out of date, proceeding with ID3 metadata update")
 
 	log.Printf("[METADATA] Getting object ACL for: %s", key)
-	aclOutput, err := bucketClient.GetObjectACL(key)
+	aclOutput, err := bucketClient.GetObjectACLWithContext(ctx, key)
 	if err != nil {
 		log.Printf("[METADATA] ERROR: Getting object ACL: %v", err)
 		return fmt.Errorf("failed to get object ACL: %v", err)
@@ -128,7 +194,7 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 
 	// Download file using bucket client
 	log.Printf("[METADATA] Downloading file from bucket: %s", key)
-	obj, err := bucketClient.GetObject(key)
+	obj, err := bucketClient.GetObjectWithContext(ctx, key)
 	if err != nil {
 		log.Printf("[METADATA] ERROR: Getting object from bucket: %v", err)
 		return fmt.Errorf("failed to get object: %v", err)
@@ -154,58 +220,75 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 	file.Close()
 	log.Printf("[METADATA] Successfully wrote %d bytes to temp file", bytesWritten)
 
-	// Parse date for year
-	log.Printf("[METADATA] Parsing recording date: %s", recording.Date)
-	date, err := time.Parse("January 02, 2006", recording.Date)
-	if err != nil {
-		log.Printf("[METADATA] ERROR: Parsing date: %v", err)
-		return fmt.Errorf("failed to parse date: %v", err)
+	// Add ID3 metadata, keeping any frames we don't set
+	log.Printf("[METADATA] Preparing to add ID3 metadata:")
+	log.Printf("[METADATA] - Title: %s", tags.Title)
+	log.Printf("[METADATA] - Artist: %s", tags.Artist)
+	log.Printf("[METADATA] - Album: %s", tags.Album)
+	log.Printf("[METADATA] - Year: %d", tags.Year)
+	log.Printf("[METADATA] - Genre: %s", tags.Genre)
+	if tags.Track > 0 {
+		log.Printf("[METADATA] - Track: %d", tags.Track)
+	}
+	if tags.PageURL != "" {
+		log.Printf("[METADATA] - Page: %s", tags.PageURL)
+	}
+	if tags.TrackGain != "" {
+		log.Printf("[METADATA] - ReplayGain: %s, peak %s", tags.TrackGain, tags.TrackPeak)
 	}
-	year := fmt.Sprintf("%d", date.Year())
-	log.Printf("[METADATA] Extracted year: %s", year)
+	if tags.Tracklist != "" {
+		log.Printf("[METADATA] - Tracklist: %d tracks", strings.Count(tags.Tracklist, "\n")+1)
+	}
+	log.Printf("[METADATA] - Cover: %s (%d bytes)", tags.Cover.Source, len(tags.Cover.Data))
+	log.Printf("[METADATA] - Fingerprint: %s", fingerprint)
 
-	// Add ID3 metadata using eyeD3
-	title := fmt.Sprintf("%s (%s)", recording.Show, recording.Date)
-	log.Printf("[METADATA] Preparing to add ID3 metadata:")
-	log.Printf("[METADATA] - Title: %s", title)
-	log.Printf("[METADATA] - Artist: %s", recording.DJ)
-	log.Printf("[METADATA] - Album: Cabbage Town Radio")
-	log.Printf("[METADATA] - Year: %s", year)
-	log.Printf("[METADATA] - Genre: Electronic")
-
-	cmd := exec.Command("eyeD3",
-		"-t", title,
-		"-a", recording.DJ,
-		"-A", "Cabbage Town Radio",
-		"-Y", year,
-		"-G", "Electronic",
-		"-c", "Live recording from Cabbage Town Radio",
-		tempFile,
-	)
-
-	log.Printf("[METADATA] Executing eyeD3 command: %v", cmd.Args)
-	output, err := cmd.CombinedOutput()
+	err = id3.UpdateFile(tempFile, func(tag *id3.Tag) error {
+		tags.apply(tag)
+		return nil
+	})
 	if err != nil {
-		log.Printf("[METADATA] ERROR: eyeD3 failed: %v, output: %s", err, string(output))
-		return fmt.Errorf("eyeD3 failed: %v, output: %s", err, string(output))
+		log.Printf("[METADATA] ERROR: Writing ID3 tag: %v", err)
+		return fmt.Errorf("failed to write ID3 tag: %v", err)
 	}
-	log.Printf("[METADATA] eyeD3 completed successfully, output: %s", string(output))
+	log.Printf("[METADATA] Wrote ID3 tag to %s", tempFile)
 
 	if dryRun {
-		// For dry run, just log where the file would be saved
-		log.Printf("[METADATA] DRY RUN: Modified file saved locally at: %s", tempFile)
 		log.Printf("[METADATA] DRY RUN: Would upload to key: %s", key)
-		log.Printf("[METADATA] DRY RUN: Would add id3-processed=true to metadata")
+		log.Printf("[METADATA] DRY RUN: Would set %s=%s in metadata", MetaFingerprint, fingerprint)
 		log.Printf("[METADATA] DRY RUN: Processing complete for %s", key)
 	} else {
-		// Prepare updated metadata - copy existing and add processed flag
+		// Re-read metadata so edits made in shed while we were tagging aren't lost
+		log.Printf("[METADATA] Re-checking object before upload: %s", key)
+		latestHead, err := bucketClient.HeadObjectWithContext(ctx, key)
+		if err != nil {
+			log.Printf("[METADATA] ERROR: Re-checking object metadata: %v", err)
+			return fmt.Errorf("failed to re-check object metadata: %v", err)
+		}
+		if aws.StringValue(latestHead.ETag) != aws.StringValue(headOutput.ETag) {
+			log.Printf("[METADATA] Object content changed during processing, will retry next run: %s", key)
+			return fmt.Errorf("object changed during processing: %v", bucket.ErrPreconditionFailed)
+		}
+
+		// Prepare updated metadata - copy existing and record the tags written
 		log.Printf("[METADATA] Preparing updated metadata...")
 		updatedMetadata := make(map[string]*string)
-		for k, v := range headOutput.Metadata {
+		for k, v := range latestHead.Metadata {
 			updatedMetadata[k] = v
 		}
-		updatedMetadata["Id3-Processed"] = aws.String("true")
-		log.Printf("[METADATA] Added id3-processed=true flag, total metadata fields: %d", len(updatedMetadata))
+		updatedMetadata[MetaProcessed] = aws.String("true")
+		updatedMetadata[MetaFingerprint] = aws.String(fingerprint)
+		log.Printf("[METADATA] Set tag fingerprint, total metadata fields: %d", len(updatedMetadata))
+
+		// The tagged file is already here, so measure it now rather than
+		// having the feed step download it again
+		if duration, size, err := measureFile(tempFile); err != nil {
+			log.Printf("[METADATA] WARNING: Could not measure duration: %v", err)
+		} else {
+			for k, v := range catalog.DurationMetadata(duration, size) {
+				updatedMetadata[k] = v
+			}
+			log.Printf("[METADATA] Measured duration: %v", duration)
+		}
 
 		// Determine ACL from existing permissions
 		log.Printf("[METADATA] Determining ACL from existing permissions...")
@@ -231,7 +314,7 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 		defer modifiedFile.Close()
 
 		log.Printf("[METADATA] Uploading modified file with metadata and ACL: %s", key)
-		err = bucketClient.PutObjectWithMetadata(key, modifiedFile, "audio/mpeg", updatedMetadata, acl)
+		err = bucketClient.PutObjectWithMetadataWithContext(ctx, key, modifiedFile, "audio/mpeg", updatedMetadata, acl)
 		if err != nil {
 			log.Printf("[METADATA] ERROR: Uploading file: %v", err)
 			return fmt.Errorf("failed to upload file: %v", err)
@@ -242,3 +325,22 @@ func addID3Metadata(recording trellis.Recording, bucketClient *bucket.Client, dr
 	log.Printf("[METADATA] Processing complete for file: %s", key)
 	return nil
 }
+
+// measureFile returns the duration and size of a local MP3
+func measureFile(path string) (time.Duration, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := mp3.Probe(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Duration, stat.Size(), nil
+}
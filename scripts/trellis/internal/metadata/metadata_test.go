@@ -0,0 +1,385 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/id3"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/state"
+)
+
+const (
+	tedRecording     = "recordings/ted/stream_20240101-200000.mp3"
+	brennanRecording = "recordings/brennan/stream_20240102-200000.mp3"
+)
+
+var errInjected = errors.New("injected failure")
+
+// testShows has no artwork, so every cover is the station's, which
+// useLocalArtwork provides
+const testShows = `{"shows": [
+	{"slug": "mulch-channel", "name": "mulch channel", "dj": "dj ted", "owners": ["ted"], "genre": "Ambient"},
+	{"slug": "late-nights-like-these", "name": "Late Nights Like These", "dj": "Nights Like These", "owners": ["brennan"]}
+]}`
+
+// useLocalArtwork points the cover cache at a site directory holding the
+// station artwork, so tests don't fetch it from the live site
+func useLocalArtwork(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "the-cabbage.png"), testImage(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := sitePublicDir
+	sitePublicDir = dir
+	t.Cleanup(func() { sitePublicDir = previous })
+}
+
+// testImage returns a small PNG
+func testImage(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(0, 0, color.RGBA{R: 0xFF, A: 0xFF})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newBucket returns a bucket with a public recording of ted's and a private
+// one of brennan's, neither tagged yet
+func newBucket(t *testing.T) *bucket.MemoryClient {
+	t.Helper()
+	useLocalArtwork(t)
+	storage := bucket.NewMemoryClient("test")
+	if err := storage.PutObject(shows.Key, []byte(testShows), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	for key, acl := range map[string]string{tedRecording: "public-read", brennanRecording: "private"} {
+		body := bytes.NewReader(mp3test.Silence(40, false))
+		if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, acl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage
+}
+
+// readTag downloads key and returns its ID3 tag
+func readTag(t *testing.T, storage bucket.Storage, key string) *id3.Tag {
+	t.Helper()
+	obj, err := storage.GetObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+	tag, err := id3.Read(obj.Body)
+	if err != nil {
+		t.Fatalf("reading tag of %s: %v", key, err)
+	}
+	return tag
+}
+
+func fingerprintOf(t *testing.T, storage bucket.Storage, key string) string {
+	t.Helper()
+	head, err := storage.HeadObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(head.Metadata[MetaFingerprint])
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	storage := newBucket(t)
+	st := state.New()
+	ctx := context.Background()
+
+	if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tag := readTag(t, storage, tedRecording)
+	for id, want := range map[string]string{
+		id3.Title:  "mulch channel (January 1, 2024)",
+		id3.Artist: "dj ted",
+		id3.Album:  "mulch channel",
+		id3.Genre:  "Ambient",
+	} {
+		if got := tag.Text(id); got != want {
+			t.Errorf("%s = %q, want %q", id, got, want)
+		}
+	}
+	if _, ok := tag.Frame("APIC"); !ok {
+		t.Errorf("no cover art")
+	}
+
+	for _, key := range []string{tedRecording, brennanRecording} {
+		if fingerprintOf(t, storage, key) == "" {
+			t.Errorf("%s has no fingerprint", key)
+		}
+		if r := st.Get(state.StepMetadata, key); r == nil || r.Outcome != state.Done {
+			t.Errorf("%s record = %+v, want done", key, r)
+		}
+		// Tagging must leave the recording's access as it was
+		acl, err := storage.GetObjectACL(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := key == tedRecording; bucket.IsPublic(acl) != want {
+			t.Errorf("%s public = %v, want %v", key, bucket.IsPublic(acl), want)
+		}
+	}
+
+	// Retagging changed the ETags, but that was trellis's own write, so the
+	// next run has nothing to do
+	puts := storage.Calls(bucket.OpPutWithMetadata)
+	if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 0 {
+		t.Errorf("uploaded %d files on the second run, want none", calls)
+	}
+}
+
+func TestUpdateMetadataIgnoresAccessChanges(t *testing.T) {
+	storage := newBucket(t)
+	const later = "recordings/ted/stream_20240108-200000.mp3"
+	body := bytes.NewReader(mp3test.Silence(40, false))
+	if err := storage.PutObjectWithMetadata(later, body, "audio/mpeg", nil, "public-read"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := UpdateMetadata(ctx, storage, state.New(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTag(t, storage, later).Text(id3.TrackNumber); got != "2" {
+		t.Errorf("track = %q, want 2", got)
+	}
+
+	// Making the earlier episode private, as shed does, changes neither its
+	// tags nor the number of the one after it
+	if err := storage.PutObjectACL(tedRecording, "private"); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.NewStore(storage).Refresh(ctx, tedRecording); err != nil {
+		t.Fatal(err)
+	}
+	puts := storage.Calls(bucket.OpPutWithMetadata)
+	if err := UpdateMetadata(ctx, storage, state.New(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 0 {
+		t.Errorf("uploaded %d files after an access change, want none", calls)
+	}
+}
+
+func TestUpdateMetadataSkipsTaggedFiles(t *testing.T) {
+	storage := newBucket(t)
+	ctx := context.Background()
+	if err := UpdateMetadata(ctx, storage, state.New(), false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without state, the stored fingerprints show the tags are current
+	st := state.New()
+	puts := storage.Calls(bucket.OpPutWithMetadata)
+	if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 0 {
+		t.Errorf("uploaded %d files, want none", calls)
+	}
+	if r := st.Get(state.StepMetadata, tedRecording); r == nil || r.Outcome != state.Skipped {
+		t.Errorf("record = %+v, want skipped", r)
+	}
+
+	// Unless forced
+	if err := UpdateMetadata(ctx, storage, state.New(), false, true); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 2 {
+		t.Errorf("forced run uploaded %d files, want 2", calls)
+	}
+}
+
+func TestUpdateMetadataDryRun(t *testing.T) {
+	storage := newBucket(t)
+	writes := func() int {
+		n := 0
+		for _, op := range []string{bucket.OpPutObject, bucket.OpPutWithMetadata, bucket.OpPutObjectStream, bucket.OpUpdateMetadata, bucket.OpCopyObject} {
+			n += storage.Calls(op)
+		}
+		return n
+	}
+	before := writes()
+	if err := UpdateMetadata(context.Background(), storage, state.New(), true, false); err != nil {
+		t.Fatal(err)
+	}
+	// Not even the catalog is saved
+	if calls := writes() - before; calls != 0 {
+		t.Errorf("dry run made %d writes", calls)
+	}
+	if _, err := storage.HeadObject(catalog.Key); !bucket.IsNotFound(err) {
+		t.Errorf("dry run saved the catalog")
+	}
+	if fingerprintOf(t, storage, tedRecording) != "" {
+		t.Errorf("dry run set a fingerprint")
+	}
+}
+
+func TestUpdateMetadataDryRunCleansUp(t *testing.T) {
+	storage := newBucket(t)
+	temp := t.TempDir()
+	t.Setenv("TMPDIR", temp)
+	if err := UpdateMetadata(context.Background(), storage, state.New(), true, false); err != nil {
+		t.Fatal(err)
+	}
+	left, err := os.ReadDir(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("dry run left %d temp entries behind", len(left))
+	}
+}
+
+func TestUpdateMetadataArtworkOutage(t *testing.T) {
+	var down atomic.Bool
+	image := testImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+	defer server.Close()
+
+	storage := newBucket(t)
+	shows := `{"shows": [{"slug": "mulch-channel", "name": "mulch channel", "dj": "dj ted", "owners": ["ted"], "artwork": "` + server.URL + `/mulch.png"}]}`
+	if err := storage.PutObject("config/shows.json", []byte(shows), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := UpdateMetadata(ctx, storage, state.New(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := fingerprintOf(t, storage, tedRecording)
+
+	// While the show's artwork can't be fetched, ted's recording is left
+	// alone rather than tagged with the station's
+	down.Store(true)
+	st := state.New()
+	puts := storage.Calls(bucket.OpPutWithMetadata)
+	if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 0 {
+		t.Errorf("uploaded %d files during the outage, want none", calls)
+	}
+	if r := st.Get(state.StepMetadata, tedRecording); r != nil {
+		t.Errorf("record = %+v, want none so the next run tries again", r)
+	}
+
+	// Once it's back, the cover is the same as before, so nothing changes
+	down.Store(false)
+	if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := storage.Calls(bucket.OpPutWithMetadata) - puts; calls != 0 {
+		t.Errorf("uploaded %d files after the outage, want none", calls)
+	}
+	if got := fingerprintOf(t, storage, tedRecording); got != fingerprint {
+		t.Errorf("fingerprint = %s, want %s as before the outage", got, fingerprint)
+	}
+}
+
+func TestFingerprintIgnoresCoverEncoding(t *testing.T) {
+	recording := catalog.Recording{Key: tedRecording, Show: "mulch channel", DJ: "dj ted"}
+	cover := coverImage{Data: []byte{1, 2, 3}, Source: "/shows/mulch.png", Hash: "abc"}
+	reencoded := cover
+	reencoded.Data = []byte{4, 5, 6}
+	if desiredTags(recording, nil, nil, 0, cover).fingerprint() != desiredTags(recording, nil, nil, 0, reencoded).fingerprint() {
+		t.Errorf("re-encoding the same cover changed the fingerprint")
+	}
+	changed := cover
+	changed.Hash = "def"
+	if desiredTags(recording, nil, nil, 0, cover).fingerprint() == desiredTags(recording, nil, nil, 0, changed).fingerprint() {
+		t.Errorf("changing the cover's source file kept the fingerprint")
+	}
+}
+
+func TestUpdateMetadataFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault bucket.Fault
+	}{
+		{"download fails", bucket.Fault{Op: bucket.OpGetObject, Key: tedRecording, Err: errInjected}},
+		{"ACL can't be read", bucket.Fault{Op: bucket.OpGetObjectACL, Key: tedRecording, Err: errInjected}},
+		{"upload fails", bucket.Fault{Op: bucket.OpPutWithMetadata, Key: tedRecording, Err: errInjected}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newBucket(t)
+			st := state.New()
+			ctx := context.Background()
+			// Catalog the recordings first, so the fault hits the metadata
+			// step rather than the listing
+			if _, err := catalog.NewStore(storage).Sync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			storage.Inject(tt.fault)
+
+			if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+				t.Fatal(err)
+			}
+			if r := st.Get(state.StepMetadata, tedRecording); r == nil || r.Outcome != state.Failed {
+				t.Fatalf("record = %+v, want failed", r)
+			}
+			if r := st.Get(state.StepMetadata, brennanRecording); r == nil || r.Outcome != state.Done {
+				t.Errorf("other recording's record = %+v, want done", r)
+			}
+
+			// The failed recording is tried again once the bucket recovers
+			storage.ClearFaults()
+			if err := UpdateMetadata(ctx, storage, st, false, false); err != nil {
+				t.Fatal(err)
+			}
+			if r := st.Get(state.StepMetadata, tedRecording); r == nil || r.Outcome != state.Done {
+				t.Errorf("record after retry = %+v, want done", r)
+			}
+			if fingerprintOf(t, storage, tedRecording) == "" {
+				t.Errorf("no fingerprint after retry")
+			}
+		})
+	}
+}
+
+func TestUpdateMetadataListingFails(t *testing.T) {
+	storage := newBucket(t)
+	storage.Inject(bucket.Fault{Op: bucket.OpListObjects, Key: "recordings/", Err: errInjected})
+	if err := UpdateMetadata(context.Background(), storage, state.New(), false, false); err == nil {
+		t.Errorf("got no error, want the listing's")
+	}
+}
@@ -0,0 +1,156 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"cabbage.town/shed.cabbage.town/pkg/artwork"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/id3"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+	"cabbage.town/trellis/trellis"
+)
+
+// Object metadata recording which tags a file was last written with
+const (
+	// MetaFingerprint is the fingerprint of the tags in the file
+	MetaFingerprint = catalog.MetaID3Fingerprint
+	// MetaProcessed is "true" once a file has been tagged at all
+	MetaProcessed = "Id3-Processed"
+)
+
+// tagsVersion is part of every fingerprint. Bump it when the way tags are
+// derived changes, so the whole archive is re-tagged on the next run.
+const tagsVersion = 4
+
+// Station-wide values for tags a show doesn't set
+const (
+	stationGenre   = "Electronic"
+	stationComment = "Live recording from Cabbage Town Radio"
+)
+
+// Descriptions of the frames the tracklist is written to: USLT, which
+// players show alongside lyrics, and TXXX for anything reading it back
+const (
+	tracklistLyrics   = "Tracklist"
+	tracklistUserText = "TRACKLIST"
+)
+
+// tagSet is the tags a recording should carry
+type tagSet struct {
+	Title  string
+	Artist string
+	Album  string
+	Year   int
+	Genre  string
+	// Track is the episode number within the show, or zero for none
+	Track     int
+	Comment   string
+	Tracklist string
+	// TrackGain and TrackPeak are the ReplayGain values, empty until the
+	// recording's loudness has been measured
+	TrackGain string
+	TrackPeak string
+	// PageURL is the linked post's page or else the recording's URL, public
+	// or not, so publishing a recording doesn't change its tags. SourceURL
+	// is the station's page.
+	PageURL   string
+	SourceURL string
+	// Cover is the front cover image
+	Cover coverImage
+}
+
+// desiredTags works out the tags for a recording. The title is the linked
+// post's title, then the name given in shed, then the show and date. show
+// may be nil, and episode zero, when they're unknown.
+func desiredTags(recording catalog.Recording, show *shows.Show, post *posts.Post, episode int, cover coverImage) tagSet {
+	tags := tagSet{
+		Title:     fmt.Sprintf("%s (%s)", recording.Show, recording.Date),
+		Artist:    recording.DJ,
+		Album:     recording.Show,
+		Year:      recording.Recorded.Year(),
+		Genre:     stationGenre,
+		Track:     episode,
+		Comment:   stationComment,
+		PageURL:   recording.URL,
+		SourceURL: trellis.AbsoluteURL("/"),
+		Cover:     cover,
+	}
+	if show != nil && show.Genre != "" {
+		tags.Genre = show.Genre
+	}
+	if l := recording.Loudness; l != nil && !math.IsInf(l.Integrated, 0) {
+		tags.TrackGain = fmt.Sprintf("%.2f dB", l.TrackGain)
+		tags.TrackPeak = fmt.Sprintf("%.6f", l.TrackPeak)
+	}
+
+	if post != nil {
+		if post.Title != "" {
+			tags.Title = post.Title
+		}
+		if post.Metadata.Excerpt != "" {
+			tags.Comment = post.Metadata.Excerpt
+		}
+		tags.Tracklist = post.Tracklist()
+		tags.PageURL = trellis.PostURL(*post)
+	} else if recording.DisplayName != "" {
+		tags.Title = recording.DisplayName
+	}
+	return tags
+}
+
+// fingerprint identifies the tag set, so a file only needs re-tagging when
+// its stored fingerprint differs
+func (t tagSet) fingerprint() string {
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.Itoa(tagsVersion),
+		t.Title,
+		t.Artist,
+		t.Album,
+		strconv.Itoa(t.Year),
+		t.Genre,
+		strconv.Itoa(t.Track),
+		t.Comment,
+		t.Tracklist,
+		t.TrackGain,
+		t.TrackPeak,
+		t.PageURL,
+		t.SourceURL,
+		t.Cover.Source,
+		t.Cover.Hash,
+	} {
+		io.WriteString(h, field)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// apply writes the tag set into tag, keeping any frames it doesn't cover
+func (t tagSet) apply(tag *id3.Tag) {
+	tag.SetText(id3.Title, t.Title)
+	tag.SetText(id3.Artist, t.Artist)
+	tag.SetText(id3.Album, t.Album)
+	tag.SetYear(t.Year)
+	tag.SetText(id3.Genre, t.Genre)
+	if t.Track > 0 {
+		tag.SetText(id3.TrackNumber, strconv.Itoa(t.Track))
+	} else {
+		tag.Remove(id3.TrackNumber)
+	}
+	tag.SetComment("eng", "", t.Comment)
+	tag.SetLyrics("eng", tracklistLyrics, t.Tracklist)
+	tag.SetUserText(tracklistUserText, t.Tracklist)
+	tag.SetUserText("REPLAYGAIN_TRACK_GAIN", t.TrackGain)
+	tag.SetUserText("REPLAYGAIN_TRACK_PEAK", t.TrackPeak)
+	tag.SetURL(id3.AudioFileURL, t.PageURL)
+	tag.SetURL(id3.AudioSourceURL, t.SourceURL)
+	if t.Cover.Data != nil {
+		tag.SetPicture(id3.PictureFrontCover, artwork.MIMEType, "Cover", t.Cover.Data)
+	}
+}
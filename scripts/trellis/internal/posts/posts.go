@@ -1,18 +1,21 @@
 package posts
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
 )
 
 // Post represents a blog post (matching shed's structure)
@@ -31,35 +34,37 @@ type Post struct {
 }
 
 type PostMetadata struct {
-	Tags      []string `json:"tags"`
-	Category  string   `json:"category"`
-	Excerpt   string   `json:"excerpt"`
-	Recording string   `json:"recording"` // S3 key of associated recording
+	Tags      []string    `json:"tags"`
+	Category  string      `json:"category"`
+	Excerpt   string      `json:"excerpt"`
+	Recording string      `json:"recording"` // S3 key of associated recording
+	Podcast   PodcastInfo `json:"podcast"`
+}
+
+// PodcastInfo is optional podcast feed detail for the post's recording (matching shed's structure)
+type PodcastInfo struct {
+	Guests     []string `json:"guests,omitempty"`
+	Chapters   string   `json:"chapters,omitempty"`
+	Transcript string   `json:"transcript,omitempty"`
+	Cover      string   `json:"cover,omitempty"`
+	Season     int      `json:"season,omitempty"`
+	Episode    int      `json:"episode,omitempty"`
 }
 
 // Config holds configuration for post generation
 type Config struct {
-	BucketClient *bucket.Client
+	BucketClient bucket.Storage
 	OutputDir    string // JSON data files (posts.json, recordings.json)
 	PlaylistsDir string // M3U playlist files
+	// Shows is loaded from the bucket when nil
+	Shows *shows.Registry
 }
 
 // UserPlaylist represents a user-specific playlist with filtering
 type UserPlaylist struct {
 	Username string
 	Filename string
-	Filter   func(Recording) bool
-}
-
-// Recording represents a recording from the trellis sync (matches trellis.Recording)
-type Recording struct {
-	URL          string
-	Key          string
-	DJ           string
-	Show         string
-	Date         string
-	LastModified time.Time
-	DisplayName  string
+	Filter   func(catalog.Recording) bool
 }
 
 // PostData is the nested post data embedded in a recording (nullable via pointer)
@@ -85,13 +90,45 @@ type RecordingOutput struct {
 	Date         string    `json:"date"`
 	LastModified time.Time `json:"lastModified"`
 	DisplayName  string    `json:"displayName"`
-	Post         *PostData `json:"post,omitempty"`
+	// Loudness lets the player even out levels between recordings
+	Loudness *LoudnessData `json:"loudness,omitempty"`
+	Waveform *WaveformData `json:"waveform,omitempty"`
+	Post     *PostData     `json:"post,omitempty"`
+	// Clips are the public clips cut from the recording, in order
+	Clips []ClipData `json:"clips,omitempty"`
+}
+
+// ClipData is a clip cut from a recording in shed, for the site's clip pages
+type ClipData struct {
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Start     float64   `json:"start"`              // seconds into the recording
+	End       float64   `json:"end"`                // seconds into the recording
+	Duration  float64   `json:"duration,omitempty"` // seconds
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WaveformData points at a recording's peaks files, in the audiowaveform
+// JSON format peaks.js reads
+type WaveformData struct {
+	URL         string `json:"url"`         // 10 pixels per second
+	OverviewURL string `json:"overviewUrl"` // at most 1000 pixels
+}
+
+// LoudnessData is a recording's measured loudness. Players that want every
+// recording at the ReplayGain reference level apply TrackGain, in dB.
+type LoudnessData struct {
+	Integrated float64 `json:"integrated"` // LUFS
+	TruePeak   float64 `json:"truePeak"`   // dBTP
+	TrackGain  float64 `json:"trackGain"`  // dB
+	TrackPeak  float64 `json:"trackPeak"`  // linear, 1 is full scale
 }
 
 // ListPosts fetches all published, non-deleted posts from S3
-func ListPosts(client *bucket.Client) ([]Post, error) {
+func ListPosts(ctx context.Context, client bucket.Storage) ([]Post, error) {
 	log.Printf("[POSTS] Listing posts from S3...")
-	objects, err := client.ListObjects("posts/")
+	objects, err := client.ListObjectsWithContext(ctx, "posts/")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list posts: %v", err)
 	}
@@ -111,7 +148,7 @@ func ListPosts(client *bucket.Client) ([]Post, error) {
 		}
 
 		// Fetch and parse post
-		output, err := client.GetObject(*obj.Key)
+		output, err := client.GetObjectWithContext(ctx, *obj.Key)
 		if err != nil {
 			log.Printf("[POSTS] WARNING: Failed to fetch %s: %v", *obj.Key, err)
 			continue
@@ -153,142 +190,38 @@ func ListPosts(client *bucket.Client) ([]Post, error) {
 	return posts, nil
 }
 
-// getShowName returns the show name and DJ name for a given username
-func getShowName(dj string) (string, string, error) {
-	switch dj {
-	case "brennan":
-		return "Late Nights Like These", "Nights Like These", nil
-	case "ted":
-		return "mulch channel", "dj ted", nil
-	case "ben":
-		return "IS WiLD hour", "DJ CHICAGO STYLE", nil
-	case "will":
-		return "tracks from terminus", "the conductor", nil
-	case "katherine":
-		return "The reginajingles show", "reginajingles", nil
-	case "seth":
-		return "Home Cooking Show", "Seth", nil
-	default:
-		return "", "", fmt.Errorf("unknown DJ: %s", dj)
-	}
-}
-
-// parseRecordingInfo extracts recording information from a URL
-func parseRecordingInfo(url string, lastModified time.Time) Recording {
-	// Example URL: https://cabbagetown.nyc3.digitaloceanspaces.com/recordings/brennan/stream_20250626-204143.mp3
-	parts := strings.Split(url, "/")
-
-	var username, show, dj string
-	var date time.Time
-
-	// Extract username from URL path
-	if len(parts) >= 5 {
-		username = parts[4]
-		show, dj, _ = getShowName(username)
-	}
-
-	filename := parts[len(parts)-1]
-
-	// Try standard format first: stream_YYYYMMDD-HHMMSS.mp3
-	if strings.HasPrefix(filename, "stream_") && len(filename) >= 23 {
-		dateStr := filename[7:15] // Extract YYYYMMDD
-		parsedDate, err := time.Parse("20060102", dateStr)
-		if err == nil {
-			date = parsedDate
-		}
-	}
-
-	// Fallback: Try to find YYYYMMDD-HHMMSS pattern anywhere in filename
-	if date.IsZero() {
-		datePattern := regexp.MustCompile(`(\d{8})-\d{6}`)
-		if matches := datePattern.FindStringSubmatch(filename); len(matches) > 1 {
-			parsedDate, err := time.Parse("20060102", matches[1])
-			if err == nil {
-				date = parsedDate
-			}
-		}
-	}
-
-	// If still no date, use lastModified
-	if date.IsZero() {
-		date = lastModified
-	}
-
-	return Recording{
-		URL:          url,
-		DJ:           dj,
-		Show:         show,
-		Date:         date.Format("January 2, 2006"),
-		LastModified: date,
-	}
-}
-
-// isRecordingPublic checks if a recording has public-read ACL
-func isRecordingPublic(client *bucket.Client, key string) bool {
-	aclOutput, err := client.GetObjectACL(key)
-	if err != nil {
-		log.Printf("[POSTS] WARNING: Failed to get ACL for %s: %v", key, err)
-		return false
-	}
-
-	// Check if the object has public-read ACL
-	for _, grant := range aclOutput.Grants {
-		if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-			return true
-		}
-	}
-
-	return false
-}
-
-// fetchRecordingsFromS3 fetches all public recordings directly from the S3 bucket
-func fetchRecordingsFromS3(client *bucket.Client) ([]Recording, error) {
+// fetchRecordingsFromS3 fetches all public recordings and clips directly from the S3 bucket
+func fetchRecordingsFromS3(ctx context.Context, client bucket.Storage, registry *shows.Registry) ([]catalog.Recording, []catalog.Clip, error) {
 	log.Printf("[POSTS] Fetching recordings from S3...")
-	objects, err := client.ListObjects("recordings/")
+	manifest, err := catalog.NewStore(client).Sync(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list recordings: %v", err)
+		return nil, nil, fmt.Errorf("failed to list recordings: %v", err)
 	}
-	log.Printf("[POSTS] Found %d objects in recordings/", len(objects))
 
-	var recordings []Recording
-	var skipped int
+	var recordings []catalog.Recording
 	var privateCount int
 
-	for _, obj := range objects {
-		if obj.Key == nil || len(*obj.Key) < 4 || (*obj.Key)[len(*obj.Key)-4:] != ".mp3" {
+	for _, entry := range manifest.Entries("recordings/") {
+		if !strings.HasSuffix(entry.Key, ".mp3") {
 			continue
 		}
-
-		// Check if recording is public
-		if !isRecordingPublic(client, *obj.Key) {
-			log.Printf("[POSTS] Skipping private recording: %s", *obj.Key)
+		if !entry.Public {
+			log.Printf("[POSTS] Skipping private recording: %s", entry.Key)
 			privateCount++
 			continue
 		}
 
-		// Construct URL
-		fullURL := "https://cabbagetown.nyc3.digitaloceanspaces.com/" + *obj.Key
-		log.Printf("[POSTS] Processing public MP3: %s", *obj.Key)
-
-		// Parse recording info (handles both standard and custom formats)
-		lastModified := time.Now()
-		if obj.LastModified != nil {
-			lastModified = *obj.LastModified
-		}
-
-		recording := parseRecordingInfo(fullURL, lastModified)
-		recording.Key = *obj.Key
+		// Construct URL using the configured public bucket URL
+		fullURL := client.PublicURL(entry.Key)
+		log.Printf("[POSTS] Processing public MP3: %s", entry.Key)
 
-		// Get object metadata to check for display name
-		headOutput, err := client.HeadObject(*obj.Key)
-		if err == nil && headOutput.Metadata != nil {
-			if displayName, ok := headOutput.Metadata["Display-Name"]; ok && displayName != nil {
-				recording.DisplayName = *displayName
-				log.Printf("[POSTS] Using display name: %s", recording.DisplayName)
-			}
+		recording, err := catalog.NewRecording(entry, registry, fullURL)
+		if err != nil {
+			log.Printf("[POSTS] WARNING: Skipping %s: %v", entry.Key, err)
+			continue
 		}
 
-		// If no display name from metadata, use the show name
+		// Use the display name from metadata if there is one, otherwise the show name
 		if recording.DisplayName == "" {
 			recording.DisplayName = recording.Show
 		}
@@ -296,20 +229,31 @@ func fetchRecordingsFromS3(client *bucket.Client) ([]Recording, error) {
 		recordings = append(recordings, recording)
 	}
 
-	// Sort by LastModified descending (newest first), then by Key for stability
-	sort.Slice(recordings, func(i, j int) bool {
-		if recordings[i].LastModified.Equal(recordings[j].LastModified) {
-			return recordings[i].Key < recordings[j].Key
+	// Newest first, then by Key for stability
+	catalog.SortRecordings(recordings)
+
+	log.Printf("[POSTS] Successfully fetched %d public recordings (private %d)", len(recordings), privateCount)
+
+	var clips []catalog.Clip
+	for _, entry := range manifest.Entries(catalog.ClipsPrefix) {
+		if !entry.Public {
+			continue
 		}
-		return recordings[i].LastModified.After(recordings[j].LastModified)
-	})
+		clip, err := catalog.NewClip(entry, registry, client.PublicURL(entry.Key))
+		if err != nil {
+			log.Printf("[POSTS] WARNING: Skipping clip %s: %v", entry.Key, err)
+			continue
+		}
+		clips = append(clips, clip)
+	}
+	catalog.SortClips(clips)
+	log.Printf("[POSTS] Fetched %d public clips", len(clips))
 
-	log.Printf("[POSTS] Successfully fetched %d public recordings (skipped %d, private %d)", len(recordings), skipped, privateCount)
-	return recordings, nil
+	return recordings, clips, nil
 }
 
 // generatePlaylist creates an M3U playlist file from recordings
-func generatePlaylist(recordings []Recording, outputFile string, outputDir string, filter func(Recording) bool) error {
+func generatePlaylist(recordings []catalog.Recording, outputFile string, outputDir string, filter func(catalog.Recording) bool) error {
 	outputFilePath := filepath.Join(outputDir, outputFile)
 
 	if err := os.MkdirAll(filepath.Dir(outputFilePath), 0755); err != nil {
@@ -331,25 +275,24 @@ func generatePlaylist(recordings []Recording, outputFile string, outputDir strin
 	return nil
 }
 
-// GeneratePlaylists creates M3U playlist files from recordings
-func GeneratePlaylists(recordings []Recording, outputDir string) error {
+// GeneratePlaylists creates M3U playlist files from recordings: one with
+// everything, plus one for each show in the registry that names a playlist file
+func GeneratePlaylists(recordings []catalog.Recording, outputDir string, registry *shows.Registry) error {
 	log.Printf("[POSTS] Generating playlists...")
 
-	userPlaylists := []UserPlaylist{
-		{
-			Username: "seth",
-			Filename: filepath.Join("playlists", "home_cooking.m3u"),
-			Filter: func(r Recording) bool {
-				return r.DJ == "Seth"
-			},
-		},
-		{
-			Username: "will",
-			Filename: filepath.Join("playlists", "tracks_from_terminus.m3u"),
-			Filter: func(r Recording) bool {
-				return r.DJ == "the conductor"
+	var userPlaylists []UserPlaylist
+	for _, show := range registry.Shows {
+		if show.Playlist == "" {
+			continue
+		}
+		show := show
+		userPlaylists = append(userPlaylists, UserPlaylist{
+			Username: strings.Join(show.Owners, ", "),
+			Filename: filepath.Join("playlists", show.Playlist),
+			Filter: func(r catalog.Recording) bool {
+				return show.HasOwner(r.Owner)
 			},
-		},
+		})
 	}
 
 	// Generate main playlist with all recordings
@@ -379,11 +322,20 @@ func GeneratePlaylists(recordings []Recording, outputDir string) error {
 }
 
 // Run fetches posts and recordings from S3, merges them, and writes recordings.json
-func Run(config Config) error {
+func Run(ctx context.Context, config Config) error {
 	log.Printf("[POSTS] Starting data export process")
 
+	registry := config.Shows
+	if registry == nil {
+		var err error
+		registry, err = shows.Load(ctx, config.BucketClient)
+		if err != nil {
+			return fmt.Errorf("failed to load shows: %v", err)
+		}
+	}
+
 	// List all published posts
-	posts, err := ListPosts(config.BucketClient)
+	posts, err := ListPosts(ctx, config.BucketClient)
 	if err != nil {
 		return fmt.Errorf("failed to list posts: %v", err)
 	}
@@ -403,14 +355,28 @@ func Run(config Config) error {
 	}
 
 	// Fetch recordings from S3
-	recordings, err := fetchRecordingsFromS3(config.BucketClient)
+	recordings, clips, err := fetchRecordingsFromS3(ctx, config.BucketClient, registry)
 	if err != nil {
 		return fmt.Errorf("failed to fetch recordings from S3: %v", err)
 	}
 
+	// Clips are listed under the recording they were cut from
+	clipsByRecKey := make(map[string][]ClipData)
+	for _, c := range clips {
+		clipsByRecKey[c.Recording] = append(clipsByRecKey[c.Recording], ClipData{
+			Key:       c.Key,
+			URL:       c.URL,
+			Title:     c.Title,
+			Start:     c.Start.Seconds(),
+			End:       c.End.Seconds(),
+			Duration:  c.Duration.Seconds(),
+			CreatedAt: c.Created,
+		})
+	}
+
 	// Convert recordings to output format, enriching with post data
 	recOutputs := make([]RecordingOutput, len(recordings))
-	enriched := 0
+	enriched, clipped := 0, 0
 	for i, r := range recordings {
 		recOutputs[i] = RecordingOutput{
 			Key:          r.Key,
@@ -418,8 +384,29 @@ func Run(config Config) error {
 			DJ:           r.DJ,
 			Show:         r.Show,
 			Date:         r.Date,
-			LastModified: r.LastModified,
-			DisplayName:  r.DisplayName,
+			LastModified: r.Recorded, // the site orders recordings by this
+
+			DisplayName: r.DisplayName,
+		}
+		if l := r.Loudness; l != nil && !math.IsInf(l.Integrated, 0) {
+			recOutputs[i].Loudness = &LoudnessData{
+				Integrated: l.Integrated,
+				TruePeak:   l.TruePeak,
+				TrackGain:  l.TrackGain,
+				TrackPeak:  l.TrackPeak,
+			}
+		}
+		if r.Metadata[catalog.MetaWaveform] != "" {
+			detail, overview := catalog.WaveformKeys(r.Key)
+			recOutputs[i].Waveform = &WaveformData{
+				URL:         config.BucketClient.PublicURL(detail),
+				OverviewURL: config.BucketClient.PublicURL(overview),
+			}
+		}
+		if c := clipsByRecKey[r.Key]; len(c) > 0 {
+			recOutputs[i].Clips = c
+			clipped += len(c)
+			delete(clipsByRecKey, r.Key)
 		}
 
 		// Attach post data if this recording has a linked post
@@ -459,7 +446,7 @@ func Run(config Config) error {
 			DisplayName:  p.Title,
 			DJ:           p.Author,
 			Show:         p.Title,
-			Date:         p.CreatedAt.Format("January 2, 2006"),
+			Date:         p.CreatedAt.Format(catalog.DateLayout),
 			LastModified: p.CreatedAt,
 			Post: &PostData{
 				ID:        p.ID,
@@ -477,6 +464,10 @@ func Run(config Config) error {
 		standalone++
 	}
 	log.Printf("[POSTS] Enriched %d recordings with post data, added %d standalone posts", enriched, standalone)
+	log.Printf("[POSTS] Listed %d clips under their recordings", clipped)
+	for key, c := range clipsByRecKey {
+		log.Printf("[POSTS] WARNING: Skipping %d clips of %s, which isn't public", len(c), key)
+	}
 
 	// Write recordings.json
 	recJSON, err := json.MarshalIndent(recOutputs, "", "  ")
@@ -489,8 +480,19 @@ func Run(config Config) error {
 	}
 	log.Printf("[POSTS] Wrote %d recordings to %s", len(recOutputs), recFile)
 
+	// Write shows.json so the site presents shows the same way shed and trellis do
+	showsJSON, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal shows: %v", err)
+	}
+	showsFile := fmt.Sprintf("%s/shows.json", config.OutputDir)
+	if err := os.WriteFile(showsFile, showsJSON, 0644); err != nil {
+		return fmt.Errorf("failed to write shows.json: %v", err)
+	}
+	log.Printf("[POSTS] Wrote %d shows to %s", len(registry.Shows), showsFile)
+
 	// Generate playlists
-	if err := GeneratePlaylists(recordings, config.PlaylistsDir); err != nil {
+	if err := GeneratePlaylists(recordings, config.PlaylistsDir, registry); err != nil {
 		return fmt.Errorf("failed to generate playlists: %v", err)
 	}
 
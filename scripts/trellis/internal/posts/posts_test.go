@@ -0,0 +1,210 @@
+package posts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+const (
+	tedRecording     = "recordings/ted/stream_20240101-200000.mp3"
+	brennanRecording = "recordings/brennan/stream_20240102-200000.mp3"
+	privateRecording = "recordings/ted/stream_20240103-200000.mp3"
+)
+
+var errInjected = errors.New("injected failure")
+
+const testShows = `{"shows": [
+	{"slug": "mulch-channel", "name": "mulch channel", "dj": "dj ted", "owners": ["ted"], "playlist": "ted.m3u"},
+	{"slug": "late-nights-like-these", "name": "Late Nights Like These", "dj": "Nights Like These", "owners": ["brennan"]}
+]}`
+
+// newBucket returns a bucket with two public recordings and a private one,
+// a post about ted's public recording and a standalone post
+func newBucket(t *testing.T) *bucket.MemoryClient {
+	t.Helper()
+	storage := bucket.NewMemoryClient("test")
+	if err := storage.PutObject("config/shows.json", []byte(testShows), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	for key, acl := range map[string]string{
+		tedRecording:     "public-read",
+		brennanRecording: "public-read",
+		privateRecording: "private",
+	} {
+		body := bytes.NewReader(mp3test.Silence(10, false))
+		if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, acl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	putPost(t, storage, Post{
+		ID: "soup", Title: "Soup Night", Slug: "soup-night", Author: "dj ted", CreatedBy: "ted",
+		CreatedAt: created, UpdatedAt: created, Published: true,
+		Metadata: PostMetadata{Recording: tedRecording, Excerpt: "soups"},
+	})
+	putPost(t, storage, Post{
+		ID: "news", Title: "Station News", Slug: "station-news", Author: "brennan", CreatedBy: "brennan",
+		CreatedAt: created, UpdatedAt: created, Published: true,
+	})
+	putPost(t, storage, Post{
+		ID: "draft", Title: "Draft", Slug: "draft", CreatedBy: "ted", CreatedAt: created, UpdatedAt: created,
+	})
+	return storage
+}
+
+func putPost(t *testing.T, storage bucket.Storage, post Post) {
+	t.Helper()
+	data, err := json.Marshal(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutObject("posts/"+post.ID+".json", data, "application/json"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func run(t *testing.T, storage bucket.Storage) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	err := Run(context.Background(), Config{
+		BucketClient: storage,
+		OutputDir:    filepath.Join(dir, "data"),
+		PlaylistsDir: dir,
+	})
+	return dir, err
+}
+
+func readRecordings(t *testing.T, dir string) []RecordingOutput {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "data", "recordings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recordings []RecordingOutput
+	if err := json.Unmarshal(data, &recordings); err != nil {
+		t.Fatal(err)
+	}
+	return recordings
+}
+
+func TestRun(t *testing.T) {
+	dir, err := run(t, newBucket(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recordings := readRecordings(t, dir)
+	var keys, titles []string
+	for _, r := range recordings {
+		keys = append(keys, r.Key)
+		titles = append(titles, r.DisplayName)
+	}
+	// Public recordings newest first, then standalone posts
+	wantKeys := []string{brennanRecording, tedRecording, ""}
+	wantTitles := []string{"Late Nights Like These", "Soup Night", "Station News"}
+	if strings.Join(keys, ",") != strings.Join(wantKeys, ",") {
+		t.Errorf("keys = %q, want %q", keys, wantKeys)
+	}
+	if strings.Join(titles, ",") != strings.Join(wantTitles, ",") {
+		t.Errorf("titles = %q, want %q", titles, wantTitles)
+	}
+	if len(recordings) > 1 {
+		if p := recordings[1].Post; p == nil || p.Slug != "soup-night" || p.Excerpt != "soups" {
+			t.Errorf("linked post = %+v, want soup-night", p)
+		}
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(dir, "playlists", "ted.m3u"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(playlist), tedRecording) || strings.Contains(string(playlist), brennanRecording) {
+		t.Errorf("ted's playlist has the wrong recordings:\n%s", playlist)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "shows.json")); err != nil {
+		t.Errorf("shows.json not written: %v", err)
+	}
+}
+
+func TestRunSkipsUnreadablePosts(t *testing.T) {
+	storage := newBucket(t)
+	storage.Inject(bucket.Fault{Op: bucket.OpGetObject, Key: "posts/soup.json", Err: errInjected})
+	dir, err := run(t, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range readRecordings(t, dir) {
+		if r.Post != nil && r.Post.ID == "soup" {
+			t.Errorf("recording %q has the unreadable post", r.Key)
+		}
+		if r.Key == tedRecording && r.DisplayName != "mulch channel" {
+			t.Errorf("display name = %q, want the show name", r.DisplayName)
+		}
+	}
+}
+
+func TestRunFails(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault bucket.Fault
+	}{
+		{"posts can't be listed", bucket.Fault{Op: bucket.OpListObjects, Key: "posts/", Err: errInjected}},
+		{"recordings can't be listed", bucket.Fault{Op: bucket.OpListObjects, Key: "recordings/", Err: errInjected}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newBucket(t)
+			storage.Inject(tt.fault)
+			dir, err := run(t, storage)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			// A failed run mustn't leave a partial recordings.json for the site
+			if _, err := os.Stat(filepath.Join(dir, "data", "recordings.json")); !os.IsNotExist(err) {
+				t.Errorf("recordings.json was written")
+			}
+		})
+	}
+}
+
+func TestRunCatchesUpWithStaleListing(t *testing.T) {
+	storage := newBucket(t)
+	const key = "recordings/brennan/stream_20240104-200000.mp3"
+	storage.StaleReads = 1
+	body := bytes.NewReader(mp3test.Silence(10, false))
+	if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, "public-read"); err != nil {
+		t.Fatal(err)
+	}
+	storage.StaleReads = 0
+
+	listed := func() bool {
+		dir, err := run(t, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range readRecordings(t, dir) {
+			if r.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	if listed() {
+		t.Fatalf("stale listing included %s", key)
+	}
+	if !listed() {
+		t.Errorf("%s missing once the listing caught up", key)
+	}
+}
@@ -0,0 +1,47 @@
+package posts
+
+import (
+	"regexp"
+	"strings"
+)
+
+// listMarker matches a markdown bullet or number at the start of a line
+var listMarker = regexp.MustCompile(`^(?:[-*+]|\d+[.)])\s+`)
+
+// Tracklist returns the tracks listed under a "Tracklist" line in the post's
+// markdown, one per line, or "" if it has none. The heading may be written
+// as a markdown heading, in bold, or plain, with or without a colon. The list
+// ends at the first blank line or heading after it.
+func (p Post) Tracklist() string {
+	lines := strings.Split(strings.ReplaceAll(p.Markdown, "\r\n", "\n"), "\n")
+
+	var tracks []string
+	inList := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !inList {
+			inList = isTracklistHeading(line)
+			continue
+		}
+		if line == "" {
+			if len(tracks) > 0 {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			break
+		}
+		tracks = append(tracks, listMarker.ReplaceAllString(line, ""))
+	}
+	return strings.Join(tracks, "\n")
+}
+
+// isTracklistHeading reports whether a line introduces a tracklist
+func isTracklistHeading(line string) bool {
+	text := strings.TrimLeft(line, "# ")
+	text = strings.Trim(text, "*_ ")
+	text = strings.TrimSuffix(text, ":")
+	text = strings.Trim(text, "*_ ")
+	return strings.EqualFold(text, "tracklist") || strings.EqualFold(text, "track list")
+}
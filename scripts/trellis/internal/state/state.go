@@ -0,0 +1,284 @@
+// Package state remembers, for each step of the nightly sync, which version
+// of each object the step last handled and how that went. It's kept in the
+// bucket at Key, so every run's steps work on exactly the objects that
+// changed since they last handled them, however old those objects are.
+//
+// An object's version is its ETag, which changes when its audio does but not
+// when only its metadata or ACL does. Steps whose result depends on more than
+// the audio, such as the tags, also record an input string describing
+// everything else they used.
+package state
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+)
+
+const (
+	// Key is where the state is stored in the bucket
+	Key = "trellis/state.json"
+	// Version is the state format written by this package
+	Version = 1
+)
+
+// MaxFailures is how many runs in a row a step tries an object before it
+// gives up on it. A stuck object is tried again once it changes.
+const MaxFailures = 5
+
+// The steps that keep state
+const (
+	StepACL      = "acl"
+	StepAnalysis = "analysis"
+	StepMetadata = "metadata"
+)
+
+// Outcome is how a step's handling of an object went
+type Outcome string
+
+const (
+	// Done means the step changed the object
+	Done Outcome = "done"
+	// Skipped means the step found nothing to do
+	Skipped Outcome = "skipped"
+	// Failed means the step gave up with an error, so it tries again next
+	// run unless it has failed MaxFailures times in a row
+	Failed Outcome = "failed"
+)
+
+// Record is what a step remembers about an object
+type Record struct {
+	ETag    string    `json:"etag"`
+	Input   string    `json:"input,omitempty"`
+	Outcome Outcome   `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+	// Failures counts the failures in a row
+	Failures int `json:"failures,omitempty"`
+}
+
+// State is the stored sync state
+type State struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Steps maps a step to its records, keyed by object key
+	Steps map[string]map[string]*Record `json:"steps"`
+
+	etag   string // ETag of the state object when it was loaded
+	loaded bool
+}
+
+// New returns an empty state
+func New() *State {
+	return &State{
+		Version: Version,
+		Steps:   make(map[string]map[string]*Record),
+	}
+}
+
+// Load reads the state, returning an empty one if there isn't one yet
+func Load(ctx context.Context, storage bucket.Storage) (*State, error) {
+	output, err := storage.GetObjectWithContext(ctx, Key)
+	if bucket.IsNotFound(err) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sync state: %v", err)
+	}
+	defer output.Body.Close()
+
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync state: %v", err)
+	}
+	s := New()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state: %v", err)
+	}
+	if s.Version > Version {
+		return nil, fmt.Errorf("sync state version %d is newer than supported version %d", s.Version, Version)
+	}
+	if s.Steps == nil {
+		s.Steps = make(map[string]map[string]*Record)
+	}
+	s.etag = aws.StringValue(output.ETag)
+	s.loaded = true
+	return s, nil
+}
+
+// Fresh reports whether there was no stored state to load, as on the first
+// run after the state was introduced
+func (s *State) Fresh() bool {
+	return !s.loaded
+}
+
+// Save writes the state unless another run saved it since it was loaded, in
+// which case it returns bucket.ErrPreconditionFailed
+func (s *State) Save(ctx context.Context, storage bucket.Storage) error {
+	head, err := storage.HeadObjectWithContext(ctx, Key)
+	switch {
+	case bucket.IsNotFound(err):
+		if s.etag != "" {
+			return bucket.ErrPreconditionFailed
+		}
+	case err != nil:
+		return fmt.Errorf("failed to check sync state: %v", err)
+	default:
+		if trimETag(aws.StringValue(head.ETag)) != trimETag(s.etag) {
+			return bucket.ErrPreconditionFailed
+		}
+	}
+
+	s.Version = Version
+	s.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync state: %v", err)
+	}
+	if err := storage.PutObjectWithContext(ctx, Key, data, "application/json"); err != nil {
+		return fmt.Errorf("failed to save sync state: %v", err)
+	}
+	sum := md5.Sum(data)
+	s.etag = hex.EncodeToString(sum[:])
+	s.loaded = true
+	return nil
+}
+
+// Get returns what step remembers about key, or nil
+func (s *State) Get(step, key string) *Record {
+	return s.Steps[step][key]
+}
+
+// Pending reports whether step should handle the object at key: it never
+// has, the object's ETag or the step's input changed since, or it failed
+// fewer than MaxFailures times in a row
+func (s *State) Pending(step, key, etag, input string) bool {
+	r := s.Get(step, key)
+	if r == nil || r.ETag != trimETag(etag) || r.Input != input {
+		return true
+	}
+	return r.Outcome == Failed && !r.Stuck()
+}
+
+// Stuck reports whether the step gave up on the object after failing
+// MaxFailures times in a row
+func (r *Record) Stuck() bool {
+	return r.Outcome == Failed && r.Failures >= MaxFailures
+}
+
+// Handled records that step handled the object at key as it was at etag
+func (s *State) Handled(step, key, etag, input string, outcome Outcome) {
+	s.put(step, key, &Record{
+		ETag:    trimETag(etag),
+		Input:   input,
+		Outcome: outcome,
+		At:      time.Now().UTC(),
+	})
+}
+
+// Failed records that step failed to handle the object at key, so it stays
+// pending until it has failed MaxFailures times in a row. Failures of an
+// earlier version of the object or with other input don't count.
+func (s *State) Failed(step, key, etag, input string, err error) {
+	failures := 1
+	if r := s.Get(step, key); r != nil && r.Outcome == Failed && r.ETag == trimETag(etag) && r.Input == input {
+		failures = r.Failures + 1
+	}
+	s.put(step, key, &Record{
+		ETag:     trimETag(etag),
+		Input:    input,
+		Outcome:  Failed,
+		Error:    err.Error(),
+		At:       time.Now().UTC(),
+		Failures: failures,
+	})
+}
+
+func (s *State) put(step, key string, r *Record) {
+	records, ok := s.Steps[step]
+	if !ok {
+		records = make(map[string]*Record)
+		s.Steps[step] = records
+	}
+	records[key] = r
+}
+
+// Rewrote records that trellis itself replaced the object at key, whose
+// ETag was from and is now to. Steps that had handled the old version are
+// taken to have handled the new one, so a step's own writes don't make the
+// object look changed to the others.
+func (s *State) Rewrote(key, from, to string) {
+	from, to = trimETag(from), trimETag(to)
+	if from == to || to == "" {
+		return
+	}
+	for _, records := range s.Steps {
+		if r, ok := records[key]; ok && r.ETag == from {
+			r.ETag = to
+		}
+	}
+}
+
+// Wrote is Rewrote for an object trellis has just written, reading its new
+// ETag from the bucket
+func (s *State) Wrote(ctx context.Context, storage bucket.Storage, key, from string) error {
+	head, err := storage.HeadObjectWithContext(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get the new ETag of %s: %v", key, err)
+	}
+	s.Rewrote(key, from, aws.StringValue(head.ETag))
+	return nil
+}
+
+// Prune forgets objects that aren't in keys, returning how many it forgot
+func (s *State) Prune(keys map[string]bool) int {
+	forgotten := make(map[string]bool)
+	for _, records := range s.Steps {
+		for key := range records {
+			if !keys[key] {
+				delete(records, key)
+				forgotten[key] = true
+			}
+		}
+	}
+	return len(forgotten)
+}
+
+// Summary counts each step's records by outcome
+func (s *State) Summary() map[string]map[Outcome]int {
+	summary := make(map[string]map[Outcome]int, len(s.Steps))
+	for step, records := range s.Steps {
+		counts := make(map[Outcome]int)
+		for _, r := range records {
+			counts[r.Outcome]++
+		}
+		summary[step] = counts
+	}
+	return summary
+}
+
+// Stuck returns the keys of the objects step gave up on, sorted
+func (s *State) Stuck(step string) []string {
+	var keys []string
+	for key, r := range s.Steps[step] {
+		if r.Stuck() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
@@ -0,0 +1,54 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPendingGivesUpAfterMaxFailures(t *testing.T) {
+	const (
+		key   = "recordings/ted/stream_20240101-200000.mp3"
+		other = "recordings/brennan/stream_20240102-200000.mp3"
+		etag  = `"0123456789abcdef0123456789abcdef"`
+	)
+	errFailed := errors.New("injected failure")
+	s := New()
+	s.Failed(StepACL, other, etag, "", errFailed)
+
+	for i := 1; i < MaxFailures; i++ {
+		s.Failed(StepACL, key, etag, "", errFailed)
+		if !s.Pending(StepACL, key, etag, "") {
+			t.Fatalf("not pending after %d failures", i)
+		}
+	}
+	s.Failed(StepACL, key, etag, "", errFailed)
+	if s.Pending(StepACL, key, etag, "") {
+		t.Errorf("still pending after %d failures", MaxFailures)
+	}
+	if got, want := s.Stuck(StepACL), []string{key}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stuck = %v, want %v", got, want)
+	}
+
+	// A new version of the object is worth trying again, and its failures
+	// are counted afresh
+	const changed = `"fedcba9876543210fedcba9876543210"`
+	if !s.Pending(StepACL, key, changed, "") {
+		t.Errorf("changed object isn't pending")
+	}
+	if !s.Pending(StepACL, key, etag, "new input") {
+		t.Errorf("object with new input isn't pending")
+	}
+	s.Failed(StepACL, key, changed, "", errFailed)
+	if r := s.Get(StepACL, key); r.Failures != 1 {
+		t.Errorf("failures after a change = %d, want 1", r.Failures)
+	}
+	if stuck := s.Stuck(StepACL); len(stuck) != 0 {
+		t.Errorf("stuck = %v, want none", stuck)
+	}
+
+	s.Handled(StepACL, key, changed, "", Done)
+	if s.Pending(StepACL, key, changed, "") {
+		t.Errorf("handled object is pending")
+	}
+}
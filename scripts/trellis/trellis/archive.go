@@ -0,0 +1,432 @@
+package trellis
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+)
+
+const jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+
+// JSONFeed is a JSON Feed 1.1 document
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description"`
+	Icon        string         `json:"icon,omitempty"`
+	Language    string         `json:"language"`
+	Authors     []JSONAuthor   `json:"authors"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+type JSONAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type JSONFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHTML   string           `json:"content_html,omitempty"`
+	ContentText   string           `json:"content_text,omitempty"`
+	Summary       string           `json:"summary,omitempty"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified,omitempty"`
+	Authors       []JSONAuthor     `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+	Attachments   []JSONAttachment `json:"attachments,omitempty"`
+	// Cabbage is the feed's extension with the recording's show details,
+	// so the site can group items without parsing titles
+	Cabbage *JSONCabbage `json:"_cabbage_town,omitempty"`
+}
+
+type JSONAttachment struct {
+	URL               string `json:"url"`
+	MimeType          string `json:"mime_type"`
+	Title             string `json:"title,omitempty"`
+	SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+	DurationInSeconds int64  `json:"duration_in_seconds,omitempty"`
+}
+
+type JSONCabbage struct {
+	About    string `json:"about"`
+	Key      string `json:"key"`
+	Show     string `json:"show"`
+	ShowSlug string `json:"show_slug"`
+	DJ       string `json:"dj"`
+	Date     string `json:"date"`
+}
+
+// AtomFeed is an Atom 1.0 document
+type AtomFeed struct {
+	XMLName  xml.Name        `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string          `xml:"id"`
+	Title    string          `xml:"title"`
+	Subtitle string          `xml:"subtitle"`
+	Updated  string          `xml:"updated"`
+	Icon     string          `xml:"icon,omitempty"`
+	Author   AtomPerson      `xml:"author"`
+	Links    []AtomEntryLink `xml:"link"`
+	Entries  []AtomEntry     `xml:"entry"`
+}
+
+type AtomEntry struct {
+	ID         string          `xml:"id"`
+	Title      string          `xml:"title"`
+	Published  string          `xml:"published"`
+	Updated    string          `xml:"updated"`
+	Authors    []AtomPerson    `xml:"author"`
+	Links      []AtomEntryLink `xml:"link"`
+	Categories []AtomCategory  `xml:"category,omitempty"`
+	Summary    *AtomText       `xml:"summary,omitempty"`
+	Content    *AtomText       `xml:"content,omitempty"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// AtomEntryLink is a link in an Atom document; AtomLink is the RSS feed's self link
+type AtomEntryLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// archiveEntry is one item in the archive feeds: a recording, its post, or both
+type archiveEntry struct {
+	Recording *catalog.Recording
+	Post      *posts.Post
+	// Image is the recording's show artwork, if it has any
+	Image string
+}
+
+// Published is when a post was written, or when a recording without one was made
+func (e archiveEntry) Published() time.Time {
+	if e.Post != nil {
+		return e.Post.CreatedAt
+	}
+	return e.Recording.Recorded
+}
+
+// Updated is when the entry last changed
+func (e archiveEntry) Updated() time.Time {
+	if e.Post != nil && e.Post.UpdatedAt.After(e.Post.CreatedAt) {
+		return e.Post.UpdatedAt
+	}
+	return e.Published()
+}
+
+// ID identifies the entry to feed readers. A recording keeps its URL as its
+// ID when a post is linked to it later, so readers don't list it twice.
+func (e archiveEntry) ID() string {
+	if e.Recording != nil {
+		return e.Recording.URL
+	}
+	return PostURL(*e.Post)
+}
+
+// URL is the entry's page, its post or the recording itself
+func (e archiveEntry) URL() string {
+	if e.Post != nil {
+		return PostURL(*e.Post)
+	}
+	return e.Recording.URL
+}
+
+// PostURL is the page on the site a post is published at
+func PostURL(post posts.Post) string {
+	return siteURL + "/patch/" + post.Slug
+}
+
+func (e archiveEntry) Title() string {
+	if e.Post != nil {
+		return e.Post.Title
+	}
+	if e.Recording.DisplayName != "" {
+		return e.Recording.DisplayName
+	}
+	return fmt.Sprintf("%s - %s", e.Recording.Show, e.Recording.Date)
+}
+
+// Text is the plain text description of a recording without a post
+func (e archiveEntry) Text() string {
+	if e.Post != nil {
+		return ""
+	}
+	return fmt.Sprintf("Episode of %s with %s, recorded on %s",
+		e.Recording.Show, e.Recording.DJ, e.Recording.Date)
+}
+
+func (e archiveEntry) Summary() string {
+	if e.Post != nil {
+		return e.Post.Metadata.Excerpt
+	}
+	return ""
+}
+
+func (e archiveEntry) Authors() []string {
+	var authors []string
+	if e.Post != nil && e.Post.Author != "" {
+		authors = append(authors, e.Post.Author)
+	}
+	if e.Recording != nil && e.Recording.DJ != "" && (len(authors) == 0 || !strings.EqualFold(authors[0], e.Recording.DJ)) {
+		authors = append(authors, e.Recording.DJ)
+	}
+	return authors
+}
+
+// Tags are the post's category and tags followed by the recording's show
+func (e archiveEntry) Tags() []string {
+	var tags []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if e.Post != nil {
+		add(e.Post.Metadata.Category)
+		for _, tag := range e.Post.Metadata.Tags {
+			add(tag)
+		}
+	}
+	if e.Recording != nil {
+		add(e.Recording.Show)
+	}
+	return tags
+}
+
+// archiveEntries merges recordings with their linked posts and adds posts
+// without a recording, newest first. Posts linked to a recording that isn't
+// public are listed without it.
+func archiveEntries(recordings []catalog.Recording, published []posts.Post, registry *shows.Registry) []archiveEntry {
+	linked := PostsByRecording(published)
+	used := make(map[string]bool)
+
+	var entries []archiveEntry
+	for i := range recordings {
+		recording := &recordings[i]
+		entry := archiveEntry{Recording: recording}
+		if post, ok := linked[recording.Key]; ok {
+			entry.Post = &post
+			used[post.ID] = true
+		}
+		if show, ok := registry.BySlug(recording.ShowSlug); ok && show.Artwork != "" {
+			entry.Image = AbsoluteURL(show.Artwork)
+		}
+		entries = append(entries, entry)
+	}
+	for i := range published {
+		if !used[published[i].ID] {
+			entries = append(entries, archiveEntry{Post: &published[i]})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Published().After(entries[j].Published())
+	})
+	return entries
+}
+
+// renderMarkdown converts a post's markdown to HTML
+func renderMarkdown(markdown string) (string, error) {
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(markdown), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// updateArchives writes the JSON Feed and Atom archives of every public
+// recording and published post; now is when the feeds were built
+func updateArchives(recordings []catalog.Recording, published []posts.Post, registry *shows.Registry, config Config, now time.Time) error {
+	entries := archiveEntries(recordings, published, registry)
+
+	html := make([]string, len(entries))
+	for i, entry := range entries {
+		if entry.Post == nil {
+			continue
+		}
+		rendered, err := renderMarkdown(entry.Post.Markdown)
+		if err != nil {
+			return fmt.Errorf("failed to render post %s: %v", entry.Post.Slug, err)
+		}
+		html[i] = rendered
+	}
+
+	info := stationChannel()
+	if config.JSONFeedFile != "" {
+		feed := buildJSONFeed(entries, html, info, AbsoluteURL(path.Clean(filepath.ToSlash(config.JSONFeedFile))))
+		// Leave HTML in content_html readable rather than \u003c-escaped
+		var output bytes.Buffer
+		encoder := json.NewEncoder(&output)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(feed); err != nil {
+			return fmt.Errorf("failed to marshal JSON feed: %v", err)
+		}
+		if err := writeArchive(filepath.Join(config.OutputDir, config.JSONFeedFile), output.Bytes()); err != nil {
+			return err
+		}
+	}
+	if config.AtomFile != "" {
+		feed := buildAtomFeed(entries, html, info, AbsoluteURL(path.Clean(filepath.ToSlash(config.AtomFile))), now)
+		output, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal Atom feed: %v", err)
+		}
+		if err := writeArchive(filepath.Join(config.OutputDir, config.AtomFile), append([]byte(xml.Header), output...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildJSONFeed builds the JSON Feed; html holds each entry's rendered post
+func buildJSONFeed(entries []archiveEntry, html []string, info channelInfo, feedURL string) JSONFeed {
+	feed := JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       info.Title,
+		HomePageURL: info.Link,
+		FeedURL:     feedURL,
+		Description: info.Description,
+		Icon:        info.Image,
+		Language:    "en-US",
+		Authors:     []JSONAuthor{{Name: info.Author, URL: info.Link}},
+		Items:       make([]JSONFeedItem, 0, len(entries)),
+	}
+
+	for i, entry := range entries {
+		item := JSONFeedItem{
+			ID:            entry.ID(),
+			URL:           entry.URL(),
+			Title:         entry.Title(),
+			ContentHTML:   html[i],
+			ContentText:   entry.Text(),
+			Summary:       entry.Summary(),
+			Image:         entry.Image,
+			DatePublished: entry.Published().UTC().Format(time.RFC3339),
+			Tags:          entry.Tags(),
+		}
+		if updated := entry.Updated(); !updated.Equal(entry.Published()) {
+			item.DateModified = updated.UTC().Format(time.RFC3339)
+		}
+		for _, author := range entry.Authors() {
+			item.Authors = append(item.Authors, JSONAuthor{Name: author})
+		}
+		if recording := entry.Recording; recording != nil {
+			item.Attachments = []JSONAttachment{{
+				URL:               recording.URL,
+				MimeType:          "audio/mpeg",
+				Title:             recording.Show,
+				SizeInBytes:       recording.Size,
+				DurationInSeconds: int64(recording.Duration.Seconds()),
+			}}
+			item.Cabbage = &JSONCabbage{
+				About:    siteURL,
+				Key:      recording.Key,
+				Show:     recording.Show,
+				ShowSlug: recording.ShowSlug,
+				DJ:       recording.DJ,
+				Date:     recording.Date,
+			}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed
+}
+
+// buildAtomFeed builds the Atom feed; html holds each entry's rendered post.
+// An empty feed is dated now.
+func buildAtomFeed(entries []archiveEntry, html []string, info channelInfo, feedURL string, now time.Time) AtomFeed {
+	feed := AtomFeed{
+		ID:       feedURL,
+		Title:    info.Title,
+		Subtitle: info.Description,
+		Updated:  now.UTC().Format(time.RFC3339),
+		Icon:     info.Image,
+		Author:   AtomPerson{Name: info.Author, URI: info.Link},
+		Links: []AtomEntryLink{
+			{Href: feedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: info.Link, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Updated().UTC().Format(time.RFC3339)
+	}
+
+	for i, entry := range entries {
+		atomEntry := AtomEntry{
+			ID:        entry.ID(),
+			Title:     entry.Title(),
+			Published: entry.Published().UTC().Format(time.RFC3339),
+			Updated:   entry.Updated().UTC().Format(time.RFC3339),
+			Links:     []AtomEntryLink{{Href: entry.URL(), Rel: "alternate"}},
+		}
+		for _, author := range entry.Authors() {
+			atomEntry.Authors = append(atomEntry.Authors, AtomPerson{Name: author})
+		}
+		for _, tag := range entry.Tags() {
+			atomEntry.Categories = append(atomEntry.Categories, AtomCategory{Term: tag})
+		}
+		if summary := entry.Summary(); summary != "" {
+			atomEntry.Summary = &AtomText{Type: "text", Body: summary}
+		}
+		if html[i] != "" {
+			atomEntry.Content = &AtomText{Type: "html", Body: html[i]}
+		} else {
+			atomEntry.Content = &AtomText{Type: "text", Body: entry.Text()}
+		}
+		if recording := entry.Recording; recording != nil {
+			atomEntry.Links = append(atomEntry.Links, AtomEntryLink{
+				Href:   recording.URL,
+				Rel:    "enclosure",
+				Type:   "audio/mpeg",
+				Length: recording.Size,
+			})
+		}
+		feed.Entries = append(feed.Entries, atomEntry)
+	}
+	return feed
+}
+
+func writeArchive(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
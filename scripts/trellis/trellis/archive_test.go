@@ -0,0 +1,61 @@
+package trellis
+
+import (
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+)
+
+func TestArchiveEntryIDs(t *testing.T) {
+	registry, err := shows.Parse([]byte(testShows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := testRecording(t, registry, "ted", time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC), time.Hour)
+	created := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	linked := posts.Post{
+		ID: "soup", Title: "Soup Night", Slug: "soup-night", Published: true, CreatedAt: created, UpdatedAt: created,
+		Metadata: posts.PostMetadata{Recording: recording.Key},
+	}
+	standalone := posts.Post{ID: "news", Title: "Station News", Slug: "station-news", Published: true, CreatedAt: created, UpdatedAt: created}
+
+	ids := func(published ...posts.Post) map[string]string {
+		entries := archiveEntries([]catalog.Recording{recording}, published, registry)
+		html := make([]string, len(entries))
+		json := buildJSONFeed(entries, html, stationChannel(), siteURL+"/archive.json")
+		atom := buildAtomFeed(entries, html, stationChannel(), siteURL+"/archive.xml", created)
+		got := make(map[string]string)
+		for i, entry := range entries {
+			if json.Items[i].ID != atom.Entries[i].ID {
+				t.Errorf("JSON Feed ID %q, Atom ID %q", json.Items[i].ID, atom.Entries[i].ID)
+			}
+			got[entry.Title()] = json.Items[i].ID
+		}
+		return got
+	}
+
+	before := ids(standalone)
+	if got := before["mulch channel - January 1, 2024"]; got != recording.URL {
+		t.Errorf("recording ID = %q, want %q", got, recording.URL)
+	}
+	if got, want := before["Station News"], PostURL(standalone); got != want {
+		t.Errorf("post ID = %q, want %q", got, want)
+	}
+
+	// Linking a post changes the entry's title and link but not its ID
+	after := ids(standalone, linked)
+	if got := after["Soup Night"]; got != recording.URL {
+		t.Errorf("recording ID with a post = %q, want %q", got, recording.URL)
+	}
+}
+
+func TestEmptyAtomFeedIsDatedWhenBuilt(t *testing.T) {
+	now := time.Date(2024, 1, 9, 12, 0, 0, 0, time.UTC)
+	feed := buildAtomFeed(nil, nil, stationChannel(), siteURL+"/archive.xml", now)
+	if feed.Updated != "2024-01-09T12:00:00Z" {
+		t.Errorf("updated = %s, want 2024-01-09T12:00:00Z", feed.Updated)
+	}
+}
@@ -0,0 +1,64 @@
+package trellis
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// measureDurations fills in Duration for recordings whose metadata doesn't
+// have one yet by reading their MP3 frames, then caches it in the metadata so
+// the next run doesn't have to download them again
+func measureDurations(ctx context.Context, config Config, recordings []catalog.Recording) error {
+	var measured []string
+	for i := range recordings {
+		recording := &recordings[i]
+		if recording.Duration > 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		log.Printf("[TRELLIS] Measuring duration of %s", recording.Key)
+		info, err := probeObject(ctx, config.BucketClient, recording.Key)
+		if err != nil {
+			log.Printf("[TRELLIS] WARNING: Failed to measure %s: %v", recording.Key, err)
+			continue
+		}
+		recording.Duration = info.Duration
+		log.Printf("[TRELLIS] %s is %v long", recording.Key, info.Duration)
+
+		err = config.BucketClient.UpdateObjectMetadataWithContext(ctx, recording.Key, bucket.MetadataUpdate{
+			Set:               catalog.DurationMetadata(info.Duration, recording.Size),
+			IfUnmodifiedSince: recording.LastModified,
+		})
+		if err != nil {
+			log.Printf("[TRELLIS] WARNING: Failed to cache duration for %s: %v", recording.Key, err)
+			continue
+		}
+		measured = append(measured, recording.Key)
+	}
+
+	if len(measured) > 0 {
+		log.Printf("[TRELLIS] Cached durations for %d recordings", len(measured))
+		if err := catalog.NewStore(config.BucketClient).Refresh(ctx, measured...); err != nil {
+			log.Printf("[TRELLIS] WARNING: Failed to refresh catalog: %v", err)
+		}
+	}
+	return nil
+}
+
+// probeObject reads just enough of an object to measure its duration
+func probeObject(ctx context.Context, storage bucket.Storage, key string) (mp3.Info, error) {
+	obj, err := storage.GetObjectWithContext(ctx, key)
+	if err != nil {
+		return mp3.Info{}, fmt.Errorf("failed to get object: %v", err)
+	}
+	defer obj.Body.Close()
+	return mp3.Probe(obj.Body)
+}
@@ -0,0 +1,126 @@
+package trellis
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+)
+
+// opmlFile lists every show feed, next to the feeds themselves
+const opmlFile = "shows.opml"
+
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+type OPMLHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated"`
+}
+
+type OPMLBody struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+type Outline struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr"`
+	XMLURL  string `xml:"xmlUrl,attr"`
+	HTMLURL string `xml:"htmlUrl,attr"`
+}
+
+// showChannel describes a show's feed, filling gaps in the registry from the station feed
+func showChannel(show *shows.Show, feedURL string) channelInfo {
+	info := stationChannel()
+	info.Title = show.Name
+	info.FeedURL = feedURL
+	info.Author = show.DJ
+	info.Host = show.DJ
+	info.Description = show.Description
+	if info.Description == "" {
+		info.Description = fmt.Sprintf("%s with %s, live on Cabbage Town Radio", show.Name, show.DJ)
+	}
+	if show.Artwork != "" {
+		info.Image = AbsoluteURL(show.Artwork)
+	}
+	if show.Category != "" {
+		info.Category = show.Category
+		info.Subcategory = show.Subcategory
+	}
+	return info
+}
+
+// updateShowFeeds writes a feed for every show in the registry and an OPML
+// file listing them to config.ShowFeedsDir
+func updateShowFeeds(recordings []catalog.Recording, registry *shows.Registry, config Config, opts feedOptions) error {
+	dir := filepath.Join(config.OutputDir, config.ShowFeedsDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	opml := OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "Cabbage Town Radio shows",
+			DateCreated: opts.Now.Format(time.RFC1123Z),
+		},
+	}
+
+	for _, show := range registry.Shows {
+		var showRecordings []catalog.Recording
+		for _, recording := range recordings {
+			if show.HasOwner(recording.Owner) {
+				showRecordings = append(showRecordings, recording)
+			}
+		}
+
+		filename := show.Slug + ".xml"
+		feedURL := AbsoluteURL(path.Join(filepath.ToSlash(config.ShowFeedsDir), filename))
+		showOpts := opts
+		showOpts.NumberEpisodes = true
+		rss := buildFeed(showRecordings, showChannel(show, feedURL), showOpts)
+		if err := writeFeed(filepath.Join(dir, filename), rss); err != nil {
+			return fmt.Errorf("failed to write feed for %s: %v", show.Slug, err)
+		}
+		log.Printf("[TRELLIS] Wrote feed for %s with %d recordings", show.Name, len(showRecordings))
+
+		opml.Body.Outlines = append(opml.Body.Outlines, Outline{
+			Type:    "rss",
+			Text:    show.Name,
+			Title:   show.Name,
+			XMLURL:  feedURL,
+			HTMLURL: siteURL,
+		})
+	}
+
+	output, err := xml.MarshalIndent(opml, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal OPML: %v", err)
+	}
+	data := append([]byte(xml.Header), output...)
+	if err := ioutil.WriteFile(filepath.Join(dir, opmlFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write OPML file: %v", err)
+	}
+	return nil
+}
+
+// AbsoluteURL turns a path on the site into a full URL, leaving full URLs alone
+func AbsoluteURL(p string) string {
+	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+		return p
+	}
+	return siteURL + "/" + strings.TrimPrefix(p, "/")
+}
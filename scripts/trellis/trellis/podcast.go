@@ -0,0 +1,168 @@
+package trellis
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/trellis/internal/posts"
+)
+
+// podcastGUIDNamespace is the UUID namespace the Podcasting 2.0 spec uses to
+// derive podcast:guid from a feed URL
+var podcastGUIDNamespace = [16]byte{0xea, 0xd4, 0xc2, 0x36, 0xbf, 0x58, 0x58, 0xc6, 0xa2, 0xc6, 0xa6, 0xb2, 0x8d, 0x12, 0x8c, 0xb6}
+
+type PodcastLocked struct {
+	Owner  string `xml:"owner,attr"`
+	Locked string `xml:",chardata"`
+}
+
+type PodcastPerson struct {
+	Role string `xml:"role,attr"`
+	Img  string `xml:"img,attr,omitempty"`
+	Name string `xml:",chardata"`
+}
+
+type PodcastChapters struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type PodcastTranscript struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// feedOptions controls the optional parts of a feed
+type feedOptions struct {
+	// Podcast adds podcast: namespace tags
+	Podcast bool
+	// Posts are the published posts, keyed by the recording they're linked to
+	Posts map[string]posts.Post
+	// Episodes are the episode numbers from EpisodeNumbers, which
+	// NumberEpisodes adds to items; only meaningful for a single show's feed
+	Episodes       map[string]int
+	NumberEpisodes bool
+	// Now is when the feeds were built, given once so every feed of a run
+	// carries the same date
+	Now time.Time
+}
+
+// listPosts loads the published posts, which feeds use for podcast details
+// and the archive formats for content
+func listPosts(ctx context.Context, config Config) ([]posts.Post, error) {
+	published, err := posts.ListPosts(ctx, config.BucketClient)
+	if err != nil {
+		log.Printf("[TRELLIS] ERROR: Failed to list posts: %v", err)
+		return nil, fmt.Errorf("failed to list posts: %v", err)
+	}
+	return published, nil
+}
+
+// PostsByRecording keys posts by the recording they're linked to
+func PostsByRecording(published []posts.Post) map[string]posts.Post {
+	linked := make(map[string]posts.Post)
+	for _, post := range published {
+		if post.Metadata.Recording != "" {
+			linked[post.Metadata.Recording] = post
+		}
+	}
+	return linked
+}
+
+// podcastGUID returns the podcast:guid for a feed: a version 5 UUID of the
+// feed URL without its scheme or trailing slashes
+func podcastGUID(feedURL string) string {
+	name := feedURL
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	name = strings.TrimRight(name, "/")
+
+	h := sha1.New()
+	h.Write(podcastGUIDNamespace[:])
+	h.Write([]byte(name))
+	u := h.Sum(nil)[:16]
+	u[6] = (u[6] & 0x0f) | 0x50 // version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// addPodcastChannel adds the channel-level podcast: tags
+func addPodcastChannel(channel *Channel, info channelInfo) {
+	channel.PodcastGUID = podcastGUID(info.FeedURL)
+	channel.PodcastMedium = "music"
+	channel.PodcastLocked = &PodcastLocked{Owner: channel.Owner.Email, Locked: "yes"}
+	if info.Host != "" {
+		channel.PodcastPeople = []PodcastPerson{{Role: "host", Img: info.Image, Name: info.Host}}
+	}
+}
+
+// addPodcastItem adds the podcast: tags for one recording, using its linked
+// post when there is one. episode is the number to use if the post doesn't
+// give one, or zero for none.
+func addPodcastItem(item *Item, recording catalog.Recording, post *posts.Post, episode int) {
+	if recording.DJ != "" {
+		item.PodcastPeople = append(item.PodcastPeople, PodcastPerson{Role: "host", Name: recording.DJ})
+	}
+	item.PodcastEpisode = episode
+
+	if post == nil {
+		return
+	}
+	details := post.Metadata.Podcast
+	for _, guest := range details.Guests {
+		item.PodcastPeople = append(item.PodcastPeople, PodcastPerson{Role: "guest", Name: guest})
+	}
+	if details.Chapters != "" {
+		item.PodcastChapters = &PodcastChapters{URL: AbsoluteURL(details.Chapters), Type: "application/json+chapters"}
+	}
+	if details.Transcript != "" {
+		item.PodcastTranscript = &PodcastTranscript{URL: AbsoluteURL(details.Transcript), Type: transcriptType(details.Transcript)}
+	}
+	if details.Season > 0 {
+		item.PodcastSeason = details.Season
+	}
+	if details.Episode > 0 {
+		item.PodcastEpisode = details.Episode
+	}
+}
+
+// EpisodeNumbers numbers each show's recordings oldest first, public or not,
+// so a recording's number doesn't change when it or an earlier one is made
+// private; a linked post's episode number always wins. recordings must be
+// every recording, newest first; the result is keyed by recording key.
+func EpisodeNumbers(recordings []catalog.Recording, linked map[string]posts.Post) map[string]int {
+	numbers := make(map[string]int)
+	counts := make(map[string]int)
+	for i := len(recordings) - 1; i >= 0; i-- {
+		recording := recordings[i]
+		counts[recording.ShowSlug]++
+		numbers[recording.Key] = counts[recording.ShowSlug]
+		if post, ok := linked[recording.Key]; ok && post.Metadata.Podcast.Episode > 0 {
+			numbers[recording.Key] = post.Metadata.Podcast.Episode
+		}
+	}
+	return numbers
+}
+
+// transcriptType guesses a transcript's MIME type from its file extension
+func transcriptType(url string) string {
+	switch strings.ToLower(path.Ext(url)) {
+	case ".vtt":
+		return "text/vtt"
+	case ".srt":
+		return "application/srt"
+	case ".json":
+		return "application/json"
+	case ".html", ".htm":
+		return "text/html"
+	default:
+		return "text/plain"
+	}
+}
@@ -0,0 +1,159 @@
+package trellis
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const testShows = `{"shows": [
+	{"slug": "mulch-channel", "name": "mulch channel", "dj": "dj ted", "owners": ["ted"], "artwork": "/shows/mulch.png", "category": "Music", "subcategory": "Music History"},
+	{"slug": "late-nights-like-these", "name": "Late Nights Like These", "dj": "Nights Like These", "owners": ["brennan"]}
+]}`
+
+// testRecording returns a public recording of owner's started at recorded
+func testRecording(t *testing.T, registry *shows.Registry, owner string, recorded time.Time, duration time.Duration) catalog.Recording {
+	t.Helper()
+	key := "recordings/" + owner + "/stream_" + recorded.Format("20060102-150405") + ".mp3"
+	show, ok := registry.ForOwner(owner)
+	if !ok {
+		t.Fatalf("no show for %s", owner)
+	}
+	return catalog.Recording{
+		Key:      key,
+		URL:      "https://cabbagetown.nyc3.digitaloceanspaces.com/" + key,
+		Owner:    owner,
+		ShowSlug: show.Slug,
+		Show:     show.Name,
+		DJ:       show.DJ,
+		Recorded: recorded,
+		Date:     recorded.Format(catalog.DateLayout),
+		Public:   true,
+		Size:     int64(duration.Seconds()) * 16000,
+		Duration: duration,
+	}
+}
+
+// writeTestFeeds writes the station feed, the show feeds and the archives of
+// a fixed set of recordings and posts to a temporary directory, which it returns
+func writeTestFeeds(t *testing.T, podcast bool) string {
+	t.Helper()
+	registry, err := shows.Parse([]byte(testShows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day int) time.Time { return time.Date(2024, 1, day, 20, 0, 0, 0, time.UTC) }
+	// Newest first, as the catalog sorts them. The private recording isn't
+	// in the feeds but still counts towards episode numbers.
+	all := []catalog.Recording{
+		testRecording(t, registry, "ted", at(8), 2*time.Hour),
+		testRecording(t, registry, "ted", at(5), time.Hour),
+		testRecording(t, registry, "brennan", at(3), 90*time.Minute),
+		testRecording(t, registry, "ted", at(1), 0),
+	}
+	all[0].DisplayName = "Soup Night"
+	all[1].Public = false
+	var recordings []catalog.Recording
+	for _, recording := range all {
+		if recording.Public {
+			recordings = append(recordings, recording)
+		}
+	}
+
+	published := []posts.Post{{
+		ID: "soup", Title: "Soup Night", Slug: "soup-night", Published: true,
+		Author:    "Ted",
+		CreatedAt: time.Date(2024, 1, 9, 10, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2024, 1, 9, 11, 30, 0, 0, time.UTC),
+		Markdown:  "Soup with **dj minestrone**.\n\n- leeks\n- [the recipe](https://example.com/soup)\n",
+		Metadata: posts.PostMetadata{
+			Recording: recordings[0].Key,
+			Category:  "Shows",
+			Tags:      []string{"soup", "mulch channel"},
+			Excerpt:   "An evening of soup",
+			Podcast: posts.PodcastInfo{
+				Guests:     []string{"dj minestrone"},
+				Chapters:   "/chapters/soup-night.json",
+				Transcript: "/transcripts/soup-night.vtt",
+				Season:     2,
+			},
+		},
+	}, {
+		ID: "news", Title: "Station News", Slug: "station-news", Published: true,
+		Author:    "brennan",
+		CreatedAt: time.Date(2024, 1, 6, 9, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2024, 1, 6, 9, 0, 0, 0, time.UTC),
+		Markdown:  "We're *back* on air & taking requests.",
+		Metadata:  posts.PostMetadata{Tags: []string{"news"}},
+	}}
+
+	dir := t.TempDir()
+	config := Config{OutputDir: dir, RSSFile: "feed.xml", ShowFeedsDir: "shows", JSONFeedFile: "archive.json", AtomFile: "archive.xml"}
+	linked := PostsByRecording(published)
+	opts := feedOptions{
+		Podcast:  podcast,
+		Posts:    linked,
+		Episodes: EpisodeNumbers(all, linked),
+		Now:      time.Date(2024, 1, 9, 12, 0, 0, 0, time.UTC),
+	}
+	if err := updateRssFeed(recordings, config, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateShowFeeds(recordings, registry, config, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateArchives(recordings, published, registry, config, opts.Now); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFeedsGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		podcast bool
+		file    string
+		golden  string
+	}{
+		{"station", false, "feed.xml", "feed.golden.xml"},
+		{"station with podcast tags", true, "feed.xml", "feed-podcast.golden.xml"},
+		{"show", false, "shows/mulch-channel.xml", "mulch-channel.golden.xml"},
+		{"show with podcast tags", true, "shows/mulch-channel.xml", "mulch-channel-podcast.golden.xml"},
+		{"show list", false, "shows/shows.opml", "shows.golden.opml"},
+		{"JSON Feed archive", false, "archive.json", "archive.golden.json"},
+		{"Atom archive", false, "archive.xml", "archive.golden.xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTestFeeds(t, tt.podcast)
+			got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs from %s:\n%s", tt.file, golden, got)
+			}
+		})
+	}
+}
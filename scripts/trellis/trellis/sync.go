@@ -1,44 +1,60 @@
 package trellis
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+	"cabbage.town/trellis/internal/posts"
 )
 
+const siteURL = "https://cabbage.town"
+
+// StationArtwork is the station's image on the site, used wherever a show has none
+const StationArtwork = "/the-cabbage.png"
+
 type UserPlaylist struct {
 	Username string
 	Filename string
-	Filter   func(Recording) bool
+	Filter   func(catalog.Recording) bool
 }
 
 type Config struct {
-	BucketClient     *bucket.Client
-	OutputDir        string
-	OutputFile       string
-	RSSFile          string
-	SethPlaylistFile string // Additional playlist file for Seth's recordings only
-	UserPlaylists    []UserPlaylist
-}
-
-type Recording struct {
-	URL          string
-	Key          string
-	DJ           string
-	Show         string
-	Date         string
-	LastModified time.Time
-	DisplayName  string
+	BucketClient bucket.Storage
+	OutputDir    string
+	// OutputFile is the main playlist; no playlists are written when it's empty
+	OutputFile string
+	// RSSFile is the podcast feed; no feed is written when it's empty
+	RSSFile string
+	// ShowFeedsDir is where each show's feed and shows.opml are written,
+	// relative to OutputDir; they're skipped when it's empty
+	ShowFeedsDir string
+	// JSONFeedFile and AtomFile are the recordings and published posts as
+	// JSON Feed 1.1 and Atom 1.0, relative to OutputDir; skipped when empty
+	JSONFeedFile string
+	AtomFile     string
+	// PodcastNamespace adds Podcasting 2.0 tags (people, chapters,
+	// transcripts, episode numbers) to the feeds, using linked posts
+	PodcastNamespace bool
+	// UserPlaylists defaults to one playlist per show that has a playlist file in the registry
+	UserPlaylists []UserPlaylist
+	// Shows is loaded from the bucket when nil
+	Shows *shows.Registry
+	// DryRun reads the catalog without saving what it finds changed in the bucket
+	DryRun bool
 }
 
 type RSS struct {
@@ -62,7 +78,13 @@ type Channel struct {
 	ItunesCategory Category `xml:"itunes:category"`
 	Explicit       string   `xml:"itunes:explicit"`
 	Type           string   `xml:"itunes:type"`
-	Items          []Item   `xml:"item"`
+
+	PodcastGUID   string          `xml:"podcast:guid,omitempty"`
+	PodcastMedium string          `xml:"podcast:medium,omitempty"`
+	PodcastLocked *PodcastLocked  `xml:"podcast:locked,omitempty"`
+	PodcastPeople []PodcastPerson `xml:"podcast:person,omitempty"`
+
+	Items []Item `xml:"item"`
 }
 
 type AtomLink struct {
@@ -95,10 +117,16 @@ type Item struct {
 	Description string    `xml:"description"`
 	PubDate     string    `xml:"pubDate"`
 	GUID        string    `xml:"guid"`
-	Duration    string    `xml:"itunes:duration"`
+	Duration    string    `xml:"itunes:duration,omitempty"`
 	Explicit    string    `xml:"itunes:explicit"`
 	Author      string    `xml:"itunes:author"`
 	Enclosure   Enclosure `xml:"enclosure"`
+
+	PodcastPeople     []PodcastPerson    `xml:"podcast:person,omitempty"`
+	PodcastChapters   *PodcastChapters   `xml:"podcast:chapters,omitempty"`
+	PodcastTranscript *PodcastTranscript `xml:"podcast:transcript,omitempty"`
+	PodcastSeason     int                `xml:"podcast:season,omitempty"`
+	PodcastEpisode    int                `xml:"podcast:episode,omitempty"`
 }
 
 type Enclosure struct {
@@ -107,166 +135,259 @@ type Enclosure struct {
 	Type   string `xml:"type,attr"`
 }
 
-func Run(config Config) error {
+func Run(ctx context.Context, config Config) error {
 	log.Printf("[TRELLIS] Starting playlist and RSS feed update process")
 	log.Printf("[TRELLIS] Config - OutputDir: %s", config.OutputDir)
 
-	log.Printf("[TRELLIS] Listing all recordings...")
-	allRecordings, err := ListRecordings(config)
+	log.Printf("[TRELLIS] Listing available recordings...")
+	// Episodes are numbered among all of a show's recordings, so making one
+	// private doesn't renumber the ones after it
+	all, err := scanRecordings(ctx, config)
 	if err != nil {
 		log.Printf("[TRELLIS] ERROR: Failed to list recordings: %v", err)
 		return fmt.Errorf("failed to list recordings: %v", err)
 	}
-	log.Printf("[TRELLIS] Found %d total recordings", len(allRecordings))
-
-	log.Printf("[TRELLIS] Filtering unavailable recordings...")
-	recordings := filterUnavailableRecordings(allRecordings)
-	log.Printf("[TRELLIS] %d recordings available after filtering", len(recordings))
-
-	// Update main playlist with all recordings
-	log.Printf("[TRELLIS] Updating main playlist: %s", config.OutputFile)
-	err = updatePlaylist(recordings, config.OutputFile, config, nil)
+	recordings, err := availableRecordings(ctx, config, all)
 	if err != nil {
-		log.Printf("[TRELLIS] ERROR: Failed to update main playlist: %v", err)
-		return fmt.Errorf("failed to update main playlist: %v", err)
+		log.Printf("[TRELLIS] ERROR: Failed to list recordings: %v", err)
+		return fmt.Errorf("failed to list recordings: %v", err)
 	}
-	log.Printf("[TRELLIS] Successfully updated main playlist")
 
-	// Update user playlists
-	for _, userPlaylist := range config.UserPlaylists {
-		log.Printf("[TRELLIS] Updating playlist for user %s: %s", userPlaylist.Username, userPlaylist.Filename)
+	// Update playlists (optional - skip if OutputFile is empty)
+	if config.OutputFile != "" {
+		if config.UserPlaylists == nil {
+			registry, err := loadShows(ctx, config)
+			if err != nil {
+				return err
+			}
+			config.UserPlaylists = ShowPlaylists(registry)
+		}
+
+		// Update main playlist with all recordings
+		log.Printf("[TRELLIS] Updating main playlist: %s", config.OutputFile)
+		err = updatePlaylist(recordings, config.OutputFile, config, nil)
+		if err != nil {
+			log.Printf("[TRELLIS] ERROR: Failed to update main playlist: %v", err)
+			return fmt.Errorf("failed to update main playlist: %v", err)
+		}
+		log.Printf("[TRELLIS] Successfully updated main playlist")
+
+		// Update user playlists
+		for _, userPlaylist := range config.UserPlaylists {
+			log.Printf("[TRELLIS] Updating playlist for user %s: %s", userPlaylist.Username, userPlaylist.Filename)
 
-		matchingRecordings := 0
-		for _, r := range recordings {
-			if userPlaylist.Filter(r) {
-				matchingRecordings++
+			matchingRecordings := 0
+			for _, r := range recordings {
+				if userPlaylist.Filter(r) {
+					matchingRecordings++
+				}
+			}
+			log.Printf("[TRELLIS] Found %d matching recordings for user %s", matchingRecordings, userPlaylist.Username)
+
+			err = updatePlaylist(recordings, userPlaylist.Filename, config, userPlaylist.Filter)
+			if err != nil {
+				log.Printf("[TRELLIS] ERROR: Failed to update playlist for user %s: %v", userPlaylist.Username, err)
+				return fmt.Errorf("failed to update playlist for user %s: %v", userPlaylist.Username, err)
 			}
+			log.Printf("[TRELLIS] Successfully updated playlist for user %s", userPlaylist.Username)
 		}
-		log.Printf("[TRELLIS] Found %d matching recordings for user %s", matchingRecordings, userPlaylist.Username)
+	} else {
+		log.Printf("[TRELLIS] Skipping playlist generation (not configured)")
+	}
 
-		err = updatePlaylist(recordings, userPlaylist.Filename, config, userPlaylist.Filter)
+	// Every feed format needs durations, and the podcast tags and archives need posts
+	feeds := config.RSSFile != "" || config.ShowFeedsDir != ""
+	archives := config.JSONFeedFile != "" || config.AtomFile != ""
+	if feeds || archives {
+		log.Printf("[TRELLIS] Measuring recordings without a cached duration...")
+		if err := measureDurations(ctx, config, recordings); err != nil {
+			return fmt.Errorf("failed to measure durations: %v", err)
+		}
+	}
+
+	var published []posts.Post
+	if (feeds && config.PodcastNamespace) || archives {
+		published, err = listPosts(ctx, config)
 		if err != nil {
-			log.Printf("[TRELLIS] ERROR: Failed to update playlist for user %s: %v", userPlaylist.Username, err)
-			return fmt.Errorf("failed to update playlist for user %s: %v", userPlaylist.Username, err)
+			return err
 		}
-		log.Printf("[TRELLIS] Successfully updated playlist for user %s", userPlaylist.Username)
+	}
+	linked := PostsByRecording(published)
+	opts := feedOptions{
+		Podcast:  config.PodcastNamespace,
+		Posts:    linked,
+		Episodes: EpisodeNumbers(all, linked),
+		Now:      time.Now(),
 	}
 
 	// Update RSS feed (optional - skip if RSSFile is empty)
 	if config.RSSFile != "" {
 		log.Printf("[TRELLIS] Updating RSS feed: %s", config.RSSFile)
-		err = updateRssFeed(recordings, config)
+		err = updateRssFeed(recordings, config, opts)
 		if err != nil {
 			log.Printf("[TRELLIS] ERROR: Failed to update RSS feed: %v", err)
 			return fmt.Errorf("failed to update RSS feed: %v", err)
 		}
+		log.Printf("[TRELLIS] Successfully updated RSS feed")
 	} else {
 		log.Printf("[TRELLIS] Skipping RSS feed generation (not configured)")
 	}
-	log.Printf("[TRELLIS] Successfully updated RSS feed")
+
+	// Update per-show feeds (optional - skip if ShowFeedsDir is empty)
+	if config.ShowFeedsDir != "" {
+		registry, err := loadShows(ctx, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("[TRELLIS] Updating show feeds in: %s", config.ShowFeedsDir)
+		if err := updateShowFeeds(recordings, registry, config, opts); err != nil {
+			log.Printf("[TRELLIS] ERROR: Failed to update show feeds: %v", err)
+			return fmt.Errorf("failed to update show feeds: %v", err)
+		}
+		log.Printf("[TRELLIS] Successfully updated show feeds")
+	}
+
+	// Update JSON Feed and Atom archives (optional - skip if neither file is set)
+	if archives {
+		registry, err := loadShows(ctx, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("[TRELLIS] Updating archive feeds")
+		if err := updateArchives(recordings, published, registry, config, opts.Now); err != nil {
+			log.Printf("[TRELLIS] ERROR: Failed to update archive feeds: %v", err)
+			return fmt.Errorf("failed to update archive feeds: %v", err)
+		}
+		log.Printf("[TRELLIS] Successfully updated archive feeds")
+	}
 
 	log.Printf("[TRELLIS] Playlist and RSS feed updates complete")
 	return nil
 }
 
-func FilterRecentRecordings(recordings []Recording) []Recording {
-	// Filter to only recordings modified in last 72 hours
-	cutoffTime := time.Now().Add(-72 * time.Hour)
-	log.Printf("[TRELLIS] Filtering recordings modified after: %s", cutoffTime.Format(time.RFC3339))
-
-	var recentRecordings []Recording
-	for _, recording := range recordings {
-		if recording.LastModified.After(cutoffTime) {
-			recentRecordings = append(recentRecordings, recording)
+// ShowPlaylists returns a playlist for each show in the registry that names a playlist file
+func ShowPlaylists(registry *shows.Registry) []UserPlaylist {
+	var playlists []UserPlaylist
+	for _, show := range registry.Shows {
+		if show.Playlist == "" {
+			continue
 		}
+		show := show
+		playlists = append(playlists, UserPlaylist{
+			Username: strings.Join(show.Owners, ", "),
+			Filename: show.Playlist,
+			Filter: func(r catalog.Recording) bool {
+				return show.HasOwner(r.Owner)
+			},
+		})
 	}
+	return playlists
+}
 
-	log.Printf("[TRELLIS] Found %d recent recordings out of %d total", len(recentRecordings), len(recordings))
-	return recentRecordings
+// loadShows returns config.Shows, or the registry from the bucket if that isn't set
+func loadShows(ctx context.Context, config Config) (*shows.Registry, error) {
+	if config.Shows != nil {
+		return config.Shows, nil
+	}
+	registry, err := shows.Load(ctx, config.BucketClient)
+	if err != nil {
+		log.Printf("[TRELLIS] ERROR: Failed to load shows: %v", err)
+		return nil, fmt.Errorf("failed to load shows: %v", err)
+	}
+	return registry, nil
 }
 
-func ListRecordings(config Config) ([]Recording, error) {
-	// Use provided bucket client
-	log.Printf("[TRELLIS] Using provided bucket client for recordings listing")
+func ListRecordings(ctx context.Context, config Config) ([]catalog.Recording, error) {
+	return scanRecordings(ctx, config)
+}
 
-	// List objects with recordings prefix
-	log.Printf("[TRELLIS] Listing objects with prefix: recordings/")
-	objects, err := config.BucketClient.ListObjects("recordings/")
+// scanRecordings lists the MP3s in the catalog after bringing it up to date
+// with the bucket, newest first
+func scanRecordings(ctx context.Context, config Config) ([]catalog.Recording, error) {
+	registry, err := loadShows(ctx, config)
 	if err != nil {
-		log.Printf("[TRELLIS] ERROR: Failed to list objects: %v", err)
-		return nil, fmt.Errorf("failed to list objects: %v", err)
+		return nil, err
 	}
-	log.Printf("[TRELLIS] Found %d objects in bucket", len(objects))
 
-	var recordings []Recording
-	var skipped int
-	for _, obj := range objects {
-		if obj.Key != nil && len(*obj.Key) > 4 && (*obj.Key)[len(*obj.Key)-4:] == ".mp3" {
-			// Construct URL using the standard bucket URL
-			fullURL := "https://cabbagetown.nyc3.digitaloceanspaces.com/" + *obj.Key
-			log.Printf("[TRELLIS] Processing MP3: %s", *obj.Key)
-			recording, err := parseRecordingInfo(fullURL)
-			if err != nil {
-				log.Printf("[TRELLIS] WARNING: Failed to parse recording info for %s: %v", fullURL, err)
-				skipped++
-				continue
-			}
-			recording.Key = *obj.Key
-			if obj.LastModified != nil {
-				recording.LastModified = *obj.LastModified
-			}
+	store := catalog.NewStore(config.BucketClient)
+	var manifest *catalog.Manifest
+	if config.DryRun {
+		log.Printf("[TRELLIS] Reading catalog (DRY RUN, changes won't be saved)...")
+		manifest, err = store.Preview(ctx)
+	} else {
+		log.Printf("[TRELLIS] Syncing catalog...")
+		manifest, err = store.Sync(ctx)
+	}
+	if err != nil {
+		log.Printf("[TRELLIS] ERROR: Failed to sync catalog: %v", err)
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
 
-			// Get object metadata to check for display name
-			headOutput, err := config.BucketClient.HeadObject(*obj.Key)
-			if err == nil && headOutput.Metadata != nil {
-				log.Printf("[TRELLIS] Metadata: %v", headOutput.Metadata)
-				if displayName, ok := headOutput.Metadata["Display-Name"]; ok && displayName != nil {
-					recording.DisplayName = *displayName
-				}
-			}
+	var entries []*catalog.Entry
+	for _, entry := range manifest.Entries("recordings/") {
+		if strings.HasSuffix(entry.Key, ".mp3") {
+			entries = append(entries, entry)
+		}
+	}
+	log.Printf("[TRELLIS] Found %d MP3s in catalog", len(entries))
 
-			recordings = append(recordings, recording)
-			log.Printf("[TRELLIS] Added recording: %s by %s (%s)", recording.Show, recording.DJ, recording.Date)
-		} else {
-			if obj.Key != nil && *obj.Key != "" {
-				log.Printf("[TRELLIS] Skipping non-MP3 file: %s", *obj.Key)
-			}
+	var recordings []catalog.Recording
+	var skipped int
+	for _, entry := range entries {
+		fullURL := config.BucketClient.PublicURL(entry.Key)
+		recording, err := catalog.NewRecording(entry, registry, fullURL)
+		if err != nil {
+			log.Printf("[TRELLIS] WARNING: Failed to parse recording info for %s: %v", fullURL, err)
+			skipped++
+			continue
 		}
+
+		recordings = append(recordings, recording)
+		log.Printf("[TRELLIS] Added recording: %s by %s (%s)", recording.Show, recording.DJ, recording.Date)
 	}
 
-	log.Printf("[TRELLIS] Processed %d total objects, %d MP3s parsed successfully, %d skipped", len(objects), len(recordings), skipped)
+	log.Printf("[TRELLIS] Processed %d MP3s, %d parsed successfully, %d skipped", len(entries), len(recordings), skipped)
 
 	// Sort recordings by date in descending order
 	log.Printf("[TRELLIS] Sorting recordings by date (newest first)...")
-	sort.Slice(recordings, func(i, j int) bool {
-		dateI, _ := time.Parse("January 02, 2006", recordings[i].Date)
-		dateJ, _ := time.Parse("January 02, 2006", recordings[j].Date)
-		return dateI.After(dateJ)
-	})
+	catalog.SortRecordings(recordings)
 	log.Printf("[TRELLIS] Recordings sorted successfully")
 
 	return recordings, nil
 }
 
-func filterUnavailableRecordings(recordings []Recording) []Recording {
-	var availableRecordings []Recording
+// availableRecordings returns the recordings whose public URL can be fetched,
+// keeping their order
+func availableRecordings(ctx context.Context, config Config, recordings []catalog.Recording) ([]catalog.Recording, error) {
+	objects := make([]*s3.Object, len(recordings))
+	for i, recording := range recordings {
+		objects[i] = &s3.Object{Key: aws.String(recording.Key)}
+	}
+	results, err := bucket.ScanObjects(ctx, config.BucketClient, objects, bucket.ScanOptions{Available: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check availability: %v", err)
+	}
+	available := make(map[string]bool)
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("[TRELLIS] WARNING: Problem checking %s: %v", result.Key, result.Err)
+		}
+		available[result.Key] = result.Available
+	}
+
+	var out []catalog.Recording
 	for _, recording := range recordings {
-		resp, err := http.Head(recording.URL)
-		if err != nil {
-			fmt.Printf("Failed to access %s: %v\n", recording.URL, err)
+		if !available[recording.Key] {
+			log.Printf("[TRELLIS] Skipping unavailable recording: %s", recording.URL)
 			continue
 		}
-		if resp.StatusCode == http.StatusOK {
-			availableRecordings = append(availableRecordings, recording)
-		} else {
-			fmt.Printf("Failed to access %s\n", recording.URL)
-		}
+		out = append(out, recording)
 	}
-
-	return availableRecordings
+	log.Printf("[TRELLIS] %d of %d recordings available", len(out), len(recordings))
+	return out, nil
 }
 
-func updatePlaylist(recordings []Recording, outputFile string, config Config, filter func(Recording) bool) error {
+func updatePlaylist(recordings []catalog.Recording, outputFile string, config Config, filter func(catalog.Recording) bool) error {
 	// Create directory for output file
 	if err := os.MkdirAll(config.OutputDir, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
@@ -296,38 +417,74 @@ func updatePlaylist(recordings []Recording, outputFile string, config Config, fi
 	return nil
 }
 
-func updateRssFeed(recordings []Recording, config Config) error {
-	now := time.Now().Format(time.RFC1123Z)
-	feedURL := "https://cabbage.town/feed.xml"
+// channelInfo is what distinguishes one podcast feed from another
+type channelInfo struct {
+	Title       string
+	Link        string
+	FeedURL     string
+	Description string
+	Author      string
+	Image       string
+	Category    string
+	Subcategory string
+	// Host is the DJ listed as the channel's podcast:person, if any
+	Host string
+}
+
+// stationChannel describes the station-wide feed
+func stationChannel() channelInfo {
+	return channelInfo{
+		Title:       "Cabbage Town Radio",
+		Link:        siteURL,
+		FeedURL:     siteURL + "/feed.xml",
+		Description: "Live recordings from Cabbage Town Radio",
+		Author:      "Cabbage Town Radio",
+		Image:       AbsoluteURL(StationArtwork),
+		Category:    "Music",
+		Subcategory: "Music Commentary",
+	}
+}
+
+func updateRssFeed(recordings []catalog.Recording, config Config, opts feedOptions) error {
+	rss := buildFeed(recordings, stationChannel(), opts)
+	return writeFeed(filepath.Join(config.OutputDir, config.RSSFile), rss)
+}
+
+// buildFeed makes an RSS feed of recordings, which must be newest first, for the given channel
+func buildFeed(recordings []catalog.Recording, info channelInfo, opts feedOptions) RSS {
+	now := opts.Now.Format(time.RFC1123Z)
+
+	var subcategory *Subcategory
+	if info.Subcategory != "" {
+		subcategory = &Subcategory{Text: info.Subcategory}
+	}
 
 	rss := RSS{
 		Version: "2.0",
 		Channel: Channel{
-			Title: "Cabbage Town Radio",
-			Link:  "https://cabbage.town",
+			Title: info.Title,
+			Link:  info.Link,
 			AtomLink: AtomLink{
-				Href: feedURL,
+				Href: info.FeedURL,
 				Rel:  "self",
 				Type: "application/rss+xml",
 			},
-			Description:   "Live recordings from Cabbage Town Radio",
+			Description:   info.Description,
 			Language:      "en-us",
 			PubDate:       now,
 			LastBuildDate: now,
 			Generator:     "Cabbage Town Radio Feed Generator",
-			Author:        "Cabbage Town Radio",
+			Author:        info.Author,
 			Owner: Owner{
 				Name:  "Cabbage Town Radio",
 				Email: "radio@cabbage.town",
 			},
 			Image: Image{
-				Href: "https://cabbage.town/the-cabbage.png",
+				Href: info.Image,
 			},
 			ItunesCategory: Category{
-				Text: "Music",
-				Subcategory: &Subcategory{
-					Text: "Music Commentary",
-				},
+				Text:        info.Category,
+				Subcategory: subcategory,
 			},
 			Explicit: "false",
 			Type:     "episodic",
@@ -335,14 +492,11 @@ func updateRssFeed(recordings []Recording, config Config) error {
 		},
 	}
 
-	for _, recording := range recordings {
-		date, err := time.Parse("January 02, 2006", recording.Date)
-		if err != nil {
-			fmt.Printf("Failed to parse date for RSS item: %v\n", err)
-			continue
-		}
+	if opts.Podcast {
+		addPodcastChannel(&rss.Channel, info)
+	}
 
-		// In the updateRssFeed function, modify the item title generation:
+	for _, recording := range recordings {
 		title := recording.Show
 		if recording.DisplayName != "" {
 			title = recording.DisplayName
@@ -353,21 +507,36 @@ func updateRssFeed(recordings []Recording, config Config) error {
 			Link:  recording.URL,
 			Description: fmt.Sprintf("Episode of %s with %s, recorded on %s",
 				recording.Show, recording.DJ, recording.Date),
-			PubDate:  date.Format(time.RFC1123Z),
+			PubDate:  recording.Recorded.Format(time.RFC1123Z),
 			GUID:     recording.URL,
-			Duration: "3600",
+			Duration: formatDuration(recording.Duration),
 			Explicit: "false",
 			Author:   recording.DJ,
 			Enclosure: Enclosure{
 				URL:    recording.URL,
 				Type:   "audio/mpeg",
-				Length: "0",
+				Length: strconv.FormatInt(recording.Size, 10),
 			},
 		}
+		if opts.Podcast {
+			var post *posts.Post
+			if p, ok := opts.Posts[recording.Key]; ok {
+				post = &p
+			}
+			episode := 0
+			if opts.NumberEpisodes {
+				episode = opts.Episodes[recording.Key]
+			}
+			addPodcastItem(&item, recording, post, episode)
+		}
 		rss.Channel.Items = append(rss.Channel.Items, item)
 	}
 
-	// Marshal to XML with proper namespaces
+	return rss
+}
+
+// writeFeed writes rss to path with the podcast namespaces declared
+func writeFeed(path string, rss RSS) error {
 	output, err := xml.MarshalIndent(rss, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal RSS feed: %v", err)
@@ -378,19 +547,29 @@ func updateRssFeed(recordings []Recording, config Config) error {
 		`<rss version="2.0" 
 			xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd" 
 			xmlns:content="http://purl.org/rss/1.0/modules/content/"
-			xmlns:atom="http://www.w3.org/2005/Atom">` +
+			xmlns:atom="http://www.w3.org/2005/Atom"
+			xmlns:podcast="https://podcastindex.org/namespace/1.0">` +
 		string(output[len("<rss version=\"2.0\">"):]))
 
-	// Write to file
-	rssFilePath := filepath.Join(config.OutputDir, config.RSSFile)
-	err = ioutil.WriteFile(rssFilePath, xmlData, 0644)
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, xmlData, 0644); err != nil {
 		return fmt.Errorf("failed to write RSS feed file: %v", err)
 	}
 
 	return nil
 }
 
+// formatDuration formats d as whole seconds for itunes:duration, or returns
+// "" if it isn't known so the element is left out
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(d.Round(time.Second).Seconds()))
+}
+
 func appendToFile(filename, text string) error {
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -403,57 +582,3 @@ func appendToFile(filename, text string) error {
 	}
 	return nil
 }
-
-func parseRecordingInfo(url string) (Recording, error) {
-	// Example URL: https://cabbagetown.nyc3.digitaloceanspaces.com/recordings/brennan/stream_20250626-204143.mp3
-	// Extract the relevant parts from the URL
-	parts := strings.Split(url, "/")
-	if len(parts) < 5 {
-		return Recording{}, fmt.Errorf("invalid URL format")
-	}
-
-	bucketFolder := parts[4]
-	show, dj, err := getShowName(bucketFolder)
-	if err != nil {
-		return Recording{}, err
-	}
-
-	filename := parts[len(parts)-1]
-	// Extract date from filename by finding the last occurrence of YYYYMMDD pattern
-	dateStr := regexp.MustCompile(`(\d{8})-\d{6}`).FindString(filename)[:8] // Extract date from filename
-
-	// Parse the date string
-	date, err := time.Parse("20060102", dateStr)
-	if err != nil {
-		return Recording{}, fmt.Errorf("failed to parse date: %v", err)
-	}
-
-	// Format the date as desired, e.g., "January 02, 2006"
-	formattedDate := date.Format("January 02, 2006")
-
-	return Recording{
-		URL:  url,
-		DJ:   dj,
-		Show: show,
-		Date: formattedDate,
-	}, nil
-}
-
-func getShowName(dj string) (string, string, error) {
-	switch dj {
-	case "brennan":
-		return "Late Nights Like These", "Nights Like These", nil
-	case "ted":
-		return "mulch channel", "dj ted", nil
-	case "ben":
-		return "IS WiLD hour", "DJ CHICAGO STYLE", nil
-	case "will":
-		return "tracks from terminus", "the conductor", nil
-	case "katherine":
-		return "The reginajingles show", "reginajingles", nil
-	case "seth":
-		return "Home Cooking Show", "Seth", nil
-	default:
-		return "", "", fmt.Errorf("unknown DJ: %s", dj)
-	}
-}
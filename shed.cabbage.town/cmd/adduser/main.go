@@ -34,7 +34,7 @@ func main() {
 	}
 
 	// Initialize bucket client
-	bucketClient, err := bucket.NewClient()
+	bucketClient, err := bucket.NewStorage()
 	if err != nil {
 		log.Fatalf("Failed to create bucket client: %v", err)
 	}
@@ -4,26 +4,35 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"golang.org/x/time/rate"
 
 	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/edit"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+	"cabbage.town/shed.cabbage.town/pkg/shows"
 	"cabbage.town/shed.cabbage.town/pkg/townsquare"
 )
 
@@ -31,7 +40,11 @@ const (
 	sessionName   = "cabbage-session"
 	userFile      = "shed/users.json"
 	maxUploadSize = 500 * 1024 * 1024 // 500MB
-	bucketName    = "cabbagetown"     // Add bucket name constant
+	// Uploads larger than this are sent to the bucket in parallel parts
+	multipartThreshold = 32 * 1024 * 1024 // 32MB
+	// slowRequestTimeout replaces the server's read and write timeouts for
+	// requests that move whole recordings, like uploads
+	slowRequestTimeout = time.Hour
 )
 
 type UserStore struct {
@@ -40,29 +53,39 @@ type UserStore struct {
 }
 
 var (
-	templates    = parseTemplates()
+	templates    *template.Template
 	store        *sessions.CookieStore
-	bucketClient *bucket.Client
+	bucketClient bucket.Storage
+	catalogStore *catalog.Store
 	users        = &UserStore{
 		Users: make(map[string]bucket.User),
 	}
 	userRefreshTicker *time.Ticker
 	userRefreshDone   chan bool
+
+	// showRegistry is refreshed from the bucket alongside users
+	showRegistry = shows.Default()
+	showsMu      sync.RWMutex
 )
 
-func parseTemplates() *template.Template {
+// parseTemplates parses the page templates in dir
+func parseTemplates(dir string) *template.Template {
 	log.Printf("[TEMPLATE] Starting template parsing")
 
 	// Parse all templates
-	tmpl, err := template.ParseFiles(
-		"templates/login.html",
-		"templates/files.html",
-		"templates/admin_users.html",
-		"templates/upload.html",
-		"templates/posts_list.html",
-		"templates/post_editor.html",
-		"templates/post_view.html",
-	)
+	var files []string
+	for _, name := range []string{
+		"login.html",
+		"files.html",
+		"admin_users.html",
+		"upload.html",
+		"posts_list.html",
+		"post_editor.html",
+		"post_view.html",
+	} {
+		files = append(files, filepath.Join(dir, name))
+	}
+	tmpl, err := template.ParseFiles(files...)
 	if err != nil {
 		log.Fatalf("[TEMPLATE] Failed to parse templates: %v", err)
 	}
@@ -110,11 +133,22 @@ type FileInfo struct {
 	Key          string             `json:"key"`
 	IsPublic     bool               `json:"isPublic"`
 	Owner        string             `json:"owner"`
-	SizeMB       float64            `json:"sizeMB"` // Changed from SizeBytes
+	Show         string             `json:"show,omitempty"` // Name of the owner's show, if they have one
+	SizeMB       float64            `json:"sizeMB"`         // Changed from SizeBytes
 	LastModified time.Time          `json:"lastModified"`
+	ETag         string             `json:"etag"`
+	Revision     string             `json:"revision"` // Metadata revision, for compare-and-swap
 	Metadata     map[string]*string `json:"metadata"`
 	PostID       string             `json:"postId,omitempty"`   // ID of associated post, if any
 	PostSlug     string             `json:"postSlug,omitempty"` // Slug of associated post, if any
+	Warnings     []string           `json:"warnings,omitempty"` // Dead air found by trellis analysis
+	// Fragments is set on the first of several recordings a dropped stream
+	// split one show into, and lists them all in order
+	Fragments []string `json:"fragments,omitempty"`
+	Length    string   `json:"length,omitempty"`    // h:mm:ss, if it has been measured
+	TrimStart string   `json:"trimStart,omitempty"` // Suggested from dead air at the start
+	TrimEnd   string   `json:"trimEnd,omitempty"`   // Suggested from dead air at the end
+	Versions  int      `json:"versions,omitempty"`  // Trims that can be undone
 }
 
 // Add this helper method
@@ -133,6 +167,8 @@ func (f FileInfo) DisplayName() string {
 type ToggleAccessRequest struct {
 	Key        string `json:"key"`
 	MakePublic bool   `json:"makePublic"`
+	ETag       string `json:"etag,omitempty"`     // ETag the client last saw, for compare-and-swap
+	Revision   string `json:"revision,omitempty"` // Metadata revision the client last saw
 }
 
 // Add this type near other type definitions
@@ -142,9 +178,41 @@ type FilePermissionCheck struct {
 	Key     string
 }
 
+type MergeFilesRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type TrimFileRequest struct {
+	Key   string `json:"key"`
+	Start string `json:"start"`          // h:mm:ss, m:ss or seconds; empty for the start
+	End   string `json:"end"`            // h:mm:ss, m:ss or seconds; empty for the end
+	ETag  string `json:"etag,omitempty"` // ETag the client last saw, for compare-and-swap
+}
+
+type UndoTrimRequest struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag,omitempty"` // ETag the client last saw, for compare-and-swap
+}
+
+type CreateClipRequest struct {
+	Key   string `json:"key"`
+	Start string `json:"start"`           // h:mm:ss, m:ss or seconds
+	End   string `json:"end"`             // h:mm:ss, m:ss or seconds
+	Title string `json:"title,omitempty"` // Made up from the recording and start if empty
+}
+
+type CreateClipResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Key     string `json:"key"`
+	URL     string `json:"url"`
+}
+
 type RenameFileRequest struct {
 	Key         string `json:"key"`
 	DisplayName string `json:"displayName"`
+	ETag        string `json:"etag,omitempty"`     // ETag the client last saw, for compare-and-swap
+	Revision    string `json:"revision,omitempty"` // Metadata revision the client last saw
 }
 
 // Post types
@@ -163,10 +231,21 @@ type Post struct {
 }
 
 type PostMetadata struct {
-	Tags      []string `json:"tags"`
-	Category  string   `json:"category"`
-	Excerpt   string   `json:"excerpt"`
-	Recording string   `json:"recording"` // S3 key of associated recording
+	Tags      []string    `json:"tags"`
+	Category  string      `json:"category"`
+	Excerpt   string      `json:"excerpt"`
+	Recording string      `json:"recording"` // S3 key of associated recording
+	Podcast   PodcastInfo `json:"podcast"`   // Extra podcast feed detail for the recording
+}
+
+// PodcastInfo is optional detail trellis adds to the recording's podcast feed entries
+type PodcastInfo struct {
+	Guests     []string `json:"guests,omitempty"`
+	Chapters   string   `json:"chapters,omitempty"`   // URL of a JSON chapters file
+	Transcript string   `json:"transcript,omitempty"` // URL of a transcript (VTT, SRT, JSON or HTML)
+	Cover      string   `json:"cover,omitempty"`      // URL of the episode's cover image
+	Season     int      `json:"season,omitempty"`
+	Episode    int      `json:"episode,omitempty"`
 }
 
 type PostListItem struct {
@@ -181,19 +260,21 @@ type PostListItem struct {
 }
 
 type CreatePostRequest struct {
-	Title     string `json:"title"`
-	Author    string `json:"author"`
-	Markdown  string `json:"markdown"`
-	Published bool   `json:"published"`
-	Recording string `json:"recording"`
+	Title     string      `json:"title"`
+	Author    string      `json:"author"`
+	Markdown  string      `json:"markdown"`
+	Published bool        `json:"published"`
+	Recording string      `json:"recording"`
+	Podcast   PodcastInfo `json:"podcast"`
 }
 
 type UpdatePostRequest struct {
-	Title     string `json:"title"`
-	Author    string `json:"author"`
-	Markdown  string `json:"markdown"`
-	Published bool   `json:"published"`
-	Recording string `json:"recording"`
+	Title     string      `json:"title"`
+	Author    string      `json:"author"`
+	Markdown  string      `json:"markdown"`
+	Published bool        `json:"published"`
+	Recording string      `json:"recording"`
+	Podcast   PodcastInfo `json:"podcast"`
 }
 
 // Auth handlers
@@ -275,102 +356,64 @@ func listFilesHandler(w http.ResponseWriter, r *http.Request) {
 		prefix = fmt.Sprintf("recordings/%s/", username) // List only user's recordings
 	}
 
-	objects, err := bucketClient.ListObjects(prefix)
+	manifest, err := catalogStore.Sync(r.Context())
 	if err != nil {
 		log.Printf("Error listing files: %v", err)
 		http.Error(w, "Failed to list files", http.StatusInternalServerError)
 		return
 	}
 
-	var files []FileInfo
-	for _, obj := range objects {
-		// Skip directories
-		if strings.HasSuffix(*obj.Key, "/") {
-			continue
-		}
-
-		// Get ACL to check if public
-		aclOutput, err := bucketClient.GetObjectACL(*obj.Key)
-		if err != nil {
-			log.Printf("Error getting ACL for %s: %v", *obj.Key, err)
-			continue
-		}
-
-		isPublic := false
-		for _, grant := range aclOutput.Grants {
-			if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-				isPublic = true
-				break
-			}
-		}
+	versions, err := edit.VersionCounts(r.Context(), bucketClient, prefix)
+	if err != nil {
+		// Only the undo buttons need these
+		log.Printf("Error listing versions: %v", err)
+	}
 
-		// Get object metadata
-		headOutput, err := bucketClient.HeadObject(*obj.Key)
-		if err != nil {
-			log.Printf("Error getting object metadata for %s: %v", *obj.Key, err)
-			continue
+	registry := currentShows()
+	var files []FileInfo
+	for _, entry := range manifest.Entries(prefix) {
+		var showName string
+		if show, ok := registry.ForOwner(entry.Owner()); ok {
+			showName = show.Name
 		}
-
-		// Extract owner username from the path
-		pathParts := strings.Split(*obj.Key, "/")
-		var owner string
-		if len(pathParts) >= 2 {
-			owner = pathParts[1] // recordings/<username>/file.mp3
+		var length string
+		if duration := catalog.CachedDuration(entry); duration > 0 {
+			length = catalog.FormatOffset(duration)
 		}
-
-		// Convert size to MB with 2 decimal precision
-		sizeMB := float64(*headOutput.ContentLength) / 1048576.0 // 1024 * 1024
-
+		trimStart, trimEnd := suggestTrim(entry)
 		files = append(files, FileInfo{
-			Key:          *obj.Key,
-			IsPublic:     isPublic,
-			Owner:        owner,
-			SizeMB:       sizeMB,
-			LastModified: *headOutput.LastModified,
-			Metadata:     headOutput.Metadata,
+			Key:          entry.Key,
+			IsPublic:     entry.Public,
+			Owner:        entry.Owner(),
+			Show:         showName,
+			SizeMB:       float64(entry.Size) / 1048576.0, // 1024 * 1024
+			LastModified: entry.LastModified,
+			ETag:         entry.ETag,
+			Revision:     bucket.Revision(entry.MetadataPointers()),
+			Metadata:     entry.MetadataPointers(),
+			PostID:       entry.PostID,
+			PostSlug:     entry.PostSlug,
+			Warnings:     silenceWarnings(entry.Metadata),
+			Length:       length,
+			TrimStart:    trimStart,
+			TrimEnd:      trimEnd,
+			Versions:     versions[entry.Key],
 		})
 	}
 
-	// Fetch all posts and create a map of recording key -> post
-	postObjects, err := bucketClient.ListObjects("posts/")
-	if err == nil {
-		recordingToPost := make(map[string]*Post)
-
-		for _, postObj := range postObjects {
-			if postObj.Key == nil || !strings.HasSuffix(*postObj.Key, ".json") {
-				continue
-			}
-
-			// Fetch the post
-			output, err := bucketClient.GetObject(*postObj.Key)
-			if err != nil {
-				continue
-			}
-			defer output.Body.Close()
-
-			data, err := ioutil.ReadAll(output.Body)
-			if err != nil {
-				continue
-			}
-
-			var post Post
-			if err := json.Unmarshal(data, &post); err != nil {
-				continue
-			}
-
-			// Only map non-deleted posts with recordings
-			if post.DeletedAt == nil && post.Metadata.Recording != "" {
-				recordingToPost[post.Metadata.Recording] = &post
-			}
-		}
-
-		// Update files with post information
-		for i := range files {
-			if post, exists := recordingToPost[files[i].Key]; exists {
-				files[i].PostID = post.ID
-				files[i].PostSlug = post.Slug
-			}
-		}
+	// Fragments are only offered for merging once their lengths are known
+	var keys []string
+	durations := make(map[string]time.Duration)
+	for _, entry := range manifest.Entries(prefix) {
+		keys = append(keys, entry.Key)
+		durations[entry.Key] = catalog.CachedDuration(entry)
+	}
+	firstFragments := make(map[string][]string)
+	for _, group := range edit.Fragments(keys, durations) {
+		firstFragments[group[0]] = group
+	}
+	for i := range files {
+		files[i].Fragments = firstFragments[files[i].Key]
 	}
 
 	data := struct {
@@ -388,6 +431,72 @@ func listFilesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// silenceWarnings describes the dead air trellis found in a recording
+func silenceWarnings(metadata map[string]string) []string {
+	silence := catalog.ParseSilence(metadata)
+	if silence == nil {
+		return nil
+	}
+
+	var warnings []string
+	if silence.Leading > 0 {
+		warnings = append(warnings, fmt.Sprintf("%s of silence at the start", catalog.FormatOffset(silence.Leading)))
+	}
+	if silence.Trailing > 0 {
+		warnings = append(warnings, fmt.Sprintf("%s of silence at the end", catalog.FormatOffset(silence.Trailing)))
+	}
+	for _, gap := range silence.Gaps {
+		warnings = append(warnings, fmt.Sprintf("%s of silence at %s", catalog.FormatOffset(gap.End-gap.Start), catalog.FormatOffset(gap.Start)))
+	}
+	if more := silence.GapCount - len(silence.Gaps); more > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d more shorter silences", more))
+	}
+	return warnings
+}
+
+// suggestTrim suggests trimming the dead air trellis found at the start and
+// end of a recording
+func suggestTrim(entry *catalog.Entry) (start, end string) {
+	silence := catalog.ParseSilence(entry.Metadata)
+	if silence == nil {
+		return "", ""
+	}
+	duration := catalog.CachedDuration(entry)
+	if duration > 0 && silence.Leading >= duration {
+		return "", "" // Silent throughout, there's nothing to keep
+	}
+	if silence.Leading > 0 {
+		start = catalog.FormatOffset(silence.Leading)
+	}
+	if silence.Trailing > 0 && duration > 0 {
+		end = catalog.FormatOffset(duration - silence.Trailing)
+	}
+	return start, end
+}
+
+// parseOffset reads a position in a recording written as h:mm:ss, m:ss or
+// seconds, any of which may have a fraction of a second. Empty is zero.
+func parseOffset(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var seconds float64
+	for i, part := range parts {
+		last := i == len(parts)-1
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || (!last && v != math.Trunc(v)) || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, sessionName)
 	username, ok := session.Values["username"].(string)
@@ -396,6 +505,9 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A recording takes far longer to arrive and store than the server's timeouts allow
+	allowSlowRequest(w)
+
 	// Limit request size
 	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
 	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
@@ -441,12 +553,21 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Upload the file
-	if err := bucketClient.PutObjectStreaming(key, file, header.Header.Get("Content-Type")); err != nil {
+	// Upload the file, in parts when it's big enough for that to pay off
+	contentType := header.Header.Get("Content-Type")
+	if header.Size > multipartThreshold {
+		err = bucketClient.PutObjectMultipartWithContext(r.Context(), key, file, contentType, bucket.UploadOptions{
+			PartSize: bucket.PartSizeFor(header.Size, 0),
+		})
+	} else {
+		err = bucketClient.PutObjectStreamingWithContext(r.Context(), key, file, contentType)
+	}
+	if err != nil {
 		log.Printf("Error uploading file: %v", err)
 		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
 		return
 	}
+	refreshCatalog(r.Context(), key)
 
 	// Redirect back to files page
 	http.Redirect(w, r, "/files", http.StatusSeeOther)
@@ -523,22 +644,14 @@ func viewFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := checkFilePermissions(permCheck); err != nil {
 		// If not admin or owner, check if file is public
-		aclOutput, aclErr := bucketClient.GetObjectACL(key)
+		aclOutput, aclErr := bucketClient.GetObjectACLWithContext(r.Context(), key)
 		if aclErr != nil {
 			log.Printf("Error getting ACL for %s: %v", key, aclErr)
 			http.Error(w, "Failed to check file access", http.StatusInternalServerError)
 			return
 		}
 
-		isPublic := false
-		for _, grant := range aclOutput.Grants {
-			if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-				isPublic = true
-				break
-			}
-		}
-
-		if !isPublic {
+		if !bucket.IsPublic(aclOutput) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -546,6 +659,10 @@ func viewFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Generate presigned URL (valid for 1 hour)
 	url, err := bucketClient.GetPresignedURL(key, time.Hour)
+	if errors.Is(err, bucket.ErrNotPresignable) {
+		serveObject(w, r, key)
+		return
+	}
 	if err != nil {
 		log.Printf("Error generating presigned URL: %v", err)
 		http.Error(w, "Failed to generate file URL", http.StatusInternalServerError)
@@ -555,6 +672,37 @@ func viewFileHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// serveObject sends an object's body itself, for buckets the browser can't
+// be redirected to, such as a local directory when working offline
+func serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, err := bucketClient.GetObjectWithContext(r.Context(), key)
+	if bucket.IsNotFound(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting %s: %v", key, err)
+		http.Error(w, "Failed to get file", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Body.Close()
+
+	if contentType := aws.StringValue(obj.ContentType); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Seekable bodies get range requests, so the audio player can seek
+	if body, ok := obj.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), aws.TimeValue(obj.LastModified), body)
+		return
+	}
+	if obj.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*obj.ContentLength, 10))
+	}
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		log.Printf("Error sending %s: %v", key, err)
+	}
+}
+
 // Update toggleAccessHandler to use atomic permission check
 func toggleAccessHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -597,34 +745,24 @@ func toggleAccessHandler(w http.ResponseWriter, r *http.Request) {
 		acl = "public-read"
 	}
 
-	// Get existing metadata to preserve it while adding privacy flags
-	headOutput, err := bucketClient.HeadObject(req.Key)
-	if err != nil {
-		log.Printf("Error getting object metadata: %v", err)
+	// Update privacy flags and ACL in place; existing metadata is preserved
+	err := bucketClient.UpdateObjectMetadataWithContext(r.Context(), req.Key, bucket.MetadataUpdate{
+		Set: map[string]*string{
+			"Manually-Privated": aws.String(fmt.Sprintf("%v", !req.MakePublic)),
+			"Privacy-Timestamp": aws.String(time.Now().UTC().Format(time.RFC3339)),
+		},
+		ACL:        acl,
+		IfMatch:    req.ETag,
+		IfRevision: req.Revision,
+	})
+	if errors.Is(err, bucket.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(ToggleAccessResponse{
 			Success: false,
-			Message: "Failed to get file metadata",
+			Message: "File was changed by someone else, please reload and try again",
 		})
 		return
 	}
-
-	// Merge existing metadata with privacy updates
-	mergedMetadata := make(map[string]*string)
-	for k, v := range headOutput.Metadata {
-		mergedMetadata[k] = v
-	}
-	mergedMetadata["Manually-Privated"] = aws.String(fmt.Sprintf("%v", !req.MakePublic))
-	mergedMetadata["Privacy-Timestamp"] = aws.String(time.Now().UTC().Format(time.RFC3339))
-
-	// Update object with merged metadata and new ACL
-	_, err = bucketClient.CopyObject(&s3.CopyObjectInput{
-		Bucket:            aws.String(bucketClient.Bucket),
-		CopySource:        aws.String(fmt.Sprintf("%s/%s", bucketClient.Bucket, req.Key)),
-		Key:               aws.String(req.Key),
-		MetadataDirective: aws.String("REPLACE"),
-		ACL:               aws.String(acl),
-		Metadata:          mergedMetadata,
-	})
 	if err != nil {
 		log.Printf("Error updating object: %v", err)
 		json.NewEncoder(w).Encode(ToggleAccessResponse{
@@ -633,6 +771,7 @@ func toggleAccessHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	refreshCatalog(r.Context(), req.Key)
 
 	json.NewEncoder(w).Encode(ToggleAccessResponse{
 		Success: true,
@@ -677,57 +816,317 @@ func renameFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get existing metadata
-	headOutput, err := bucketClient.HeadObject(req.Key)
-	if err != nil {
-		log.Printf("Error getting object metadata: %v", err)
-		http.Error(w, "Failed to get file metadata", http.StatusInternalServerError)
+	if err := catalog.ValidateDisplayName(req.DisplayName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get existing ACL
-	aclOutput, err := bucketClient.GetObjectACL(req.Key)
+	// Update display name in place; existing metadata and ACL are preserved
+	err := bucketClient.UpdateObjectMetadataWithContext(r.Context(), req.Key, bucket.MetadataUpdate{
+		Set: map[string]*string{
+			catalog.MetaDisplayName:  aws.String(req.DisplayName),
+			"Display-Name-Timestamp": aws.String(time.Now().UTC().Format(time.RFC3339)),
+		},
+		IfMatch:    req.ETag,
+		IfRevision: req.Revision,
+	})
+	if errors.Is(err, bucket.ErrPreconditionFailed) {
+		http.Error(w, "File was changed by someone else, please reload and try again", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting ACL for %s: %v", req.Key, err)
-		http.Error(w, "Failed to get file ACL", http.StatusInternalServerError)
+		log.Printf("Error updating object: %v", err)
+		http.Error(w, "Failed to update file metadata", http.StatusInternalServerError)
 		return
 	}
+	refreshCatalog(r.Context(), req.Key)
 
-	// Determine if file is public
-	acl := "private"
-	for _, grant := range aclOutput.Grants {
-		if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-			acl = "public-read"
-			break
+	json.NewEncoder(w).Encode(AdminResponse{
+		Success: true,
+		Message: "File renamed successfully",
+	})
+}
+
+// mergeFilesHandler joins the fragments of a show into one recording
+func mergeFilesHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req MergeFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	for _, key := range req.Keys {
+		if err := sanitizeAndValidateKey(key); err != nil {
+			http.Error(w, "Invalid file path", http.StatusBadRequest)
+			return
+		}
+		permCheck := FilePermissionCheck{
+			IsAdmin: isAdmin(username),
+			Owner:   username,
+			Key:     key,
+		}
+		if err := checkFilePermissions(permCheck); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 	}
 
-	// Merge existing metadata with display name
-	mergedMetadata := make(map[string]*string)
-	for k, v := range headOutput.Metadata {
-		mergedMetadata[k] = v
+	// Merging downloads and uploads whole recordings
+	allowSlowRequest(w)
+	merged, err := edit.Merge(r.Context(), bucketClient, req.Keys)
+	if errors.Is(err, edit.ErrNotFragments) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, edit.ErrChanged) {
+		http.Error(w, "A recording was changed during the merge, please reload and try again", http.StatusConflict)
+		return
 	}
-	mergedMetadata["Display-Name"] = aws.String(req.DisplayName)
-	mergedMetadata["Display-Name-Timestamp"] = aws.String(time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Error merging %v: %v", req.Keys, err)
+		http.Error(w, "Failed to merge recordings", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[MERGE] %s merged %d fragments into %s", username, len(merged.Fragments), merged.Key)
 
-	// Update object with merged metadata and preserve existing ACL
-	_, err = bucketClient.CopyObject(&s3.CopyObjectInput{
-		Bucket:            aws.String(bucketClient.Bucket),
-		CopySource:        aws.String(fmt.Sprintf("%s/%s", bucketClient.Bucket, req.Key)),
-		Key:               aws.String(req.Key),
-		MetadataDirective: aws.String("REPLACE"),
-		ACL:               aws.String(acl),
-		Metadata:          mergedMetadata,
+	json.NewEncoder(w).Encode(AdminResponse{
+		Success: true,
+		Message: fmt.Sprintf("Merged %d recordings into %s", len(merged.Fragments), merged.Key),
 	})
+}
+
+// trimFileHandler cuts a recording down to the audio between two times,
+// keeping the untrimmed audio so it can be undone
+func trimFileHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req TrimFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := sanitizeAndValidateKey(req.Key); err != nil {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	permCheck := FilePermissionCheck{
+		IsAdmin: isAdmin(username),
+		Owner:   username,
+		Key:     req.Key,
+	}
+	if err := checkFilePermissions(permCheck); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !strings.EqualFold(filepath.Ext(req.Key), ".mp3") {
+		http.Error(w, "Only MP3 recordings can be trimmed", http.StatusBadRequest)
+		return
+	}
+
+	start, err := parseOffset(req.Start)
 	if err != nil {
-		log.Printf("Error updating object: %v", err)
-		http.Error(w, "Failed to update file metadata", http.StatusInternalServerError)
+		http.Error(w, "Invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseOffset(req.End)
+	if err != nil {
+		http.Error(w, "Invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Trimming downloads and uploads the whole recording
+	allowSlowRequest(w)
+	trimmed, err := edit.Trim(r.Context(), bucketClient, req.Key, start, end, req.ETag)
+	if errors.Is(err, edit.ErrInvalidRange) {
+		http.Error(w, "Invalid range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, mp3.ErrEmptyRange) {
+		http.Error(w, "There's no audio between those times", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, edit.ErrChanged) {
+		http.Error(w, "File was changed by someone else, please reload and try again", http.StatusConflict)
 		return
 	}
+	if err != nil {
+		log.Printf("Error trimming %s: %v", req.Key, err)
+		http.Error(w, "Failed to trim recording", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[TRIM] %s trimmed %s to %v-%v, kept %s", username, req.Key, start, end, trimmed.Version)
 
 	json.NewEncoder(w).Encode(AdminResponse{
 		Success: true,
-		Message: "File renamed successfully",
+		Message: fmt.Sprintf("Trimmed to %s", catalog.FormatOffset(trimmed.Info.Duration)),
+	})
+}
+
+// undoTrimHandler puts back the audio a recording had before its latest trim
+func undoTrimHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req UndoTrimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := sanitizeAndValidateKey(req.Key); err != nil {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	permCheck := FilePermissionCheck{
+		IsAdmin: isAdmin(username),
+		Owner:   username,
+		Key:     req.Key,
+	}
+	if err := checkFilePermissions(permCheck); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Undoing copies the whole recording back from its kept version
+	allowSlowRequest(w)
+	version, err := edit.Restore(r.Context(), bucketClient, req.Key, req.ETag)
+	if errors.Is(err, edit.ErrNoVersions) {
+		http.Error(w, "This recording has no trims to undo", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, edit.ErrChanged) {
+		http.Error(w, "File was changed by someone else, please reload and try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error undoing trim of %s: %v", req.Key, err)
+		http.Error(w, "Failed to undo trim", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[TRIM] %s restored %s from %s", username, req.Key, version)
+
+	json.NewEncoder(w).Encode(AdminResponse{
+		Success: true,
+		Message: "Trim undone",
+	})
+}
+
+// createClipHandler cuts a stretch of a public recording into a shareable
+// file of its own
+func createClipHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, sessionName)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateClipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := sanitizeAndValidateKey(req.Key); err != nil {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(filepath.Ext(req.Key), ".mp3") {
+		http.Error(w, "Only MP3 recordings can be clipped", http.StatusBadRequest)
+		return
+	}
+
+	start, err := parseOffset(req.Start)
+	if err != nil {
+		http.Error(w, "Invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseOffset(req.End)
+	if err != nil {
+		http.Error(w, "Invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	title := strings.TrimSpace(req.Title)
+	if err := catalog.ValidateDisplayName(title); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := catalogStore.Load(r.Context())
+	if err != nil {
+		log.Printf("Error loading catalog: %v", err)
+		http.Error(w, "Failed to create clip", http.StatusInternalServerError)
+		return
+	}
+	entry, ok := manifest.Recordings[req.Key]
+	if !ok || entry.Owner() == "" {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	if !entry.Public {
+		http.Error(w, edit.ErrNotPublic.Error(), http.StatusForbidden)
+		return
+	}
+	recording, err := catalog.NewRecording(entry, currentShows(), bucketClient.PublicURL(entry.Key))
+	if err != nil {
+		http.Error(w, "Recording doesn't belong to a show", http.StatusBadRequest)
+		return
+	}
+	if entry.PostID != "" && entry.PostPublished && title == "" {
+		if post, err := loadPost(r.Context(), entry.PostID); err == nil {
+			recording.DisplayName = post.Title
+		}
+	}
+
+	// Clipping downloads the recording up to the end of the clip
+	allowSlowRequest(w)
+	clip, err := edit.Clip(r.Context(), bucketClient, recording, start, end, title)
+	if errors.Is(err, edit.ErrInvalidRange) {
+		http.Error(w, "The start must be before the end", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, edit.ErrClipTooLong) || errors.Is(err, mp3.ErrEmptyRange) || errors.Is(err, catalog.ErrInvalidDisplayName) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, edit.ErrNotPublic) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, edit.ErrChanged) {
+		http.Error(w, "The recording changed while it was being clipped, please try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error clipping %s: %v", req.Key, err)
+		http.Error(w, "Failed to create clip", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[CLIP] %s clipped %v-%v of %s into %s", username, start, end, req.Key, clip.Key)
+
+	json.NewEncoder(w).Encode(CreateClipResponse{
+		Success: true,
+		Message: fmt.Sprintf("Saved %s clip %q", catalog.FormatOffset(clip.Info.Duration), clip.Title),
+		Key:     clip.Key,
+		URL:     clip.URL,
 	})
 }
 
@@ -888,7 +1287,7 @@ func listPostsAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	posts, err := listPosts()
+	posts, err := listPosts(r.Context())
 	if err != nil {
 		log.Printf("Error listing posts: %v", err)
 		http.Error(w, "Failed to list posts", http.StatusInternalServerError)
@@ -920,7 +1319,7 @@ func getPostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	post, err := loadPost(id)
+	post, err := loadPost(r.Context(), id)
 	if err != nil {
 		log.Printf("Error loading post %s: %v", id, err)
 		http.Error(w, "Post not found", http.StatusNotFound)
@@ -985,6 +1384,7 @@ func createPostAPIHandler(w http.ResponseWriter, r *http.Request) {
 			Category:  "",
 			Excerpt:   generateExcerpt(req.Markdown),
 			Recording: req.Recording,
+			Podcast:   req.Podcast,
 		},
 	}
 
@@ -992,7 +1392,7 @@ func createPostAPIHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[POST_CREATE] Storing recording reference: '%s'", req.Recording)
 	}
 
-	if err := savePost(&post); err != nil {
+	if err := savePost(r.Context(), &post); err != nil {
 		log.Printf("Error saving post: %v", err)
 		http.Error(w, "Failed to save post", http.StatusInternalServerError)
 		return
@@ -1014,7 +1414,7 @@ func updatePostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	// Load existing post
-	post, err := loadPost(id)
+	post, err := loadPost(r.Context(), id)
 	if err != nil {
 		log.Printf("Error loading post %s: %v", id, err)
 		http.Error(w, "Post not found", http.StatusNotFound)
@@ -1059,8 +1459,9 @@ func updatePostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	post.UpdatedAt = time.Now().UTC()
 	post.Metadata.Excerpt = generateExcerpt(req.Markdown)
 	post.Metadata.Recording = req.Recording
+	post.Metadata.Podcast = req.Podcast
 
-	if err := savePost(post); err != nil {
+	if err := savePost(r.Context(), post); err != nil {
 		log.Printf("Error updating post: %v", err)
 		http.Error(w, "Failed to update post", http.StatusInternalServerError)
 		return
@@ -1082,7 +1483,7 @@ func deletePostAPIHandler(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	// Load existing post
-	post, err := loadPost(id)
+	post, err := loadPost(r.Context(), id)
 	if err != nil {
 		log.Printf("Error loading post %s: %v", id, err)
 		http.Error(w, "Post not found", http.StatusNotFound)
@@ -1102,7 +1503,7 @@ func deletePostAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := deletePost(id); err != nil {
+	if err := deletePost(r.Context(), id); err != nil {
 		log.Printf("Error deleting post: %v", err)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1131,7 +1532,7 @@ func uploadPostImageHandler(w http.ResponseWriter, r *http.Request) {
 	postID := vars["id"]
 
 	// Load post to verify ownership
-	post, err := loadPost(postID)
+	post, err := loadPost(r.Context(), postID)
 	if err != nil {
 		log.Printf("Error loading post %s: %v", postID, err)
 		http.Error(w, "Post not found", http.StatusNotFound)
@@ -1199,7 +1600,7 @@ func uploadPostImageHandler(w http.ResponseWriter, r *http.Request) {
 		"Upload-Time": aws.String(time.Now().UTC().Format(time.RFC3339)),
 	}
 
-	err = bucketClient.PutObjectWithMetadata(key, file, contentType, metadata, "public-read")
+	err = bucketClient.PutObjectWithMetadataWithContext(r.Context(), key, file, contentType, metadata, "public-read")
 	if err != nil {
 		log.Printf("Error uploading image: %v", err)
 		http.Error(w, "Failed to upload image", http.StatusInternalServerError)
@@ -1207,7 +1608,7 @@ func uploadPostImageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return the public URL
-	url := fmt.Sprintf("https://%s.nyc3.digitaloceanspaces.com/%s", bucketClient.Bucket, key)
+	url := bucketClient.PublicURL(key)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -1271,7 +1672,7 @@ func uploadPostImageHandler(w http.ResponseWriter, r *http.Request) {
 // 	}
 
 // 	// Return the public URL
-// 	url := fmt.Sprintf("https://%s.nyc3.digitaloceanspaces.com/%s", bucketClient.Bucket, key)
+// 	url := bucketClient.PublicURL(key)
 
 // 	w.Header().Set("Content-Type", "application/json")
 // 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1292,7 +1693,7 @@ func listRecordingsAPIHandler(w http.ResponseWriter, r *http.Request) {
 
 	prefix := fmt.Sprintf("recordings/%s/", username)
 
-	objects, err := bucketClient.ListObjects(prefix)
+	manifest, err := catalogStore.Sync(r.Context())
 	if err != nil {
 		log.Printf("Error listing recordings: %v", err)
 		http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
@@ -1302,59 +1703,36 @@ func listRecordingsAPIHandler(w http.ResponseWriter, r *http.Request) {
 	type RecordingItem struct {
 		Key          string `json:"key"`
 		DisplayName  string `json:"displayName"`
+		Show         string `json:"show,omitempty"`
+		Date         string `json:"date,omitempty"`
 		LastModified string `json:"lastModified"`
 	}
 
+	registry := currentShows()
 	var recordings []RecordingItem
-	for _, obj := range objects {
-		if obj.Key == nil {
+	for _, entry := range manifest.Entries(prefix) {
+		if !entry.Public || !strings.HasSuffix(entry.Key, ".mp3") {
 			continue
 		}
 
-		// Only include .mp3 files
-		if len(*obj.Key) < 4 || (*obj.Key)[len(*obj.Key)-4:] != ".mp3" {
-			continue
+		item := RecordingItem{
+			Key:          entry.Key,
+			DisplayName:  entry.DisplayName,
+			LastModified: entry.LastModified.Format(time.RFC3339),
 		}
-
-		// Check if file is public by checking ACL
-		aclOutput, err := bucketClient.GetObjectACL(*obj.Key)
-		if err != nil {
-			log.Printf("Error getting ACL for %s: %v", *obj.Key, err)
-			continue
-		}
-
-		// Check if public-read
-		isPublic := false
-		for _, grant := range aclOutput.Grants {
-			if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-				isPublic = true
-				break
+		if recording, err := catalog.NewRecording(entry, registry, bucketClient.PublicURL(entry.Key)); err == nil {
+			item.Show = recording.Show
+			item.Date = recording.Date
+			if item.DisplayName == "" {
+				item.DisplayName = fmt.Sprintf("%s (%s)", recording.Show, recording.Date)
 			}
 		}
-
-		if !isPublic {
-			continue
-		}
-
-		// Get display name from metadata if available
-		displayName := *obj.Key
-		headOutput, err := bucketClient.HeadObject(*obj.Key)
-		if err == nil && headOutput.Metadata != nil {
-			if name, ok := headOutput.Metadata["Display-Name"]; ok && name != nil {
-				displayName = *name
-			}
-		}
-
-		lastModified := ""
-		if obj.LastModified != nil {
-			lastModified = obj.LastModified.Format(time.RFC3339)
+		// Fall back to the key if there's nothing better to show
+		if item.DisplayName == "" {
+			item.DisplayName = entry.Key
 		}
 
-		recordings = append(recordings, RecordingItem{
-			Key:          *obj.Key,
-			DisplayName:  displayName,
-			LastModified: lastModified,
-		})
+		recordings = append(recordings, item)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1370,7 +1748,7 @@ func postsListPageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	posts, err := listPosts()
+	posts, err := listPosts(r.Context())
 	if err != nil {
 		log.Printf("Error listing posts: %v", err)
 		http.Error(w, "Failed to list posts", http.StatusInternalServerError)
@@ -1420,7 +1798,7 @@ func postEditorPageHandler(w http.ResponseWriter, r *http.Request) {
 
 	if id != "" {
 		// Edit existing post
-		post, err = loadPost(id)
+		post, err = loadPost(r.Context(), id)
 		if err != nil {
 			log.Printf("Error loading post %s: %v", id, err)
 			http.Error(w, "Post not found", http.StatusNotFound)
@@ -1471,7 +1849,7 @@ func postViewPageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	post, err := loadPost(id)
+	post, err := loadPost(r.Context(), id)
 	if err != nil {
 		log.Printf("Error loading post %s: %v", id, err)
 		http.Error(w, "Post not found", http.StatusNotFound)
@@ -1560,6 +1938,25 @@ func loadUsers() error {
 	return nil
 }
 
+// loadShows replaces the show registry with the one in the bucket
+func loadShows(ctx context.Context) error {
+	registry, err := shows.Load(ctx, bucketClient)
+	if err != nil {
+		return err
+	}
+
+	showsMu.Lock()
+	showRegistry = registry
+	showsMu.Unlock()
+	return nil
+}
+
+func currentShows() *shows.Registry {
+	showsMu.RLock()
+	defer showsMu.RUnlock()
+	return showRegistry
+}
+
 func saveUsers() error {
 	users.mu.RLock()
 	store := bucket.UserStore{
@@ -1651,8 +2048,14 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[HOME] Template execution complete")
 }
 
+// requestRate and requestBurst limit how fast a client can call protected routes
+var (
+	requestRate  = rate.Every(1 * time.Second)
+	requestBurst = 3
+)
+
 func rateLimitMiddleware(next http.Handler) http.Handler {
-	limiter := rate.NewLimiter(rate.Every(1*time.Second), 3)
+	limiter := rate.NewLimiter(requestRate, requestBurst)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !limiter.Allow() {
 			http.Error(w, "Too many requests", http.StatusTooManyRequests)
@@ -1662,11 +2065,21 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// publicOrigin returns the scheme and host that public bucket objects are served from
+func publicOrigin() string {
+	u, err := url.Parse(bucketClient.PublicURL(""))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
 func securityHeadersMiddleware(next http.Handler) http.Handler {
+	csp := fmt.Sprintf("default-src 'self'; script-src 'self' 'unsafe-inline' cdn.jsdelivr.net; style-src 'self' 'unsafe-inline' cdn.jsdelivr.net maxcdn.bootstrapcdn.com; font-src 'self' maxcdn.bootstrapcdn.com; img-src 'self' data: %s;", publicOrigin())
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Frame-Options", "DENY")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline' cdn.jsdelivr.net; style-src 'self' 'unsafe-inline' cdn.jsdelivr.net maxcdn.bootstrapcdn.com; font-src 'self' maxcdn.bootstrapcdn.com; img-src 'self' data: https://cabbagetown.nyc3.digitaloceanspaces.com;")
+		w.Header().Set("Content-Security-Policy", csp)
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
 		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
 		next.ServeHTTP(w, r)
@@ -1729,6 +2142,10 @@ func setupRoutes() *mux.Router {
 	protected.HandleFunc("/api/upload", uploadHandler).Methods("POST")
 	protected.HandleFunc("/api/files/toggle-access", toggleAccessHandler).Methods("POST")
 	protected.HandleFunc("/api/files/rename", renameFileHandler).Methods("POST")
+	protected.HandleFunc("/api/files/merge", mergeFilesHandler).Methods("POST")
+	protected.HandleFunc("/api/files/trim", trimFileHandler).Methods("POST")
+	protected.HandleFunc("/api/files/undo-trim", undoTrimHandler).Methods("POST")
+	protected.HandleFunc("/api/clips", createClipHandler).Methods("POST")
 	protected.HandleFunc("/files/{key:.+}", viewFileHandler).Methods("GET")
 
 	// Post page endpoints
@@ -1776,12 +2193,11 @@ func init() {
 	if err := godotenv.Load("../.env"); err != nil {
 		log.Printf("Warning: Could not load .env file: %v", err)
 	}
+}
 
-	// Initialize session store
-	sessionKey := os.Getenv("SESSION_KEY")
-	if sessionKey == "" {
-		log.Fatal("SESSION_KEY environment variable is required")
-	}
+// setup points the server at storage and loads its users and shows. Session
+// cookies are signed with sessionKey.
+func setup(storage bucket.Storage, sessionKey string) {
 	store = sessions.NewCookieStore([]byte(sessionKey))
 
 	// Configure session security
@@ -1792,17 +2208,16 @@ func init() {
 		SameSite: http.SameSiteStrictMode,
 	}
 
-	// Initialize bucket client
-	var err error
-	bucketClient, err = bucket.NewClient()
-	if err != nil {
-		log.Fatalf("Failed to create bucket client: %v", err)
-	}
+	bucketClient = storage
+	catalogStore = catalog.NewStore(bucketClient)
 
 	// Load users from S3
 	if err := loadUsers(); err != nil {
 		log.Printf("Warning: Could not load users from S3: %v", err)
 	}
+	if err := loadShows(context.Background()); err != nil {
+		log.Printf("Warning: Could not load shows from S3, using built-in shows: %v", err)
+	}
 }
 
 func startUserRefresh(ctx context.Context) {
@@ -1818,6 +2233,9 @@ func startUserRefresh(ctx context.Context) {
 				} else {
 					log.Printf("[USER REFRESH] Successfully refreshed users list")
 				}
+				if err := loadShows(ctx); err != nil {
+					log.Printf("[USER REFRESH] Error refreshing shows: %v", err)
+				}
 			case <-userRefreshDone:
 				userRefreshTicker.Stop()
 				return
@@ -1830,6 +2248,20 @@ func startUserRefresh(ctx context.Context) {
 }
 
 func main() {
+	// Initialize session store
+	sessionKey := os.Getenv("SESSION_KEY")
+	if sessionKey == "" {
+		log.Fatal("SESSION_KEY environment variable is required")
+	}
+
+	// Initialize bucket client (local directory if BUCKET_LOCAL_DIR is set)
+	storage, err := bucket.NewStorage()
+	if err != nil {
+		log.Fatalf("Failed to create bucket client: %v", err)
+	}
+
+	templates = parseTemplates("templates")
+	setup(storage, sessionKey)
 	router := setupRoutes()
 
 	// Create a context that we can cancel
@@ -1966,13 +2398,41 @@ func generatePostID(title string) string {
 	return fmt.Sprintf("%s-%s", timestamp, slug)
 }
 
+// allowSlowRequest extends the read and write deadlines of the request w
+// answers to slowRequestTimeout from now
+func allowSlowRequest(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(slowRequestTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		log.Printf("Warning: failed to extend read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		log.Printf("Warning: failed to extend write deadline: %v", err)
+	}
+}
+
+// refreshCatalog updates the catalog after recordings change. Failures are only
+// logged since the next listing reconciles the catalog anyway.
+func refreshCatalog(ctx context.Context, keys ...string) {
+	if err := catalogStore.Refresh(ctx, keys...); err != nil {
+		log.Printf("[CATALOG] Warning: failed to refresh %v: %v", keys, err)
+	}
+}
+
+// refreshCatalogPosts updates recording links in the catalog after posts change
+func refreshCatalogPosts(ctx context.Context, ids ...string) {
+	if err := catalogStore.RefreshPosts(ctx, ids...); err != nil {
+		log.Printf("[CATALOG] Warning: failed to refresh posts %v: %v", ids, err)
+	}
+}
+
 func getPostKey(id string) string {
 	return fmt.Sprintf("posts/%s.json", id)
 }
 
-func loadPost(id string) (*Post, error) {
+func loadPost(ctx context.Context, id string) (*Post, error) {
 	key := getPostKey(id)
-	result, err := bucketClient.GetObject(key)
+	result, err := bucketClient.GetObjectWithContext(ctx, key)
 	if err != nil {
 		return nil, fmt.Errorf("error getting post: %v", err)
 	}
@@ -1991,23 +2451,24 @@ func loadPost(id string) (*Post, error) {
 	return &post, nil
 }
 
-func savePost(post *Post) error {
+func savePost(ctx context.Context, post *Post) error {
 	data, err := json.MarshalIndent(post, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error encoding post: %v", err)
 	}
 
 	key := getPostKey(post.ID)
-	err = bucketClient.PutObject(key, data, "application/json")
+	err = bucketClient.PutObjectWithContext(ctx, key, data, "application/json")
 	if err != nil {
 		return fmt.Errorf("error uploading post: %v", err)
 	}
+	refreshCatalogPosts(ctx, post.ID)
 
 	return nil
 }
 
-func listPosts() ([]PostListItem, error) {
-	objects, err := bucketClient.ListObjects("posts/")
+func listPosts(ctx context.Context) ([]PostListItem, error) {
+	objects, err := bucketClient.ListObjectsWithContext(ctx, "posts/")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list posts: %v", err)
 	}
@@ -2023,7 +2484,7 @@ func listPosts() ([]PostListItem, error) {
 		id := strings.TrimPrefix(*obj.Key, "posts/")
 		id = strings.TrimSuffix(id, ".json")
 
-		post, err := loadPost(id)
+		post, err := loadPost(ctx, id)
 		if err != nil {
 			log.Printf("Error loading post %s: %v", id, err)
 			continue
@@ -2066,9 +2527,9 @@ func listPosts() ([]PostListItem, error) {
 	return posts, nil
 }
 
-func deletePost(id string) error {
+func deletePost(ctx context.Context, id string) error {
 	// Load the post
-	post, err := loadPost(id)
+	post, err := loadPost(ctx, id)
 	if err != nil {
 		return fmt.Errorf("post not found: %v", err)
 	}
@@ -2078,7 +2539,7 @@ func deletePost(id string) error {
 	post.DeletedAt = &now
 
 	// Save the post with the DeletedAt field
-	if err := savePost(post); err != nil {
+	if err := savePost(ctx, post); err != nil {
 		return fmt.Errorf("failed to soft delete post: %v", err)
 	}
 
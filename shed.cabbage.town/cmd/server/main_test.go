@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"golang.org/x/time/rate"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/edit"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+const (
+	tedRecording     = "recordings/ted/stream_20240101-200000.mp3"
+	brennanRecording = "recordings/brennan/stream_20240102-200000.mp3"
+)
+
+var errInjected = errors.New("injected failure")
+
+// newTestServer starts shed on storage, with users ted and brennan, who own
+// shows, and admin. ted has a private recording and brennan a public one.
+func newTestServer(t *testing.T, storage bucket.Storage) *httptest.Server {
+	t.Helper()
+	return newTestServerWithTimeout(t, storage, 0)
+}
+
+// newTestServerWithTimeout is newTestServer with the server's read and write
+// timeouts set to timeout, as in production
+func newTestServerWithTimeout(t *testing.T, storage bucket.Storage, timeout time.Duration) *httptest.Server {
+	t.Helper()
+	if templates == nil {
+		templates = parseTemplates("../../templates")
+	}
+	requestRate = rate.Inf
+
+	seedUsers(t, storage, map[string]bucket.User{
+		"ted":     {Password: "ted-password"},
+		"brennan": {Password: "brennan-password"},
+		"admin":   {Password: "admin-password", IsAdmin: true},
+	})
+	putRecording(t, storage, tedRecording, "private")
+	putRecording(t, storage, brennanRecording, "public-read")
+
+	setup(storage, "test-session-key")
+	server := httptest.NewUnstartedServer(setupRoutes())
+	server.Config.ReadTimeout = timeout
+	server.Config.WriteTimeout = timeout
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func seedUsers(t *testing.T, storage bucket.Storage, users map[string]bucket.User) {
+	t.Helper()
+	data, err := json.Marshal(bucket.UserStore{Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutObject(userFile, data, "application/json"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putRecording(t *testing.T, storage bucket.Storage, key, acl string) {
+	t.Helper()
+	body := bytes.NewReader(mp3test.Silence(40, false))
+	if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, acl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// login returns a client signed in as username, which doesn't follow redirects
+func login(t *testing.T, server *httptest.Server, username, password string) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp := postJSON(t, client, server.URL+"/login", LoginRequest{Username: username, Password: password})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("logging in as %s: status %d", username, resp.StatusCode)
+	}
+	return client
+}
+
+// postJSON posts v and returns the response, with its body read and closed
+func postJSON(t *testing.T, client *http.Client, url string, v interface{}) *response {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func get(t *testing.T, client *http.Client, url string, header http.Header) *response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+type response struct {
+	*http.Response
+	body []byte
+}
+
+func readResponse(t *testing.T, resp *http.Response) *response {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &response{Response: resp, body: body}
+}
+
+func head(t *testing.T, storage bucket.Storage, key string) map[string]string {
+	t.Helper()
+	output, err := storage.HeadObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := make(map[string]string)
+	for k, v := range output.Metadata {
+		metadata[k] = aws.StringValue(v)
+	}
+	return metadata
+}
+
+func etag(t *testing.T, storage bucket.Storage, key string) string {
+	t.Helper()
+	output, err := storage.HeadObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(output.ETag)
+}
+
+func isPublic(t *testing.T, storage bucket.Storage, key string) bool {
+	t.Helper()
+	acl, err := storage.GetObjectACL(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket.IsPublic(acl)
+}
+
+func TestLogin(t *testing.T) {
+	server := newTestServer(t, bucket.NewMemoryClient("test"))
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     int
+	}{
+		{"valid", "ted", "ted-password", http.StatusOK},
+		{"wrong password", "ted", "brennan-password", http.StatusUnauthorized},
+		{"unknown user", "nobody", "ted-password", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postJSON(t, http.DefaultClient, server.URL+"/login", LoginRequest{Username: tt.username, Password: tt.password})
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     []string
+		dontWant []string
+	}{
+		{"owner sees own recordings", "ted", "ted-password", []string{tedRecording}, []string{brennanRecording}},
+		{"admin sees every recording", "admin", "admin-password", []string{tedRecording, brennanRecording}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, bucket.NewMemoryClient("test"))
+			client := login(t, server, tt.username, tt.password)
+
+			resp := get(t, client, server.URL+"/files", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.body)
+			}
+			for _, key := range tt.want {
+				if !bytes.Contains(resp.body, []byte(key)) {
+					t.Errorf("page doesn't list %s", key)
+				}
+			}
+			for _, key := range tt.dontWant {
+				if bytes.Contains(resp.body, []byte(key)) {
+					t.Errorf("page lists %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestListFilesCatchesUpWithStaleListing(t *testing.T) {
+	storage := bucket.NewMemoryClient("test")
+	server := newTestServer(t, storage)
+	client := login(t, server, "ted", "ted-password")
+
+	// The new recording is missing from the first listing, as on a replica
+	// that hasn't caught up
+	const key = "recordings/ted/stream_20240103-200000.mp3"
+	storage.StaleReads = 1
+	putRecording(t, storage, key, "private")
+	storage.StaleReads = 0
+
+	if resp := get(t, client, server.URL+"/files", nil); bytes.Contains(resp.body, []byte(key)) {
+		t.Fatalf("stale listing shows %s", key)
+	}
+	if resp := get(t, client, server.URL+"/files", nil); !bytes.Contains(resp.body, []byte(key)) {
+		t.Errorf("page doesn't list %s once the listing caught up", key)
+	}
+}
+
+func TestListFilesListingFails(t *testing.T) {
+	storage := bucket.NewMemoryClient("test")
+	server := newTestServer(t, storage)
+	client := login(t, server, "ted", "ted-password")
+
+	storage.Inject(bucket.Fault{Op: bucket.OpListObjects, Key: "recordings/", Err: errInjected})
+	if resp := get(t, client, server.URL+"/files", nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+}
+
+func TestToggleAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		key        string
+		makePublic bool
+		staleETag  bool
+		fault      *bucket.Fault
+		wantStatus int
+		wantOK     bool
+		wantPublic bool
+	}{
+		{name: "owner publishes", username: "ted", password: "ted-password", key: tedRecording, makePublic: true,
+			wantStatus: http.StatusOK, wantOK: true, wantPublic: true},
+		{name: "owner makes private", username: "brennan", password: "brennan-password", key: brennanRecording,
+			wantStatus: http.StatusOK, wantOK: true, wantPublic: false},
+		{name: "admin publishes", username: "admin", password: "admin-password", key: tedRecording, makePublic: true,
+			wantStatus: http.StatusOK, wantOK: true, wantPublic: true},
+		{name: "someone else's recording", username: "brennan", password: "brennan-password", key: tedRecording, makePublic: true,
+			wantStatus: http.StatusUnauthorized, wantPublic: false},
+		{name: "changed since loaded", username: "ted", password: "ted-password", key: tedRecording, makePublic: true, staleETag: true,
+			wantStatus: http.StatusConflict, wantPublic: false},
+		{name: "bucket fails", username: "ted", password: "ted-password", key: tedRecording, makePublic: true,
+			fault:      &bucket.Fault{Op: bucket.OpUpdateMetadata, Err: errInjected},
+			wantStatus: http.StatusOK, wantOK: false, wantPublic: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServer(t, storage)
+			client := login(t, server, tt.username, tt.password)
+
+			req := ToggleAccessRequest{Key: tt.key, MakePublic: tt.makePublic, ETag: etag(t, storage, tt.key)}
+			if tt.staleETag {
+				req.ETag = `"0123456789abcdef0123456789abcdef"`
+			}
+			if tt.fault != nil {
+				storage.Inject(*tt.fault)
+			}
+			resp := postJSON(t, client, server.URL+"/api/files/toggle-access", req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.body)
+			}
+			if resp.StatusCode == http.StatusOK {
+				var result ToggleAccessResponse
+				if err := json.Unmarshal(resp.body, &result); err != nil {
+					t.Fatal(err)
+				}
+				if result.Success != tt.wantOK {
+					t.Errorf("success = %v, want %v", result.Success, tt.wantOK)
+				}
+			}
+
+			storage.ClearFaults()
+			if got := isPublic(t, storage, tt.key); got != tt.wantPublic {
+				t.Errorf("public = %v, want %v", got, tt.wantPublic)
+			}
+			if tt.wantOK {
+				want := map[bool]string{true: "false", false: "true"}[tt.makePublic]
+				if got := head(t, storage, tt.key)["Manually-Privated"]; got != want {
+					t.Errorf("Manually-Privated = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		key        string
+		newName    string // Soup Night if empty
+		staleETag  bool
+		fault      *bucket.Fault
+		wantStatus int
+	}{
+		{name: "owner renames", username: "ted", password: "ted-password", key: tedRecording, wantStatus: http.StatusOK},
+		{name: "someone else's recording", username: "ted", password: "ted-password", key: brennanRecording, wantStatus: http.StatusUnauthorized},
+		{name: "changed since loaded", username: "ted", password: "ted-password", key: tedRecording, staleETag: true, wantStatus: http.StatusConflict},
+		{name: "bucket fails", username: "ted", password: "ted-password", key: tedRecording,
+			fault: &bucket.Fault{Op: bucket.OpUpdateMetadata, Err: errInjected}, wantStatus: http.StatusInternalServerError},
+		{name: "name isn't ASCII", username: "ted", password: "ted-password", key: tedRecording, newName: "Soup Night ☕", wantStatus: http.StatusBadRequest},
+		{name: "name too long", username: "ted", password: "ted-password", key: tedRecording, newName: strings.Repeat("soup ", 41), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServer(t, storage)
+			client := login(t, server, tt.username, tt.password)
+
+			newName := tt.newName
+			if newName == "" {
+				newName = "Soup Night"
+			}
+			req := RenameFileRequest{Key: tt.key, DisplayName: newName, ETag: etag(t, storage, tt.key)}
+			if tt.staleETag {
+				req.ETag = `"0123456789abcdef0123456789abcdef"`
+			}
+			if tt.fault != nil {
+				storage.Inject(*tt.fault)
+			}
+			resp := postJSON(t, client, server.URL+"/api/files/rename", req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.body)
+			}
+
+			storage.ClearFaults()
+			renamed := head(t, storage, tt.key)["Display-Name"] == newName
+			if want := tt.wantStatus == http.StatusOK; renamed != want {
+				t.Errorf("renamed = %v, want %v", renamed, want)
+			}
+		})
+	}
+}
+
+func TestViewFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		key        string
+		fault      *bucket.Fault
+		wantStatus int
+	}{
+		{name: "owner", username: "ted", password: "ted-password", key: tedRecording, wantStatus: http.StatusTemporaryRedirect},
+		{name: "someone else's public recording", username: "ted", password: "ted-password", key: brennanRecording, wantStatus: http.StatusTemporaryRedirect},
+		{name: "someone else's private recording", username: "brennan", password: "brennan-password", key: tedRecording, wantStatus: http.StatusUnauthorized},
+		{name: "ACL can't be read", username: "ted", password: "ted-password", key: brennanRecording,
+			fault: &bucket.Fault{Op: bucket.OpGetObjectACL, Err: errInjected}, wantStatus: http.StatusInternalServerError},
+		{name: "URL can't be signed", username: "ted", password: "ted-password", key: tedRecording,
+			fault: &bucket.Fault{Op: bucket.OpGetPresignedURL, Err: errInjected}, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServer(t, storage)
+			client := login(t, server, tt.username, tt.password)
+			if tt.fault != nil {
+				storage.Inject(*tt.fault)
+			}
+
+			resp := get(t, client, server.URL+"/files/"+tt.key, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.body)
+			}
+			if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusTemporaryRedirect && !strings.Contains(location, tt.key) {
+				t.Errorf("redirected to %s, want a URL for %s", location, tt.key)
+			}
+		})
+	}
+}
+
+func TestViewFileServesLocalBucket(t *testing.T) {
+	storage, err := bucket.NewFSClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, storage)
+	client := login(t, server, "ted", "ted-password")
+	want := mp3test.Silence(40, false)
+
+	resp := get(t, client, server.URL+"/files/"+tedRecording, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.body)
+	}
+	if !bytes.Equal(resp.body, want) {
+		t.Errorf("got %d bytes, want the %d byte recording", len(resp.body), len(want))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want audio/mpeg", got)
+	}
+
+	// The player seeks with range requests
+	resp = get(t, client, server.URL+"/files/"+tedRecording, http.Header{"Range": {"bytes=417-833"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range status = %d, want 206", resp.StatusCode)
+	}
+	if !bytes.Equal(resp.body, want[417:834]) {
+		t.Errorf("range returned the wrong %d bytes", len(resp.body))
+	}
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		fault      *bucket.Fault
+		wantStatus int
+	}{
+		{name: "stored privately", wantStatus: http.StatusSeeOther},
+		{name: "bucket fails", fault: &bucket.Fault{Op: bucket.OpPutObjectStream, Err: errInjected}, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServer(t, storage)
+			client := login(t, server, "ted", "ted-password")
+			if tt.fault != nil {
+				storage.Inject(*tt.fault)
+			}
+
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			form.WriteField("date", "2024-02-01T20:00")
+			part, err := form.CreateFormFile("file", "show.mp3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(mp3test.Silence(10, false))
+			form.Close()
+
+			resp, err := client.Post(server.URL+"/api/upload", form.FormDataContentType(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			storage.ClearFaults()
+			const key = "recordings/ted/stream_20240201-200000.mp3"
+			_, err = storage.HeadObject(key)
+			if stored := err == nil; stored != (tt.fault == nil) {
+				t.Fatalf("stored = %v, want %v", stored, tt.fault == nil)
+			}
+			if tt.fault == nil && isPublic(t, storage, key) {
+				t.Errorf("upload is public, want private")
+			}
+		})
+	}
+}
+
+func TestConcurrentMetadataEdits(t *testing.T) {
+	storage := bucket.NewMemoryClient("test")
+	server := newTestServer(t, storage)
+	ted := login(t, server, "ted", "ted-password")
+	admin := login(t, server, "admin", "admin-password")
+
+	// Both load the files page, seeing the same ETag and revision
+	loaded := etag(t, storage, tedRecording)
+	revision := bucket.Revision(toPointers(head(t, storage, tedRecording)))
+
+	resp := postJSON(t, ted, server.URL+"/api/files/toggle-access", ToggleAccessRequest{
+		Key: tedRecording, MakePublic: true, ETag: loaded, Revision: revision,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("toggle status = %d: %s", resp.StatusCode, resp.body)
+	}
+	if etag(t, storage, tedRecording) != loaded {
+		t.Fatalf("a metadata edit changed the ETag")
+	}
+
+	// The ETag is unchanged, but the revision shows the rename is based on
+	// stale metadata
+	resp = postJSON(t, admin, server.URL+"/api/files/rename", RenameFileRequest{
+		Key: tedRecording, DisplayName: "Soup Night", ETag: loaded, Revision: revision,
+	})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("rename status = %d, want 409: %s", resp.StatusCode, resp.body)
+	}
+	if got := head(t, storage, tedRecording)["Display-Name"]; got != "" {
+		t.Errorf("Display-Name = %q, want it unset", got)
+	}
+}
+
+func toPointers(metadata map[string]string) map[string]*string {
+	out := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		out[k] = aws.String(v)
+	}
+	return out
+}
+
+func TestUploadOutlastsServerTimeouts(t *testing.T) {
+	storage := bucket.NewMemoryClient("test")
+	const timeout = 200 * time.Millisecond
+	server := newTestServerWithTimeout(t, storage, timeout)
+	client := login(t, server, "ted", "ted-password")
+
+	// The body trickles in over several timeouts, like a big recording on a
+	// slow connection
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		form.WriteField("date", "2024-02-01T20:00")
+		part, _ := form.CreateFormFile("file", "show.mp3")
+		silence := mp3test.Silence(8, false)
+		for i := 0; i < 4; i++ {
+			time.Sleep(timeout)
+			part.Write(silence[i*len(silence)/4 : (i+1)*len(silence)/4])
+		}
+		form.Close()
+		writer.Close()
+	}()
+
+	resp, err := client.Post(server.URL+"/api/upload", form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303", resp.StatusCode)
+	}
+	if _, err := storage.HeadObject("recordings/ted/stream_20240201-200000.mp3"); err != nil {
+		t.Errorf("upload wasn't stored: %v", err)
+	}
+}
+
+func TestEditsOutlastServerTimeouts(t *testing.T) {
+	const (
+		timeout  = 200 * time.Millisecond
+		fragment = "recordings/ted/stream_20240101-200001.mp3"
+	)
+	trim := func(t *testing.T, storage bucket.Storage) {
+		if _, err := edit.Trim(context.Background(), storage, tedRecording, 0, 500*time.Millisecond, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish := func(t *testing.T, storage bucket.Storage) {
+		if err := storage.PutObjectACL(tedRecording, "public-read"); err != nil {
+			t.Fatal(err)
+		}
+		if err := catalog.NewStore(storage).Refresh(context.Background(), tedRecording); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		path    string
+		req     interface{}
+		prepare func(t *testing.T, storage bucket.Storage)
+		// slow is the operation on the recording's audio that's held up
+		slow string
+	}{
+		{"merge", "/api/files/merge", MergeFilesRequest{Keys: []string{tedRecording, fragment}}, nil, bucket.OpGetObject},
+		{"trim", "/api/files/trim", TrimFileRequest{Key: tedRecording, End: "0.5"}, nil, bucket.OpGetObject},
+		{"undo trim", "/api/files/undo-trim", UndoTrimRequest{Key: tedRecording}, trim, bucket.OpCopyObject},
+		{"clip", "/api/clips", CreateClipRequest{Key: tedRecording, End: "0.5"}, publish, bucket.OpGetObject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServerWithTimeout(t, storage, timeout)
+			client := login(t, server, "ted", "ted-password")
+			putRecording(t, storage, fragment, "private")
+			if tt.prepare != nil {
+				tt.prepare(t, storage)
+			}
+
+			// Reading the audio takes longer than the server allows a
+			// request, like a big recording from a slow bucket
+			storage.Inject(bucket.Fault{Op: tt.slow, Key: tedRecording, Latency: 2 * timeout, Times: 1})
+			resp := postJSON(t, client, server.URL+tt.path, tt.req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", resp.StatusCode, resp.body)
+			}
+		})
+	}
+}
+
+func TestCreateClipTitles(t *testing.T) {
+	tests := []struct {
+		name       string
+		title      string
+		wantStatus int
+		wantTitle  string
+	}{
+		{name: "given title", title: "  Soup Night  ", wantStatus: http.StatusOK, wantTitle: "Soup Night"},
+		{name: "made up title", wantStatus: http.StatusOK, wantTitle: "mulch channel (January 1, 2024) from 0:00"},
+		{name: "title isn't ASCII", title: "Soup Night ☕", wantStatus: http.StatusBadRequest},
+		{name: "title too long", title: strings.Repeat("soup ", 41), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			server := newTestServer(t, storage)
+			client := login(t, server, "ted", "ted-password")
+			if err := storage.PutObjectACL(tedRecording, "public-read"); err != nil {
+				t.Fatal(err)
+			}
+			if err := catalog.NewStore(storage).Refresh(context.Background(), tedRecording); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := postJSON(t, client, server.URL+"/api/clips", CreateClipRequest{Key: tedRecording, End: "0.5", Title: tt.title})
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var clip CreateClipResponse
+			if err := json.Unmarshal(resp.body, &clip); err != nil {
+				t.Fatal(err)
+			}
+			if got := head(t, storage, clip.Key)["Display-Name"]; got != tt.wantTitle {
+				t.Errorf("title = %q, want %q", got, tt.wantTitle)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Package artwork turns show and episode images into cover art small enough
+// to embed in every recording's ID3 tag.
+//
+// Images may be JPEG, PNG or GIF. They're scaled down with a box filter so
+// the longest side is at most MaxSize pixels and re-encoded as JPEG; smaller
+// images keep their size but are still re-encoded, so the tag never carries
+// a multi-megabyte original.
+package artwork
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+const (
+	// MaxSize is the longest side of prepared cover art, in pixels
+	MaxSize = 600
+	// Quality is the JPEG quality cover art is encoded at
+	Quality = 85
+	// MIMEType is the type of prepared cover art
+	MIMEType = "image/jpeg"
+)
+
+// Prepare decodes an image and returns it as a JPEG no larger than MaxSize
+// on either side
+func Prepare(r io.Reader) ([]byte, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+	if width > MaxSize || height > MaxSize {
+		if width >= height {
+			width, height = MaxSize, max(1, height*MaxSize/width)
+		} else {
+			width, height = max(1, width*MaxSize/height), MaxSize
+		}
+		img = scale(img, width, height)
+	} else {
+		img = flatten(img)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: Quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten draws img over white, since JPEG has no transparency and
+// transparent pixels would otherwise come out black
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Over)
+	return out
+}
+
+// scale shrinks img to width x height, averaging the source pixels that
+// cover each destination pixel
+func scale(img image.Image, width, height int) *image.RGBA {
+	src := flatten(img)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, (y+1)*srcH/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, (x+1)*srcW/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4:]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					n++
+				}
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i] = uint8(r / n)
+			out.Pix[i+1] = uint8(g / n)
+			out.Pix[i+2] = uint8(b / n)
+			out.Pix[i+3] = 0xFF
+		}
+	}
+	return out
+}
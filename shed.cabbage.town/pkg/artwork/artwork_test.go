@@ -0,0 +1,94 @@
+package artwork
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testPNG encodes a width x height PNG whose left third is transparent,
+// middle third half-transparent black and right third opaque red
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			switch {
+			case x < width/3:
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 0})
+			case x < 2*width/3:
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 0x80})
+			default:
+				img.SetNRGBA(x, y, color.NRGBA{0xFF, 0, 0, 0xFF})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// near reports whether c is within JPEG's error of r, g, b
+func near(c color.Color, r, g, b uint8) bool {
+	cr, cg, cb, _ := c.RGBA()
+	within := func(got uint32, want uint8) bool {
+		d := int(got>>8) - int(want)
+		return d >= -12 && d <= 12
+	}
+	return within(cr, r) && within(cg, g) && within(cb, b)
+}
+
+func TestPrepare(t *testing.T) {
+	tests := []struct {
+		name                  string
+		width, height         int
+		wantWidth, wantHeight int
+	}{
+		{"oversized wide", 1800, 900, 600, 300},
+		{"oversized tall", 900, 1500, 360, 600},
+		{"small", 300, 150, 300, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := testPNG(t, tt.width, tt.height)
+			prepared, err := Prepare(bytes.NewReader(original))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, format, err := image.Decode(bytes.NewReader(prepared))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "jpeg" {
+				t.Errorf("format = %s, want jpeg", format)
+			}
+			if got := img.Bounds().Size(); got.X != tt.wantWidth || got.Y != tt.wantHeight {
+				t.Errorf("size = %v, want %dx%d", got, tt.wantWidth, tt.wantHeight)
+			}
+
+			// Transparency is flattened onto white rather than coming out black
+			y := tt.wantHeight / 2
+			if c := img.At(tt.wantWidth/6, y); !near(c, 0xFF, 0xFF, 0xFF) {
+				t.Errorf("transparent third = %v, want white", c)
+			}
+			if c := img.At(tt.wantWidth/2, y); !near(c, 0x7F, 0x7F, 0x7F) {
+				t.Errorf("half-transparent black third = %v, want grey", c)
+			}
+			if c := img.At(5*tt.wantWidth/6, y); !near(c, 0xFF, 0, 0) {
+				t.Errorf("opaque red third = %v, want red", c)
+			}
+		})
+	}
+}
+
+func TestPrepareRejectsNonImages(t *testing.T) {
+	if _, err := Prepare(strings.NewReader("not an image")); err == nil {
+		t.Error("Prepare() of text succeeded")
+	}
+}
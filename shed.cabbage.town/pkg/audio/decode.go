@@ -0,0 +1,103 @@
+// Package audio decodes MP3 recordings to PCM and analyses them.
+//
+// Decoding is done in pure Go, so trellis needs no ffmpeg. A Decoder always
+// produces stereo: mono files come out with the same signal on both channels,
+// and Channels reports how many the file really has.
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	gomp3 "github.com/hajimehoshi/go-mp3"
+
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// Frame is one stereo sample, each channel scaled to [-1, 1)
+type Frame [2]float64
+
+// Analyzer receives decoded audio in order, a block at a time
+type Analyzer interface {
+	Write(frames []Frame)
+}
+
+// Decoder decodes an MP3 stream as it's read
+type Decoder struct {
+	dec      *gomp3.Decoder
+	channels int
+	buf      []byte
+}
+
+// NewDecoder starts decoding r, which may begin with an ID3v2 tag
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	// The decoder doesn't say whether the stream is mono, so read up to the
+	// first frame header first and hand what was read on to the decoder
+	var head bytes.Buffer
+	channels, err := mp3.Channels(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first frame: %v", err)
+	}
+	dec, err := gomp3.NewDecoder(io.MultiReader(&head, r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start decoding: %v", err)
+	}
+	return &Decoder{dec: dec, channels: channels}, nil
+}
+
+// Channels is how many channels the stream has, taken from its first frame:
+// 1 for mono or 2
+func (d *Decoder) Channels() int {
+	return d.channels
+}
+
+// SampleRate is the stream's sample rate in Hz, taken from its first frame
+func (d *Decoder) SampleRate() int {
+	return d.dec.SampleRate()
+}
+
+// Read decodes up to len(frames) frames, returning how many it decoded and
+// io.EOF once the stream is finished
+func (d *Decoder) Read(frames []Frame) (int, error) {
+	size := len(frames) * 4
+	if cap(d.buf) < size {
+		d.buf = make([]byte, size)
+	}
+	buf := d.buf[:size]
+
+	n, err := io.ReadFull(d.dec, buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	count := n / 4
+	for i := 0; i < count; i++ {
+		frames[i][0] = float64(int16(binary.LittleEndian.Uint16(buf[4*i:]))) / 32768
+		frames[i][1] = float64(int16(binary.LittleEndian.Uint16(buf[4*i+2:]))) / 32768
+	}
+	if count == 0 && err == nil {
+		err = io.EOF
+	}
+	return count, err
+}
+
+// Run decodes the rest of the stream, passing every block to each analyzer
+func (d *Decoder) Run(analyzers ...Analyzer) error {
+	frames := make([]Frame, 4096)
+	for {
+		n, err := d.Read(frames)
+		if n > 0 {
+			for _, analyzer := range analyzers {
+				analyzer.Write(frames[:n])
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode: %v", err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package audio
+
+import (
+	"math"
+)
+
+// ReferenceLoudness is the level ReplayGain 2.0 adjusts tracks to, in LUFS
+const ReferenceLoudness = -18.0
+
+// Gating thresholds from EBU R128 / ITU-R BS.1770-4
+const (
+	absoluteGate = -70.0 // LUFS
+	relativeGate = -10.0 // LU below the ungated level
+)
+
+// oversampling is the true peak interpolation factor, and tapsPerPhase the
+// length of each phase of the interpolation filter
+const (
+	oversampling = 4
+	tapsPerPhase = 12
+)
+
+// Loudness is the result of measuring a recording
+type Loudness struct {
+	// Integrated is the gated integrated loudness in LUFS, or -Inf for silence
+	Integrated float64
+	// TruePeak is the highest interpolated sample level in dBTP
+	TruePeak float64
+	// Peak is the highest sample level, where 1 is full scale
+	Peak float64
+}
+
+// TrackGain is the ReplayGain 2.0 track gain in dB
+func (l Loudness) TrackGain() float64 {
+	return ReferenceLoudness - l.Integrated
+}
+
+// LoudnessMeter measures integrated loudness and peaks as described in EBU
+// R128. Loudness is measured over 400ms blocks overlapping by 75%, from
+// K-weighted energy in 100ms steps.
+type LoudnessMeter struct {
+	// channels is how many of each frame's channels are measured: mono
+	// recordings are decoded to two copies of one channel, and counting both
+	// would make them 3 LU louder than they are
+	channels int
+	filters  [2]kWeighting
+	peak     [2]truePeak
+
+	step   int // samples per 100ms step
+	inStep int
+	energy float64    // of the step so far
+	steps  [4]float64 // the last four steps' mean square
+	seen   int        // how many steps have been completed
+	blocks []float64  // mean square of each 400ms block
+}
+
+// NewLoudnessMeter returns a meter for audio at the given sample rate with
+// the given number of channels, as reported by Decoder.Channels
+func NewLoudnessMeter(sampleRate, channels int) *LoudnessMeter {
+	m := &LoudnessMeter{channels: min(max(channels, 1), 2), step: sampleRate / 10}
+	for c := range m.filters {
+		m.filters[c] = newKWeighting(float64(sampleRate))
+	}
+	return m
+}
+
+// Write adds frames to the measurement
+func (m *LoudnessMeter) Write(frames []Frame) {
+	for _, frame := range frames {
+		for c, sample := range frame[:m.channels] {
+			m.peak[c].add(sample)
+			weighted := m.filters[c].process(sample)
+			m.energy += weighted * weighted
+		}
+		m.inStep++
+		if m.inStep < m.step {
+			continue
+		}
+
+		copy(m.steps[:], m.steps[1:])
+		m.steps[3] = m.energy / float64(m.step)
+		m.energy, m.inStep = 0, 0
+		m.seen++
+		if m.seen >= 4 {
+			m.blocks = append(m.blocks, (m.steps[0]+m.steps[1]+m.steps[2]+m.steps[3])/4)
+		}
+	}
+}
+
+// Result returns the loudness of everything written so far
+func (m *LoudnessMeter) Result() Loudness {
+	var peak, samplePeak float64
+	for c := range m.peak {
+		peak = math.Max(peak, m.peak[c].max)
+		samplePeak = math.Max(samplePeak, m.peak[c].sampleMax)
+	}
+	return Loudness{
+		Integrated: m.integrated(),
+		TruePeak:   20 * math.Log10(peak),
+		Peak:       samplePeak,
+	}
+}
+
+// integrated applies the absolute and relative gates to the blocks
+func (m *LoudnessMeter) integrated() float64 {
+	absolute := energyFor(absoluteGate)
+	var sum float64
+	var count int
+	for _, block := range m.blocks {
+		if block > absolute {
+			sum += block
+			count++
+		}
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	relative := energyFor(loudnessOf(sum/float64(count)) + relativeGate)
+	sum, count = 0, 0
+	for _, block := range m.blocks {
+		if block > absolute && block > relative {
+			sum += block
+			count++
+		}
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return loudnessOf(sum / float64(count))
+}
+
+// loudnessOf converts a block's summed channel mean square to LUFS
+func loudnessOf(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// energyFor is the inverse of loudnessOf
+func energyFor(loudness float64) float64 {
+	return math.Pow(10, (loudness+0.691)/10)
+}
+
+// biquad is a second order IIR filter in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting is the BS.1770 K-weighting curve: a high shelf modelling the
+// head followed by the RLB high-pass
+type kWeighting struct {
+	shelf, highPass biquad
+}
+
+// newKWeighting designs the K-weighting filters for any sample rate. The
+// parameters reproduce the coefficients BS.1770 gives for 48kHz.
+func newKWeighting(sampleRate float64) kWeighting {
+	var k kWeighting
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	K := math.Tan(math.Pi * f0 / sampleRate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + K/q + K*K
+	k.shelf = biquad{
+		b0: (vh + vb*K/q + K*K) / a0,
+		b1: 2 * (K*K - vh) / a0,
+		b2: (vh - vb*K/q + K*K) / a0,
+		a1: 2 * (K*K - 1) / a0,
+		a2: (1 - K/q + K*K) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	K = math.Tan(math.Pi * f0 / sampleRate)
+	a0 = 1 + K/q + K*K
+	k.highPass = biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (K*K - 1) / a0,
+		a2: (1 - K/q + K*K) / a0,
+	}
+	return k
+}
+
+func (k *kWeighting) process(x float64) float64 {
+	return k.highPass.process(k.shelf.process(x))
+}
+
+// interpolationFilter is a windowed sinc low-pass for 4x oversampling,
+// split into one set of taps per output phase
+var interpolationFilter = func() [oversampling][tapsPerPhase]float64 {
+	var phases [oversampling][tapsPerPhase]float64
+	length := oversampling * tapsPerPhase
+	center := float64(length-1) / 2
+	for n := 0; n < length; n++ {
+		t := (float64(n) - center) / oversampling
+		sinc := 1.0
+		if t != 0 {
+			sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+		}
+		window := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(n)+0.5)/float64(length))
+		phases[n%oversampling][n/oversampling] = sinc * window
+	}
+	return phases
+}()
+
+// truePeak tracks the highest level of a channel oversampled 4x
+type truePeak struct {
+	history   [tapsPerPhase]float64 // most recent sample first
+	max       float64
+	sampleMax float64
+}
+
+func (p *truePeak) add(x float64) {
+	copy(p.history[1:], p.history[:tapsPerPhase-1])
+	p.history[0] = x
+	if a := math.Abs(x); a > p.sampleMax {
+		p.sampleMax = a
+	}
+
+	for _, taps := range interpolationFilter {
+		var y float64
+		for i, tap := range taps {
+			y += tap * p.history[i]
+		}
+		if a := math.Abs(y); a > p.max {
+			p.max = a
+		}
+	}
+	if p.sampleMax > p.max {
+		p.max = p.sampleMax
+	}
+}
@@ -0,0 +1,83 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+// sine returns seconds of a 1kHz sine wave at full scale on both channels,
+// as a mono recording is decoded
+func sine(sampleRate int, seconds float64) []Frame {
+	frames := make([]Frame, int(float64(sampleRate)*seconds))
+	for i := range frames {
+		v := math.Sin(2 * math.Pi * 1000 * float64(i) / float64(sampleRate))
+		frames[i] = Frame{v, v}
+	}
+	return frames
+}
+
+func TestLoudnessMeter(t *testing.T) {
+	// BS.1770 gives a full scale 1kHz sine -3.01 LUFS in one channel, so
+	// the same signal in both is 3 LU louder
+	tests := []struct {
+		name     string
+		channels int
+		want     float64
+	}{
+		{"mono", 1, -3.01},
+		{"stereo", 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewLoudnessMeter(48000, tt.channels)
+			m.Write(sine(48000, 5))
+			got := m.Result()
+			if math.Abs(got.Integrated-tt.want) > 0.1 {
+				t.Errorf("integrated = %.2f LUFS, want %.2f", got.Integrated, tt.want)
+			}
+			if math.Abs(got.Peak-1) > 0.01 {
+				t.Errorf("peak = %.3f, want 1", got.Peak)
+			}
+		})
+	}
+}
+
+func TestDecoderChannels(t *testing.T) {
+	for _, mono := range []bool{true, false} {
+		// A tag in front mustn't hide the first frame
+		tag := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 20}, make([]byte, 20)...)
+		data := append(tag, mp3test.Silence(10, mono)...)
+		decoder, err := NewDecoder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 2
+		if mono {
+			want = 1
+		}
+		if got := decoder.Channels(); got != want {
+			t.Errorf("mono %v: channels = %d, want %d", mono, got, want)
+		}
+
+		// Reading the first frame header doesn't lose any audio
+		frames := make([]Frame, 4096)
+		var total int
+		for {
+			n, err := decoder.Read(frames)
+			total += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if total != 10*mp3test.FrameSamples {
+			t.Errorf("mono %v: decoded %d frames, want %d", mono, total, 10*mp3test.FrameSamples)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// silenceWindow is how much audio the silence detector judges at a time
+const silenceWindow = 100 * time.Millisecond
+
+// Span is a stretch of audio, measured from its start
+type Span struct {
+	Start, End time.Duration
+}
+
+// Length is how long the span lasts
+func (s Span) Length() time.Duration {
+	return s.End - s.Start
+}
+
+// SilenceDetector finds stretches of audio that stay below a level. Audio is
+// judged in 100ms windows by its peak, so a stretch is only silent if no
+// sample in it reaches the threshold.
+type SilenceDetector struct {
+	sampleRate int
+	threshold  float64 // linear
+	minLength  time.Duration
+
+	window   int // samples per window
+	inWindow int
+	peak     float64 // of the window so far
+	windows  int     // how many windows have been completed
+	silentAt int     // window the current silent run started in, or -1
+	spans    []Span
+}
+
+// NewSilenceDetector returns a detector for audio at sampleRate that finds
+// stretches of at least minLength whose peak stays below threshold dBFS
+func NewSilenceDetector(sampleRate int, threshold float64, minLength time.Duration) *SilenceDetector {
+	return &SilenceDetector{
+		sampleRate: sampleRate,
+		threshold:  math.Pow(10, threshold/20),
+		minLength:  minLength,
+		window:     int(int64(sampleRate) * int64(silenceWindow) / int64(time.Second)),
+		silentAt:   -1,
+	}
+}
+
+// Write adds frames to the detector
+func (d *SilenceDetector) Write(frames []Frame) {
+	for _, frame := range frames {
+		for _, sample := range frame {
+			d.peak = math.Max(d.peak, math.Abs(sample))
+		}
+		d.inWindow++
+		if d.inWindow == d.window {
+			d.endWindow()
+		}
+	}
+}
+
+// Silences returns the silent stretches in everything written so far, in
+// order, along with the length of the audio
+func (d *SilenceDetector) Silences() ([]Span, time.Duration) {
+	length := d.at(d.windows) + d.samples(d.inWindow)
+	spans := d.spans
+	if d.silentAt >= 0 {
+		end := d.at(d.windows)
+		if d.inWindow > 0 && d.peak < d.threshold {
+			end = length
+		}
+		if span := (Span{d.at(d.silentAt), end}); span.Length() >= d.minLength {
+			spans = append(spans[:len(spans):len(spans)], span)
+		}
+	}
+	return spans, length
+}
+
+func (d *SilenceDetector) endWindow() {
+	silent := d.peak < d.threshold
+	switch {
+	case silent && d.silentAt < 0:
+		d.silentAt = d.windows
+	case !silent && d.silentAt >= 0:
+		if span := (Span{d.at(d.silentAt), d.at(d.windows)}); span.Length() >= d.minLength {
+			d.spans = append(d.spans, span)
+		}
+		d.silentAt = -1
+	}
+	d.windows++
+	d.peak, d.inWindow = 0, 0
+}
+
+// at is when a window starts
+func (d *SilenceDetector) at(window int) time.Duration {
+	return d.samples(window * d.window)
+}
+
+func (d *SilenceDetector) samples(n int) time.Duration {
+	return time.Duration(int64(n) * int64(time.Second) / int64(d.sampleRate))
+}
@@ -0,0 +1,132 @@
+package audio
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// level returns ms milliseconds of audio at 1kHz whose samples are all v
+func level(v float64, ms int) []Frame {
+	frames := make([]Frame, ms)
+	for i := range frames {
+		frames[i] = Frame{v, -v}
+	}
+	return frames
+}
+
+func audioOf(parts ...[]Frame) []Frame {
+	var frames []Frame
+	for _, part := range parts {
+		frames = append(frames, part...)
+	}
+	return frames
+}
+
+func TestSilenceDetector(t *testing.T) {
+	const (
+		loud  = 0.5
+		quiet = 0.0005 // -66 dBFS
+		hum   = 0.002  // -54 dBFS
+	)
+	s := func(start, end int) Span {
+		return Span{time.Duration(start) * time.Millisecond, time.Duration(end) * time.Millisecond}
+	}
+	tests := []struct {
+		name       string
+		frames     []Frame
+		want       []Span
+		wantLength time.Duration
+	}{
+		{
+			name:       "leading, gap and trailing",
+			frames:     audioOf(level(0, 2000), level(loud, 3000), level(quiet, 1500), level(loud, 2000), level(0, 2000)),
+			want:       []Span{s(0, 2000), s(5000, 6500), s(8500, 10500)},
+			wantLength: 10500 * time.Millisecond,
+		},
+		{
+			name:       "just under the minimum",
+			frames:     audioOf(level(loud, 1000), level(0, 900), level(loud, 1000)),
+			wantLength: 2900 * time.Millisecond,
+		},
+		{
+			name:       "exactly the minimum",
+			frames:     audioOf(level(loud, 1000), level(0, 1000), level(loud, 1000)),
+			want:       []Span{s(1000, 2000)},
+			wantLength: 3000 * time.Millisecond,
+		},
+		{
+			name:       "just over the minimum",
+			frames:     audioOf(level(loud, 1000), level(0, 1100), level(loud, 1000)),
+			want:       []Span{s(1000, 2100)},
+			wantLength: 3100 * time.Millisecond,
+		},
+		{
+			name:       "above the threshold",
+			frames:     audioOf(level(loud, 1000), level(hum, 3000), level(loud, 1000)),
+			wantLength: 5000 * time.Millisecond,
+		},
+		{
+			// One loud sample spoils its whole window
+			name:       "click in the silence",
+			frames:     audioOf(level(loud, 1000), level(0, 750), level(loud, 1), level(0, 749), level(loud, 1000)),
+			wantLength: 3500 * time.Millisecond,
+		},
+		{
+			name:       "all silent",
+			frames:     level(0, 3000),
+			want:       []Span{s(0, 3000)},
+			wantLength: 3000 * time.Millisecond,
+		},
+		{
+			name:       "silent partial window at the end",
+			frames:     audioOf(level(loud, 2000), level(0, 1050)),
+			want:       []Span{s(2000, 3050)},
+			wantLength: 3050 * time.Millisecond,
+		},
+		{
+			// The silence ends where the last whole window does
+			name:       "loud partial window at the end",
+			frames:     audioOf(level(loud, 2000), level(0, 1000), level(loud, 50)),
+			want:       []Span{s(2000, 3000)},
+			wantLength: 3050 * time.Millisecond,
+		},
+		{
+			name:       "nothing written",
+			wantLength: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewSilenceDetector(1000, -60, time.Second)
+			// Write in uneven blocks, as the decoder does
+			for frames := tt.frames; len(frames) > 0; {
+				n := min(len(frames), 333)
+				d.Write(frames[:n])
+				frames = frames[n:]
+			}
+			spans, length := d.Silences()
+			if !reflect.DeepEqual(spans, tt.want) {
+				t.Errorf("silences = %v, want %v", spans, tt.want)
+			}
+			if length != tt.wantLength {
+				t.Errorf("length = %v, want %v", length, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestSilencesCanBeReadMidway(t *testing.T) {
+	d := NewSilenceDetector(1000, -60, time.Second)
+	d.Write(audioOf(level(0.5, 1000), level(0, 1500)))
+	if spans, _ := d.Silences(); !reflect.DeepEqual(spans, []Span{{time.Second, 2500 * time.Millisecond}}) {
+		t.Errorf("silences so far = %v, want the trailing 1.5s", spans)
+	}
+
+	// The silence carries on rather than being recorded twice
+	d.Write(audioOf(level(0, 500), level(0.5, 1000)))
+	spans, _ := d.Silences()
+	if want := []Span{{time.Second, 3 * time.Second}}; !reflect.DeepEqual(spans, want) {
+		t.Errorf("silences = %v, want %v", spans, want)
+	}
+}
@@ -0,0 +1,101 @@
+package audio
+
+import (
+	"math"
+)
+
+// Waveform is a recording's peaks in the audiowaveform JSON format, which
+// peaks.js reads directly. Data holds a min and max pair per pixel, taken
+// across both channels and scaled to 8 bits.
+type Waveform struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// Downsample merges neighbouring pixels so the waveform is at most
+// maxLength pixels long. A waveform that's already short enough is
+// returned as it is.
+func (w *Waveform) Downsample(maxLength int) *Waveform {
+	if w.Length <= maxLength {
+		return w
+	}
+	factor := (w.Length + maxLength - 1) / maxLength
+
+	out := *w
+	out.SamplesPerPixel = w.SamplesPerPixel * factor
+	out.Data = make([]int8, 0, 2*(w.Length/factor+1))
+	for start := 0; start < w.Length; start += factor {
+		end := min(start+factor, w.Length)
+		lo, hi := w.Data[2*start], w.Data[2*start+1]
+		for i := start + 1; i < end; i++ {
+			lo = min(lo, w.Data[2*i])
+			hi = max(hi, w.Data[2*i+1])
+		}
+		out.Data = append(out.Data, lo, hi)
+	}
+	out.Length = len(out.Data) / 2
+	return &out
+}
+
+// WaveformBuilder collects a waveform from decoded audio
+type WaveformBuilder struct {
+	sampleRate      int
+	samplesPerPixel int
+
+	inPixel int
+	lo, hi  float64
+	data    []int8
+}
+
+// NewWaveformBuilder returns a builder making one pixel from every
+// samplesPerPixel frames of audio at sampleRate
+func NewWaveformBuilder(sampleRate, samplesPerPixel int) *WaveformBuilder {
+	return &WaveformBuilder{sampleRate: sampleRate, samplesPerPixel: samplesPerPixel}
+}
+
+// Write adds frames to the waveform
+func (b *WaveformBuilder) Write(frames []Frame) {
+	for _, frame := range frames {
+		for _, sample := range frame {
+			b.lo = math.Min(b.lo, sample)
+			b.hi = math.Max(b.hi, sample)
+		}
+		b.inPixel++
+		if b.inPixel == b.samplesPerPixel {
+			b.flush()
+		}
+	}
+}
+
+// Waveform returns the waveform of everything written so far, including a
+// final partial pixel
+func (b *WaveformBuilder) Waveform() *Waveform {
+	data := b.data
+	if b.inPixel > 0 {
+		data = append(data[:len(data):len(data)], quantize(b.lo), quantize(b.hi))
+	}
+	return &Waveform{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      b.sampleRate,
+		SamplesPerPixel: b.samplesPerPixel,
+		Bits:            8,
+		Length:          len(data) / 2,
+		Data:            data,
+	}
+}
+
+func (b *WaveformBuilder) flush() {
+	b.data = append(b.data, quantize(b.lo), quantize(b.hi))
+	b.lo, b.hi, b.inPixel = 0, 0, 0
+}
+
+// quantize scales a sample to a signed 8-bit value
+func quantize(v float64) int8 {
+	return int8(math.Max(-128, math.Min(127, math.Round(v*128))))
+}
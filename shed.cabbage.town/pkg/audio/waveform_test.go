@@ -0,0 +1,82 @@
+package audio
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestWaveformBuilder(t *testing.T) {
+	b := NewWaveformBuilder(44100, 4)
+	var frames []Frame
+	for i := 0; i < 4; i++ {
+		frames = append(frames, Frame{0.5, -0.25})
+	}
+	for i := 0; i < 4; i++ {
+		frames = append(frames, Frame{1, 1})
+	}
+	// Two frames short of a whole pixel
+	frames = append(frames, Frame{-1, -1}, Frame{-0.5, 0})
+	b.Write(frames[:3])
+	b.Write(frames[3:])
+
+	w := b.Waveform()
+	want := []int8{-32, 64, 0, 127, -128, 0}
+	if !reflect.DeepEqual(w.Data, want) {
+		t.Errorf("data = %v, want %v", w.Data, want)
+	}
+	if w.Length != len(w.Data)/2 || w.Length != 3 {
+		t.Errorf("length = %d with %d values, want 3", w.Length, len(w.Data))
+	}
+	if w.SampleRate != 44100 || w.SamplesPerPixel != 4 || w.Bits != 8 || w.Channels != 1 {
+		t.Errorf("header = %+v", w)
+	}
+
+	// Finishing the partial pixel later doesn't change the waveform
+	// already returned
+	b.Write([]Frame{{0.25, 0.25}, {0.25, 0.25}})
+	if !reflect.DeepEqual(w.Data, want) {
+		t.Errorf("data after more writes = %v, want %v", w.Data, want)
+	}
+	if got := b.Waveform(); !reflect.DeepEqual(got.Data, []int8{-32, 64, 0, 127, -128, 32}) || got.Length != 3 {
+		t.Errorf("data with the pixel finished = %v (length %d)", got.Data, got.Length)
+	}
+}
+
+func TestWaveformDownsample(t *testing.T) {
+	w := &Waveform{Version: 2, Channels: 1, SampleRate: 44100, SamplesPerPixel: 256, Bits: 8, Length: 3,
+		Data: []int8{-32, 64, 0, 127, -128, 0}}
+	got := w.Downsample(2)
+	if want := []int8{-32, 127, -128, 0}; !reflect.DeepEqual(got.Data, want) {
+		t.Errorf("data = %v, want %v", got.Data, want)
+	}
+	if got.Length != 2 || got.SamplesPerPixel != 512 {
+		t.Errorf("length %d at %d samples per pixel, want 2 at 512", got.Length, got.SamplesPerPixel)
+	}
+	if w.Downsample(3) != w {
+		t.Error("a waveform short enough already was copied")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	long := &Waveform{SamplesPerPixel: 256, Length: 10007}
+	lo, hi := int8(127), int8(-128)
+	for i := 0; i < long.Length; i++ {
+		a, b := int8(rng.Intn(256)-128), int8(rng.Intn(256)-128)
+		a, b = min(a, b), max(a, b)
+		long.Data = append(long.Data, a, b)
+		lo, hi = min(lo, a), max(hi, b)
+	}
+	for _, maxLength := range []int{1, 2, 999, 1000, 5003, 10006} {
+		got := long.Downsample(maxLength)
+		if got.Length > maxLength || got.Length != len(got.Data)/2 || len(got.Data)%2 != 0 {
+			t.Errorf("Downsample(%d): length %d with %d values", maxLength, got.Length, len(got.Data))
+		}
+		gotLo, gotHi := int8(127), int8(-128)
+		for i := 0; i < got.Length; i++ {
+			gotLo, gotHi = min(gotLo, got.Data[2*i]), max(gotHi, got.Data[2*i+1])
+		}
+		if gotLo != lo || gotHi != hi {
+			t.Errorf("Downsample(%d): range %d..%d, want %d..%d", maxLength, gotLo, gotHi, lo, hi)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package bucket
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,11 +14,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-const (
-	BucketName = "cabbagetown"
-	endpoint   = "https://nyc3.digitaloceanspaces.com"
-	region     = "us-east-1"
-)
+// BucketName is the default bucket, used unless overridden by Config
+const BucketName = "cabbagetown"
 
 // User represents a user in the system
 type User struct {
@@ -34,10 +32,20 @@ type UserStore struct {
 type Client struct {
 	s3Client *s3.S3
 	Bucket   string
+	config   Config
 }
 
-// NewClient creates a new bucket client
+// NewClient creates a new bucket client using the configuration from LoadConfig
 func NewClient() (*Client, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConfig(config)
+}
+
+// NewClientWithConfig creates a new bucket client for the given configuration
+func NewClientWithConfig(config Config) (*Client, error) {
 	accessKey := os.Getenv("DO_ACCESS_KEY_ID")
 	secretKey := os.Getenv("DO_SECRET_ACCESS_KEY")
 
@@ -47,9 +55,11 @@ func NewClient() (*Client, error) {
 
 	sess, err := session.NewSession(&aws.Config{
 		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, ""),
-		Endpoint:         aws.String(endpoint),
-		Region:           aws.String(region),
-		S3ForcePathStyle: aws.Bool(false),
+		Endpoint:         aws.String(config.Endpoint),
+		Region:           aws.String(config.Region),
+		S3ForcePathStyle: aws.Bool(config.PathStyle),
+		// Retries are handled by config.Retry so they can be classified and logged
+		MaxRetries: aws.Int(0),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %v", err)
@@ -57,62 +67,173 @@ func NewClient() (*Client, error) {
 
 	return &Client{
 		s3Client: s3.New(sess),
-		Bucket:   BucketName,
+		Bucket:   config.Bucket,
+		config:   config,
 	}, nil
 }
 
+// PublicURL returns the public URL for key, honouring any configured CDN base URL
+func (c *Client) PublicURL(key string) string {
+	return c.config.PublicURL(key)
+}
+
+// call runs fn under the retry policy with the timeout configured for op
+func (c *Client) call(ctx context.Context, op string, fn func(context.Context) error) error {
+	return c.config.Retry.do(ctx, op, c.config.timeout(op), fn)
+}
+
 // GetObject retrieves an object from the bucket
 func (c *Client) GetObject(key string) (*s3.GetObjectOutput, error) {
-	return c.s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(c.Bucket),
-		Key:    aws.String(key),
+	return c.GetObjectWithContext(context.Background(), key)
+}
+
+// GetObjectWithContext retrieves an object from the bucket. A configured
+// GetObject timeout covers reading the body too, so it ends when Body is closed.
+func (c *Client) GetObjectWithContext(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	cancel := context.CancelFunc(func() {})
+	if timeout := c.config.timeout(OpGetObject); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	var output *s3.GetObjectOutput
+	err := c.config.Retry.do(ctx, OpGetObject, 0, func(ctx context.Context) error {
+		var err error
+		output, err = c.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	output.Body = &cancelOnClose{ReadCloser: output.Body, cancel: cancel}
+	return output, nil
+}
+
+// cancelOnClose releases a context when the body reading under it is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// putObject uploads input, retrying only when the body can be rewound to
+// where it started
+func (c *Client) putObject(ctx context.Context, op string, input *s3.PutObjectInput, body io.Reader) error {
+	policy := c.config.Retry
+	seeker, canSeek := body.(io.Seeker)
+	var start int64
+	if canSeek {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			canSeek = false
+		}
+	}
+	if !canSeek {
+		policy.MaxAttempts = 1
+	}
+
+	attempt := 0
+	return policy.do(ctx, op, c.config.timeout(op), func(ctx context.Context) error {
+		if attempt++; attempt > 1 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind body: %v", err)
+			}
+		}
+		_, err := c.s3Client.PutObjectWithContext(ctx, input)
+		return err
 	})
 }
 
 // PutObject uploads an object to the bucket
 func (c *Client) PutObject(key string, body []byte, contentType string) error {
+	return c.PutObjectWithContext(context.Background(), key, body, contentType)
+}
+
+// PutObjectWithContext uploads an object to the bucket
+func (c *Client) PutObjectWithContext(ctx context.Context, key string, body []byte, contentType string) error {
+	reader := bytes.NewReader(body)
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(c.Bucket),
 		Key:         aws.String(key),
-		Body:        bytes.NewReader(body),
+		Body:        reader,
 		ContentType: aws.String(contentType),
 	}
-
-	_, err := c.s3Client.PutObject(input)
-	return err
+	return c.putObject(ctx, OpPutObject, input, reader)
 }
 
 // GetObjectACL gets the ACL for an object
 func (c *Client) GetObjectACL(key string) (*s3.GetObjectAclOutput, error) {
-	return c.s3Client.GetObjectAcl(&s3.GetObjectAclInput{
-		Bucket: aws.String(c.Bucket),
-		Key:    aws.String(key),
+	return c.GetObjectACLWithContext(context.Background(), key)
+}
+
+// GetObjectACLWithContext gets the ACL for an object
+func (c *Client) GetObjectACLWithContext(ctx context.Context, key string) (*s3.GetObjectAclOutput, error) {
+	var output *s3.GetObjectAclOutput
+	err := c.call(ctx, OpGetObjectACL, func(ctx context.Context) error {
+		var err error
+		output, err = c.s3Client.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
 	})
+	return output, err
 }
 
 // PutObjectACL sets the ACL for an object
 func (c *Client) PutObjectACL(key string, acl string) error {
-	_, err := c.s3Client.PutObjectAcl(&s3.PutObjectAclInput{
-		Bucket: aws.String(c.Bucket),
-		Key:    aws.String(key),
-		ACL:    aws.String(acl),
+	return c.PutObjectACLWithContext(context.Background(), key, acl)
+}
+
+// PutObjectACLWithContext sets the ACL for an object
+func (c *Client) PutObjectACLWithContext(ctx context.Context, key string, acl string) error {
+	return c.call(ctx, OpPutObjectACL, func(ctx context.Context) error {
+		_, err := c.s3Client.PutObjectAclWithContext(ctx, &s3.PutObjectAclInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+			ACL:    aws.String(acl),
+		})
+		return err
 	})
-	return err
 }
 
 // ListObjects lists objects with the given prefix
 func (c *Client) ListObjects(prefix string) ([]*s3.Object, error) {
-	var objects []*s3.Object
+	return c.ListObjectsWithContext(context.Background(), prefix)
+}
 
-	err := c.s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+// ListObjectsWithContext lists objects with the given prefix. The timeout and
+// retries apply to each page, so a long listing isn't restarted from scratch.
+func (c *Client) ListObjectsWithContext(ctx context.Context, prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(c.Bucket),
 		Prefix: aws.String(prefix),
-	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		objects = append(objects, page.Contents...)
-		return true
-	})
+	}
 
-	return objects, err
+	for {
+		var page *s3.ListObjectsV2Output
+		err := c.call(ctx, OpListObjects, func(ctx context.Context) error {
+			var err error
+			page, err = c.s3Client.ListObjectsV2WithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return objects, err
+		}
+		objects = append(objects, page.Contents...)
+		if !aws.BoolValue(page.IsTruncated) || page.NextContinuationToken == nil {
+			return objects, nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
 }
 
 // GetPresignedURL generates a presigned URL for an object that expires after the specified duration
@@ -127,15 +248,19 @@ func (c *Client) GetPresignedURL(key string, expires time.Duration) (string, err
 
 // PutObjectStreaming uploads a file from a reader to the bucket
 func (c *Client) PutObjectStreaming(key string, reader io.Reader, contentType string) error {
+	return c.PutObjectStreamingWithContext(context.Background(), key, reader, contentType)
+}
+
+// PutObjectStreamingWithContext uploads a file from a reader to the bucket.
+// It is only retried if reader is also an io.Seeker.
+func (c *Client) PutObjectStreamingWithContext(ctx context.Context, key string, reader io.Reader, contentType string) error {
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(c.Bucket),
 		Key:         aws.String(key),
 		Body:        aws.ReadSeekCloser(reader),
 		ContentType: aws.String(contentType),
 	}
-
-	_, err := c.s3Client.PutObject(input)
-	return err
+	return c.putObject(ctx, OpPutObjectStream, input, reader)
 }
 
 // GetPresignedPutURL generates a presigned URL for uploading a file
@@ -149,26 +274,70 @@ func (c *Client) GetPresignedPutURL(key, contentType string, expires time.Durati
 }
 
 // CopyObject copies an object within the bucket, allowing metadata updates
-// WARNING: When using MetadataDirective="REPLACE", ensure you preserve existing 
+// WARNING: When using MetadataDirective="REPLACE", ensure you preserve existing
 // metadata by first calling HeadObject() and merging existing metadata with your updates.
 // Otherwise, all existing metadata will be lost.
 func (c *Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
-	return c.s3Client.CopyObject(input)
+	return c.CopyObjectWithContext(context.Background(), input)
+}
+
+// CopyObjectWithContext copies an object within the bucket; see CopyObject
+func (c *Client) CopyObjectWithContext(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	var output *s3.CopyObjectOutput
+	err := c.call(ctx, OpCopyObject, func(ctx context.Context) error {
+		var err error
+		output, err = c.s3Client.CopyObjectWithContext(ctx, input)
+		return err
+	})
+	return output, err
+}
+
+// DeleteObject removes an object from the bucket
+func (c *Client) DeleteObject(key string) error {
+	return c.DeleteObjectWithContext(context.Background(), key)
+}
+
+// DeleteObjectWithContext removes an object from the bucket
+func (c *Client) DeleteObjectWithContext(ctx context.Context, key string) error {
+	return c.call(ctx, OpDeleteObject, func(ctx context.Context) error {
+		_, err := c.s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
 }
 
 // HeadObject gets metadata for an object without downloading the content
 func (c *Client) HeadObject(key string) (*s3.HeadObjectOutput, error) {
-	return c.s3Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(c.Bucket),
-		Key:    aws.String(key),
+	return c.HeadObjectWithContext(context.Background(), key)
+}
+
+// HeadObjectWithContext gets metadata for an object without downloading the content
+func (c *Client) HeadObjectWithContext(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	var output *s3.HeadObjectOutput
+	err := c.call(ctx, OpHeadObject, func(ctx context.Context) error {
+		var err error
+		output, err = c.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(c.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
 	})
+	return output, err
 }
 
 // PutObjectWithMetadata uploads a file with specified metadata and ACL
-// WARNING: This completely replaces all metadata on the object. If you want to 
-// preserve existing metadata, use UpdateObjectMetadata instead or manually merge 
+// WARNING: This completely replaces all metadata on the object. If you want to
+// preserve existing metadata, use UpdateObjectMetadata instead or manually merge
 // existing metadata before calling this method.
 func (c *Client) PutObjectWithMetadata(key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	return c.PutObjectWithMetadataWithContext(context.Background(), key, reader, contentType, metadata, acl)
+}
+
+// PutObjectWithMetadataWithContext uploads a file with specified metadata and
+// ACL; see PutObjectWithMetadata
+func (c *Client) PutObjectWithMetadataWithContext(ctx context.Context, key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(c.Bucket),
 		Key:         aws.String(key),
@@ -177,57 +346,61 @@ func (c *Client) PutObjectWithMetadata(key string, reader io.Reader, contentType
 		Metadata:    metadata,
 		ACL:         aws.String(acl),
 	}
+	return c.putObject(ctx, OpPutWithMetadata, input, reader)
+}
 
-	_, err := c.s3Client.PutObject(input)
-	return err
+// UpdateObjectMetadata updates an object's metadata; see UpdateObjectMetadataWithContext
+func (c *Client) UpdateObjectMetadata(key string, update MetadataUpdate) error {
+	return c.UpdateObjectMetadataWithContext(context.Background(), key, update)
 }
 
-// UpdateObjectMetadata updates specific metadata fields while preserving existing metadata.
-// This method fetches existing metadata, merges it with the provided updates, and re-uploads
-// the object with the combined metadata.
-func (c *Client) UpdateObjectMetadata(key string, metadataUpdates map[string]*string) error {
-	// Get current object metadata
-	headOutput, err := c.HeadObject(key)
+// UpdateObjectMetadataWithContext merges update into the object's metadata with a server-side
+// copy, so the object body is never downloaded. Content-Type and the other standard
+// headers are preserved, as is the ACL unless update.ACL is set.
+//
+// The preconditions are checked against the metadata read just before the copy,
+// and the copy is conditional on the ETag read then, so a change to the audio in
+// between still results in ErrPreconditionFailed. S3 can't make a copy
+// conditional on metadata, though: another metadata update landing between the
+// read and the copy isn't detected, and the later copy wins.
+func (c *Client) UpdateObjectMetadataWithContext(ctx context.Context, key string, update MetadataUpdate) error {
+	headOutput, err := c.HeadObjectWithContext(ctx, key)
 	if err != nil {
 		return fmt.Errorf("failed to get existing metadata: %v", err)
 	}
-
-	// Get current object content
-	getOutput, err := c.GetObject(key)
-	if err != nil {
-		return fmt.Errorf("failed to get object content: %v", err)
-	}
-	defer getOutput.Body.Close()
-
-	// Get current ACL
-	aclOutput, err := c.GetObjectACL(key)
-	if err != nil {
-		return fmt.Errorf("failed to get object ACL: %v", err)
-	}
-
-	// Merge existing metadata with updates
-	mergedMetadata := make(map[string]*string)
-	for k, v := range headOutput.Metadata {
-		mergedMetadata[k] = v
-	}
-	for k, v := range metadataUpdates {
-		mergedMetadata[k] = v
+	etag := aws.StringValue(headOutput.ETag)
+	if err := update.check(etag, aws.TimeValue(headOutput.LastModified), headOutput.Metadata); err != nil {
+		return err
 	}
 
-	// Determine current ACL setting
-	acl := "private" // default
-	for _, grant := range aclOutput.Grants {
-		if grant.Grantee.URI != nil && *grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
-			acl = "public-read"
-			break
+	acl := update.ACL
+	if acl == "" {
+		aclOutput, err := c.GetObjectACLWithContext(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to get object ACL: %v", err)
 		}
+		acl = CannedACL(aclOutput)
 	}
 
-	// Re-upload with merged metadata
-	contentType := "application/octet-stream" // default
-	if headOutput.ContentType != nil {
-		contentType = *headOutput.ContentType
+	_, err = c.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:             aws.String(c.Bucket),
+		Key:                aws.String(key),
+		CopySource:         aws.String(CopySource(c.Bucket, key)),
+		CopySourceIfMatch:  aws.String(etag),
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		Metadata:           update.apply(headOutput.Metadata),
+		ACL:                aws.String(acl),
+		ContentType:        headOutput.ContentType,
+		CacheControl:       headOutput.CacheControl,
+		ContentDisposition: headOutput.ContentDisposition,
+		ContentEncoding:    headOutput.ContentEncoding,
+		ContentLanguage:    headOutput.ContentLanguage,
+	})
+	if isPreconditionFailed(err) {
+		return ErrPreconditionFailed
 	}
-
-	return c.PutObjectWithMetadata(key, getOutput.Body, contentType, mergedMetadata, acl)
+	if err != nil {
+		return fmt.Errorf("failed to update metadata: %v", err)
+	}
+	return nil
 }
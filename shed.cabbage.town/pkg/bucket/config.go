@@ -0,0 +1,153 @@
+package bucket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEndpoint = "https://nyc3.digitaloceanspaces.com"
+	defaultRegion   = "us-east-1"
+	defaultTimeout  = 30 * time.Second
+)
+
+// Config describes where the bucket lives and how public object URLs are built.
+// It is loaded from the JSON file named by BUCKET_CONFIG_FILE (if set) and then
+// overridden field by field from BUCKET_* environment variables.
+type Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	PathStyle bool   `json:"pathStyle"`
+	// PublicBaseURL replaces the bucket URL in public links, e.g. a CDN domain.
+	// When empty, links point straight at the bucket.
+	PublicBaseURL string `json:"publicBaseURL,omitempty"`
+
+	Retry RetryPolicy `json:"retry"`
+	// Timeout bounds each attempt of a metadata request (head, list, ACL, copy).
+	// Zero means no limit.
+	Timeout Duration `json:"timeout"`
+	// Timeouts overrides Timeout per operation, keyed by operation name such as
+	// "HeadObject". Transfers (GetObject and the Put operations) have no timeout
+	// unless one is set here.
+	Timeouts map[string]Duration `json:"timeouts,omitempty"`
+}
+
+// DefaultConfig returns the configuration for the production Space
+func DefaultConfig() Config {
+	return Config{
+		Endpoint: defaultEndpoint,
+		Region:   defaultRegion,
+		Bucket:   BucketName,
+		Retry:    DefaultRetryPolicy(),
+		Timeout:  Duration(defaultTimeout),
+	}
+}
+
+// LoadConfig builds a Config from defaults, BUCKET_CONFIG_FILE and the environment:
+//
+//	BUCKET_ENDPOINT     S3 endpoint, e.g. http://localhost:9000 for MinIO
+//	BUCKET_REGION       signing region
+//	BUCKET_NAME         bucket name
+//	BUCKET_PATH_STYLE   "true" to use path-style addressing
+//	BUCKET_PUBLIC_URL   base URL for public links (CDN)
+//	BUCKET_TIMEOUT      per-attempt timeout for metadata requests, e.g. "10s"
+//	BUCKET_MAX_ATTEMPTS how many times to try a failing request
+func LoadConfig() (Config, error) {
+	config := DefaultConfig()
+
+	if path := os.Getenv("BUCKET_CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("failed to read bucket config %s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("failed to parse bucket config %s: %v", path, err)
+		}
+	}
+
+	if v := os.Getenv("BUCKET_ENDPOINT"); v != "" {
+		config.Endpoint = v
+	}
+	if v := os.Getenv("BUCKET_REGION"); v != "" {
+		config.Region = v
+	}
+	if v := os.Getenv("BUCKET_NAME"); v != "" {
+		config.Bucket = v
+	}
+	if v := os.Getenv("BUCKET_PATH_STYLE"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid BUCKET_PATH_STYLE %q: %v", v, err)
+		}
+		config.PathStyle = pathStyle
+	}
+	if v := os.Getenv("BUCKET_PUBLIC_URL"); v != "" {
+		config.PublicBaseURL = v
+	}
+
+	if v := os.Getenv("BUCKET_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid BUCKET_TIMEOUT %q: %v", v, err)
+		}
+		config.Timeout = Duration(timeout)
+	}
+	if v := os.Getenv("BUCKET_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return config, fmt.Errorf("invalid BUCKET_MAX_ATTEMPTS %q", v)
+		}
+		config.Retry.MaxAttempts = attempts
+	}
+
+	if config.Bucket == "" {
+		return config, fmt.Errorf("bucket name must not be empty")
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return config, fmt.Errorf("invalid bucket endpoint %q: %v", config.Endpoint, err)
+	}
+	return config, nil
+}
+
+// BaseURL returns the URL public objects are served from, with a trailing slash.
+// For the default config this is https://cabbagetown.nyc3.digitaloceanspaces.com/.
+func (c Config) BaseURL() string {
+	if c.PublicBaseURL != "" {
+		return strings.TrimSuffix(c.PublicBaseURL, "/") + "/"
+	}
+
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return strings.TrimSuffix(c.Endpoint, "/") + "/" + c.Bucket + "/"
+	}
+	if c.PathStyle {
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + c.Bucket + "/"
+		return endpoint.String()
+	}
+	endpoint.Host = c.Bucket + "." + endpoint.Host
+	endpoint.Path = "/"
+	return endpoint.String()
+}
+
+// PublicURL returns the public URL for key
+func (c Config) PublicURL(key string) string {
+	return c.BaseURL() + key
+}
+
+// timeout returns the per-attempt timeout for op, or zero for no limit
+func (c Config) timeout(op string) time.Duration {
+	if t, ok := c.Timeouts[op]; ok {
+		return time.Duration(t)
+	}
+	switch op {
+	case OpGetObject, OpPutObject, OpPutObjectStream, OpPutWithMetadata, OpPutMultipart:
+		return 0
+	}
+	return time.Duration(c.Timeout)
+}
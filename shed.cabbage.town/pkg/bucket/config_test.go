@@ -0,0 +1,122 @@
+package bucket
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bucket.json")
+	file := `{
+		"endpoint": "https://file.example.com",
+		"region": "file-region",
+		"bucket": "file-bucket",
+		"pathStyle": false,
+		"publicBaseURL": "https://cdn.file.example.com",
+		"timeout": "5s",
+		"retry": {"maxAttempts": 2, "baseDelay": "1s", "maxDelay": "2s"}
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BUCKET_CONFIG_FILE", path)
+	t.Setenv("BUCKET_ENDPOINT", "http://localhost:9000")
+	t.Setenv("BUCKET_REGION", "env-region")
+	t.Setenv("BUCKET_NAME", "env-bucket")
+	t.Setenv("BUCKET_PATH_STYLE", "true")
+	t.Setenv("BUCKET_PUBLIC_URL", "")
+	t.Setenv("BUCKET_TIMEOUT", "10s")
+	t.Setenv("BUCKET_MAX_ATTEMPTS", "")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Endpoint:      "http://localhost:9000",
+		Region:        "env-region",
+		Bucket:        "env-bucket",
+		PathStyle:     true,
+		PublicBaseURL: "https://cdn.file.example.com",
+		Timeout:       Duration(10 * time.Second),
+		Retry:         RetryPolicy{MaxAttempts: 2, BaseDelay: Duration(time.Second), MaxDelay: Duration(2 * time.Second)},
+	}
+	if config.Endpoint != want.Endpoint || config.Region != want.Region || config.Bucket != want.Bucket ||
+		config.PathStyle != want.PathStyle || config.PublicBaseURL != want.PublicBaseURL ||
+		config.Timeout != want.Timeout || config.Retry != want.Retry {
+		t.Errorf("LoadConfig() = %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadConfigRejectsBadEnv(t *testing.T) {
+	tests := []struct {
+		name, env, value string
+	}{
+		{"path style", "BUCKET_PATH_STYLE", "sometimes"},
+		{"timeout", "BUCKET_TIMEOUT", "ten seconds"},
+		{"max attempts", "BUCKET_MAX_ATTEMPTS", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BUCKET_CONFIG_FILE", "")
+			t.Setenv(tt.env, tt.value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("LoadConfig() with %s=%q succeeded", tt.env, tt.value)
+			}
+		})
+	}
+}
+
+func TestConfigPublicURL(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{
+			name:   "default",
+			config: DefaultConfig(),
+			want:   "https://cabbagetown.nyc3.digitaloceanspaces.com/" + key,
+		},
+		{
+			name:   "virtual hosted",
+			config: Config{Endpoint: "https://s3.example.com/", Bucket: "radio"},
+			want:   "https://radio.s3.example.com/" + key,
+		},
+		{
+			name:   "path style",
+			config: Config{Endpoint: "http://localhost:9000", Bucket: "radio", PathStyle: true},
+			want:   "http://localhost:9000/radio/" + key,
+		},
+		{
+			name:   "path style with trailing slash",
+			config: Config{Endpoint: "http://localhost:9000/", Bucket: "radio", PathStyle: true},
+			want:   "http://localhost:9000/radio/" + key,
+		},
+		{
+			name:   "path style under a path",
+			config: Config{Endpoint: "http://localhost:9000/s3/", Bucket: "radio", PathStyle: true},
+			want:   "http://localhost:9000/s3/radio/" + key,
+		},
+		{
+			name:   "CDN",
+			config: Config{Endpoint: "http://localhost:9000", Bucket: "radio", PathStyle: true, PublicBaseURL: "https://cdn.example.com"},
+			want:   "https://cdn.example.com/" + key,
+		},
+		{
+			name:   "CDN with trailing slash",
+			config: Config{Endpoint: "https://s3.example.com", Bucket: "radio", PublicBaseURL: "https://cdn.example.com/media/"},
+			want:   "https://cdn.example.com/media/" + key,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.PublicURL(key); got != tt.want {
+				t.Errorf("PublicURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
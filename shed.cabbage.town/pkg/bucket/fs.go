@@ -0,0 +1,588 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// sidecarDir holds per-object metadata and ACLs, mirroring the object tree
+const sidecarDir = ".bucket"
+
+// FSClient implements Storage on top of a local directory so shed and trellis
+// can run offline. Object bodies live at <root>/<key>; content type, user
+// metadata, ACL and ETag live in a JSON sidecar at <root>/.bucket/<key>.json.
+type FSClient struct {
+	// PublicBaseURL, if set, is used for public links instead of file:// URLs,
+	// e.g. when the directory is served by a local static file server
+	PublicBaseURL string
+
+	root   string
+	bucket string
+	mu     sync.RWMutex
+}
+
+// objectInfo is the sidecar stored next to every object
+type objectInfo struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata"`
+	ACL         string            `json:"acl"`
+	ETag        string            `json:"etag"`
+}
+
+// NewFSClient creates a filesystem-backed bucket rooted at dir
+func NewFSClient(dir string) (*FSClient, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, sidecarDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create bucket directory: %v", err)
+	}
+	return &FSClient{
+		root:   root,
+		bucket: filepath.Base(root),
+	}, nil
+}
+
+// BucketName returns the name of the local bucket (the root directory name)
+func (c *FSClient) BucketName() string {
+	return c.bucket
+}
+
+// objectPath returns where key is stored. Keys are checked once cleaned, so
+// one can't climb out of the bucket or into the sidecars with "..".
+func (c *FSClient) objectPath(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key: %q", key)
+	}
+	p := filepath.Join(c.root, filepath.FromSlash(key))
+	sidecars := filepath.Join(c.root, sidecarDir)
+	sep := string(filepath.Separator)
+	if !strings.HasPrefix(p, c.root+sep) || p == sidecars || strings.HasPrefix(p, sidecars+sep) {
+		return "", fmt.Errorf("invalid key: %q", key)
+	}
+	return p, nil
+}
+
+func (c *FSClient) sidecarPath(key string) string {
+	return filepath.Join(c.root, sidecarDir, filepath.FromSlash(key)+".json")
+}
+
+func notFound(code, key string) error {
+	return awserr.New(code, fmt.Sprintf("object %s does not exist", key), nil)
+}
+
+// readInfo loads the sidecar for key, returning defaults if none exists
+func (c *FSClient) readInfo(key string) (objectInfo, error) {
+	info := objectInfo{
+		ContentType: "application/octet-stream",
+		Metadata:    map[string]string{},
+		ACL:         "private",
+	}
+	data, err := os.ReadFile(c.sidecarPath(key))
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("failed to parse sidecar for %s: %v", key, err)
+	}
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	return info, nil
+}
+
+func (c *FSClient) writeInfo(key string, info objectInfo) error {
+	p := c.sidecarPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// stat returns the file info and sidecar for an existing object
+func (c *FSClient) stat(key, code string) (string, os.FileInfo, objectInfo, error) {
+	p, err := c.objectPath(key)
+	if err != nil {
+		return "", nil, objectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() {
+		return "", nil, objectInfo{}, notFound(code, key)
+	}
+	info, err := c.readInfo(key)
+	if err != nil {
+		return "", nil, objectInfo{}, err
+	}
+	if info.ETag == "" {
+		if info.ETag, err = fileETag(p); err != nil {
+			return "", nil, objectInfo{}, err
+		}
+	}
+	return p, fi, info, nil
+}
+
+// fileETag hashes a file that was placed in the bucket directory by hand
+func fileETag(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// write stores body under key along with its sidecar
+func (c *FSClient) write(key string, body io.Reader, info objectInfo) error {
+	p, err := c.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("failed to store object: %v", err)
+	}
+
+	info.ETag = hex.EncodeToString(hash.Sum(nil))
+	return c.writeInfo(key, info)
+}
+
+func toInfoMetadata(metadata map[string]*string) map[string]string {
+	out := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if v != nil {
+			out[http.CanonicalHeaderKey(k)] = *v
+		}
+	}
+	return out
+}
+
+func toS3Metadata(metadata map[string]string) map[string]*string {
+	out := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		out[k] = aws.String(v)
+	}
+	return out
+}
+
+func quoteETag(etag string) *string {
+	return aws.String(`"` + etag + `"`)
+}
+
+// GetObject opens an object for reading
+func (c *FSClient) GetObject(key string) (*s3.GetObjectOutput, error) {
+	return c.GetObjectWithContext(context.Background(), key)
+}
+
+// GetObjectWithContext is like GetObject but fails early if ctx is already done
+func (c *FSClient) GetObjectWithContext(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	p, fi, info, err := c.stat(key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          f,
+		ContentLength: aws.Int64(fi.Size()),
+		ContentType:   aws.String(info.ContentType),
+		ETag:          quoteETag(info.ETag),
+		LastModified:  aws.Time(fi.ModTime().UTC()),
+		Metadata:      toS3Metadata(info.Metadata),
+	}, nil
+}
+
+// PutObject stores an object, replacing any existing metadata
+func (c *FSClient) PutObject(key string, body []byte, contentType string) error {
+	return c.PutObjectWithContext(context.Background(), key, body, contentType)
+}
+
+// PutObjectWithContext is like PutObject but honours ctx
+func (c *FSClient) PutObjectWithContext(ctx context.Context, key string, body []byte, contentType string) error {
+	return c.PutObjectWithMetadataWithContext(ctx, key, bytes.NewReader(body), contentType, nil, "private")
+}
+
+// PutObjectStreaming stores an object read from reader
+func (c *FSClient) PutObjectStreaming(key string, reader io.Reader, contentType string) error {
+	return c.PutObjectStreamingWithContext(context.Background(), key, reader, contentType)
+}
+
+// PutObjectStreamingWithContext is like PutObjectStreaming but honours ctx
+func (c *FSClient) PutObjectStreamingWithContext(ctx context.Context, key string, reader io.Reader, contentType string) error {
+	return c.PutObjectWithMetadataWithContext(ctx, key, reader, contentType, nil, "private")
+}
+
+// PutObjectWithMetadata stores an object with the given metadata and canned ACL
+func (c *FSClient) PutObjectWithMetadata(key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	return c.PutObjectWithMetadataWithContext(context.Background(), key, reader, contentType, metadata, acl)
+}
+
+// PutObjectWithMetadataWithContext is like PutObjectWithMetadata but fails early if ctx is already done
+func (c *FSClient) PutObjectWithMetadataWithContext(ctx context.Context, key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if acl == "" {
+		acl = "private"
+	}
+	return c.write(key, contextReader{ctx, reader}, objectInfo{
+		ContentType: contentType,
+		Metadata:    toInfoMetadata(metadata),
+		ACL:         acl,
+	})
+}
+
+// HeadObject returns an object's metadata without its content
+func (c *FSClient) HeadObject(key string) (*s3.HeadObjectOutput, error) {
+	return c.HeadObjectWithContext(context.Background(), key)
+}
+
+// HeadObjectWithContext is like HeadObject but fails early if ctx is already done
+func (c *FSClient) HeadObjectWithContext(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, fi, info, err := c.stat(key, "NotFound")
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(fi.Size()),
+		ContentType:   aws.String(info.ContentType),
+		ETag:          quoteETag(info.ETag),
+		LastModified:  aws.Time(fi.ModTime().UTC()),
+		Metadata:      toS3Metadata(info.Metadata),
+	}, nil
+}
+
+// ListObjects lists objects with the given prefix in key order
+func (c *FSClient) ListObjects(prefix string) ([]*s3.Object, error) {
+	return c.ListObjectsWithContext(context.Background(), prefix)
+}
+
+// ListObjectsWithContext is like ListObjects but fails early if ctx is already done
+func (c *FSClient) ListObjectsWithContext(ctx context.Context, prefix string) ([]*s3.Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var objects []*s3.Object
+	err := filepath.WalkDir(c.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == sidecarDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".upload-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		info, err := c.readInfo(key)
+		if err != nil {
+			return err
+		}
+		if info.ETag == "" {
+			if info.ETag, err = fileETag(p); err != nil {
+				return err
+			}
+		}
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(fi.Size()),
+			LastModified: aws.Time(fi.ModTime().UTC()),
+			ETag:         quoteETag(info.ETag),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key < *objects[j].Key
+	})
+	return objects, nil
+}
+
+// GetObjectACL returns grants equivalent to the object's canned ACL
+func (c *FSClient) GetObjectACL(key string) (*s3.GetObjectAclOutput, error) {
+	return c.GetObjectACLWithContext(context.Background(), key)
+}
+
+// GetObjectACLWithContext is like GetObjectACL but fails early if ctx is already done
+func (c *FSClient) GetObjectACLWithContext(ctx context.Context, key string) (*s3.GetObjectAclOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, _, info, err := c.stat(key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	return aclOutput(info.ACL), nil
+}
+
+func aclOutput(acl string) *s3.GetObjectAclOutput {
+	output := &s3.GetObjectAclOutput{
+		Owner: &s3.Owner{ID: aws.String("local")},
+		Grants: []*s3.Grant{{
+			Grantee:    &s3.Grantee{ID: aws.String("local"), Type: aws.String(s3.TypeCanonicalUser)},
+			Permission: aws.String(s3.PermissionFullControl),
+		}},
+	}
+	if acl == "public-read" {
+		output.Grants = append(output.Grants, &s3.Grant{
+			Grantee:    &s3.Grantee{URI: aws.String(allUsersURI), Type: aws.String(s3.TypeGroup)},
+			Permission: aws.String(s3.PermissionRead),
+		})
+	}
+	return output
+}
+
+// PutObjectACL sets the object's canned ACL
+func (c *FSClient) PutObjectACL(key string, acl string) error {
+	return c.PutObjectACLWithContext(context.Background(), key, acl)
+}
+
+// PutObjectACLWithContext is like PutObjectACL but fails early if ctx is already done
+func (c *FSClient) PutObjectACLWithContext(ctx context.Context, key string, acl string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, _, info, err := c.stat(key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return err
+	}
+	info.ACL = acl
+	return c.writeInfo(key, info)
+}
+
+// CopyObject copies an object within the bucket, honouring MetadataDirective
+// the same way S3 does: COPY keeps the source metadata, REPLACE uses the input's.
+func (c *FSClient) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return c.CopyObjectWithContext(context.Background(), input)
+}
+
+// CopyObjectWithContext is like CopyObject but fails early if ctx is already done
+func (c *FSClient) CopyObjectWithContext(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, fmt.Errorf("invalid copy source: %v", err)
+	}
+	source = strings.TrimPrefix(source, "/")
+	sourceKey := strings.TrimPrefix(source, c.bucket+"/")
+	if sourceKey == source {
+		return nil, fmt.Errorf("copy source %s is not in bucket %s", source, c.bucket)
+	}
+
+	p, _, info, err := c.stat(sourceKey, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	if input.CopySourceIfMatch != nil && !etagsMatch(*input.CopySourceIfMatch, info.ETag) {
+		return nil, awserr.New("PreconditionFailed", "copy source ETag does not match", nil)
+	}
+
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		info.Metadata = toInfoMetadata(input.Metadata)
+		if input.ContentType != nil {
+			info.ContentType = *input.ContentType
+		}
+	}
+	info.ACL = aws.StringValue(input.ACL)
+	if info.ACL == "" {
+		info.ACL = "private"
+	}
+
+	destKey := aws.StringValue(input.Key)
+	if destKey == sourceKey {
+		// Metadata-only copy onto itself: just rewrite the sidecar
+		if err := c.writeInfo(destKey, info); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		os.Chtimes(p, now, now)
+	} else {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := c.write(destKey, f, info); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{
+			ETag:         quoteETag(info.ETag),
+			LastModified: aws.Time(time.Now().UTC()),
+		},
+	}, nil
+}
+
+// DeleteObject removes an object and its sidecar
+func (c *FSClient) DeleteObject(key string) error {
+	return c.DeleteObjectWithContext(context.Background(), key)
+}
+
+// DeleteObjectWithContext is like DeleteObject but fails early if ctx is already done
+func (c *FSClient) DeleteObjectWithContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, err := c.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	if err := os.Remove(c.sidecarPath(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete sidecar: %v", err)
+	}
+	return nil
+}
+
+// UpdateObjectMetadata merges update into the object's metadata and ACL
+func (c *FSClient) UpdateObjectMetadata(key string, update MetadataUpdate) error {
+	return c.UpdateObjectMetadataWithContext(context.Background(), key, update)
+}
+
+// UpdateObjectMetadataWithContext is like UpdateObjectMetadata but fails early if ctx is already done
+func (c *FSClient) UpdateObjectMetadataWithContext(ctx context.Context, key string, update MetadataUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, fi, info, err := c.stat(key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return err
+	}
+	if err := update.check(info.ETag, fi.ModTime(), toS3Metadata(info.Metadata)); err != nil {
+		return err
+	}
+	info.Metadata = toInfoMetadata(update.apply(toS3Metadata(info.Metadata)))
+	if update.ACL != "" {
+		info.ACL = update.ACL
+	}
+	if err := c.writeInfo(key, info); err != nil {
+		return err
+	}
+	// Like S3, a metadata change counts as a modification
+	now := time.Now()
+	return os.Chtimes(p, now, now)
+}
+
+// PublicURL returns PublicBaseURL + key, or a file:// URL if no base is set
+func (c *FSClient) PublicURL(key string) string {
+	if c.PublicBaseURL != "" {
+		return strings.TrimSuffix(c.PublicBaseURL, "/") + "/" + key
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(c.root, filepath.FromSlash(key)))}).String()
+}
+
+// GetPresignedURL returns ErrNotPresignable: browsers won't follow a file://
+// URL from a web page, so callers have to serve local objects themselves
+func (c *FSClient) GetPresignedURL(key string, expires time.Duration) (string, error) {
+	return "", ErrNotPresignable
+}
+
+// GetPresignedPutURL returns ErrNotPresignable
+func (c *FSClient) GetPresignedPutURL(key, contentType string, expires time.Duration) (string, error) {
+	return "", ErrNotPresignable
+}
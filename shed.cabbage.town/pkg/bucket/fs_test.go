@@ -0,0 +1,50 @@
+package bucket
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFSClientKeepsKeysOutOfSidecars(t *testing.T) {
+	storage, err := NewFSClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	if err := storage.PutObjectWithMetadata(key, strings.NewReader("audio"), "audio/mpeg", nil, "private"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"/recordings/ted/stream_20240101-200000.mp3",
+		"../outside.mp3",
+		"recordings/../../outside.mp3",
+		".bucket",
+		".bucket/" + key + ".json",
+		"x/../.bucket/" + key + ".json",
+		"recordings/../.bucket/../.bucket/" + key + ".json",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			if err := storage.PutObject(bad, []byte(`{"acl": "public-read"}`), "application/json"); err == nil {
+				t.Errorf("PutObject(%q) succeeded", bad)
+			}
+			if _, err := storage.GetObject(bad); err == nil {
+				t.Errorf("GetObject(%q) succeeded", bad)
+			}
+		})
+	}
+
+	acl, err := storage.GetObjectACL(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsPublic(acl) {
+		t.Errorf("%s was made public through its sidecar", key)
+	}
+
+	// Keys that stay among the objects once cleaned are fine
+	if _, err := storage.GetObject("recordings/x/../ted/stream_20240101-200000.mp3"); err != nil {
+		t.Errorf("GetObject of a key with .. inside the bucket: %v", err)
+	}
+}
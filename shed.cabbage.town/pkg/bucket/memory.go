@@ -0,0 +1,514 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Fault describes an error or delay injected into MemoryClient operations.
+// A fault matches when Op is empty or equal to the operation name, and Key is
+// empty, equal to the object key, or a prefix of it ending in "*".
+type Fault struct {
+	Op  string
+	Key string
+	Err error
+	// Latency holds the operation up before it takes effect, so one whose
+	// ctx is done meanwhile fails without changing anything
+	Latency time.Duration
+	// Times limits how often the fault fires; zero means every time
+	Times int
+
+	fired int
+}
+
+func (f *Fault) matches(op, key string) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Key == "" || f.Key == key {
+		return true
+	}
+	return strings.HasSuffix(f.Key, "*") && strings.HasPrefix(key, strings.TrimSuffix(f.Key, "*"))
+}
+
+type memObject struct {
+	body         []byte
+	contentType  string
+	metadata     map[string]string
+	acl          string
+	etag         string
+	lastModified time.Time
+}
+
+type memEntry struct {
+	current *memObject
+	// previous is served instead of current while stale reads remain,
+	// simulating a read that lands on a replica that hasn't caught up
+	previous   *memObject
+	staleReads int
+}
+
+// MemoryClient is an in-memory Storage for tests. It keeps object bodies, user
+// metadata, canned ACLs, ETags and LastModified, and can inject errors, latency
+// and eventually-consistent reads.
+type MemoryClient struct {
+	// Now supplies LastModified timestamps; defaults to time.Now
+	Now func() time.Time
+	// StaleReads is how many reads of a key keep returning the previous
+	// version after each write. Newly created keys are invisible to reads
+	// and listings for that many reads.
+	StaleReads int
+
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]*memEntry
+	faults  []*Fault
+	calls   map[string]int
+}
+
+// NewMemoryClient creates an empty in-memory bucket
+func NewMemoryClient(bucket string) *MemoryClient {
+	return &MemoryClient{
+		Now:     time.Now,
+		bucket:  bucket,
+		objects: make(map[string]*memEntry),
+		calls:   make(map[string]int),
+	}
+}
+
+// BucketName returns the name the client was created with
+func (c *MemoryClient) BucketName() string {
+	return c.bucket
+}
+
+// Inject registers a fault; faults are checked in the order they were added
+func (c *MemoryClient) Inject(f Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults, &f)
+}
+
+// ClearFaults removes all injected faults
+func (c *MemoryClient) ClearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = nil
+}
+
+// Calls returns how many times op has been called
+func (c *MemoryClient) Calls(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[op]
+}
+
+// SetLastModified overrides an object's LastModified, e.g. to age it past a cutoff
+func (c *MemoryClient) SetLastModified(key string, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.objects[key]
+	if !ok {
+		return notFound(s3.ErrCodeNoSuchKey, key)
+	}
+	entry.current.lastModified = t
+	return nil
+}
+
+// Keys returns every stored key in order, ignoring staleness and faults
+func (c *MemoryClient) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.objects))
+	for k := range c.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// enter records the call and applies any matching fault. The returned
+// latency must be slept by the caller after releasing the lock.
+func (c *MemoryClient) enter(op, key string) (time.Duration, error) {
+	c.calls[op]++
+	for _, f := range c.faults {
+		if !f.matches(op, key) {
+			continue
+		}
+		if f.Times > 0 && f.fired >= f.Times {
+			continue
+		}
+		f.fired++
+		return f.Latency, f.Err
+	}
+	return 0, nil
+}
+
+// call applies faults for op, waits out any injected latency and then runs fn
+// under the lock. Latency is cut short when ctx is done, in which case ctx's
+// error is returned and fn never runs.
+func (c *MemoryClient) call(ctx context.Context, op, key string, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	latency, err := c.enter(op, key)
+	c.mu.Unlock()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fn()
+}
+
+// read returns the version of key a reader would currently observe
+func (c *MemoryClient) read(key string) *memObject {
+	entry, ok := c.objects[key]
+	if !ok {
+		return nil
+	}
+	if entry.staleReads > 0 {
+		entry.staleReads--
+		return entry.previous
+	}
+	return entry.current
+}
+
+func (c *MemoryClient) store(key string, obj *memObject) {
+	obj.lastModified = c.Now().UTC()
+	sum := md5.Sum(obj.body)
+	obj.etag = hex.EncodeToString(sum[:])
+
+	entry, ok := c.objects[key]
+	if !ok {
+		entry = &memEntry{}
+		c.objects[key] = entry
+	}
+	entry.previous = entry.current
+	entry.current = obj
+	entry.staleReads = c.StaleReads
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	out := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		out[k] = v
+	}
+	return out
+}
+
+// GetObject returns a copy of the object's body and metadata
+func (c *MemoryClient) GetObject(key string) (*s3.GetObjectOutput, error) {
+	return c.GetObjectWithContext(context.Background(), key)
+}
+
+// GetObjectWithContext is like GetObject but honours ctx
+func (c *MemoryClient) GetObjectWithContext(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	var output *s3.GetObjectOutput
+	err := c.call(ctx, OpGetObject, key, func() error {
+		obj := c.read(key)
+		if obj == nil {
+			return notFound(s3.ErrCodeNoSuchKey, key)
+		}
+		output = &s3.GetObjectOutput{
+			Body:          io.NopCloser(bytes.NewReader(obj.body)),
+			ContentLength: aws.Int64(int64(len(obj.body))),
+			ContentType:   aws.String(obj.contentType),
+			ETag:          quoteETag(obj.etag),
+			LastModified:  aws.Time(obj.lastModified),
+			Metadata:      toS3Metadata(obj.metadata),
+		}
+		return nil
+	})
+	return output, err
+}
+
+// PutObject stores body with a private ACL and no metadata
+func (c *MemoryClient) PutObject(key string, body []byte, contentType string) error {
+	return c.PutObjectWithContext(context.Background(), key, body, contentType)
+}
+
+// PutObjectWithContext is like PutObject but honours ctx
+func (c *MemoryClient) PutObjectWithContext(ctx context.Context, key string, body []byte, contentType string) error {
+	return c.put(ctx, OpPutObject, key, bytes.NewReader(body), contentType, nil, "private")
+}
+
+// PutObjectStreaming stores the contents of reader
+func (c *MemoryClient) PutObjectStreaming(key string, reader io.Reader, contentType string) error {
+	return c.PutObjectStreamingWithContext(context.Background(), key, reader, contentType)
+}
+
+// PutObjectStreamingWithContext is like PutObjectStreaming but honours ctx
+func (c *MemoryClient) PutObjectStreamingWithContext(ctx context.Context, key string, reader io.Reader, contentType string) error {
+	return c.put(ctx, OpPutObjectStream, key, reader, contentType, nil, "private")
+}
+
+// PutObjectWithMetadata stores reader with the given metadata and canned ACL
+func (c *MemoryClient) PutObjectWithMetadata(key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	return c.PutObjectWithMetadataWithContext(context.Background(), key, reader, contentType, metadata, acl)
+}
+
+// PutObjectWithMetadataWithContext is like PutObjectWithMetadata but honours ctx
+func (c *MemoryClient) PutObjectWithMetadataWithContext(ctx context.Context, key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	return c.put(ctx, OpPutWithMetadata, key, reader, contentType, metadata, acl)
+}
+
+func (c *MemoryClient) put(ctx context.Context, op, key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error {
+	body, err := io.ReadAll(contextReader{ctx, reader})
+	if err != nil {
+		return fmt.Errorf("failed to read body: %v", err)
+	}
+	if acl == "" {
+		acl = "private"
+	}
+	return c.call(ctx, op, key, func() error {
+		c.store(key, &memObject{
+			body:        body,
+			contentType: contentType,
+			metadata:    toInfoMetadata(metadata),
+			acl:         acl,
+		})
+		return nil
+	})
+}
+
+// HeadObject returns the object's metadata
+func (c *MemoryClient) HeadObject(key string) (*s3.HeadObjectOutput, error) {
+	return c.HeadObjectWithContext(context.Background(), key)
+}
+
+// HeadObjectWithContext is like HeadObject but honours ctx
+func (c *MemoryClient) HeadObjectWithContext(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	var output *s3.HeadObjectOutput
+	err := c.call(ctx, OpHeadObject, key, func() error {
+		obj := c.read(key)
+		if obj == nil {
+			return notFound("NotFound", key)
+		}
+		output = &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(obj.body))),
+			ContentType:   aws.String(obj.contentType),
+			ETag:          quoteETag(obj.etag),
+			LastModified:  aws.Time(obj.lastModified),
+			Metadata:      toS3Metadata(obj.metadata),
+		}
+		return nil
+	})
+	return output, err
+}
+
+// ListObjects lists visible objects with the given prefix in key order
+func (c *MemoryClient) ListObjects(prefix string) ([]*s3.Object, error) {
+	return c.ListObjectsWithContext(context.Background(), prefix)
+}
+
+// ListObjectsWithContext is like ListObjects but honours ctx
+func (c *MemoryClient) ListObjectsWithContext(ctx context.Context, prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := c.call(ctx, OpListObjects, prefix, func() error {
+		for key := range c.objects {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			obj := c.read(key)
+			if obj == nil {
+				continue
+			}
+			objects = append(objects, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.body))),
+				ETag:         quoteETag(obj.etag),
+				LastModified: aws.Time(obj.lastModified),
+			})
+		}
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key < *objects[j].Key
+	})
+	return objects, err
+}
+
+// GetObjectACL returns grants equivalent to the object's canned ACL
+func (c *MemoryClient) GetObjectACL(key string) (*s3.GetObjectAclOutput, error) {
+	return c.GetObjectACLWithContext(context.Background(), key)
+}
+
+// GetObjectACLWithContext is like GetObjectACL but honours ctx
+func (c *MemoryClient) GetObjectACLWithContext(ctx context.Context, key string) (*s3.GetObjectAclOutput, error) {
+	var output *s3.GetObjectAclOutput
+	err := c.call(ctx, OpGetObjectACL, key, func() error {
+		obj := c.read(key)
+		if obj == nil {
+			return notFound(s3.ErrCodeNoSuchKey, key)
+		}
+		output = aclOutput(obj.acl)
+		return nil
+	})
+	return output, err
+}
+
+// PutObjectACL sets the object's canned ACL
+func (c *MemoryClient) PutObjectACL(key string, acl string) error {
+	return c.PutObjectACLWithContext(context.Background(), key, acl)
+}
+
+// PutObjectACLWithContext is like PutObjectACL but honours ctx
+func (c *MemoryClient) PutObjectACLWithContext(ctx context.Context, key string, acl string) error {
+	return c.call(ctx, OpPutObjectACL, key, func() error {
+		entry, ok := c.objects[key]
+		if !ok {
+			return notFound(s3.ErrCodeNoSuchKey, key)
+		}
+		// ACL changes don't create a new version of the object
+		entry.current.acl = acl
+		return nil
+	})
+}
+
+// CopyObject copies an object within the bucket, honouring MetadataDirective
+func (c *MemoryClient) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return c.CopyObjectWithContext(context.Background(), input)
+}
+
+// CopyObjectWithContext is like CopyObject but honours ctx
+func (c *MemoryClient) CopyObjectWithContext(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	var output *s3.CopyObjectOutput
+	key := aws.StringValue(input.Key)
+	err := c.call(ctx, OpCopyObject, key, func() error {
+		source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+		if err != nil {
+			return fmt.Errorf("invalid copy source: %v", err)
+		}
+		source = strings.TrimPrefix(source, "/")
+		sourceKey := strings.TrimPrefix(source, c.bucket+"/")
+		if sourceKey == source {
+			return fmt.Errorf("copy source %s is not in bucket %s", source, c.bucket)
+		}
+		entry, ok := c.objects[sourceKey]
+		if !ok {
+			return notFound(s3.ErrCodeNoSuchKey, sourceKey)
+		}
+
+		src := entry.current
+		if input.CopySourceIfMatch != nil && !etagsMatch(*input.CopySourceIfMatch, src.etag) {
+			return awserr.New("PreconditionFailed", "copy source ETag does not match", nil)
+		}
+		obj := &memObject{
+			body:        src.body,
+			contentType: src.contentType,
+			metadata:    copyMetadata(src.metadata),
+			acl:         aws.StringValue(input.ACL),
+		}
+		if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+			obj.metadata = toInfoMetadata(input.Metadata)
+			if input.ContentType != nil {
+				obj.contentType = *input.ContentType
+			}
+		}
+		if obj.acl == "" {
+			obj.acl = "private"
+		}
+		c.store(key, obj)
+
+		output = &s3.CopyObjectOutput{
+			CopyObjectResult: &s3.CopyObjectResult{
+				ETag:         quoteETag(obj.etag),
+				LastModified: aws.Time(obj.lastModified),
+			},
+		}
+		return nil
+	})
+	return output, err
+}
+
+// DeleteObject removes an object
+func (c *MemoryClient) DeleteObject(key string) error {
+	return c.DeleteObjectWithContext(context.Background(), key)
+}
+
+// DeleteObjectWithContext is like DeleteObject but honours ctx
+func (c *MemoryClient) DeleteObjectWithContext(ctx context.Context, key string) error {
+	return c.call(ctx, OpDeleteObject, key, func() error {
+		delete(c.objects, key)
+		return nil
+	})
+}
+
+// UpdateObjectMetadata merges update into the object's metadata and ACL
+func (c *MemoryClient) UpdateObjectMetadata(key string, update MetadataUpdate) error {
+	return c.UpdateObjectMetadataWithContext(context.Background(), key, update)
+}
+
+// UpdateObjectMetadataWithContext is like UpdateObjectMetadata but honours ctx
+func (c *MemoryClient) UpdateObjectMetadataWithContext(ctx context.Context, key string, update MetadataUpdate) error {
+	return c.call(ctx, OpUpdateMetadata, key, func() error {
+		entry, ok := c.objects[key]
+		if !ok {
+			return notFound(s3.ErrCodeNoSuchKey, key)
+		}
+		src := entry.current
+		if err := update.check(src.etag, src.lastModified, toS3Metadata(src.metadata)); err != nil {
+			return err
+		}
+		obj := &memObject{
+			body:        src.body,
+			contentType: src.contentType,
+			metadata:    toInfoMetadata(update.apply(toS3Metadata(src.metadata))),
+			acl:         src.acl,
+		}
+		if update.ACL != "" {
+			obj.acl = update.ACL
+		}
+		c.store(key, obj)
+		return nil
+	})
+}
+
+// PublicURL returns a fake public URL for key
+func (c *MemoryClient) PublicURL(key string) string {
+	return fmt.Sprintf("https://%s.memory.invalid/%s", c.bucket, key)
+}
+
+// GetPresignedURL returns a fake signed URL
+func (c *MemoryClient) GetPresignedURL(key string, expires time.Duration) (string, error) {
+	var u string
+	err := c.call(context.Background(), OpGetPresignedURL, key, func() error {
+		u = fmt.Sprintf("https://%s.memory.invalid/%s?expires=%d", c.bucket, key, int(expires.Seconds()))
+		return nil
+	})
+	return u, err
+}
+
+// GetPresignedPutURL returns a fake signed upload URL
+func (c *MemoryClient) GetPresignedPutURL(key, contentType string, expires time.Duration) (string, error) {
+	var u string
+	err := c.call(context.Background(), OpGetPresignedPut, key, func() error {
+		u = fmt.Sprintf("https://%s.memory.invalid/%s?expires=%d&content-type=%s",
+			c.bucket, key, int(expires.Seconds()), url.QueryEscape(contentType))
+		return nil
+	})
+	return u, err
+}
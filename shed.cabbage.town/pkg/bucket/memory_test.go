@@ -0,0 +1,31 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryClientLatencyHoldsUpWrites(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	storage := NewMemoryClient("test")
+	storage.Inject(Fault{Op: OpPutObject, Key: key, Latency: time.Second, Times: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := storage.PutObjectWithContext(ctx, key, []byte("audio"), "audio/mpeg")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PutObjectWithContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := storage.HeadObject(key); err == nil {
+		t.Fatal("put cut short by its ctx was still written")
+	}
+
+	if err := storage.PutObjectWithContext(context.Background(), key, []byte("audio"), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.HeadObject(key); err != nil {
+		t.Fatalf("HeadObject() after retry: %v", err)
+	}
+}
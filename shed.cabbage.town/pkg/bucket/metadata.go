@@ -0,0 +1,114 @@
+package bucket
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrPreconditionFailed is returned when a conditional update finds that the
+// object has changed since its ETag was read
+var ErrPreconditionFailed = errors.New("object was modified concurrently")
+
+// MetaRevision is the metadata key counting an object's metadata updates.
+// A metadata-only copy keeps the object's ETag, so UpdateObjectMetadata bumps
+// this instead, giving IfRevision something that changes on every edit.
+const MetaRevision = "Metadata-Revision"
+
+// Revision returns the metadata revision recorded in metadata, or "0" for an
+// object whose metadata has never been updated
+func Revision(metadata map[string]*string) string {
+	for k, v := range metadata {
+		if http.CanonicalHeaderKey(k) == MetaRevision && v != nil {
+			return *v
+		}
+	}
+	return "0"
+}
+
+// nextRevision returns the revision after the one in metadata
+func nextRevision(metadata map[string]*string) string {
+	n, err := strconv.Atoi(Revision(metadata))
+	if err != nil {
+		n = 0
+	}
+	return strconv.Itoa(n + 1)
+}
+
+// MetadataUpdate describes a change to an object's user metadata
+type MetadataUpdate struct {
+	// Set is merged into the existing metadata; a nil value removes the key
+	Set map[string]*string
+	// ACL replaces the object's canned ACL; empty keeps the current one
+	ACL string
+	// IfMatch, if set, makes the update fail with ErrPreconditionFailed
+	// unless it matches the object's current ETag. ETags only change when
+	// the content does; use IfRevision to also catch metadata edits.
+	IfMatch string
+	// IfRevision, if set, makes the update fail with ErrPreconditionFailed
+	// unless it matches the object's current Revision
+	IfRevision string
+	// IfUnmodifiedSince, if set, makes the update fail with
+	// ErrPreconditionFailed if the object changed after this time
+	IfUnmodifiedSince time.Time
+}
+
+// check returns ErrPreconditionFailed if the object's current state doesn't
+// satisfy the update's preconditions
+func (u MetadataUpdate) check(etag string, lastModified time.Time, metadata map[string]*string) error {
+	if u.IfMatch != "" && !etagsMatch(u.IfMatch, etag) {
+		return ErrPreconditionFailed
+	}
+	if u.IfRevision != "" && u.IfRevision != Revision(metadata) {
+		return ErrPreconditionFailed
+	}
+	if !u.IfUnmodifiedSince.IsZero() && lastModified.Truncate(time.Second).After(u.IfUnmodifiedSince) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// apply returns existing merged with the update, with keys in canonical form
+// and the revision bumped
+func (u MetadataUpdate) apply(existing map[string]*string) map[string]*string {
+	merged := make(map[string]*string, len(existing)+len(u.Set))
+	for k, v := range existing {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range u.Set {
+		if v == nil {
+			delete(merged, http.CanonicalHeaderKey(k))
+			continue
+		}
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	merged[MetaRevision] = aws.String(nextRevision(existing))
+	return merged
+}
+
+// etagsMatch compares two ETags, ignoring the quotes S3 wraps them in
+func etagsMatch(a, b string) bool {
+	return strings.Trim(a, `"`) == strings.Trim(b, `"`)
+}
+
+// CopySource builds the URL-encoded CopySource for an object in bucket
+func CopySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+func isPreconditionFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "PreconditionFailed"
+}
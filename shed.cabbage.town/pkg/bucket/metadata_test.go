@@ -0,0 +1,79 @@
+package bucket
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestUpdateObjectMetadataRevision(t *testing.T) {
+	fs, err := NewFSClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]Storage{
+		"memory": NewMemoryClient("test"),
+		"fs":     fs,
+	}
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			const key = "recordings/ted/stream_20240101-200000.mp3"
+			if err := storage.PutObject(key, []byte("audio"), "audio/mpeg"); err != nil {
+				t.Fatal(err)
+			}
+			revision := func() string {
+				head, err := storage.HeadObject(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return Revision(head.Metadata)
+			}
+			if got := revision(); got != "0" {
+				t.Fatalf("new object's revision = %q, want 0", got)
+			}
+
+			set := map[string]*string{"Display-Name": aws.String("Soup Night")}
+			if err := storage.UpdateObjectMetadata(key, MetadataUpdate{Set: set, IfRevision: "0"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := revision(); got != "1" {
+				t.Fatalf("revision after update = %q, want 1", got)
+			}
+
+			// An edit based on the metadata from before the first one fails,
+			// though the content and so the ETag are unchanged
+			err := storage.UpdateObjectMetadata(key, MetadataUpdate{Set: set, IfRevision: "0"})
+			if err != ErrPreconditionFailed {
+				t.Fatalf("stale update returned %v, want ErrPreconditionFailed", err)
+			}
+			if err := storage.UpdateObjectMetadata(key, MetadataUpdate{Set: set, IfRevision: "1"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := revision(); got != "2" {
+				t.Errorf("revision after second update = %q, want 2", got)
+			}
+		})
+	}
+}
+
+func TestUpdateObjectMetadataIfMatch(t *testing.T) {
+	storage := NewMemoryClient("test")
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	if err := storage.PutObject(key, []byte("audio"), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := storage.HeadObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := aws.StringValue(head.ETag)
+
+	if err := storage.PutObjectStreaming(key, bytes.NewReader([]byte("trimmed")), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+	err = storage.UpdateObjectMetadata(key, MetadataUpdate{Set: map[string]*string{"A": aws.String("b")}, IfMatch: loaded})
+	if err != ErrPreconditionFailed {
+		t.Errorf("update after new audio returned %v, want ErrPreconditionFailed", err)
+	}
+}
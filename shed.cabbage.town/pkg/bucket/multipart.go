@@ -0,0 +1,423 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// MinPartSize is the smallest part S3 accepts (except for the last part)
+	MinPartSize     = 5 * 1024 * 1024
+	maxUploadParts  = 10000
+	defaultPartSize = 16 * 1024 * 1024
+)
+
+// UploadOptions controls multipart uploads. Zero values pick sensible defaults.
+type UploadOptions struct {
+	// PartSize is the size of each part in bytes (default 16MB, minimum 5MB)
+	PartSize int64
+	// Concurrency is how many parts are uploaded in parallel (default 4)
+	Concurrency int
+	// MaxRetries is how many times a failed part is retried (default 3); the
+	// delay between retries follows the client's retry policy
+	MaxRetries int
+	// LeavePartsOnError keeps a failed upload's parts so it can be resumed
+	// with ResumeUpload; by default the upload is aborted and parts deleted
+	LeavePartsOnError bool
+
+	Metadata map[string]*string
+	ACL      string
+}
+
+func (o UploadOptions) withDefaults() UploadOptions {
+	if o.PartSize == 0 {
+		o.PartSize = defaultPartSize
+	}
+	if o.PartSize < MinPartSize {
+		o.PartSize = MinPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	} else if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.ACL == "" {
+		o.ACL = "private"
+	}
+	return o
+}
+
+// PartSizeFor returns a part size large enough to upload size bytes within
+// S3's part limit, never smaller than partSize (0 means the default part size)
+func PartSizeFor(size, partSize int64) int64 {
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	if min := (size + maxUploadParts - 1) / maxUploadParts; min > partSize {
+		return min
+	}
+	return partSize
+}
+
+// IncompleteUpload is a multipart upload that was started but never completed
+type IncompleteUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// Uploads is implemented by backends whose multipart uploads can be left
+// incomplete, so they can be listed and then resumed or aborted. Only Client
+// implements it; the others store bodies in one piece.
+type Uploads interface {
+	ListIncompleteUploadsWithContext(ctx context.Context, prefix string) ([]IncompleteUpload, error)
+	ResumeUploadWithContext(ctx context.Context, upload IncompleteUpload, source io.ReaderAt, size int64, opts UploadOptions) error
+	AbortUploadWithContext(ctx context.Context, upload IncompleteUpload) error
+}
+
+var _ Uploads = (*Client)(nil)
+
+// partUploader uploads the parts of one multipart upload
+type partUploader struct {
+	client   *Client
+	key      string
+	uploadID string
+	opts     UploadOptions
+
+	mu    sync.Mutex
+	parts []*s3.CompletedPart
+	err   error
+}
+
+func (u *partUploader) setErr(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *partUploader) failed() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err != nil
+}
+
+// upload sends one part, retrying it on its own if it fails
+func (u *partUploader) upload(ctx context.Context, number int64, body []byte) {
+	policy := u.client.config.Retry
+	policy.MaxAttempts = u.opts.MaxRetries + 1
+	var output *s3.UploadPartOutput
+	err := policy.do(ctx, fmt.Sprintf("UploadPart %d of %s", number, u.key), u.client.config.timeout(OpPutMultipart), func(ctx context.Context) error {
+		var err error
+		output, err = u.client.s3Client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(u.client.Bucket),
+			Key:        aws.String(u.key),
+			UploadId:   aws.String(u.uploadID),
+			PartNumber: aws.Int64(number),
+			Body:       bytes.NewReader(body),
+		})
+		return err
+	})
+	if err != nil {
+		u.setErr(fmt.Errorf("failed to upload part %d: %v", number, err))
+		return
+	}
+	u.mu.Lock()
+	u.parts = append(u.parts, &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(number)})
+	u.mu.Unlock()
+}
+
+// run reads parts with next and uploads them with bounded concurrency.
+// next returns the part number and body, or io.EOF when there are no more parts.
+func (u *partUploader) run(ctx context.Context, next func() (int64, []byte, error)) error {
+	sem := make(chan struct{}, u.opts.Concurrency)
+	var wg sync.WaitGroup
+	for !u.failed() {
+		if err := ctx.Err(); err != nil {
+			u.setErr(err)
+			break
+		}
+		number, body, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			u.setErr(err)
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			u.upload(ctx, number, body)
+		}()
+	}
+	wg.Wait()
+	return u.err
+}
+
+// complete finishes the upload, or aborts it after a failure unless the
+// caller asked to keep the parts for resuming
+func (u *partUploader) complete(ctx context.Context, runErr error) error {
+	if runErr != nil {
+		if u.opts.LeavePartsOnError {
+			return fmt.Errorf("multipart upload %s of %s failed (parts kept for resume): %v", u.uploadID, u.key, runErr)
+		}
+		// Abort even if ctx is done so the parts don't linger in the bucket
+		if err := u.client.AbortUpload(IncompleteUpload{Key: u.key, UploadID: u.uploadID}); err != nil {
+			log.Printf("[BUCKET] WARNING: Failed to abort upload %s of %s: %v", u.uploadID, u.key, err)
+		}
+		return fmt.Errorf("multipart upload of %s failed: %v", u.key, runErr)
+	}
+
+	sort.Slice(u.parts, func(i, j int) bool {
+		return *u.parts[i].PartNumber < *u.parts[j].PartNumber
+	})
+	err := u.client.call(ctx, OpPutMultipart, func(ctx context.Context) error {
+		_, err := u.client.s3Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(u.client.Bucket),
+			Key:             aws.String(u.key),
+			UploadId:        aws.String(u.uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: u.parts},
+		})
+		return err
+	})
+	if err != nil {
+		return u.complete(ctx, fmt.Errorf("failed to complete upload: %v", err))
+	}
+	return nil
+}
+
+// PutObjectMultipart uploads reader in parts, uploading up to opts.Concurrency
+// parts at once and retrying each part independently. Bodies smaller than one
+// part are sent with a single PutObject.
+func (c *Client) PutObjectMultipart(key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	return c.PutObjectMultipartWithContext(context.Background(), key, reader, contentType, opts)
+}
+
+// PutObjectMultipartWithContext uploads reader in parts; see PutObjectMultipart.
+// When ctx is done no further parts are started and the upload fails.
+func (c *Client) PutObjectMultipartWithContext(ctx context.Context, key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	opts = opts.withDefaults()
+
+	// Read the first part before starting an upload so small files stay simple
+	first := make([]byte, opts.PartSize)
+	n, err := io.ReadFull(reader, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return c.PutObjectWithMetadataWithContext(ctx, key, bytes.NewReader(first[:n]), contentType, opts.Metadata, opts.ACL)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload body: %v", err)
+	}
+
+	var created *s3.CreateMultipartUploadOutput
+	err = c.call(ctx, OpPutMultipart, func(ctx context.Context) error {
+		var err error
+		created, err = c.s3Client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(c.Bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+			Metadata:    opts.Metadata,
+			ACL:         aws.String(opts.ACL),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %v", err)
+	}
+
+	u := &partUploader{client: c, key: key, uploadID: *created.UploadId, opts: opts}
+	number := int64(0)
+	pending := first
+	done := false
+	runErr := u.run(ctx, func() (int64, []byte, error) {
+		if pending != nil {
+			body := pending
+			pending = nil
+			number++
+			return number, body, nil
+		}
+		if done {
+			return 0, nil, io.EOF
+		}
+		if number >= maxUploadParts {
+			return 0, nil, fmt.Errorf("upload exceeds %d parts of %d bytes", maxUploadParts, opts.PartSize)
+		}
+		body := make([]byte, opts.PartSize)
+		n, err := io.ReadFull(reader, body)
+		switch {
+		case err == io.EOF:
+			return 0, nil, io.EOF
+		case err == io.ErrUnexpectedEOF:
+			done = true
+		case err != nil:
+			return 0, nil, fmt.Errorf("failed to read upload body: %v", err)
+		}
+		number++
+		return number, body[:n], nil
+	})
+	return u.complete(ctx, runErr)
+}
+
+// ListIncompleteUploads lists multipart uploads under prefix that were never
+// completed or aborted
+func (c *Client) ListIncompleteUploads(prefix string) ([]IncompleteUpload, error) {
+	return c.ListIncompleteUploadsWithContext(context.Background(), prefix)
+}
+
+// ListIncompleteUploadsWithContext lists incomplete multipart uploads under prefix
+func (c *Client) ListIncompleteUploadsWithContext(ctx context.Context, prefix string) ([]IncompleteUpload, error) {
+	var uploads []IncompleteUpload
+	err := c.call(ctx, OpListObjects, func(ctx context.Context) error {
+		uploads = nil
+		return c.s3Client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+			Bucket: aws.String(c.Bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				uploads = append(uploads, IncompleteUpload{
+					Key:       aws.StringValue(upload.Key),
+					UploadID:  aws.StringValue(upload.UploadId),
+					Initiated: aws.TimeValue(upload.Initiated),
+				})
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list incomplete uploads: %v", err)
+	}
+	return uploads, nil
+}
+
+// ResumeUpload finishes an incomplete upload from source, which should hold
+// the same bytes that were originally being uploaded. Stored parts whose MD5
+// matches source are kept and the rest uploaded again; the part size is taken
+// from the first stored part when there is one.
+func (c *Client) ResumeUpload(upload IncompleteUpload, source io.ReaderAt, size int64, opts UploadOptions) error {
+	return c.ResumeUploadWithContext(context.Background(), upload, source, size, opts)
+}
+
+// ResumeUploadWithContext finishes an incomplete upload; see ResumeUpload
+func (c *Client) ResumeUploadWithContext(ctx context.Context, upload IncompleteUpload, source io.ReaderAt, size int64, opts UploadOptions) error {
+	opts = opts.withDefaults()
+
+	var existing map[int64]*s3.Part
+	err := c.call(ctx, OpListObjects, func(ctx context.Context) error {
+		existing = make(map[int64]*s3.Part)
+		return c.s3Client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+			Bucket:   aws.String(c.Bucket),
+			Key:      aws.String(upload.Key),
+			UploadId: aws.String(upload.UploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				existing[aws.Int64Value(part.PartNumber)] = part
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list parts of %s: %v", upload.Key, err)
+	}
+	if first, ok := existing[1]; ok && aws.Int64Value(first.Size) > 0 {
+		opts.PartSize = aws.Int64Value(first.Size)
+	}
+
+	totalParts := (size + opts.PartSize - 1) / opts.PartSize
+	log.Printf("[BUCKET] Resuming upload of %s: %d of %d parts already uploaded", upload.Key, len(existing), totalParts)
+
+	u := &partUploader{client: c, key: upload.Key, uploadID: upload.UploadID, opts: opts}
+	number := int64(0)
+	runErr := u.run(ctx, func() (int64, []byte, error) {
+		for {
+			number++
+			if number > totalParts {
+				return 0, nil, io.EOF
+			}
+			offset := (number - 1) * opts.PartSize
+			length := opts.PartSize
+			if offset+length > size {
+				length = size - offset
+			}
+			body := make([]byte, length)
+			if _, err := source.ReadAt(body, offset); err != nil && !errors.Is(err, io.EOF) {
+				return 0, nil, fmt.Errorf("failed to read part %d: %v", number, err)
+			}
+			// A part's ETag is its MD5, so a stored part from a different
+			// file isn't mistaken for this one
+			if part, ok := existing[number]; ok && aws.Int64Value(part.Size) == length && partMatches(part, body) {
+				u.mu.Lock()
+				u.parts = append(u.parts, &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(number)})
+				u.mu.Unlock()
+				continue
+			}
+			return number, body, nil
+		}
+	})
+	return u.complete(ctx, runErr)
+}
+
+// partMatches reports whether a stored part holds body
+func partMatches(part *s3.Part, body []byte) bool {
+	sum := md5.Sum(body)
+	return etagsMatch(aws.StringValue(part.ETag), hex.EncodeToString(sum[:]))
+}
+
+// AbortUpload aborts an incomplete upload and deletes its parts
+func (c *Client) AbortUpload(upload IncompleteUpload) error {
+	return c.AbortUploadWithContext(context.Background(), upload)
+}
+
+// AbortUploadWithContext aborts an incomplete upload and deletes its parts
+func (c *Client) AbortUploadWithContext(ctx context.Context, upload IncompleteUpload) error {
+	return c.call(ctx, OpPutMultipart, func(ctx context.Context) error {
+		_, err := c.s3Client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.Bucket),
+			Key:      aws.String(upload.Key),
+			UploadId: aws.String(upload.UploadID),
+		})
+		return err
+	})
+}
+
+// PutObjectMultipart stores reader in one piece; local files need no parts
+func (c *FSClient) PutObjectMultipart(key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	return c.PutObjectMultipartWithContext(context.Background(), key, reader, contentType, opts)
+}
+
+// PutObjectMultipartWithContext stores reader in one piece
+func (c *FSClient) PutObjectMultipartWithContext(ctx context.Context, key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	opts = opts.withDefaults()
+	return c.PutObjectWithMetadataWithContext(ctx, key, reader, contentType, opts.Metadata, opts.ACL)
+}
+
+// PutObjectMultipart stores reader in one piece, applying faults for PutObjectMultipart
+func (c *MemoryClient) PutObjectMultipart(key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	return c.PutObjectMultipartWithContext(context.Background(), key, reader, contentType, opts)
+}
+
+// PutObjectMultipartWithContext stores reader in one piece
+func (c *MemoryClient) PutObjectMultipartWithContext(ctx context.Context, key string, reader io.Reader, contentType string, opts UploadOptions) error {
+	opts = opts.withDefaults()
+	return c.put(ctx, OpPutMultipart, key, reader, contentType, opts.Metadata, opts.ACL)
+}
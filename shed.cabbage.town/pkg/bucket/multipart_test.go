@@ -0,0 +1,314 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testBucket = "test-bucket"
+
+// fakeS3 is just enough of a path-style S3 API for multipart uploads
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// uploads maps upload IDs to their stored parts by number
+	uploads map[string]map[int64][]byte
+	// partCalls counts UploadPart requests by part number
+	partCalls map[int64]int
+	aborted   []string
+	// failPart makes every upload of that part number fail with a 500
+	failPart int64
+	nextID   int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Client) {
+	t.Helper()
+	fake := &fakeS3{
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]map[int64][]byte),
+		partCalls: make(map[int64]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("DO_ACCESS_KEY_ID", "test")
+	t.Setenv("DO_SECRET_ACCESS_KEY", "test")
+	client, err := NewClientWithConfig(Config{
+		Endpoint:  server.URL,
+		Region:    defaultRegion,
+		Bucket:    testBucket,
+		PathStyle: true,
+		Retry:     RetryPolicy{MaxAttempts: 1, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, client
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = make(map[int64][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: testBucket, Key: key, UploadId: id})
+
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.ParseInt(query.Get("partNumber"), 10, 64)
+		f.partCalls[number]++
+		if number == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeXML(w, s3Error{Code: "InternalError", Message: "part failed"})
+			return
+		}
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeXML(w, s3Error{Code: "NoSuchUpload"})
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", md5ETag(body))
+
+	case r.Method == http.MethodGet && uploadID != "":
+		type part struct {
+			PartNumber int64
+			ETag       string
+			Size       int64
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			Bucket      string
+			Key         string
+			UploadId    string
+			IsTruncated bool
+			Parts       []part `xml:"Part"`
+		}{Bucket: testBucket, Key: key, UploadId: uploadID}
+		for number, data := range f.uploads[uploadID] {
+			result.Parts = append(result.Parts, part{number, md5ETag(data), int64(len(data))})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		writeXML(w, result)
+
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int64
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeXML(w, s3Error{Code: "MalformedXML", Message: err.Error()})
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			data, ok := f.uploads[uploadID][part.PartNumber]
+			if !ok || !etagsMatch(part.ETag, md5ETag(data)) {
+				w.WriteHeader(http.StatusBadRequest)
+				writeXML(w, s3Error{Code: "InvalidPart"})
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: key, ETag: `"multipart"`})
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		f.aborted = append(f.aborted, uploadID)
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		w.Header().Set("ETag", md5ETag(body))
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		writeXML(w, s3Error{Code: "NotImplemented", Message: r.Method + " " + r.URL.String()})
+	}
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// testBody returns size bytes that differ from part to part
+func testBody(size int) []byte {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i / 1024)
+	}
+	return body
+}
+
+func TestPutObjectMultipart(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	tests := []struct {
+		name      string
+		size      int
+		failPart  int64
+		leave     bool
+		wantErr   bool
+		wantParts map[int64]int
+		wantAbort bool
+	}{
+		{name: "small body", size: 1000, wantParts: map[int64]int{}},
+		{name: "three parts", size: 2*MinPartSize + 1000, wantParts: map[int64]int{1: 1, 2: 1, 3: 1}},
+		{name: "exact parts", size: 2 * MinPartSize, wantParts: map[int64]int{1: 1, 2: 1}},
+		{name: "failing part aborts", size: 2*MinPartSize + 1000, failPart: 2, wantErr: true, wantAbort: true},
+		{name: "failing part left for resume", size: 2*MinPartSize + 1000, failPart: 2, leave: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeS3(t)
+			fake.failPart = tt.failPart
+			body := testBody(tt.size)
+
+			err := client.PutObjectMultipartWithContext(context.Background(), key, bytes.NewReader(body), "audio/mpeg", UploadOptions{
+				PartSize:          MinPartSize,
+				MaxRetries:        1,
+				LeavePartsOnError: tt.leave,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PutObjectMultipartWithContext() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if _, ok := fake.objects[key]; ok {
+					t.Error("failed upload was stored")
+				}
+				if got := fake.partCalls[tt.failPart]; got != 2 {
+					t.Errorf("failing part was tried %d times, want 2", got)
+				}
+				if got := len(fake.aborted) == 1; got != tt.wantAbort {
+					t.Errorf("aborted = %v, want abort %v", fake.aborted, tt.wantAbort)
+				}
+				if got := len(fake.uploads) == 1; got != tt.leave {
+					t.Errorf("%d uploads left, want parts kept %v", len(fake.uploads), tt.leave)
+				}
+				return
+			}
+			if !bytes.Equal(fake.objects[key], body) {
+				t.Errorf("stored %d bytes, want the %d uploaded", len(fake.objects[key]), len(body))
+			}
+			if len(fake.partCalls) != len(tt.wantParts) {
+				t.Errorf("part uploads = %v, want %v", fake.partCalls, tt.wantParts)
+			}
+			for number, want := range tt.wantParts {
+				if got := fake.partCalls[number]; got != want {
+					t.Errorf("part %d uploaded %d times, want %d", number, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	fake, client := newFakeS3(t)
+	body := testBody(2*MinPartSize + 1000)
+
+	// Part 1 made it up intact; part 2 is the right size but holds another
+	// file's bytes, and part 3 never arrived
+	stale := bytes.Repeat([]byte{0xff}, MinPartSize)
+	fake.uploads["upload-stale"] = map[int64][]byte{
+		1: body[:MinPartSize],
+		2: stale,
+	}
+	upload := IncompleteUpload{Key: key, UploadID: "upload-stale"}
+
+	if err := client.ResumeUploadWithContext(context.Background(), upload, bytes.NewReader(body), int64(len(body)), UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects[key], body) {
+		t.Errorf("stored %d bytes, want the %d uploaded", len(fake.objects[key]), len(body))
+	}
+	want := map[int64]int{2: 1, 3: 1}
+	if len(fake.partCalls) != len(want) || fake.partCalls[2] != 1 || fake.partCalls[3] != 1 {
+		t.Errorf("part uploads = %v, want %v", fake.partCalls, want)
+	}
+}
+
+func TestPartMatches(t *testing.T) {
+	body := []byte("audio")
+	tests := []struct {
+		name string
+		etag string
+		want bool
+	}{
+		{"quoted", md5ETag(body), true},
+		{"unquoted", strings.Trim(md5ETag(body), `"`), true},
+		{"other body", md5ETag([]byte("other")), false},
+		{"multipart", `"` + strings.Trim(md5ETag(body), `"`) + `-2"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etag := tt.etag
+			if got := partMatches(&s3.Part{ETag: &etag}, body); got != tt.want {
+				t.Errorf("partMatches(%s) = %v, want %v", tt.etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.uploads["upload-abandoned"] = map[int64][]byte{1: []byte("audio")}
+
+	upload := IncompleteUpload{Key: "recordings/ted/stream_20240101-200000.mp3", UploadID: "upload-abandoned"}
+	if err := client.AbortUploadWithContext(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.uploads["upload-abandoned"]; ok {
+		t.Error("aborted upload still has its parts")
+	}
+}
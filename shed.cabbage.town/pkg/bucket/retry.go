@@ -0,0 +1,145 @@
+package bucket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Duration is a time.Duration that reads from and writes to JSON as a string like "30s"
+type Duration time.Duration
+
+// UnmarshalJSON parses a Go duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RetryPolicy controls how failed bucket requests are retried. The delay before
+// retry n is a random duration up to BaseDelay*2^(n-1), capped at MaxDelay.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first
+	MaxAttempts int      `json:"maxAttempts"`
+	BaseDelay   Duration `json:"baseDelay"`
+	MaxDelay    Duration `json:"maxDelay"`
+}
+
+// DefaultRetryPolicy tries each request up to four times over a few seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   Duration(200 * time.Millisecond),
+		MaxDelay:    Duration(5 * time.Second),
+	}
+}
+
+// backoff returns the jittered delay to wait after the given failed attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	base := time.Duration(p.BaseDelay)
+	if base <= 0 {
+		base = time.Duration(DefaultRetryPolicy().BaseDelay)
+	}
+	limit := time.Duration(p.MaxDelay)
+	if limit <= 0 {
+		limit = time.Duration(DefaultRetryPolicy().MaxDelay)
+	}
+
+	delay := base
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// do runs fn until it succeeds, fails with an error that isn't retryable, runs
+// out of attempts or ctx is done. Each attempt gets its own timeout when
+// timeout is non-zero; an attempt that times out is retried.
+func (p RetryPolicy) do(ctx context.Context, op string, timeout time.Duration, fn func(context.Context) error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := fn(attemptCtx)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if err == nil || ctx.Err() != nil || attempt >= attempts {
+			return err
+		}
+		if !timedOut && !IsRetryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		log.Printf("[BUCKET] %s failed (attempt %d/%d), retrying in %v: %v", op, attempt, attempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying:
+// throttling, server errors, request timeouts and dropped connections.
+// Client errors such as NoSuchKey or AccessDenied and cancelled contexts are not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case request.CanceledErrorCode:
+			return false
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "Throttling", "TooManyRequests":
+			return true
+		}
+	}
+
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) {
+		status := rerr.StatusCode()
+		if status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+			return true
+		}
+		if status >= http.StatusBadRequest {
+			return false
+		}
+	}
+
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
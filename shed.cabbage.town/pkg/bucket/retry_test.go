@@ -0,0 +1,123 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"slow down", awserr.New("SlowDown", "reduce your request rate", nil), true},
+		{"request timeout", awserr.New("RequestTimeout", "idle connection", nil), true},
+		{"503", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "try again", nil), 503, "req"), true},
+		{"503 with unknown code", awserr.NewRequestFailure(awserr.New("Gateway", "bad gateway", nil), 503, "req"), true},
+		{"wrapped 503", fmt.Errorf("failed to head: %w", awserr.NewRequestFailure(awserr.New("Gateway", "", nil), 503, "req")), true},
+		{"no such key", awserr.NewRequestFailure(awserr.New("NoSuchKey", "not found", nil), 404, "req"), false},
+		{"403", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"), false},
+		{"context canceled", context.Canceled, false},
+		{"sdk canceled", awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffStaysWithinMaxDelay(t *testing.T) {
+	for _, policy := range []RetryPolicy{
+		DefaultRetryPolicy(),
+		{BaseDelay: Duration(time.Nanosecond), MaxDelay: Duration(time.Nanosecond)},
+		{BaseDelay: Duration(time.Second), MaxDelay: Duration(time.Millisecond)},
+		{},
+	} {
+		limit := time.Duration(policy.MaxDelay)
+		if limit <= 0 {
+			limit = time.Duration(DefaultRetryPolicy().MaxDelay)
+		}
+		for attempt := 1; attempt <= 64; attempt++ {
+			for i := 0; i < 20; i++ {
+				if delay := policy.backoff(attempt); delay <= 0 || delay > limit {
+					t.Fatalf("%+v: backoff(%d) = %v, want within (0, %v]", policy, attempt, delay, limit)
+				}
+			}
+		}
+	}
+}
+
+func TestDoRetriesTimedOutAttempt(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}
+	calls := 0
+	err := policy.do(context.Background(), "HeadObject", 10*time.Millisecond, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			// The first attempt hangs until its own timeout cuts it off
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("do() = %v, want success on the second attempt", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestDoStopsWhenCancelled(t *testing.T) {
+	slowDown := awserr.New("SlowDown", "reduce your request rate", nil)
+
+	t.Run("during an attempt", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		policy := RetryPolicy{MaxAttempts: 5, BaseDelay: Duration(time.Millisecond), MaxDelay: Duration(time.Millisecond)}
+		calls := 0
+		err := policy.do(ctx, "HeadObject", 0, func(ctx context.Context) error {
+			calls++
+			cancel()
+			return slowDown
+		})
+		if !errors.Is(err, slowDown) {
+			t.Errorf("do() = %v, want %v", err, slowDown)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+	})
+
+	t.Run("during backoff", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		policy := RetryPolicy{MaxAttempts: 5, BaseDelay: Duration(time.Hour), MaxDelay: Duration(time.Hour)}
+		calls := 0
+		start := time.Now()
+		err := policy.do(ctx, "HeadObject", 0, func(ctx context.Context) error {
+			calls++
+			return slowDown
+		})
+		if !errors.Is(err, slowDown) {
+			t.Errorf("do() = %v, want %v", err, slowDown)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("do() took %v to notice ctx was done", elapsed)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/time/rate"
+)
+
+const defaultScanRateLimit = 200
+
+// ScanOptions controls what Scan fetches for each listed object
+type ScanOptions struct {
+	// Head fetches each object's metadata
+	Head bool
+	// ACL fetches each object's ACL and fills in IsPublic
+	ACL bool
+	// Available checks that each object's public URL answers an HTTP HEAD with 200
+	Available bool
+	// Filter, if set, skips listed objects it returns false for before anything is fetched
+	Filter func(obj *s3.Object) bool
+
+	// Workers is how many objects are processed at once (default 8)
+	Workers int
+	// RateLimit caps requests per second across all workers (default 200, which
+	// keeps well under the Space's request limits); negative means no limit
+	RateLimit float64
+	// HTTPClient is used for availability checks (default http.DefaultClient)
+	HTTPClient *http.Client
+}
+
+// ScanResult is one listed object together with whatever Scan was asked to fetch.
+// Err collects the failures for this object; fields whose fetch failed are left empty.
+type ScanResult struct {
+	Key       string
+	Object    *s3.Object
+	Head      *s3.HeadObjectOutput
+	ACL       *s3.GetObjectAclOutput
+	IsPublic  bool
+	Available bool
+	Err       error
+}
+
+// Scan lists prefix and fetches head, ACL and availability for each object using
+// a bounded pool of workers. Results are returned in listing order, one per
+// object that passed the filter. Only listing failures and ctx being done are
+// returned as an error; problems with individual objects are reported in
+// ScanResult.Err.
+func Scan(ctx context.Context, storage Storage, prefix string, opts ScanOptions) ([]ScanResult, error) {
+	objects, err := storage.ListObjectsWithContext(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", prefix, err)
+	}
+	return ScanObjects(ctx, storage, objects, opts)
+}
+
+// ScanObjects is Scan for objects that have already been listed
+func ScanObjects(ctx context.Context, storage Storage, objects []*s3.Object, opts ScanOptions) ([]ScanResult, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.RateLimit == 0 {
+		opts.RateLimit = defaultScanRateLimit
+	}
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), opts.Workers)
+	}
+
+	var results []ScanResult
+	for _, obj := range objects {
+		if obj.Key == nil || strings.HasSuffix(*obj.Key, "/") {
+			continue
+		}
+		if opts.Filter != nil && !opts.Filter(obj) {
+			continue
+		}
+		results = append(results, ScanResult{Key: *obj.Key, Object: obj})
+	}
+
+	jobs := make(chan *ScanResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range jobs {
+				scanObject(ctx, storage, limiter, opts, result)
+			}
+		}()
+	}
+	for i := range results {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- &results[i]
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// scanObject fills in result, waiting on limiter before every request
+func scanObject(ctx context.Context, storage Storage, limiter *rate.Limiter, opts ScanOptions, result *ScanResult) {
+	var errs []error
+
+	if opts.Head {
+		if err := limiter.Wait(ctx); err != nil {
+			result.Err = err
+			return
+		}
+		head, err := storage.HeadObjectWithContext(ctx, result.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("head: %v", err))
+		} else {
+			result.Head = head
+		}
+	}
+
+	if opts.ACL {
+		if err := limiter.Wait(ctx); err != nil {
+			result.Err = err
+			return
+		}
+		acl, err := storage.GetObjectACLWithContext(ctx, result.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("acl: %v", err))
+		} else {
+			result.ACL = acl
+			result.IsPublic = IsPublic(acl)
+		}
+	}
+
+	if opts.Available {
+		if err := limiter.Wait(ctx); err != nil {
+			result.Err = err
+			return
+		}
+		available, err := checkAvailable(ctx, storage, opts.HTTPClient, result.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("availability: %v", err))
+		}
+		result.Available = available
+	}
+
+	result.Err = errors.Join(errs...)
+}
+
+// checkAvailable reports whether key's public URL can be fetched. Backends
+// without an HTTP URL (a local directory) count objects as available if they exist.
+func checkAvailable(ctx context.Context, storage Storage, client *http.Client, key string) (bool, error) {
+	url := storage.PublicURL(key)
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		_, err := storage.HeadObjectWithContext(ctx, key)
+		return err == nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// Size returns the object's size, preferring the listing over the head
+func (r ScanResult) Size() int64 {
+	if r.Object != nil && r.Object.Size != nil {
+		return *r.Object.Size
+	}
+	if r.Head != nil {
+		return aws.Int64Value(r.Head.ContentLength)
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package bucket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// servedMemoryClient serves public URLs from a test HTTP server
+type servedMemoryClient struct {
+	*MemoryClient
+	baseURL string
+}
+
+func (c servedMemoryClient) PublicURL(key string) string {
+	return c.baseURL + "/" + key
+}
+
+func TestScanAvailable(t *testing.T) {
+	keys := map[string]int{
+		"recordings/ted/stream_20240101-200000.mp3":     http.StatusOK,
+		"recordings/ted/stream_20240102-200000.mp3":     http.StatusNotFound,
+		"recordings/brennan/stream_20240103-200000.mp3": http.StatusInternalServerError,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("availability checked with %s, want HEAD", r.Method)
+		}
+		w.WriteHeader(keys[strings.TrimPrefix(r.URL.Path, "/")])
+	}))
+	defer server.Close()
+
+	memory := NewMemoryClient("test")
+	for key := range keys {
+		if err := memory.PutObject(key, []byte("audio"), "audio/mpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage := servedMemoryClient{memory, server.URL}
+
+	results, err := Scan(context.Background(), storage, "recordings/", ScanOptions{Available: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("got %d results, want %d", len(results), len(keys))
+	}
+	for _, result := range results {
+		if want := keys[result.Key] == http.StatusOK; result.Available != want {
+			t.Errorf("%s: Available = %v, want %v", result.Key, result.Available, want)
+		}
+		if result.Err != nil {
+			t.Errorf("%s: Err = %v, want nil", result.Key, result.Err)
+		}
+	}
+
+	// An unreachable URL is an error, not just unavailable
+	server.Close()
+	results, err = Scan(context.Background(), storage, "recordings/ted/stream_20240101", ScanOptions{Available: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Available || results[0].Err == nil {
+		t.Errorf("unreachable results = %+v, want one unavailable with an error", results)
+	}
+}
+
+func TestScanAvailableWithoutHTTP(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	storage, err := NewFSClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutObject(key, []byte("audio"), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	available, err := checkAvailable(context.Background(), storage, http.DefaultClient, key)
+	if !available || err != nil {
+		t.Errorf("checkAvailable(%s) = %v, %v; want true, nil", key, available, err)
+	}
+	available, err = checkAvailable(context.Background(), storage, http.DefaultClient, "recordings/ted/missing.mp3")
+	if available || err == nil {
+		t.Errorf("checkAvailable(missing) = %v, %v; want false and an error", available, err)
+	}
+}
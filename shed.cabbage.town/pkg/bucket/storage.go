@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const allUsersURI = "http://acs.amazonaws.com/groups/global/AllUsers"
+
+// ErrNotPresignable is returned by backends that have no URLs a browser can
+// fetch objects from, such as a local directory
+var ErrNotPresignable = errors.New("bucket can't presign URLs")
+
+// Operation names, used to configure per-operation timeouts and to target
+// faults injected into a MemoryClient
+const (
+	OpGetObject       = "GetObject"
+	OpPutObject       = "PutObject"
+	OpHeadObject      = "HeadObject"
+	OpListObjects     = "ListObjects"
+	OpGetObjectACL    = "GetObjectACL"
+	OpPutObjectACL    = "PutObjectACL"
+	OpCopyObject      = "CopyObject"
+	OpDeleteObject    = "DeleteObject"
+	OpUpdateMetadata  = "UpdateObjectMetadata"
+	OpPutWithMetadata = "PutObjectWithMetadata"
+	OpPutObjectStream = "PutObjectStreaming"
+	OpPutMultipart    = "PutObjectMultipart"
+	OpGetPresignedPut = "GetPresignedPutURL"
+	OpGetPresignedURL = "GetPresignedURL"
+)
+
+// Storage is the set of bucket operations used by shed and trellis.
+// Client talks to the real Space, FSClient stores objects in a local directory
+// and MemoryClient keeps them in memory for tests.
+type Storage interface {
+	// BucketName returns the name of the bucket objects are stored in
+	BucketName() string
+	// PublicURL returns the URL a public-read object is served from
+	PublicURL(key string) string
+
+	GetObject(key string) (*s3.GetObjectOutput, error)
+	PutObject(key string, body []byte, contentType string) error
+	PutObjectStreaming(key string, reader io.Reader, contentType string) error
+	PutObjectWithMetadata(key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error
+	// PutObjectMultipart uploads large bodies in parallel parts where the backend supports it
+	PutObjectMultipart(key string, reader io.Reader, contentType string, opts UploadOptions) error
+	HeadObject(key string) (*s3.HeadObjectOutput, error)
+	ListObjects(prefix string) ([]*s3.Object, error)
+	GetObjectACL(key string) (*s3.GetObjectAclOutput, error)
+	PutObjectACL(key string, acl string) error
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	// DeleteObject removes an object; deleting a key that doesn't exist isn't an error
+	DeleteObject(key string) error
+	UpdateObjectMetadata(key string, update MetadataUpdate) error
+
+	// The WithContext variants stop waiting and return ctx's error once ctx is
+	// done. The methods above are equivalent to calling them with context.Background().
+	GetObjectWithContext(ctx context.Context, key string) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(ctx context.Context, key string, body []byte, contentType string) error
+	PutObjectStreamingWithContext(ctx context.Context, key string, reader io.Reader, contentType string) error
+	PutObjectWithMetadataWithContext(ctx context.Context, key string, reader io.Reader, contentType string, metadata map[string]*string, acl string) error
+	PutObjectMultipartWithContext(ctx context.Context, key string, reader io.Reader, contentType string, opts UploadOptions) error
+	HeadObjectWithContext(ctx context.Context, key string) (*s3.HeadObjectOutput, error)
+	ListObjectsWithContext(ctx context.Context, prefix string) ([]*s3.Object, error)
+	GetObjectACLWithContext(ctx context.Context, key string) (*s3.GetObjectAclOutput, error)
+	PutObjectACLWithContext(ctx context.Context, key string, acl string) error
+	CopyObjectWithContext(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	DeleteObjectWithContext(ctx context.Context, key string) error
+	UpdateObjectMetadataWithContext(ctx context.Context, key string, update MetadataUpdate) error
+
+	// Presigning happens locally and never touches the network. Backends a
+	// browser can't fetch from return ErrNotPresignable.
+	GetPresignedURL(key string, expires time.Duration) (string, error)
+	GetPresignedPutURL(key, contentType string, expires time.Duration) (string, error)
+}
+
+var (
+	_ Storage = (*Client)(nil)
+	_ Storage = (*FSClient)(nil)
+	_ Storage = (*MemoryClient)(nil)
+)
+
+// NewStorage returns a filesystem-backed store rooted at BUCKET_LOCAL_DIR when
+// that variable is set, and a client for the real Space otherwise.
+func NewStorage() (Storage, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if dir := os.Getenv("BUCKET_LOCAL_DIR"); dir != "" {
+		client, err := NewFSClient(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local bucket: %v", err)
+		}
+		client.PublicBaseURL = config.PublicBaseURL
+		return client, nil
+	}
+	return NewClientWithConfig(config)
+}
+
+// contextReader stops a streamed body once ctx is done, for backends whose
+// writes don't otherwise notice cancellation
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// BucketName returns the name of the Space this client talks to
+func (c *Client) BucketName() string {
+	return c.Bucket
+}
+
+// IsPublic reports whether an ACL grants read access to everyone
+func IsPublic(acl *s3.GetObjectAclOutput) bool {
+	if acl == nil {
+		return false
+	}
+	for _, grant := range acl.Grants {
+		if grant.Grantee != nil && grant.Grantee.URI != nil && *grant.Grantee.URI == allUsersURI {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err means the object doesn't exist
+func IsNotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return true
+	}
+	return false
+}
+
+// CannedACL returns the canned ACL ("public-read" or "private") matching the given grants
+func CannedACL(acl *s3.GetObjectAclOutput) string {
+	if IsPublic(acl) {
+		return "public-read"
+	}
+	return "private"
+}
@@ -0,0 +1,526 @@
+// Package catalog keeps a manifest of the bucket's recordings and clips at
+// catalog/index.json, so shed and trellis can load one object instead of
+// listing recordings/, clips/ and posts/ and fetching metadata for every object.
+//
+// Shed refreshes entries as it changes objects; Sync reconciles the manifest
+// with the bucket listing, re-reading only objects whose ETag or LastModified
+// changed. ACL changes made with PutObjectACL don't show up in the listing, so
+// code that makes them should call Refresh.
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+)
+
+const (
+	// Key is where the manifest is stored in the bucket
+	Key = "catalog/index.json"
+	// Version is the manifest format written by this package. Manifests with
+	// an older version are rebuilt from the bucket.
+	Version = 1
+
+	recordingsPrefix = "recordings/"
+	postsPrefix      = "posts/"
+	saveAttempts     = 3
+)
+
+// Entry describes one object under recordings/ or ClipsPrefix
+type Entry struct {
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Public       bool      `json:"public"`
+	DisplayName  string    `json:"displayName,omitempty"`
+	// PostID links the recording to a post; PostPublished says if that post is live
+	PostID        string `json:"postId,omitempty"`
+	PostSlug      string `json:"postSlug,omitempty"`
+	PostPublished bool   `json:"postPublished,omitempty"`
+	// Metadata is the object's user metadata, which also records processing
+	// state such as Id3-Processed
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Owner returns the username from a recordings/<username>/... key, or "" for
+// a clip
+func (e *Entry) Owner() string {
+	parts := strings.Split(e.Key, "/")
+	if len(parts) < 3 || parts[0]+"/" != recordingsPrefix {
+		return ""
+	}
+	return parts[1]
+}
+
+// MetadataPointers returns Metadata in the form the S3 API uses
+func (e *Entry) MetadataPointers() map[string]*string {
+	out := make(map[string]*string, len(e.Metadata))
+	for k, v := range e.Metadata {
+		out[k] = aws.String(v)
+	}
+	return out
+}
+
+// PostRef is what the manifest remembers about a post, so unchanged posts
+// aren't downloaded again
+type PostRef struct {
+	ETag      string `json:"etag"`
+	Slug      string `json:"slug,omitempty"`
+	Recording string `json:"recording,omitempty"`
+	Published bool   `json:"published"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// Manifest is the stored catalog
+type Manifest struct {
+	Version int `json:"version"`
+	// Generation increases by one on every save
+	Generation int64     `json:"generation"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Recordings is keyed by object key, and holds clips too
+	Recordings map[string]*Entry `json:"recordings"`
+	// Posts is keyed by post ID
+	Posts map[string]*PostRef `json:"posts"`
+
+	etag string // ETag of the manifest object when it was loaded
+}
+
+// New returns an empty manifest
+func New() *Manifest {
+	return &Manifest{
+		Version:    Version,
+		Recordings: make(map[string]*Entry),
+		Posts:      make(map[string]*PostRef),
+	}
+}
+
+// Entries returns the entries whose keys start with prefix, in key order
+func (m *Manifest) Entries(prefix string) []*Entry {
+	var entries []*Entry
+	for key, entry := range m.Recordings {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// linkPosts points each recording at the post that references it, preferring
+// published posts. It reports whether any link changed.
+func (m *Manifest) linkPosts() bool {
+	ids := make([]string, 0, len(m.Posts))
+	for id := range m.Posts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	type link struct {
+		id        string
+		slug      string
+		published bool
+	}
+	links := make(map[string]link)
+	for _, id := range ids {
+		ref := m.Posts[id]
+		if ref.Deleted || ref.Recording == "" {
+			continue
+		}
+		if current, ok := links[ref.Recording]; ok && current.published && !ref.Published {
+			continue
+		}
+		links[ref.Recording] = link{id: id, slug: ref.Slug, published: ref.Published}
+	}
+
+	changed := false
+	for key, entry := range m.Recordings {
+		l := links[key]
+		if entry.PostID != l.id || entry.PostSlug != l.slug || entry.PostPublished != l.published {
+			entry.PostID = l.id
+			entry.PostSlug = l.slug
+			entry.PostPublished = l.published
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Store loads and saves the manifest
+type Store struct {
+	storage bucket.Storage
+	mu      sync.Mutex // serializes updates made by this process
+}
+
+// NewStore returns a Store for the manifest in storage
+func NewStore(storage bucket.Storage) *Store {
+	return &Store{storage: storage}
+}
+
+// Load reads the manifest, returning an empty one if there isn't one yet or
+// it was written in an older format
+func (s *Store) Load(ctx context.Context) (*Manifest, error) {
+	output, err := s.storage.GetObjectWithContext(ctx, Key)
+	if bucket.IsNotFound(err) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get catalog: %v", err)
+	}
+	defer output.Body.Close()
+
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %v", err)
+	}
+	m := New()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %v", err)
+	}
+	if m.Version > Version {
+		return nil, fmt.Errorf("catalog version %d is newer than supported version %d", m.Version, Version)
+	}
+	etag := aws.StringValue(output.ETag)
+	if m.Version < Version {
+		log.Printf("[CATALOG] Catalog version %d is out of date, rebuilding", m.Version)
+		m = New()
+	}
+	if m.Recordings == nil {
+		m.Recordings = make(map[string]*Entry)
+	}
+	if m.Posts == nil {
+		m.Posts = make(map[string]*PostRef)
+	}
+	m.etag = etag
+	return m, nil
+}
+
+// save writes m unless the stored manifest changed since m was loaded, in
+// which case it returns bucket.ErrPreconditionFailed. The check and the write
+// aren't atomic, but Sync repairs anything lost in between.
+func (s *Store) save(ctx context.Context, m *Manifest) error {
+	head, err := s.storage.HeadObjectWithContext(ctx, Key)
+	switch {
+	case bucket.IsNotFound(err):
+		if m.etag != "" {
+			return bucket.ErrPreconditionFailed
+		}
+	case err != nil:
+		return fmt.Errorf("failed to check catalog: %v", err)
+	default:
+		if trimETag(aws.StringValue(head.ETag)) != trimETag(m.etag) {
+			return bucket.ErrPreconditionFailed
+		}
+	}
+
+	m.Version = Version
+	m.Generation++
+	m.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %v", err)
+	}
+	if err := s.storage.PutObjectWithContext(ctx, Key, data, "application/json"); err != nil {
+		return fmt.Errorf("failed to save catalog: %v", err)
+	}
+	sum := md5.Sum(data)
+	m.etag = hex.EncodeToString(sum[:])
+	return nil
+}
+
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// Update loads the manifest, applies fn and saves the result if fn reports a
+// change. If another writer saves in between, it starts over with a fresh copy.
+func (s *Store) Update(ctx context.Context, fn func(m *Manifest) (bool, error)) (*Manifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		m, err := s.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := fn(m)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return m, nil
+		}
+		err = s.save(ctx, m)
+		if err == bucket.ErrPreconditionFailed && attempt < saveAttempts {
+			log.Printf("[CATALOG] Catalog changed while updating, retrying (attempt %d)", attempt)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// Sync loads the manifest and reconciles it with the bucket, saving it if
+// anything changed
+func (s *Store) Sync(ctx context.Context) (*Manifest, error) {
+	return s.Update(ctx, func(m *Manifest) (bool, error) {
+		return reconcile(ctx, s.storage, m)
+	})
+}
+
+// Preview is Sync without the save, for dry runs: the manifest returned is
+// reconciled with the bucket, but the stored one is left as it was
+func (s *Store) Preview(ctx context.Context) (*Manifest, error) {
+	m, err := s.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := reconcile(ctx, s.storage, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Refresh re-reads the given recordings from the bucket, dropping entries for
+// keys that no longer exist
+func (s *Store) Refresh(ctx context.Context, keys ...string) error {
+	objects := make([]*s3.Object, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.Object{Key: aws.String(key)}
+	}
+	_, err := s.Update(ctx, func(m *Manifest) (bool, error) {
+		changed, err := rescan(ctx, s.storage, m, objects)
+		if err != nil {
+			return false, err
+		}
+		return m.linkPosts() || changed, nil
+	})
+	return err
+}
+
+// RefreshPosts re-reads the given posts so recordings link to them correctly
+func (s *Store) RefreshPosts(ctx context.Context, ids ...string) error {
+	_, err := s.Update(ctx, func(m *Manifest) (bool, error) {
+		for _, id := range ids {
+			ref, err := readPost(ctx, s.storage, PostKey(id))
+			if bucket.IsNotFound(err) {
+				delete(m.Posts, id)
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			m.Posts[id] = ref
+		}
+		m.linkPosts()
+		return true, nil
+	})
+	return err
+}
+
+// reconcile brings m up to date with the bucket listing
+func reconcile(ctx context.Context, storage bucket.Storage, m *Manifest) (bool, error) {
+	var objects []*s3.Object
+	for _, prefix := range []string{recordingsPrefix, ClipsPrefix} {
+		listed, err := storage.ListObjectsWithContext(ctx, prefix)
+		if err != nil {
+			return false, fmt.Errorf("failed to list %s: %v", prefix, err)
+		}
+		objects = append(objects, listed...)
+	}
+
+	changed := false
+	seen := make(map[string]bool, len(objects))
+	var stale []*s3.Object
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		seen[key] = true
+		entry, ok := m.Recordings[key]
+		if ok && trimETag(entry.ETag) == trimETag(aws.StringValue(obj.ETag)) &&
+			entry.LastModified.Equal(aws.TimeValue(obj.LastModified)) {
+			continue
+		}
+		stale = append(stale, obj)
+	}
+	for key := range m.Recordings {
+		if !seen[key] {
+			delete(m.Recordings, key)
+			changed = true
+		}
+	}
+
+	if len(stale) > 0 {
+		log.Printf("[CATALOG] Re-reading %d of %d recordings", len(stale), len(objects))
+		rescanned, err := rescan(ctx, storage, m, stale)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || rescanned
+	}
+
+	postsChanged, err := reconcilePosts(ctx, storage, m)
+	if err != nil {
+		return false, err
+	}
+	linksChanged := m.linkPosts()
+	return changed || postsChanged || linksChanged, nil
+}
+
+// rescan fetches head and ACL for objects and updates their entries. Objects
+// that can't be read keep their previous entry so one bad object doesn't
+// hide the rest.
+func rescan(ctx context.Context, storage bucket.Storage, m *Manifest, objects []*s3.Object) (bool, error) {
+	results, err := bucket.ScanObjects(ctx, storage, objects, bucket.ScanOptions{Head: true, ACL: true})
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, result := range results {
+		if result.Head == nil && bucket.IsNotFound(result.Err) {
+			if _, ok := m.Recordings[result.Key]; ok {
+				delete(m.Recordings, result.Key)
+				changed = true
+			}
+			continue
+		}
+		if result.Head == nil || result.ACL == nil {
+			log.Printf("[CATALOG] WARNING: Failed to read %s: %v", result.Key, result.Err)
+			continue
+		}
+		m.Recordings[result.Key] = entryFromScan(result, m.Recordings[result.Key])
+		changed = true
+	}
+	return changed, nil
+}
+
+// entryFromScan builds an entry from a scan, keeping the post link from previous
+func entryFromScan(result bucket.ScanResult, previous *Entry) *Entry {
+	head := result.Head
+	entry := &Entry{
+		Key:          result.Key,
+		ETag:         trimETag(aws.StringValue(head.ETag)),
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		ContentType:  aws.StringValue(head.ContentType),
+		Public:       result.IsPublic,
+		Metadata:     make(map[string]string, len(head.Metadata)),
+	}
+	// Prefer the listing's timestamp so the next reconcile sees no change
+	if result.Object != nil && result.Object.LastModified != nil {
+		entry.LastModified = *result.Object.LastModified
+	}
+	for k, v := range head.Metadata {
+		if v != nil {
+			entry.Metadata[k] = *v
+		}
+	}
+	entry.DisplayName = entry.Metadata[MetaDisplayName]
+	if previous != nil {
+		entry.PostID = previous.PostID
+		entry.PostSlug = previous.PostSlug
+		entry.PostPublished = previous.PostPublished
+	}
+	return entry
+}
+
+// reconcilePosts re-reads posts whose ETag changed since the last sync
+func reconcilePosts(ctx context.Context, storage bucket.Storage, m *Manifest) (bool, error) {
+	objects, err := storage.ListObjectsWithContext(ctx, postsPrefix)
+	if err != nil {
+		return false, fmt.Errorf("failed to list posts: %v", err)
+	}
+
+	changed := false
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(key, postsPrefix), ".json")
+		seen[id] = true
+		if ref, ok := m.Posts[id]; ok && ref.ETag == trimETag(aws.StringValue(obj.ETag)) {
+			continue
+		}
+		ref, err := readPost(ctx, storage, key)
+		if err != nil {
+			log.Printf("[CATALOG] WARNING: Failed to read post %s: %v", key, err)
+			continue
+		}
+		m.Posts[id] = ref
+		changed = true
+	}
+	for id := range m.Posts {
+		if !seen[id] {
+			delete(m.Posts, id)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// PostKey returns the key a post is stored under
+func PostKey(id string) string {
+	return postsPrefix + id + ".json"
+}
+
+// readPost reads the fields of a post the catalog cares about
+func readPost(ctx context.Context, storage bucket.Storage, key string) (*PostRef, error) {
+	output, err := storage.GetObjectWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	var post struct {
+		Slug      string     `json:"slug"`
+		Published bool       `json:"published"`
+		DeletedAt *time.Time `json:"deletedAt"`
+		Metadata  struct {
+			Recording string `json:"recording"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&post); err != nil {
+		return nil, fmt.Errorf("failed to parse post: %v", err)
+	}
+
+	etag := aws.StringValue(output.ETag)
+	if etag == "" {
+		sum := md5.Sum(data)
+		etag = hex.EncodeToString(sum[:])
+	}
+	return &PostRef{
+		ETag:      trimETag(etag),
+		Slug:      post.Slug,
+		Recording: post.Metadata.Recording,
+		Published: post.Published,
+		Deleted:   post.DeletedAt != nil,
+	}, nil
+}
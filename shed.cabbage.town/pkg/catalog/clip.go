@@ -0,0 +1,111 @@
+package catalog
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+)
+
+// ClipsPrefix is where clips cut from recordings are stored, under the slug
+// of the recording's show
+const ClipsPrefix = "clips/"
+
+// Object metadata linking a clip to the recording it was cut from. Start and
+// end are in seconds from the start of the recording.
+const (
+	MetaClipOf    = "Clip-Of"
+	MetaClipStart = "Clip-Start"
+	MetaClipEnd   = "Clip-End"
+)
+
+// Clip is a stretch of a recording stored as a file of its own, so it can be
+// shared without the rest of the show
+type Clip struct {
+	Key string
+	URL string
+	// ShowSlug, Show and DJ come from the show the clip is filed under
+	ShowSlug string
+	Show     string
+	DJ       string
+	Title    string
+	// Recording is the key of the recording the clip was cut from
+	Recording  string
+	Start, End time.Duration
+	// Duration is the clip's own length, which can differ from End-Start by
+	// part of a frame; zero if it's unknown
+	Duration time.Duration
+	// Created is when the clip was cut
+	Created time.Time
+	Public  bool
+}
+
+// ClipKey returns where a clip of recording from from to to is stored
+func ClipKey(showSlug, recording string, from, to time.Duration) string {
+	name := strings.TrimSuffix(path.Base(recording), path.Ext(recording))
+	return fmt.Sprintf("%s%s/%s_%s-%s.mp3", ClipsPrefix, showSlug, name, from.Round(time.Millisecond), to.Round(time.Millisecond))
+}
+
+// ClipMetadata returns the metadata that links a clip to its recording
+func ClipMetadata(recording string, from, to time.Duration) map[string]*string {
+	return map[string]*string{
+		MetaClipOf:    aws.String(recording),
+		MetaClipStart: aws.String(strconv.FormatFloat(from.Seconds(), 'f', 3, 64)),
+		MetaClipEnd:   aws.String(strconv.FormatFloat(to.Seconds(), 'f', 3, 64)),
+	}
+}
+
+// NewClip builds a Clip from a catalog entry. It fails if the key isn't a
+// clip key, its show isn't in the registry or it isn't linked to a recording.
+func NewClip(entry *Entry, registry *shows.Registry, url string) (Clip, error) {
+	parts := strings.Split(strings.TrimPrefix(entry.Key, ClipsPrefix), "/")
+	if !strings.HasPrefix(entry.Key, ClipsPrefix) || len(parts) != 2 || parts[1] == "" {
+		return Clip{}, fmt.Errorf("invalid clip key: %s", entry.Key)
+	}
+	show, ok := registry.BySlug(parts[0])
+	if !ok {
+		return Clip{}, fmt.Errorf("unknown show: %s", parts[0])
+	}
+	recording := entry.Metadata[MetaClipOf]
+	if recording == "" {
+		return Clip{}, fmt.Errorf("clip %s has no recording", entry.Key)
+	}
+	seconds := func(k string) time.Duration {
+		v, _ := strconv.ParseFloat(entry.Metadata[k], 64)
+		return time.Duration(v * float64(time.Second))
+	}
+
+	return Clip{
+		Key:       entry.Key,
+		URL:       url,
+		ShowSlug:  show.Slug,
+		Show:      show.Name,
+		DJ:        show.DJ,
+		Title:     entry.DisplayName,
+		Recording: recording,
+		Start:     seconds(MetaClipStart),
+		End:       seconds(MetaClipEnd),
+		Duration:  CachedDuration(entry),
+		Created:   entry.LastModified,
+		Public:    entry.Public,
+	}, nil
+}
+
+// SortClips orders clips by where they start in their recordings, then by key
+func SortClips(clips []Clip) {
+	sort.Slice(clips, func(i, j int) bool {
+		if clips[i].Recording != clips[j].Recording {
+			return clips[i].Recording < clips[j].Recording
+		}
+		if clips[i].Start != clips[j].Start {
+			return clips[i].Start < clips[j].Start
+		}
+		return clips[i].Key < clips[j].Key
+	})
+}
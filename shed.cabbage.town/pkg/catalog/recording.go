@@ -0,0 +1,402 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+)
+
+// DateLayout is how a recording's date is written in playlists, feeds, tags
+// and recordings.json
+const DateLayout = "January 2, 2006"
+
+// Object metadata that caches a recording's duration. The size the duration
+// was measured at is stored with it, so a re-uploaded file is measured again.
+const (
+	MetaDuration      = "Duration-Seconds"
+	MetaDurationBytes = "Duration-Bytes"
+)
+
+// Object metadata from loudness analysis. Loudness is in LUFS, the true peak
+// in dBTP, the ReplayGain 2.0 track gain in dB and its peak linear. Silent
+// recordings have a loudness of -Inf and no gain. Channels is how many
+// channels were measured; measurements without it counted mono recordings
+// twice and are redone.
+const (
+	MetaLoudness         = "Loudness-Integrated"
+	MetaTruePeak         = "Loudness-True-Peak"
+	MetaTrackGain        = "Replaygain-Track-Gain"
+	MetaTrackPeak        = "Replaygain-Track-Peak"
+	MetaLoudnessChannels = "Loudness-Channels"
+)
+
+// Object metadata from silence detection, in seconds. Leading and trailing
+// silence are always set once a recording has been checked, zero if there's
+// none. Gaps lists the longest silences in the middle as start-end pairs,
+// with their total count stored separately since metadata space is limited.
+const (
+	MetaSilenceLeading  = "Silence-Leading"
+	MetaSilenceTrailing = "Silence-Trailing"
+	MetaSilenceGaps     = "Silence-Gaps"
+	MetaSilenceGapCount = "Silence-Gap-Count"
+)
+
+// maxStoredGaps is how many gaps SilenceMetadata keeps
+const maxStoredGaps = 10
+
+// MetaWaveform is set to the key of a recording's waveform once it has been
+// generated
+const MetaWaveform = "Waveform"
+
+// MetaID3Fingerprint identifies the tags trellis last wrote into the file
+const MetaID3Fingerprint = "Id3-Fingerprint"
+
+// MetaDisplayName is the name a DJ gave a recording or clip
+const MetaDisplayName = "Display-Name"
+
+// MaxDisplayNameLength is the longest display name, leaving room in the 2KB
+// of metadata an object can have for everything else
+const MaxDisplayNameLength = 200
+
+// ErrInvalidDisplayName is returned by ValidateDisplayName
+var ErrInvalidDisplayName = errors.New("names must be at most 200 characters of plain ASCII: letters, digits, spaces and punctuation")
+
+// ValidateDisplayName checks a display name can be stored in object
+// metadata, which travels as an HTTP header and so can only hold printable
+// ASCII. An empty name is valid and means the recording has none.
+func ValidateDisplayName(name string) error {
+	if len(name) > MaxDisplayNameLength {
+		return ErrInvalidDisplayName
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < ' ' || name[i] > '~' {
+			return ErrInvalidDisplayName
+		}
+	}
+	return nil
+}
+
+// AudioMetadata is the object metadata that describes a recording's audio.
+// It no longer holds once the audio is edited, so edits clear it and trellis
+// measures, analyses and tags the new audio on its next run.
+var AudioMetadata = []string{
+	MetaDuration, MetaDurationBytes,
+	MetaLoudness, MetaTruePeak, MetaTrackGain, MetaTrackPeak, MetaLoudnessChannels,
+	MetaSilenceLeading, MetaSilenceTrailing, MetaSilenceGaps, MetaSilenceGapCount,
+	MetaWaveform,
+	MetaID3Fingerprint,
+}
+
+// ErrNoDate is returned by ParseKey for a valid key whose filename has no date
+var ErrNoDate = errors.New("no date in filename")
+
+var (
+	timestampPattern = regexp.MustCompile(`(\d{8})-(\d{6})`)
+	datePattern      = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+)
+
+// KeyInfo is what a recording's object key says about it
+type KeyInfo struct {
+	Owner    string
+	Filename string
+	// Recorded is when the stream started according to the filename, or zero
+	// if the filename has no date
+	Recorded time.Time
+}
+
+// ParseKey parses a recordings/<owner>/<filename> key. Filenames are normally
+// stream_YYYYMMDD-HHMMSS.mp3, but the last YYYYMMDD-HHMMSS, YYYYMMDD or
+// YYYY-MM-DD anywhere in the name is used. A valid key without a date is
+// returned together with ErrNoDate.
+func ParseKey(key string) (KeyInfo, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 || parts[0] != "recordings" || parts[1] == "" || parts[len(parts)-1] == "" {
+		return KeyInfo{}, fmt.Errorf("invalid recording key: %s", key)
+	}
+	info := KeyInfo{Owner: parts[1], Filename: parts[len(parts)-1]}
+
+	matches := timestampPattern.FindAllStringSubmatch(info.Filename, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if t, err := time.Parse("20060102150405", matches[i][1]+matches[i][2]); err == nil {
+			info.Recorded = t
+			return info, nil
+		}
+	}
+
+	matches = datePattern.FindAllStringSubmatch(info.Filename, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if t, err := time.Parse("20060102", matches[i][1]+matches[i][2]+matches[i][3]); err == nil {
+			info.Recorded = t
+			return info, nil
+		}
+	}
+
+	return info, ErrNoDate
+}
+
+// Recording is a recording as presented in playlists, feeds and on the site
+type Recording struct {
+	Key   string
+	ETag  string
+	URL   string
+	Owner string
+	// ShowSlug, Show and DJ come from the owner's show in the registry
+	ShowSlug string
+	Show     string
+	DJ       string
+	// Recorded is when the stream started, from the filename or, if the
+	// filename has no date, the object's LastModified
+	Recorded time.Time
+	// Date is Recorded formatted with DateLayout
+	Date         string
+	LastModified time.Time
+	DisplayName  string
+	Public       bool
+	Size         int64
+	// Duration is read from the object's metadata; zero if it hasn't been measured
+	Duration time.Duration
+	// Loudness is read from the object's metadata; nil if it hasn't been measured
+	Loudness *Loudness
+	// Silence is read from the object's metadata; nil if it hasn't been checked
+	Silence  *Silence
+	Metadata map[string]string
+}
+
+// Loudness is what loudness analysis found out about a recording
+type Loudness struct {
+	Integrated float64
+	TruePeak   float64
+	TrackGain  float64
+	TrackPeak  float64
+	Channels   int
+}
+
+// Silence is the dead air silence detection found in a recording
+type Silence struct {
+	Leading  time.Duration
+	Trailing time.Duration
+	// Gaps are the longest silences between the start and end, in order
+	Gaps []Gap
+	// GapCount is how many gaps were found, which may be more than are kept
+	GapCount int
+}
+
+// Gap is a silence in the middle of a recording
+type Gap struct {
+	Start, End time.Duration
+}
+
+// Any reports whether any silence was found
+func (s Silence) Any() bool {
+	return s.Leading > 0 || s.Trailing > 0 || s.GapCount > 0
+}
+
+// FormatOffset writes a position or length in a recording as h:mm:ss or m:ss
+func FormatOffset(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// NewRecording builds a Recording from a catalog entry. It fails if the key
+// isn't a recording key or its owner doesn't have a show in the registry.
+func NewRecording(entry *Entry, registry *shows.Registry, url string) (Recording, error) {
+	info, err := ParseKey(entry.Key)
+	if err != nil && err != ErrNoDate {
+		return Recording{}, err
+	}
+	show, ok := registry.ForOwner(info.Owner)
+	if !ok {
+		return Recording{}, fmt.Errorf("unknown DJ: %s", info.Owner)
+	}
+
+	recorded := info.Recorded
+	if recorded.IsZero() {
+		recorded = entry.LastModified
+	}
+
+	return Recording{
+		Key:          entry.Key,
+		ETag:         entry.ETag,
+		URL:          url,
+		Owner:        info.Owner,
+		ShowSlug:     show.Slug,
+		Show:         show.Name,
+		DJ:           show.DJ,
+		Recorded:     recorded,
+		Date:         recorded.Format(DateLayout),
+		LastModified: entry.LastModified,
+		DisplayName:  entry.DisplayName,
+		Public:       entry.Public,
+		Size:         entry.Size,
+		Duration:     CachedDuration(entry),
+		Loudness:     parseLoudness(entry.Metadata),
+		Silence:      ParseSilence(entry.Metadata),
+		Metadata:     entry.Metadata,
+	}, nil
+}
+
+// CachedDuration returns the duration stored in the entry's metadata, if it
+// was measured at the object's current size
+func CachedDuration(entry *Entry) time.Duration {
+	if entry.Metadata[MetaDurationBytes] != strconv.FormatInt(entry.Size, 10) {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(entry.Metadata[MetaDuration], 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// DurationMetadata returns the metadata that caches duration for an object of size bytes
+func DurationMetadata(duration time.Duration, size int64) map[string]*string {
+	return map[string]*string{
+		MetaDuration:      aws.String(strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)),
+		MetaDurationBytes: aws.String(strconv.FormatInt(size, 10)),
+	}
+}
+
+// WaveformKeys returns where a recording's waveform peaks are stored: a
+// detailed waveform for scrubbing and a short overview for small players.
+// recordings/<owner>/<name>.mp3 maps to waveforms/<owner>/<name>.json.
+func WaveformKeys(key string) (detail, overview string) {
+	base := "waveforms/" + strings.TrimSuffix(strings.TrimPrefix(key, "recordings/"), ".mp3")
+	return base + ".json", base + ".overview.json"
+}
+
+// LoudnessMetadata returns the metadata that stores a loudness measurement
+func LoudnessMetadata(l Loudness) map[string]*string {
+	format := func(v float64, precision int) *string {
+		return aws.String(strconv.FormatFloat(v, 'f', precision, 64))
+	}
+	metadata := map[string]*string{
+		MetaLoudness:         format(l.Integrated, 2),
+		MetaTruePeak:         format(l.TruePeak, 2),
+		MetaTrackGain:        nil,
+		MetaTrackPeak:        format(l.TrackPeak, 6),
+		MetaLoudnessChannels: aws.String(strconv.Itoa(l.Channels)),
+	}
+	if !math.IsInf(l.Integrated, 0) {
+		metadata[MetaTrackGain] = format(l.TrackGain, 2)
+	}
+	return metadata
+}
+
+// parseLoudness reads a loudness measurement from metadata, returning nil
+// if there isn't a complete one
+func parseLoudness(metadata map[string]string) *Loudness {
+	var l Loudness
+	var err error
+	if l.Integrated, err = strconv.ParseFloat(metadata[MetaLoudness], 64); err != nil {
+		return nil
+	}
+	if l.TruePeak, err = strconv.ParseFloat(metadata[MetaTruePeak], 64); err != nil {
+		return nil
+	}
+	if l.TrackPeak, err = strconv.ParseFloat(metadata[MetaTrackPeak], 64); err != nil {
+		return nil
+	}
+	if l.Channels, err = strconv.Atoi(metadata[MetaLoudnessChannels]); err != nil {
+		return nil
+	}
+	if gain, ok := metadata[MetaTrackGain]; ok {
+		if l.TrackGain, err = strconv.ParseFloat(gain, 64); err != nil {
+			return nil
+		}
+	}
+	return &l
+}
+
+// SilenceMetadata returns the metadata that stores silence detection's
+// findings, keeping only the longest gaps
+func SilenceMetadata(s Silence) map[string]*string {
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', 1, 64)
+	}
+	metadata := map[string]*string{
+		MetaSilenceLeading:  aws.String(seconds(s.Leading)),
+		MetaSilenceTrailing: aws.String(seconds(s.Trailing)),
+		MetaSilenceGaps:     nil,
+		MetaSilenceGapCount: nil,
+	}
+	if len(s.Gaps) == 0 {
+		return metadata
+	}
+
+	gaps := append([]Gap(nil), s.Gaps...)
+	if len(gaps) > maxStoredGaps {
+		sort.SliceStable(gaps, func(i, j int) bool {
+			return gaps[i].End-gaps[i].Start > gaps[j].End-gaps[j].Start
+		})
+		gaps = gaps[:maxStoredGaps]
+		sort.Slice(gaps, func(i, j int) bool { return gaps[i].Start < gaps[j].Start })
+	}
+	pairs := make([]string, len(gaps))
+	for i, gap := range gaps {
+		pairs[i] = seconds(gap.Start) + "-" + seconds(gap.End)
+	}
+	metadata[MetaSilenceGaps] = aws.String(strings.Join(pairs, ","))
+	metadata[MetaSilenceGapCount] = aws.String(strconv.Itoa(max(s.GapCount, len(s.Gaps))))
+	return metadata
+}
+
+// ParseSilence reads silence detection's findings from metadata, returning
+// nil if the recording hasn't been checked
+func ParseSilence(metadata map[string]string) *Silence {
+	seconds := func(v string) (time.Duration, error) {
+		f, err := strconv.ParseFloat(v, 64)
+		return time.Duration(f * float64(time.Second)), err
+	}
+
+	var s Silence
+	var err error
+	if s.Leading, err = seconds(metadata[MetaSilenceLeading]); err != nil {
+		return nil
+	}
+	if s.Trailing, err = seconds(metadata[MetaSilenceTrailing]); err != nil {
+		return nil
+	}
+	if gaps := metadata[MetaSilenceGaps]; gaps != "" {
+		for _, pair := range strings.Split(gaps, ",") {
+			start, end, ok := strings.Cut(pair, "-")
+			if !ok {
+				continue
+			}
+			var gap Gap
+			if gap.Start, err = seconds(start); err != nil {
+				continue
+			}
+			if gap.End, err = seconds(end); err != nil {
+				continue
+			}
+			s.Gaps = append(s.Gaps, gap)
+		}
+	}
+	s.GapCount = len(s.Gaps)
+	if count, err := strconv.Atoi(metadata[MetaSilenceGapCount]); err == nil && count > s.GapCount {
+		s.GapCount = count
+	}
+	return &s
+}
+
+// SortRecordings orders recordings newest first, breaking ties by key
+func SortRecordings(recordings []Recording) {
+	sort.Slice(recordings, func(i, j int) bool {
+		if recordings[i].Recorded.Equal(recordings[j].Recorded) {
+			return recordings[i].Key < recordings[j].Key
+		}
+		return recordings[i].Recorded.After(recordings[j].Recorded)
+	})
+}
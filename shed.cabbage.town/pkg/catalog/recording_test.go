@@ -0,0 +1,120 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/shows"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key          string
+		wantOwner    string
+		wantFilename string
+		wantRecorded time.Time
+		wantErr      error
+		wantInvalid  bool
+	}{
+		{
+			key:          "recordings/ted/stream_20240101-200000.mp3",
+			wantOwner:    "ted",
+			wantFilename: "stream_20240101-200000.mp3",
+			wantRecorded: time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			// A merge is named after its fragments; the last one is when it ends
+			key:          "recordings/ted/stream_20240101-200000_20240101-213000.mp3",
+			wantOwner:    "ted",
+			wantFilename: "stream_20240101-200000_20240101-213000.mp3",
+			wantRecorded: time.Date(2024, 1, 1, 21, 30, 0, 0, time.UTC),
+		},
+		{
+			// An impossible timestamp falls back to an earlier one
+			key:          "recordings/ted/stream_20240101-200000_20241399-999999.mp3",
+			wantOwner:    "ted",
+			wantFilename: "stream_20240101-200000_20241399-999999.mp3",
+			wantRecorded: time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			key:          "recordings/brennan/soup-20240315.mp3",
+			wantOwner:    "brennan",
+			wantFilename: "soup-20240315.mp3",
+			wantRecorded: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			key:          "recordings/brennan/soup 2024-03-15 live.mp3",
+			wantOwner:    "brennan",
+			wantFilename: "soup 2024-03-15 live.mp3",
+			wantRecorded: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			key:          "recordings/brennan/archive/2023-12-31.mp3",
+			wantOwner:    "brennan",
+			wantFilename: "2023-12-31.mp3",
+			wantRecorded: time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			key:          "recordings/brennan/soup night.mp3",
+			wantOwner:    "brennan",
+			wantFilename: "soup night.mp3",
+			wantErr:      ErrNoDate,
+		},
+		{key: "clips/ted/stream_20240101-200000.mp3", wantInvalid: true},
+		{key: "recordings/stream_20240101-200000.mp3", wantInvalid: true},
+		{key: "recordings//stream_20240101-200000.mp3", wantInvalid: true},
+		{key: "recordings/ted/", wantInvalid: true},
+		{key: "stream_20240101-200000.mp3", wantInvalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			info, err := ParseKey(tt.key)
+			if tt.wantInvalid {
+				if err == nil || err == ErrNoDate {
+					t.Fatalf("ParseKey() = %+v, %v; want an invalid key error", info, err)
+				}
+				return
+			}
+			if err != tt.wantErr {
+				t.Fatalf("ParseKey() error = %v, want %v", err, tt.wantErr)
+			}
+			if info.Owner != tt.wantOwner || info.Filename != tt.wantFilename || !info.Recorded.Equal(tt.wantRecorded) {
+				t.Errorf("ParseKey() = %+v, want owner %s, filename %s, recorded %v", info, tt.wantOwner, tt.wantFilename, tt.wantRecorded)
+			}
+		})
+	}
+}
+
+func TestNewRecordingDate(t *testing.T) {
+	registry, err := shows.Parse([]byte(`{"shows": [{"slug": "mulch", "name": "mulch channel", "dj": "DJ Ted", "owners": ["ted"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		key      string
+		wantDate string
+	}{
+		{"recordings/ted/stream_20240101-200000.mp3", "January 1, 2024"},
+		// Without a date in the name, the upload time stands in
+		{"recordings/ted/mulch.mp3", "February 29, 2024"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			recording, err := NewRecording(&Entry{Key: tt.key, LastModified: lastModified}, registry, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recording.Date != tt.wantDate {
+				t.Errorf("Date = %q, want %q", recording.Date, tt.wantDate)
+			}
+			if recording.Show != "mulch channel" || recording.DJ != "DJ Ted" {
+				t.Errorf("show = %q by %q, want mulch channel by DJ Ted", recording.Show, recording.DJ)
+			}
+		})
+	}
+
+	if _, err := NewRecording(&Entry{Key: "recordings/nobody/stream_20240101-200000.mp3"}, registry, ""); err == nil {
+		t.Error("NewRecording() for an owner without a show succeeded")
+	}
+}
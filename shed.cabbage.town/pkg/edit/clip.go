@@ -0,0 +1,137 @@
+package edit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/id3"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// MaxClipLength is the longest clip that can be cut; anything longer is
+// better shared as the whole recording
+const MaxClipLength = 30 * time.Minute
+
+// ErrNotPublic is returned by Clip for a private recording
+var ErrNotPublic = errors.New("only public recordings can be clipped")
+
+// ErrClipTooLong is returned by Clip for a range longer than MaxClipLength
+var ErrClipTooLong = errors.New("clips can be at most 30 minutes long")
+
+// Clipped describes a clip
+type Clipped struct {
+	Key   string
+	URL   string
+	Title string
+	Info  mp3.Info
+}
+
+// Clip copies the audio from from to to out of a public recording, on frame
+// boundaries, into a public file of its own under catalog.ClipsPrefix. The
+// clip gets its own ID3 tag with the show's details and artwork, and links
+// back to the recording in its tag and metadata. An empty title is made up
+// from the recording's name and the start time; a given one must pass
+// catalog.ValidateDisplayName. Cutting the same range again replaces the
+// clip.
+func Clip(ctx context.Context, storage bucket.Storage, recording catalog.Recording, from, to time.Duration, title string) (*Clipped, error) {
+	if from < 0 || to <= from {
+		return nil, ErrInvalidRange
+	}
+	if to-from > MaxClipLength {
+		return nil, ErrClipTooLong
+	}
+
+	src, err := stat(ctx, storage, recording.Key)
+	if err != nil {
+		return nil, err
+	}
+	if src.acl != "public-read" {
+		return nil, ErrNotPublic
+	}
+
+	if title == "" {
+		// A post's title can be too long or too fancy for metadata, in
+		// which case the show's name will do
+		made := func(name string) string {
+			return fmt.Sprintf("%s (%s) from %s", name, recording.Date, catalog.FormatOffset(from))
+		}
+		title = made(recording.DisplayName)
+		if recording.DisplayName == "" || catalog.ValidateDisplayName(title) != nil {
+			title = made(recording.Show)
+		}
+	}
+	if err := catalog.ValidateDisplayName(title); err != nil {
+		return nil, err
+	}
+	key := catalog.ClipKey(recording.ShowSlug, recording.Key, from, to)
+	url := storage.PublicURL(key)
+
+	file, cleanup, err := tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	log.Printf("[EDIT] Clipping %v-%v of %s", from, to, recording.Key)
+	retag := func(tag *id3.Tag) *id3.Tag {
+		return clipTag(tag, recording, from, title, url)
+	}
+	info, err := splice(ctx, storage, file, []cut{{src: src, from: from, to: to}}, retag)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := catalog.ClipMetadata(recording.Key, from, to)
+	for k, v := range catalog.DurationMetadata(info.Duration, fi.Size()) {
+		metadata[k] = v
+	}
+	metadata[catalog.MetaDisplayName] = aws.String(title)
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := storage.PutObjectWithMetadataWithContext(ctx, key, file, "audio/mpeg", metadata, "public-read"); err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	log.Printf("[EDIT] Stored %v clip as %s", info.Duration, key)
+
+	if err := catalog.NewStore(storage).Refresh(ctx, key); err != nil {
+		log.Printf("[EDIT] WARNING: Failed to refresh the catalog: %v", err)
+	}
+	return &Clipped{Key: key, URL: url, Title: title, Info: info}, nil
+}
+
+// clipTag builds a clip's tag. Only the genre and pictures are taken from
+// the recording's tag; its tracklist, ReplayGain and episode number describe
+// the whole show.
+func clipTag(recordingTag *id3.Tag, recording catalog.Recording, from time.Duration, title, url string) *id3.Tag {
+	tag := &id3.Tag{Version: recordingTag.Version}
+	tag.SetText(id3.Title, title)
+	tag.SetText(id3.Artist, recording.DJ)
+	tag.SetText(id3.Album, recording.Show)
+	tag.SetYear(recording.Recorded.Year())
+	if genre := recordingTag.Text(id3.Genre); genre != "" {
+		tag.SetText(id3.Genre, genre)
+	}
+	tag.SetComment("eng", "", fmt.Sprintf("Clip from %s of %s (%s)", catalog.FormatOffset(from), recording.Show, recording.Date))
+	tag.SetURL(id3.AudioFileURL, url)
+	tag.SetURL(id3.AudioSourceURL, recording.URL)
+	for _, frame := range recordingTag.Frames {
+		if frame.ID == id3.Picture {
+			tag.Frames = append(tag.Frames, frame)
+		}
+	}
+	return tag
+}
@@ -0,0 +1,60 @@
+package edit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+func TestClipTitles(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	tests := []struct {
+		name        string
+		displayName string
+		title       string
+		want        string
+		wantErr     error
+	}{
+		{name: "given title", title: "Soup Night", want: "Soup Night"},
+		{name: "made up from the name", displayName: "Soup Night", want: "Soup Night (January 1, 2024) from 0:00"},
+		{name: "made up from the show", want: "mulch channel (January 1, 2024) from 0:00"},
+		// A post's title isn't checked like a name given in shed
+		{name: "name that can't be metadata", displayName: "Soup Night ☕", want: "mulch channel (January 1, 2024) from 0:00"},
+		{name: "given title that can't be metadata", title: "Soup Night ☕", wantErr: catalog.ErrInvalidDisplayName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			body := bytes.NewReader(mp3test.Silence(40, false))
+			if err := storage.PutObjectWithMetadata(key, body, "audio/mpeg", nil, "public-read"); err != nil {
+				t.Fatal(err)
+			}
+			recording := catalog.Recording{
+				Key: key, URL: storage.PublicURL(key), Owner: "ted",
+				ShowSlug: "mulch-channel", Show: "mulch channel", DJ: "dj ted",
+				Recorded: time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC), Date: "January 1, 2024",
+				DisplayName: tt.displayName,
+			}
+
+			clip, err := Clip(context.Background(), storage, recording, 0, 500*time.Millisecond, tt.title)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.Title != tt.want {
+				t.Errorf("title = %q, want %q", clip.Title, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+// Package edit changes recordings in the bucket, and cuts clips from them,
+// without re-encoding them.
+//
+// Edits copy whole MPEG frames into a temporary file with mp3.Splicer, which
+// then replaces the recording or, for clips, is stored next to it. Whatever
+// an edit replaces is kept first: under TrashPrefix for merges, and under
+// VersionsPrefix for trims, which can be undone. The metadata describing the
+// old audio is cleared, so trellis measures, analyses and tags the new audio
+// on its next run.
+package edit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/id3"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// TrashPrefix is where recordings replaced by an edit are kept, under their
+// original key
+const TrashPrefix = "trash/"
+
+// ErrChanged is returned when a recording changes while it's being edited
+var ErrChanged = errors.New("recording changed during the edit")
+
+// staleUserText is the TXXX frames that describe the old audio
+var staleUserText = []string{"REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK"}
+
+// source is an object being edited, as it was before the edit
+type source struct {
+	key         string
+	etag        string
+	size        int64
+	contentType string
+	metadata    map[string]*string
+	acl         string
+}
+
+// stat reads what an edit needs to know about key
+func stat(ctx context.Context, storage bucket.Storage, key string) (*source, error) {
+	head, err := storage.HeadObjectWithContext(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata of %s: %v", key, err)
+	}
+	acl, err := storage.GetObjectACLWithContext(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ACL of %s: %v", key, err)
+	}
+	return &source{
+		key:         key,
+		etag:        aws.StringValue(head.ETag),
+		size:        aws.Int64Value(head.ContentLength),
+		contentType: aws.StringValue(head.ContentType),
+		metadata:    head.Metadata,
+		acl:         bucket.CannedACL(acl),
+	}, nil
+}
+
+// open starts reading the object, failing with ErrChanged if it isn't the
+// version stat saw
+func (s *source) open(ctx context.Context, storage bucket.Storage) (io.ReadCloser, error) {
+	output, err := storage.GetObjectWithContext(ctx, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", s.key, err)
+	}
+	if etag := aws.StringValue(output.ETag); etag != "" && !s.is(etag) {
+		output.Body.Close()
+		return nil, ErrChanged
+	}
+	return output.Body, nil
+}
+
+// duration returns the object's length from its cached metadata, or
+// measures it if that's missing or was measured at another size
+func (s *source) duration(ctx context.Context, storage bucket.Storage) (time.Duration, error) {
+	entry := &catalog.Entry{Size: s.size, Metadata: aws.StringValueMap(s.metadata)}
+	if duration := catalog.CachedDuration(entry); duration > 0 {
+		return duration, nil
+	}
+	body, err := s.open(ctx, storage)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	info, err := mp3.Probe(body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %v", s.key, err)
+	}
+	return info.Duration, nil
+}
+
+// is reports whether etag is the version stat saw, ignoring the quotes S3
+// wraps ETags in
+func (s *source) is(etag string) bool {
+	return strings.Trim(etag, `"`) == strings.Trim(s.etag, `"`)
+}
+
+// trash keeps a private copy of the object and its metadata under TrashPrefix
+func (s *source) trash(ctx context.Context, storage bucket.Storage) error {
+	if err := s.keep(ctx, storage, TrashPrefix+s.key); err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %v", s.key, err)
+	}
+	return nil
+}
+
+// keep copies the object and its metadata to a private key, failing if it
+// isn't the version stat saw
+func (s *source) keep(ctx context.Context, storage bucket.Storage, key string) error {
+	_, err := storage.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(storage.BucketName()),
+		Key:               aws.String(key),
+		CopySource:        aws.String(bucket.CopySource(storage.BucketName(), s.key)),
+		CopySourceIfMatch: aws.String(s.etag),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		ACL:               aws.String("private"),
+	})
+	return err
+}
+
+// replace uploads file as the object's new audio, keeping its content type,
+// ACL and metadata apart from AudioMetadata. The new duration is cached
+// straight away since it's already known.
+func (s *source) replace(ctx context.Context, storage bucket.Storage, file *os.File, info mp3.Info) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]*string, len(s.metadata))
+	for k, v := range s.metadata {
+		metadata[http.CanonicalHeaderKey(k)] = v
+	}
+	for _, k := range catalog.AudioMetadata {
+		delete(metadata, http.CanonicalHeaderKey(k))
+	}
+	for k, v := range catalog.DurationMetadata(info.Duration, fi.Size()) {
+		metadata[k] = v
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := storage.PutObjectWithMetadataWithContext(ctx, s.key, file, s.contentType, metadata, s.acl); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.key, err)
+	}
+	return nil
+}
+
+// cut is a stretch of a source's audio; a zero to runs to its end
+type cut struct {
+	src      *source
+	from, to time.Duration
+}
+
+// splice writes the cuts to file as one stream. retag is given the first
+// source's ID3 tag, or an empty one, and returns the tag to write in front
+// of the audio, or nil for none.
+func splice(ctx context.Context, storage bucket.Storage, file *os.File, cuts []cut, retag func(*id3.Tag) *id3.Tag) (mp3.Info, error) {
+	var splicer *mp3.Splicer
+	for i, c := range cuts {
+		body, err := c.src.open(ctx, storage)
+		if err != nil {
+			return mp3.Info{}, err
+		}
+		br := bufio.NewReaderSize(contextReader{ctx, body}, 64*1024)
+
+		if i == 0 {
+			tag, err := readTag(br)
+			if err == nil {
+				err = writeTag(file, retag(tag))
+			}
+			if err == nil {
+				splicer, err = mp3.NewSplicer(file)
+			}
+			if err != nil {
+				body.Close()
+				return mp3.Info{}, err
+			}
+		}
+
+		err = splicer.Append(br, c.from, c.to)
+		body.Close()
+		if err != nil {
+			return mp3.Info{}, fmt.Errorf("failed to copy audio from %s: %w", c.src.key, err)
+		}
+	}
+	return splicer.Finish()
+}
+
+// readTag reads the ID3v2 tag at the start of br, leaving the audio unread
+func readTag(br *bufio.Reader) (*id3.Tag, error) {
+	if magic, err := br.Peek(3); err != nil || string(magic) != "ID3" {
+		return id3.NewTag(), nil
+	}
+	tag, err := id3.Read(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ID3 tag: %v", err)
+	}
+	return tag, nil
+}
+
+func writeTag(file *os.File, tag *id3.Tag) error {
+	if tag == nil || len(tag.Frames) == 0 {
+		return nil
+	}
+	data, err := tag.Bytes(id3.Padding)
+	if err != nil {
+		return fmt.Errorf("failed to encode ID3 tag: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write ID3 tag: %v", err)
+	}
+	return nil
+}
+
+// keepTag keeps a recording's tag through an edit, apart from the frames
+// that describe the old audio
+func keepTag(tag *id3.Tag) *id3.Tag {
+	for _, description := range staleUserText {
+		tag.SetUserText(description, "")
+	}
+	return tag
+}
+
+// tempFile creates the file an edit is assembled in
+func tempFile() (*os.File, func(), error) {
+	file, err := os.CreateTemp("", "edit-*.mp3")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	return file, func() {
+		file.Close()
+		os.Remove(file.Name())
+	}, nil
+}
+
+// removeWaveforms deletes the waveform files generated for a recording that
+// no longer exists. Failures only leave stray files behind, so they're logged.
+func removeWaveforms(ctx context.Context, storage bucket.Storage, key string) {
+	detail, overview := catalog.WaveformKeys(key)
+	for _, k := range []string{detail, overview} {
+		if err := storage.DeleteObjectWithContext(ctx, k); err != nil {
+			log.Printf("[EDIT] WARNING: Failed to delete %s: %v", k, err)
+		}
+	}
+}
+
+// relinkPosts points posts linked to any of the old keys at key instead
+func relinkPosts(ctx context.Context, storage bucket.Storage, store *catalog.Store, old []string, key string) error {
+	manifest, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	moved := make(map[string]bool, len(old))
+	for _, k := range old {
+		moved[k] = true
+	}
+
+	var ids []string
+	for id, ref := range manifest.Posts {
+		if !ref.Deleted && moved[ref.Recording] {
+			if err := relinkPost(ctx, storage, id, key); err != nil {
+				return err
+			}
+			log.Printf("[EDIT] Linked post %s to %s", id, key)
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return store.RefreshPosts(ctx, ids...)
+}
+
+// relinkPost sets a post's recording, leaving the rest of it untouched
+func relinkPost(ctx context.Context, storage bucket.Storage, id, key string) error {
+	postKey := catalog.PostKey(id)
+	output, err := storage.GetObjectWithContext(ctx, postKey)
+	if err != nil {
+		return fmt.Errorf("failed to get post %s: %v", id, err)
+	}
+	defer output.Body.Close()
+
+	var post map[string]json.RawMessage
+	if err := json.NewDecoder(output.Body).Decode(&post); err != nil {
+		return fmt.Errorf("failed to parse post %s: %v", id, err)
+	}
+	var metadata map[string]json.RawMessage
+	if raw, ok := post["metadata"]; ok {
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return fmt.Errorf("failed to parse post %s: %v", id, err)
+		}
+	}
+	if metadata == nil {
+		metadata = make(map[string]json.RawMessage)
+	}
+	if metadata["recording"], err = json.Marshal(key); err != nil {
+		return err
+	}
+	if post["metadata"], err = json.Marshal(metadata); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(post, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode post %s: %v", id, err)
+	}
+	if err := storage.PutObjectWithContext(ctx, postKey, data, "application/json"); err != nil {
+		return fmt.Errorf("failed to save post %s: %v", id, err)
+	}
+	return nil
+}
+
+// contextReader stops a download once ctx is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
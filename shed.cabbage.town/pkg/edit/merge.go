@@ -0,0 +1,201 @@
+package edit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// MaxFragmentGap is how far a fragment can start from where the one before it
+// ended for the two to count as one show: long enough for a stream to
+// reconnect, but not for the DJ to have started another show
+const MaxFragmentGap = 10 * time.Minute
+
+// ErrNotFragments is returned by Merge for keys that aren't the fragments of
+// one show
+var ErrNotFragments = errors.New("recordings must be two or more stream_YYYYMMDD-HHMMSS.mp3 files with the same owner and date, each starting within 10 minutes of the end of the one before")
+
+// Merged describes a merge
+type Merged struct {
+	// Key is the merged recording, which took the earliest fragment's key
+	Key string
+	// Fragments are the keys that were merged, in order; each is kept
+	// under TrashPrefix
+	Fragments []string
+	Info      mp3.Info
+}
+
+// Fragments groups recording keys that look like pieces of one show: two or
+// more stream_YYYYMMDD-HHMMSS.mp3 recordings with the same owner and date,
+// each starting within MaxFragmentGap of where the one before it ended, as
+// left behind when a stream drops and reconnects. durations gives each
+// recording's length; one whose length isn't known can't be checked, so
+// nothing after it joins its group. Each group is in recording order, and
+// the groups are ordered by their first key.
+func Fragments(keys []string, durations map[string]time.Duration) [][]string {
+	days := make(map[string][]catalog.KeyInfo)
+	byInfo := make(map[catalog.KeyInfo]string)
+	for _, key := range keys {
+		info, ok := fragmentInfo(key)
+		if !ok {
+			continue
+		}
+		day := fragmentDay(info)
+		days[day] = append(days[day], info)
+		byInfo[info] = key
+	}
+
+	var fragments [][]string
+	add := func(group []string) {
+		if len(group) >= 2 {
+			fragments = append(fragments, group)
+		}
+	}
+	for _, infos := range days {
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Recorded.Before(infos[j].Recorded) })
+		var group []string
+		for i, info := range infos {
+			if i > 0 && !follows(infos[i-1], info, durations[byInfo[infos[i-1]]]) {
+				add(group)
+				group = nil
+			}
+			group = append(group, byInfo[info])
+		}
+		add(group)
+	}
+	sort.Slice(fragments, func(i, j int) bool { return fragments[i][0] < fragments[j][0] })
+	return fragments
+}
+
+// follows reports whether next starts close to where previous, which lasted
+// duration, ended
+func follows(previous, next catalog.KeyInfo, duration time.Duration) bool {
+	if duration <= 0 {
+		return false
+	}
+	gap := next.Recorded.Sub(previous.Recorded.Add(duration))
+	return gap <= MaxFragmentGap && gap >= -MaxFragmentGap
+}
+
+// fragmentDay is the owner and date of a fragment
+func fragmentDay(info catalog.KeyInfo) string {
+	return info.Owner + "/" + info.Recorded.Format("2006-01-02")
+}
+
+// oneDay reports whether keys are two or more different fragments with the
+// same owner and date
+func oneDay(keys []string) bool {
+	seen := make(map[string]bool)
+	var day string
+	for _, key := range keys {
+		info, ok := fragmentInfo(key)
+		if !ok || seen[key] || (day != "" && fragmentDay(info) != day) {
+			return false
+		}
+		seen[key] = true
+		day = fragmentDay(info)
+	}
+	return len(keys) >= 2
+}
+
+// fragmentInfo parses a key that could be a fragment of a stream
+func fragmentInfo(key string) (catalog.KeyInfo, bool) {
+	info, err := catalog.ParseKey(key)
+	if err != nil || !strings.HasPrefix(info.Filename, "stream_") || !strings.HasSuffix(info.Filename, ".mp3") {
+		return catalog.KeyInfo{}, false
+	}
+	return info, true
+}
+
+// Merge joins the fragments of a show into one recording under the earliest
+// fragment's key. The audio is copied frame by frame, behind a single ID3
+// tag taken from the earliest fragment and a new Xing header. The merged
+// recording keeps the earliest fragment's metadata and ACL, every fragment
+// is moved to the trash, and posts linked to a later fragment are linked
+// to the merged recording.
+func Merge(ctx context.Context, storage bucket.Storage, keys []string) (*Merged, error) {
+	// Check the keys before reading anything, then the gaps between them
+	if !oneDay(keys) {
+		return nil, ErrNotFragments
+	}
+	stats := make(map[string]*source, len(keys))
+	durations := make(map[string]time.Duration, len(keys))
+	for _, key := range keys {
+		src, err := stat(ctx, storage, key)
+		if err != nil {
+			return nil, err
+		}
+		if durations[key], err = src.duration(ctx, storage); err != nil {
+			return nil, err
+		}
+		stats[key] = src
+	}
+	fragments, err := checkFragments(keys, durations)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]*source, len(fragments))
+	cuts := make([]cut, len(fragments))
+	for i, key := range fragments {
+		sources[i] = stats[key]
+		cuts[i] = cut{src: sources[i]}
+	}
+
+	file, cleanup, err := tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	log.Printf("[EDIT] Merging %d fragments into %s", len(fragments), fragments[0])
+	info, err := splice(ctx, storage, file, cuts, keepTag)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[EDIT] Merged %d frames, %v of audio", info.Frames, info.Duration)
+
+	// Nothing is overwritten or deleted until every fragment is safe
+	for _, src := range sources {
+		if err := src.trash(ctx, storage); err != nil {
+			return nil, err
+		}
+	}
+	if err := sources[0].replace(ctx, storage, file, info); err != nil {
+		return nil, err
+	}
+	for _, src := range sources[1:] {
+		if err := storage.DeleteObjectWithContext(ctx, src.key); err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %v", src.key, err)
+		}
+		removeWaveforms(ctx, storage, src.key)
+	}
+	log.Printf("[EDIT] Moved %d fragments to %s", len(fragments), TrashPrefix)
+
+	store := catalog.NewStore(storage)
+	if err := relinkPosts(ctx, storage, store, fragments[1:], fragments[0]); err != nil {
+		return nil, fmt.Errorf("merged, but failed to relink posts: %v", err)
+	}
+	if err := store.Refresh(ctx, fragments...); err != nil {
+		log.Printf("[EDIT] WARNING: Failed to refresh the catalog: %v", err)
+	}
+
+	return &Merged{Key: fragments[0], Fragments: fragments, Info: info}, nil
+}
+
+// checkFragments returns keys in recording order if they can be merged
+func checkFragments(keys []string, durations map[string]time.Duration) ([]string, error) {
+	groups := Fragments(keys, durations)
+	if len(groups) != 1 || len(groups[0]) != len(keys) {
+		return nil, ErrNotFragments
+	}
+	return groups[0], nil
+}
@@ -0,0 +1,77 @@
+package edit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFragments(t *testing.T) {
+	const (
+		first  = "recordings/ted/stream_20240101-200000.mp3"
+		second = "recordings/ted/stream_20240101-203000.mp3"
+		third  = "recordings/ted/stream_20240101-210500.mp3"
+		late   = "recordings/ted/stream_20240101-230000.mp3"
+		later  = "recordings/ted/stream_20240101-231000.mp3"
+	)
+	tests := []struct {
+		name      string
+		keys      []string
+		durations map[string]time.Duration
+		want      [][]string
+	}{
+		{
+			name:      "contiguous fragments",
+			keys:      []string{third, first, second},
+			durations: map[string]time.Duration{first: 30 * time.Minute, second: 30 * time.Minute, third: time.Hour},
+			want:      [][]string{{first, second, third}},
+		},
+		{
+			name:      "gaps up to ten minutes either way",
+			keys:      []string{first, second, third},
+			durations: map[string]time.Duration{first: 20 * time.Minute, second: 45 * time.Minute},
+			want:      [][]string{{first, second, third}},
+		},
+		{
+			name:      "a long gap splits the show",
+			keys:      []string{first, second, late, later},
+			durations: map[string]time.Duration{first: 30 * time.Minute, second: 30 * time.Minute, late: 5 * time.Minute},
+			want:      [][]string{{first, second}, {late, later}},
+		},
+		{
+			name:      "a fragment that starts too far before the last ended",
+			keys:      []string{first, second},
+			durations: map[string]time.Duration{first: time.Hour},
+			want:      nil,
+		},
+		{
+			name:      "unknown length ends the chain",
+			keys:      []string{first, second, third},
+			durations: map[string]time.Duration{first: 30 * time.Minute},
+			want:      [][]string{{first, second}},
+		},
+		{
+			name: "different owners and days",
+			keys: []string{
+				first,
+				"recordings/brennan/stream_20240101-203000.mp3",
+				"recordings/ted/stream_20240102-203000.mp3",
+			},
+			durations: map[string]time.Duration{first: 30 * time.Minute},
+			want:      nil,
+		},
+		{
+			name:      "only stream recordings",
+			keys:      []string{first, "recordings/ted/upload_20240101-203000.mp3"},
+			durations: map[string]time.Duration{first: 30 * time.Minute},
+			want:      nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Fragments(tt.keys, tt.durations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fragments = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
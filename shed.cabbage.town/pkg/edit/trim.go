@@ -0,0 +1,202 @@
+package edit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+)
+
+// VersionsPrefix is where the audio a trim replaces is kept, so the trim can
+// be undone. A recording's versions are under its key without the extension,
+// named by when they were replaced.
+const VersionsPrefix = "versions/"
+
+// versionTime names versions so they sort in the order they were replaced
+const versionTime = "20060102-150405.000"
+
+// ErrInvalidRange is returned by Trim for a range that doesn't trim anything
+var ErrInvalidRange = errors.New("the start must be before the end, and something must be cut")
+
+// ErrNoVersions is returned by Restore for a recording that was never trimmed
+var ErrNoVersions = errors.New("recording has no earlier versions")
+
+// Trimmed describes a trim
+type Trimmed struct {
+	Key string
+	// Version is where the audio before the trim was kept
+	Version string
+	Info    mp3.Info
+}
+
+// Trim cuts a recording down to the audio from from to to, on frame
+// boundaries; a zero to keeps the rest of the recording. The recording keeps
+// its ID3 tag, metadata and ACL, and the audio it had is kept under
+// VersionsPrefix for Restore. If ifMatch isn't empty the trim fails with
+// ErrChanged unless it's the recording's ETag.
+func Trim(ctx context.Context, storage bucket.Storage, key string, from, to time.Duration, ifMatch string) (*Trimmed, error) {
+	if from < 0 || to < 0 || (to > 0 && to <= from) || (from == 0 && to == 0) {
+		return nil, ErrInvalidRange
+	}
+
+	src, err := stat(ctx, storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !src.is(ifMatch) {
+		return nil, ErrChanged
+	}
+
+	file, cleanup, err := tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	log.Printf("[EDIT] Trimming %s to %v-%v", key, from, to)
+	info, err := splice(ctx, storage, file, []cut{{src: src, from: from, to: to}}, keepTag)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[EDIT] Kept %d frames, %v of audio", info.Frames, info.Duration)
+
+	version := versionKey(key, time.Now())
+	if err := src.keep(ctx, storage, version); err != nil {
+		return nil, fmt.Errorf("failed to keep %s as %s: %v", key, version, err)
+	}
+	if err := src.replace(ctx, storage, file, info); err != nil {
+		return nil, err
+	}
+	log.Printf("[EDIT] Kept the untrimmed audio as %s", version)
+
+	if err := catalog.NewStore(storage).Refresh(ctx, key); err != nil {
+		log.Printf("[EDIT] WARNING: Failed to refresh the catalog: %v", err)
+	}
+	return &Trimmed{Key: key, Version: version, Info: info}, nil
+}
+
+// Restore undoes the latest trim of a recording, putting back the audio,
+// tag and metadata it had before while keeping its current ACL. The version
+// is removed, so restoring again undoes the trim before that. It returns the
+// version that was restored.
+func Restore(ctx context.Context, storage bucket.Storage, key string, ifMatch string) (string, error) {
+	versions, err := Versions(ctx, storage, key)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", ErrNoVersions
+	}
+	latest := versions[len(versions)-1]
+
+	current, err := stat(ctx, storage, key)
+	if err != nil {
+		return "", err
+	}
+	if ifMatch != "" && !current.is(ifMatch) {
+		return "", ErrChanged
+	}
+	version, err := stat(ctx, storage, latest)
+	if err != nil {
+		return "", err
+	}
+
+	// The waveform files are shared by every version of a recording and now
+	// show the trimmed audio, so the restored audio needs new ones
+	metadata := make(map[string]*string, len(version.metadata))
+	for k, v := range version.metadata {
+		metadata[http.CanonicalHeaderKey(k)] = v
+	}
+	delete(metadata, http.CanonicalHeaderKey(catalog.MetaWaveform))
+
+	_, err = storage.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(storage.BucketName()),
+		Key:               aws.String(key),
+		CopySource:        aws.String(bucket.CopySource(storage.BucketName(), latest)),
+		CopySourceIfMatch: aws.String(version.etag),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          metadata,
+		ContentType:       aws.String(version.contentType),
+		ACL:               aws.String(current.acl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to restore %s from %s: %v", key, latest, err)
+	}
+	if err := storage.DeleteObjectWithContext(ctx, latest); err != nil {
+		log.Printf("[EDIT] WARNING: Failed to delete %s after restoring it: %v", latest, err)
+	}
+	log.Printf("[EDIT] Restored %s from %s", key, latest)
+
+	if err := catalog.NewStore(storage).Refresh(ctx, key); err != nil {
+		log.Printf("[EDIT] WARNING: Failed to refresh the catalog: %v", err)
+	}
+	return latest, nil
+}
+
+// Versions returns the keys of a recording's earlier versions, oldest first
+func Versions(ctx context.Context, storage bucket.Storage, key string) ([]string, error) {
+	objects, err := storage.ListObjectsWithContext(ctx, versionDir(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %v", key, err)
+	}
+	var versions []string
+	for _, obj := range objects {
+		k := aws.StringValue(obj.Key)
+		if recording, ok := versionOf(k); ok && recording == key {
+			versions = append(versions, k)
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// VersionCounts returns how many earlier versions each recording under
+// prefix has, for recordings that have any
+func VersionCounts(ctx context.Context, storage bucket.Storage, prefix string) (map[string]int, error) {
+	objects, err := storage.ListObjectsWithContext(ctx, VersionsPrefix+prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, obj := range objects {
+		if recording, ok := versionOf(aws.StringValue(obj.Key)); ok {
+			counts[recording]++
+		}
+	}
+	return counts, nil
+}
+
+// versionDir is the prefix a recording's versions are kept under
+func versionDir(key string) string {
+	return VersionsPrefix + strings.TrimSuffix(key, path.Ext(key)) + "/"
+}
+
+// versionKey is where a recording's audio replaced at t is kept
+func versionKey(key string, t time.Time) string {
+	return versionDir(key) + t.UTC().Format(versionTime) + path.Ext(key)
+}
+
+// versionOf returns the recording a version key belongs to
+func versionOf(version string) (string, bool) {
+	rest, ok := strings.CutPrefix(version, VersionsPrefix)
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		return "", false
+	}
+	return rest[:i] + path.Ext(rest[i+1:]), true
+}
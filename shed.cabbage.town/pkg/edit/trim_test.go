@@ -0,0 +1,175 @@
+package edit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+	"cabbage.town/shed.cabbage.town/pkg/catalog"
+	"cabbage.town/shed.cabbage.town/pkg/mp3"
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+// object returns key's body, metadata with canonical keys and canned ACL
+func object(t *testing.T, storage bucket.Storage, key string) ([]byte, map[string]string, string) {
+	t.Helper()
+	output, err := storage.GetObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Body.Close()
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := make(map[string]string)
+	for k, v := range output.Metadata {
+		metadata[http.CanonicalHeaderKey(k)] = aws.StringValue(v)
+	}
+	acl, err := storage.GetObjectACL(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body, metadata, bucket.CannedACL(acl)
+}
+
+func TestTrimAndRestore(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	ctx := context.Background()
+	storage := bucket.NewMemoryClient("test")
+	original := mp3test.Silence(200, false)
+	metadata := map[string]*string{
+		catalog.MetaDisplayName: aws.String("Soup Night"),
+		catalog.MetaWaveform:    aws.String("waveforms/ted/stream_20240101-200000.json"),
+		catalog.MetaLoudness:    aws.String("-16.0"),
+	}
+	for k, v := range catalog.DurationMetadata(5224*time.Millisecond, int64(len(original))) {
+		metadata[k] = v
+	}
+	if err := storage.PutObjectWithMetadata(key, bytes.NewReader(original), "audio/mpeg", metadata, "public-read"); err != nil {
+		t.Fatal(err)
+	}
+
+	trimmed, err := Trim(ctx, storage, key, time.Second, 3*time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := time.Duration(mp3test.FrameSamples) * time.Second / mp3test.SampleRate
+	if d := trimmed.Info.Duration - 2*time.Second; d < -frame || d > frame {
+		t.Errorf("trimmed to %v, want 2s give or take a frame", trimmed.Info.Duration)
+	}
+	if want := "versions/recordings/ted/stream_20240101-200000/"; !strings.HasPrefix(trimmed.Version, want) || !strings.HasSuffix(trimmed.Version, ".mp3") {
+		t.Errorf("version = %s, want an .mp3 under %s", trimmed.Version, want)
+	}
+
+	body, got, acl := object(t, storage, key)
+	info, err := mp3.Probe(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != trimmed.Info.Frames {
+		t.Errorf("stored %d frames, Trim reported %d", info.Frames, trimmed.Info.Frames)
+	}
+	if acl != "public-read" {
+		t.Errorf("trimmed ACL = %s, want public-read", acl)
+	}
+	if got[catalog.MetaDisplayName] != "Soup Night" {
+		t.Errorf("trimmed display name = %q, want it kept", got[catalog.MetaDisplayName])
+	}
+	for _, k := range []string{catalog.MetaWaveform, catalog.MetaLoudness} {
+		if v, ok := got[k]; ok {
+			t.Errorf("trimmed recording still has %s: %s", k, v)
+		}
+	}
+	if entry := (&catalog.Entry{Size: int64(len(body)), Metadata: got}); catalog.CachedDuration(entry) != trimmed.Info.Duration.Round(time.Millisecond) {
+		t.Errorf("cached duration = %v, want %v", catalog.CachedDuration(entry), trimmed.Info.Duration)
+	}
+
+	kept, _, acl := object(t, storage, trimmed.Version)
+	if !bytes.Equal(kept, original) {
+		t.Errorf("version holds %d bytes, want the %d untrimmed", len(kept), len(original))
+	}
+	if acl != "private" {
+		t.Errorf("version ACL = %s, want private", acl)
+	}
+
+	restored, err := Restore(ctx, storage, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != trimmed.Version {
+		t.Errorf("restored %s, want %s", restored, trimmed.Version)
+	}
+	body, got, acl = object(t, storage, key)
+	if !bytes.Equal(body, original) {
+		t.Errorf("restored %d bytes, want the %d untrimmed", len(body), len(original))
+	}
+	if acl != "public-read" {
+		t.Errorf("restored ACL = %s, want public-read", acl)
+	}
+	if v, ok := got[catalog.MetaWaveform]; ok {
+		t.Errorf("restored recording still points at the trimmed waveform %s", v)
+	}
+	if got[catalog.MetaDisplayName] != "Soup Night" || got[catalog.MetaLoudness] != "-16.0" {
+		t.Errorf("restored metadata = %v, want the untrimmed recording's", got)
+	}
+	if _, err := storage.HeadObject(trimmed.Version); !bucket.IsNotFound(err) {
+		t.Errorf("version still there after restoring it: %v", err)
+	}
+
+	if _, err := Restore(ctx, storage, key, ""); !errors.Is(err, ErrNoVersions) {
+		t.Errorf("second Restore() = %v, want %v", err, ErrNoVersions)
+	}
+}
+
+func TestTrimRejects(t *testing.T) {
+	const key = "recordings/ted/stream_20240101-200000.mp3"
+	storage := bucket.NewMemoryClient("test")
+	if err := storage.PutObject(key, mp3test.Silence(40, false), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]time.Duration{{0, 0}, {time.Second, time.Second}, {time.Second, 500 * time.Millisecond}, {-time.Second, 0}} {
+		if _, err := Trim(context.Background(), storage, key, r[0], r[1], ""); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("Trim(%v, %v) = %v, want %v", r[0], r[1], err, ErrInvalidRange)
+		}
+	}
+	if _, err := Trim(context.Background(), storage, key, 0, 500*time.Millisecond, `"stale"`); !errors.Is(err, ErrChanged) {
+		t.Errorf("Trim() of a changed recording = %v, want %v", err, ErrChanged)
+	}
+}
+
+func TestVersionOf(t *testing.T) {
+	key := "recordings/ted/stream_20240101-200000.mp3"
+	version := versionKey(key, time.Date(2024, 1, 2, 3, 4, 5, 600e6, time.UTC))
+	if want := "versions/recordings/ted/stream_20240101-200000/20240102-030405.600.mp3"; version != want {
+		t.Errorf("versionKey() = %s, want %s", version, want)
+	}
+
+	tests := []struct {
+		version string
+		want    string
+		ok      bool
+	}{
+		{version, key, true},
+		{"versions/recordings/ted/soup.night/20240102-030405.600.mp3", "recordings/ted/soup.night.mp3", true},
+		{"versions/stream.mp3", "", false},
+		{"recordings/ted/stream_20240101-200000.mp3", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, ok := versionOf(tt.version)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("versionOf() = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
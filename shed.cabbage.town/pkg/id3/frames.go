@@ -0,0 +1,405 @@
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// IDs of the frames this package has helpers for
+const (
+	Title          = "TIT2"
+	Artist         = "TPE1"
+	Album          = "TALB"
+	Genre          = "TCON"
+	TrackNumber    = "TRCK"
+	Comment        = "COMM"
+	Lyrics         = "USLT"
+	UserText       = "TXXX"
+	Picture        = "APIC"
+	AudioFileURL   = "WOAF" // the file's official web page
+	AudioSourceURL = "WOAS" // the official web page of the audio's source
+)
+
+// PictureFrontCover is the APIC picture type players show as cover art
+const PictureFrontCover = 3
+
+// Text encodings
+const (
+	encodingLatin1  = 0
+	encodingUTF16   = 1 // with byte order mark
+	encodingUTF16BE = 2
+	encodingUTF8    = 3
+)
+
+// Frame returns the first frame with the given ID
+func (t *Tag) Frame(id string) (Frame, bool) {
+	for _, frame := range t.Frames {
+		if frame.ID == id {
+			return frame, true
+		}
+	}
+	return Frame{}, false
+}
+
+// Set replaces every frame with the same ID as frame
+func (t *Tag) Set(frame Frame) {
+	t.replace(frame, func(f Frame) bool { return f.ID == frame.ID })
+}
+
+// Remove removes every frame with the given ID
+func (t *Tag) Remove(id string) {
+	t.removeMatching(func(f Frame) bool { return f.ID == id })
+}
+
+// removeMatching removes every frame that matches
+func (t *Tag) removeMatching(match func(Frame) bool) {
+	frames := t.Frames[:0]
+	for _, frame := range t.Frames {
+		if !match(frame) {
+			frames = append(frames, frame)
+		}
+	}
+	t.Frames = frames
+}
+
+// replace puts frame in place of the first frame that matches, dropping any
+// other matches, or appends it if none do
+func (t *Tag) replace(frame Frame, match func(Frame) bool) {
+	frames := t.Frames[:0]
+	added := false
+	for _, f := range t.Frames {
+		if !match(f) {
+			frames = append(frames, f)
+		} else if !added {
+			frames = append(frames, frame)
+			added = true
+		}
+	}
+	if !added {
+		frames = append(frames, frame)
+	}
+	t.Frames = frames
+}
+
+// Text returns the value of a text frame such as Title, or "" if the tag
+// doesn't have it. Only the first value of a multi-value v2.4 frame is returned.
+func (t *Tag) Text(id string) string {
+	frame, ok := t.Frame(id)
+	if !ok {
+		return ""
+	}
+	data, ok := frame.content(t.Version)
+	if !ok || len(data) == 0 {
+		return ""
+	}
+	value, _ := decodeString(data[0], data[1:])
+	return value
+}
+
+// SetText sets a text frame such as Title, replacing any existing value
+func (t *Tag) SetText(id, value string) {
+	encoding := t.encodingFor(value)
+	data := append([]byte{encoding}, encodeString(encoding, value)...)
+	t.Set(Frame{ID: id, Data: data})
+}
+
+// SetYear sets the recording year: TDRC in v2.4 and TYER in v2.3
+func (t *Tag) SetYear(year int) {
+	if t.Version == 3 {
+		t.SetText("TYER", strconv.Itoa(year))
+	} else {
+		t.SetText("TDRC", strconv.Itoa(year))
+	}
+}
+
+// Comment returns the text of the comment with the given language and
+// description, or "" if there isn't one
+func (t *Tag) Comment(lang, description string) string {
+	return t.langText(Comment, lang, description)
+}
+
+// SetComment sets the comment with the given three-letter language code and
+// description, leaving comments with other descriptions alone
+func (t *Tag) SetComment(lang, description, text string) {
+	t.setLangText(Comment, lang, description, text)
+}
+
+// SetLyrics sets the unsynchronised lyrics frame with the given language and
+// description, or removes it if text is empty
+func (t *Tag) SetLyrics(lang, description, text string) {
+	if text == "" {
+		t.removeLangText(Lyrics, lang, description)
+		return
+	}
+	t.setLangText(Lyrics, lang, description, text)
+}
+
+// UserText returns the value of the TXXX frame with the given description,
+// or "" if there isn't one
+func (t *Tag) UserText(description string) string {
+	for _, frame := range t.Frames {
+		if frame.ID != UserText {
+			continue
+		}
+		if d, value, ok := t.parseUserText(frame); ok && d == description {
+			return value
+		}
+	}
+	return ""
+}
+
+// SetUserText sets the TXXX frame with the given description, or removes it
+// if value is empty
+func (t *Tag) SetUserText(description, value string) {
+	match := func(f Frame) bool {
+		if f.ID != UserText {
+			return false
+		}
+		d, _, ok := t.parseUserText(f)
+		return ok && d == description
+	}
+	if value == "" {
+		t.removeMatching(match)
+		return
+	}
+
+	encoding := t.encodingFor(description + value)
+	data := []byte{encoding}
+	data = append(data, encodeString(encoding, description)...)
+	data = append(data, terminator(encoding)...)
+	data = append(data, encodeString(encoding, value)...)
+	t.replace(Frame{ID: UserText, Data: data}, match)
+}
+
+// SetURL sets a URL link frame such as AudioFileURL, or removes it if url
+// is empty
+func (t *Tag) SetURL(id, url string) {
+	if url == "" {
+		t.Remove(id)
+		return
+	}
+	t.Set(Frame{ID: id, Data: encodeString(encodingLatin1, url)})
+}
+
+// langText returns the text of a COMM or USLT frame with the given language
+// and description
+func (t *Tag) langText(id, lang, description string) string {
+	for _, frame := range t.Frames {
+		if frame.ID != id {
+			continue
+		}
+		if l, d, text, ok := t.parseLangText(frame); ok && l == lang && d == description {
+			return text
+		}
+	}
+	return ""
+}
+
+// setLangText sets a COMM or USLT frame, replacing the one with the same
+// language and description
+func (t *Tag) setLangText(id, lang, description, text string) {
+	encoding := t.encodingFor(description + text)
+	data := []byte{encoding}
+	data = append(data, padLanguage(lang)...)
+	data = append(data, encodeString(encoding, description)...)
+	data = append(data, terminator(encoding)...)
+	data = append(data, encodeString(encoding, text)...)
+
+	t.replace(Frame{ID: id, Data: data}, t.matchLangText(id, lang, description))
+}
+
+func (t *Tag) removeLangText(id, lang, description string) {
+	t.removeMatching(t.matchLangText(id, lang, description))
+}
+
+func (t *Tag) matchLangText(id, lang, description string) func(Frame) bool {
+	return func(f Frame) bool {
+		if f.ID != id {
+			return false
+		}
+		l, d, _, ok := t.parseLangText(f)
+		return ok && l == lang && d == description
+	}
+}
+
+// SetPicture embeds an image of the given APIC picture type, such as
+// PictureFrontCover, replacing any other picture of that type
+func (t *Tag) SetPicture(pictureType byte, mimeType, description string, image []byte) {
+	encoding := t.encodingFor(description)
+	data := []byte{encoding}
+	data = append(data, mimeType...)
+	data = append(data, 0, pictureType)
+	data = append(data, encodeString(encoding, description)...)
+	data = append(data, terminator(encoding)...)
+	data = append(data, image...)
+
+	t.replace(Frame{ID: Picture, Data: data}, func(f Frame) bool {
+		if f.ID != Picture {
+			return false
+		}
+		existing, ok := t.pictureType(f)
+		return ok && existing == pictureType
+	})
+}
+
+// pictureType returns the picture type of an APIC frame
+func (t *Tag) pictureType(frame Frame) (byte, bool) {
+	data, ok := frame.content(t.Version)
+	if !ok || len(data) < 2 {
+		return 0, false
+	}
+	end := bytes.IndexByte(data[1:], 0)
+	if end < 0 || 2+end >= len(data) {
+		return 0, false
+	}
+	return data[2+end], true
+}
+
+// parseLangText parses a frame laid out like COMM and USLT: encoding,
+// language, description and text
+func (t *Tag) parseLangText(frame Frame) (lang, description, text string, ok bool) {
+	data, ok := frame.content(t.Version)
+	if !ok || len(data) < 4 {
+		return "", "", "", false
+	}
+	description, rest := decodeString(data[0], data[4:])
+	text, _ = decodeString(data[0], rest)
+	return string(data[1:4]), description, text, true
+}
+
+func (t *Tag) parseUserText(frame Frame) (description, value string, ok bool) {
+	data, ok := frame.content(t.Version)
+	if !ok || len(data) < 1 {
+		return "", "", false
+	}
+	description, rest := decodeString(data[0], data[1:])
+	value, _ = decodeString(data[0], rest)
+	return description, value, true
+}
+
+// content returns the frame's data with any v2.4 unsynchronisation and data
+// length indicator removed. It reports false for compressed or encrypted frames.
+func (f Frame) content(version byte) ([]byte, bool) {
+	data := f.Data
+	if version == 3 {
+		if f.Flags&0x00C0 != 0 {
+			return nil, false
+		}
+		if f.Flags&0x0020 != 0 && len(data) > 0 {
+			data = data[1:] // group identifier
+		}
+		return data, true
+	}
+
+	if f.Flags&0x000C != 0 {
+		return nil, false
+	}
+	if f.Flags&0x0040 != 0 && len(data) > 0 {
+		data = data[1:] // group identifier
+	}
+	if f.Flags&0x0002 != 0 {
+		data = resync(data)
+	}
+	if f.Flags&0x0001 != 0 && len(data) >= 4 {
+		data = data[4:] // data length indicator
+	}
+	return data, true
+}
+
+// encodingFor picks the encoding to write value in: UTF-8 for v2.4, and for
+// v2.3, which has no UTF-8, Latin-1 if it's enough or UTF-16 otherwise
+func (t *Tag) encodingFor(value string) byte {
+	if t.Version != 3 {
+		return encodingUTF8
+	}
+	for _, r := range value {
+		if r > 0xFF {
+			return encodingUTF16
+		}
+	}
+	return encodingLatin1
+}
+
+func encodeString(encoding byte, s string) []byte {
+	switch encoding {
+	case encodingLatin1:
+		out := make([]byte, 0, len(s))
+		for _, r := range s {
+			out = append(out, byte(r))
+		}
+		return out
+	case encodingUTF16:
+		units := utf16.Encode([]rune(s))
+		out := []byte{0xFF, 0xFE}
+		for _, u := range units {
+			out = append(out, byte(u), byte(u>>8))
+		}
+		return out
+	default:
+		return []byte(s)
+	}
+}
+
+func terminator(encoding byte) []byte {
+	if encoding == encodingUTF16 || encoding == encodingUTF16BE {
+		return []byte{0, 0}
+	}
+	return []byte{0}
+}
+
+// decodeString decodes a string up to its terminator or the end of data,
+// returning it and whatever follows the terminator
+func decodeString(encoding byte, data []byte) (string, []byte) {
+	var raw, rest []byte
+	if encoding == encodingUTF16 || encoding == encodingUTF16BE {
+		raw, rest = data, nil
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				raw, rest = data[:i], data[i+2:]
+				break
+			}
+		}
+	} else if i := bytes.IndexByte(data, 0); i >= 0 {
+		raw, rest = data[:i], data[i+1:]
+	} else {
+		raw = data
+	}
+
+	switch encoding {
+	case encodingLatin1:
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b)
+		}
+		return string(runes), rest
+	case encodingUTF16, encodingUTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == encodingUTF16 && len(raw) >= 2 {
+			if raw[0] == 0xFF && raw[1] == 0xFE {
+				order, raw = binary.LittleEndian, raw[2:]
+			} else if raw[0] == 0xFE && raw[1] == 0xFF {
+				raw = raw[2:]
+			}
+		}
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = order.Uint16(raw[2*i:])
+		}
+		return string(utf16.Decode(units)), rest
+	default:
+		if !utf8.Valid(raw) {
+			return string(bytes.ToValidUTF8(raw, []byte("�"))), rest
+		}
+		return string(raw), rest
+	}
+}
+
+// padLanguage returns a three-byte ISO 639-2 language code
+func padLanguage(lang string) []byte {
+	b := []byte("XXX")
+	copy(b, lang)
+	return b
+}
@@ -0,0 +1,323 @@
+// Package id3 reads and writes ID3v2.3 and ID3v2.4 tags at the start of MP3
+// files.
+//
+// Frames are kept as raw bytes, so frames this package doesn't understand are
+// written back exactly as they were read. A file is rewritten in place when
+// the new tag fits in the space the old one took up, and otherwise copied
+// behind a larger tag with room to grow.
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultVersion is the major version of tags created for untagged files.
+// Files that already have a v2.3 or v2.4 tag keep their version.
+const DefaultVersion = 4
+
+// Padding is the space left after the frames when a file has to be
+// rewritten, so later edits usually fit in place
+const Padding = 1024
+
+const headerSize = 10
+
+// Header flags
+const (
+	flagUnsynchronisation = 0x80
+	flagExtendedHeader    = 0x40
+	flagFooter            = 0x10
+)
+
+// ErrInvalidTag is returned for a tag that claims to be ID3v2 but can't be parsed
+var ErrInvalidTag = errors.New("invalid ID3v2 tag")
+
+// Frame is one frame of a tag. Data is the frame's content as stored, and
+// Flags its two flag bytes, whose meaning depends on the tag version.
+type Frame struct {
+	ID    string
+	Flags uint16
+	Data  []byte
+}
+
+// Tag is an ID3v2 tag
+type Tag struct {
+	// Version is the major version: 3 or 4
+	Version byte
+	Frames  []Frame
+}
+
+// NewTag returns an empty tag of the default version
+func NewTag() *Tag {
+	return &Tag{Version: DefaultVersion}
+}
+
+// Read reads the tag at the start of r. A stream without a tag, or with a
+// tag older than v2.3, gives an empty tag of the default version.
+func Read(r io.Reader) (*Tag, error) {
+	tag, _, err := read(r)
+	return tag, err
+}
+
+// ReadFile reads the tag at the start of the file at path
+func ReadFile(path string) (*Tag, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// read reads the tag at the start of r and returns it with the number of
+// bytes it takes up in the file, which is zero when there is no tag
+func read(r io.Reader) (*Tag, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return NewTag(), 0, nil
+		}
+		return nil, 0, err
+	}
+	if string(header[:3]) != "ID3" {
+		return NewTag(), 0, nil
+	}
+
+	version, flags := header[3], header[5]
+	size := int64(syncsafe(header[6:10]))
+	total := headerSize + size
+	if version >= 4 && flags&flagFooter != 0 {
+		total += headerSize
+	}
+	if version != 3 && version != 4 {
+		// v2.2 uses three-letter frame IDs; it's replaced rather than converted
+		return NewTag(), total, nil
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, fmt.Errorf("%v: %v", ErrInvalidTag, err)
+	}
+	if version == 3 && flags&flagUnsynchronisation != 0 {
+		// v2.4 marks unsynchronisation per frame instead, which is kept with the frame
+		body = resync(body)
+	}
+	if flags&flagExtendedHeader != 0 {
+		skip, err := extendedHeaderSize(body, version)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = body[skip:]
+	}
+
+	frames, err := parseFrames(body, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Tag{Version: version, Frames: frames}, total, nil
+}
+
+// extendedHeaderSize returns how many bytes of body the extended header uses
+func extendedHeaderSize(body []byte, version byte) (int, error) {
+	if len(body) < 4 {
+		return 0, ErrInvalidTag
+	}
+	var size int
+	if version == 3 {
+		// The v2.3 size excludes the size bytes themselves
+		size = int(binary.BigEndian.Uint32(body)) + 4
+	} else {
+		size = syncsafe(body[:4])
+	}
+	if size < 4 || size > len(body) {
+		return 0, ErrInvalidTag
+	}
+	return size, nil
+}
+
+func parseFrames(body []byte, version byte) ([]Frame, error) {
+	var frames []Frame
+	for len(body) >= headerSize {
+		if body[0] == 0 {
+			break // padding
+		}
+		id := string(body[:4])
+		var size int
+		if version == 3 {
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		} else {
+			size = syncsafe(body[4:8])
+		}
+		if size < 0 || headerSize+size > len(body) {
+			return nil, fmt.Errorf("%v: frame %q overruns the tag", ErrInvalidTag, id)
+		}
+		frames = append(frames, Frame{
+			ID:    id,
+			Flags: binary.BigEndian.Uint16(body[8:10]),
+			Data:  append([]byte(nil), body[headerSize:headerSize+size]...),
+		})
+		body = body[headerSize+size:]
+	}
+	return frames, nil
+}
+
+// Bytes encodes the tag, followed by n bytes of padding
+func (t *Tag) Bytes(n int) ([]byte, error) {
+	if t.Version != 3 && t.Version != 4 {
+		return nil, fmt.Errorf("unsupported ID3v2 version: 2.%d", t.Version)
+	}
+
+	var frames bytes.Buffer
+	for _, frame := range t.Frames {
+		if frame.discardOnTagAlter(t.Version) {
+			continue
+		}
+		if len(frame.ID) != 4 {
+			return nil, fmt.Errorf("invalid frame ID: %q", frame.ID)
+		}
+		size := make([]byte, 4)
+		if t.Version == 3 {
+			binary.BigEndian.PutUint32(size, uint32(len(frame.Data)))
+		} else {
+			if len(frame.Data) >= 1<<28 {
+				return nil, fmt.Errorf("frame %s is too large", frame.ID)
+			}
+			putSyncsafe(size, len(frame.Data))
+		}
+		frames.WriteString(frame.ID)
+		frames.Write(size)
+		binary.Write(&frames, binary.BigEndian, frame.Flags)
+		frames.Write(frame.Data)
+	}
+
+	size := frames.Len() + n
+	if size >= 1<<28 {
+		return nil, errors.New("tag is too large")
+	}
+	out := make([]byte, headerSize, headerSize+size)
+	copy(out, "ID3")
+	out[3] = t.Version
+	putSyncsafe(out[6:10], size)
+	out = append(out, frames.Bytes()...)
+	return append(out, make([]byte, n)...), nil
+}
+
+// discardOnTagAlter reports whether the frame asks to be dropped when any
+// other part of the tag changes
+func (f Frame) discardOnTagAlter(version byte) bool {
+	if version == 3 {
+		return f.Flags&0x8000 != 0
+	}
+	return f.Flags&0x4000 != 0
+}
+
+// WriteFile replaces the tag at the start of the file at path, leaving the
+// audio after it untouched
+func WriteFile(path string, tag *Tag) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, oldSize, err := read(file)
+	if err != nil {
+		return fmt.Errorf("failed to read existing tag: %v", err)
+	}
+
+	frames, err := tag.Bytes(0)
+	if err != nil {
+		return err
+	}
+	if oldSize > 0 && int64(len(frames)) <= oldSize {
+		// Fits in the old tag's space: pad it out and overwrite in place
+		data, err := tag.Bytes(int(oldSize) - len(frames))
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(data, 0); err != nil {
+			return fmt.Errorf("failed to write tag: %v", err)
+		}
+		return file.Close()
+	}
+
+	data, err := tag.Bytes(Padding)
+	if err != nil {
+		return err
+	}
+	return rewrite(path, file, oldSize, data)
+}
+
+// rewrite writes data followed by the contents of file after offset to a
+// temporary file, then moves it over path
+func rewrite(path string, file *os.File, offset int64, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := temp.Write(data); err != nil {
+		return fmt.Errorf("failed to write tag: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek past old tag: %v", err)
+	}
+	if _, err := io.Copy(temp, file); err != nil {
+		return fmt.Errorf("failed to copy audio: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if stat, err := file.Stat(); err == nil {
+		os.Chmod(temp.Name(), stat.Mode())
+	}
+	file.Close()
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace file: %v", err)
+	}
+	return nil
+}
+
+// UpdateFile reads the tag of the file at path, passes it to update and
+// writes the result back
+func UpdateFile(path string, update func(*Tag) error) error {
+	tag, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := update(tag); err != nil {
+		return err
+	}
+	return WriteFile(path, tag)
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, n int) {
+	b[0] = byte(n>>21) & 0x7f
+	b[1] = byte(n>>14) & 0x7f
+	b[2] = byte(n>>7) & 0x7f
+	b[3] = byte(n) & 0x7f
+}
+
+// resync undoes unsynchronisation, which inserts a zero after every 0xFF
+func resync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
@@ -0,0 +1,283 @@
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+// unknownData is the content of a frame this package has no helpers for. It
+// has false syncs in it, so unsynchronisation changes it on disk.
+var unknownData = []byte{0x01, 0xFF, 0xE0, 0x02, 0xFF, 0x00, 0x03, 0xFF}
+
+// rawFrame encodes a frame by hand, independently of Tag.Bytes
+func rawFrame(version byte, id string, flags uint16, data []byte) []byte {
+	out := []byte(id)
+	size := make([]byte, 4)
+	if version == 3 {
+		binary.BigEndian.PutUint32(size, uint32(len(data)))
+	} else {
+		putSyncsafe(size, len(data))
+	}
+	out = append(out, size...)
+	out = append(out, byte(flags>>8), byte(flags))
+	return append(out, data...)
+}
+
+// unsynchronise inserts a zero after every 0xFF that's followed by a byte
+// with its top three bits set or by a zero, or that ends the data
+func unsynchronise(b []byte) []byte {
+	var out []byte
+	for i, c := range b {
+		out = append(out, c)
+		if c == 0xFF && (i+1 == len(b) || b[i+1]&0xE0 == 0xE0 || b[i+1] == 0) {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+// fixture is a sample MP3 file: an ID3v2 tag laid out by hand followed by
+// a few frames of audio
+type fixture struct {
+	name    string
+	version byte
+	// flags are the tag header flags; extended is an extended header and
+	// footer asks for a v2.4 footer
+	flags    byte
+	extended []byte
+	footer   bool
+	// frames are the frames as they'll appear in the body, and unknown the
+	// frame that should come back byte-for-byte
+	frames  [][]byte
+	unknown Frame
+	padding int
+}
+
+func (f fixture) tagged() bool {
+	return f.version != 0
+}
+
+// bytes returns the whole file and the audio in it
+func (f fixture) bytes() (file, audio []byte) {
+	audio = mp3test.Silence(4, false)
+	if !f.tagged() {
+		return audio, audio
+	}
+	body := append([]byte(nil), f.extended...)
+	for _, frame := range f.frames {
+		body = append(body, frame...)
+	}
+	body = append(body, make([]byte, f.padding)...)
+	if f.flags&flagUnsynchronisation != 0 && f.version == 3 {
+		body = unsynchronise(body)
+	}
+
+	header := []byte{'I', 'D', '3', f.version, 0, f.flags, 0, 0, 0, 0}
+	putSyncsafe(header[6:], len(body))
+	file = append(header, body...)
+	if f.footer {
+		footer := append([]byte(nil), header...)
+		copy(footer, "3DI")
+		file = append(file, footer...)
+	}
+	return append(file, audio...), audio
+}
+
+func fixtures() []fixture {
+	title3 := rawFrame(3, Title, 0, append([]byte{encodingLatin1}, "Soup"...))
+	title4 := rawFrame(4, Title, 0, append([]byte{encodingUTF8}, "Soup"...))
+	unknown3 := Frame{ID: "XSOP", Flags: 0x0020, Data: append([]byte{0x07}, unknownData...)} // grouped
+	unknown4 := Frame{ID: "XSOP", Flags: 0x0041, Data: append([]byte{0x07, 0, 0, 0, 8}, unknownData...)}
+	unsynced4 := Frame{ID: "XSOP", Flags: 0x0002, Data: unsynchronise(unknownData)}
+	frame := func(version byte, f Frame) []byte {
+		return rawFrame(version, f.ID, f.Flags, f.Data)
+	}
+
+	return []fixture{
+		{name: "untagged"},
+		{
+			name: "v2.3", version: 3, padding: 64,
+			frames: [][]byte{title3, frame(3, unknown3)}, unknown: unknown3,
+		},
+		{
+			name: "v2.4", version: 4, padding: 64,
+			frames: [][]byte{title4, frame(4, unknown4)}, unknown: unknown4,
+		},
+		{
+			name: "v2.3 unsynchronised", version: 3, flags: flagUnsynchronisation,
+			frames: [][]byte{title3, frame(3, unknown3)}, unknown: unknown3,
+		},
+		{
+			name: "v2.4 unsynchronised", version: 4, flags: flagUnsynchronisation,
+			frames: [][]byte{title4, frame(4, unsynced4)}, unknown: unsynced4,
+		},
+		{
+			name: "v2.3 extended header", version: 3, flags: flagExtendedHeader, padding: 16,
+			// Size excluding itself, flags and the padding size
+			extended: []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 16},
+			frames:   [][]byte{title3, frame(3, unknown3)}, unknown: unknown3,
+		},
+		{
+			name: "v2.4 extended header", version: 4, flags: flagExtendedHeader,
+			// Size including itself, one flag byte, no flags set
+			extended: []byte{0, 0, 0, 6, 1, 0},
+			frames:   [][]byte{title4, frame(4, unknown4)}, unknown: unknown4,
+		},
+		{
+			name: "v2.4 footer", version: 4, flags: flagFooter, footer: true,
+			frames: [][]byte{title4, frame(4, unknown4)}, unknown: unknown4,
+		},
+	}
+}
+
+func TestRead(t *testing.T) {
+	for _, f := range fixtures() {
+		t.Run(f.name, func(t *testing.T) {
+			data, _ := f.bytes()
+			tag, err := Read(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.tagged() {
+				if tag.Version != DefaultVersion || len(tag.Frames) != 0 {
+					t.Errorf("tag = %+v, want an empty v2.%d tag", tag, DefaultVersion)
+				}
+				return
+			}
+			if tag.Version != f.version {
+				t.Errorf("version = %d, want %d", tag.Version, f.version)
+			}
+			if got := tag.Text(Title); got != "Soup" {
+				t.Errorf("title = %q, want %q", got, "Soup")
+			}
+			checkUnknown(t, tag, f.unknown)
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	cover := bytes.Repeat([]byte{0xFF, 0xD8, 0x00, 0xFF}, 1024)
+	edits := []struct {
+		name    string
+		edit    func(*Tag)
+		inPlace bool
+	}{
+		{"in place", func(tag *Tag) { tag.SetText(Title, "Stew") }, true},
+		{"rewrite", func(tag *Tag) {
+			tag.SetText(Title, "Stew")
+			tag.SetPicture(PictureFrontCover, "image/jpeg", "", cover)
+		}, false},
+	}
+
+	for _, f := range fixtures() {
+		for _, e := range edits {
+			if !f.tagged() && e.inPlace {
+				continue // there's no old tag to fit into
+			}
+			t.Run(f.name+"/"+e.name, func(t *testing.T) {
+				data, audio := f.bytes()
+				path := filepath.Join(t.TempDir(), "recording.mp3")
+				if err := os.WriteFile(path, data, 0640); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := UpdateFile(path, func(tag *Tag) error {
+					e.edit(tag)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				written, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.inPlace && len(written) != len(data) {
+					t.Errorf("file is %d bytes, want %d as before", len(written), len(data))
+				}
+				if !e.inPlace {
+					if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0640 {
+						t.Errorf("rewritten file mode = %v, %v; want 0640", stat.Mode().Perm(), err)
+					}
+				}
+				if len(written) < headerSize || string(written[:3]) != "ID3" {
+					t.Fatalf("file doesn't start with a tag")
+				}
+				if written[5]&(flagUnsynchronisation|flagExtendedHeader|flagFooter) != 0 {
+					t.Errorf("header flags = %#x, want none", written[5])
+				}
+				size := headerSize + syncsafe(written[6:10])
+				if size > len(written) || !bytes.Equal(written[size:], audio) {
+					t.Fatalf("audio after the %d byte tag changed", size)
+				}
+
+				tag, err := Read(bytes.NewReader(written))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := f.version
+				if !f.tagged() {
+					want = DefaultVersion
+				}
+				if tag.Version != want {
+					t.Errorf("version = %d, want %d", tag.Version, want)
+				}
+				if got := tag.Text(Title); got != "Stew" {
+					t.Errorf("title = %q, want %q", got, "Stew")
+				}
+				if f.tagged() {
+					checkUnknown(t, tag, f.unknown)
+				}
+				if !e.inPlace {
+					picture, ok := tag.Frame(Picture)
+					if !ok || !bytes.HasSuffix(picture.Data, cover) {
+						t.Errorf("cover art missing or changed")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWriteFileDropsFramesMarkedDiscard(t *testing.T) {
+	title := rawFrame(4, Title, 0, append([]byte{encodingUTF8}, "Soup"...))
+	discard := rawFrame(4, "XDIS", 0x4000, []byte{1, 2, 3})
+	f := fixture{version: 4, frames: [][]byte{title, discard}, padding: 16}
+	data, _ := f.bytes()
+	path := filepath.Join(t.TempDir(), "recording.mp3")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateFile(path, func(tag *Tag) error {
+		tag.SetText(Title, "Stew")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tag.Frame("XDIS"); ok {
+		t.Errorf("frame marked to discard on tag alteration was kept")
+	}
+}
+
+// checkUnknown checks the tag kept want exactly as it was read
+func checkUnknown(t *testing.T, tag *Tag, want Frame) {
+	t.Helper()
+	got, ok := tag.Frame(want.ID)
+	if !ok {
+		t.Errorf("unknown frame %s missing", want.ID)
+		return
+	}
+	if got.Flags != want.Flags || !bytes.Equal(got.Data, want.Data) {
+		t.Errorf("unknown frame = %#x %x, want %#x %x", got.Flags, got.Data, want.Flags, want.Data)
+	}
+}
@@ -0,0 +1,267 @@
+// Package mp3 reads MPEG audio frame headers to work out how long a stream is,
+// and splices streams together on frame boundaries.
+//
+// Files with a Xing, Info or VBRI header are measured from the frame count in
+// that header, which only needs the start of the file. Anything else is
+// measured by walking every frame header to the end of the stream.
+package mp3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNoFrames is returned when no MPEG audio frame can be found
+var ErrNoFrames = errors.New("no MPEG audio frames found")
+
+// Info describes an MPEG audio stream
+type Info struct {
+	Duration   time.Duration
+	Frames     int64
+	SampleRate int
+	// VBR is true when the length came from a Xing or VBRI header rather than
+	// from counting frames. LAME writes an Info header for CBR files too, so
+	// this doesn't always mean the bitrate varies.
+	VBR bool
+}
+
+// MPEG version as encoded in the frame header
+const (
+	mpeg25 = 0
+	mpeg2  = 2
+	mpeg1  = 3
+)
+
+// Layer as encoded in the frame header
+const (
+	layer3 = 1
+	layer2 = 2
+	layer1 = 3
+)
+
+// bitrates in kbps, indexed by [table][bitrate index]
+var bitrates = [5][16]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // MPEG-1 layer I
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // MPEG-1 layer II
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // MPEG-1 layer III
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},    // MPEG-2/2.5 layer I
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},         // MPEG-2/2.5 layer II and III
+}
+
+// sampleRates in Hz, indexed by [version][sample rate index]
+var sampleRates = map[int][3]int{
+	mpeg1:  {44100, 48000, 32000},
+	mpeg2:  {22050, 24000, 16000},
+	mpeg25: {11025, 12000, 8000},
+}
+
+// frameHeader is a parsed four-byte frame header
+type frameHeader struct {
+	version    int
+	layer      int
+	bitrate    int // kbps
+	sampleRate int
+	padding    bool
+	mono       bool
+}
+
+// parseHeader parses b as a frame header, reporting false if it isn't one
+func parseHeader(b []byte) (frameHeader, bool) {
+	if b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return frameHeader{}, false
+	}
+	h := frameHeader{
+		version: int(b[1]>>3) & 3,
+		layer:   int(b[1]>>1) & 3,
+		padding: b[2]&0x02 != 0,
+		mono:    b[3]>>6 == 3,
+	}
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int(b[2]>>2) & 3
+	if h.version == 1 || h.layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return frameHeader{}, false
+	}
+
+	var table int
+	switch {
+	case h.version == mpeg1 && h.layer == layer1:
+		table = 0
+	case h.version == mpeg1 && h.layer == layer2:
+		table = 1
+	case h.version == mpeg1:
+		table = 2
+	case h.layer == layer1:
+		table = 3
+	default:
+		table = 4
+	}
+	h.bitrate = bitrates[table][bitrateIndex]
+	h.sampleRate = sampleRates[h.version][sampleRateIndex]
+	return h, true
+}
+
+// samples returns the number of samples per channel in the frame
+func (h frameHeader) samples() int {
+	switch {
+	case h.layer == layer1:
+		return 384
+	case h.layer == layer3 && h.version != mpeg1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// length returns the size of the frame in bytes, including the header
+func (h frameHeader) length() int {
+	// Layer I frames are made of four-byte slots, the others of single bytes
+	if h.layer == layer1 {
+		n := 12 * h.bitrate * 1000 / h.sampleRate
+		if h.padding {
+			n++
+		}
+		return n * 4
+	}
+	n := h.samples() / 8 * h.bitrate * 1000 / h.sampleRate
+	if h.padding {
+		n++
+	}
+	return n
+}
+
+// xingOffset returns where a Xing or Info header starts in the frame
+func (h frameHeader) xingOffset() int {
+	switch {
+	case h.version == mpeg1 && h.mono:
+		return 4 + 17
+	case h.version == mpeg1:
+		return 4 + 32
+	case h.mono:
+		return 4 + 9
+	default:
+		return 4 + 17
+	}
+}
+
+// vbrFrames returns the frame count from a Xing, Info or VBRI header in
+// frame, which must be the whole first frame
+func vbrFrames(h frameHeader, frame []byte) (int64, bool) {
+	if off := h.xingOffset(); len(frame) >= off+12 {
+		tag := string(frame[off : off+4])
+		flags := binary.BigEndian.Uint32(frame[off+4:])
+		if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+			return int64(binary.BigEndian.Uint32(frame[off+8:])), true
+		}
+	}
+	// VBRI always sits 32 bytes after the header
+	if off := 4 + 32; len(frame) >= off+18 && string(frame[off:off+4]) == "VBRI" {
+		return int64(binary.BigEndian.Uint32(frame[off+14:])), true
+	}
+	return 0, false
+}
+
+// Probe reads r until it knows the stream's duration. It stops after the
+// first frame when there is a VBR header and reads to EOF otherwise.
+func Probe(r io.Reader) (Info, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	if err := skipID3v2(br); err != nil {
+		return Info{}, err
+	}
+
+	first, err := nextHeader(br)
+	if err != nil {
+		return Info{}, err
+	}
+	frame := make([]byte, first.length())
+	if _, err := io.ReadFull(br, frame); err != nil {
+		return Info{}, ErrNoFrames
+	}
+
+	info := Info{SampleRate: first.sampleRate}
+	samplesPerFrame := int64(first.samples())
+	if frames, ok := vbrFrames(first, frame); ok {
+		info.Frames = frames
+		info.VBR = true
+		info.Duration = samplesDuration(frames*samplesPerFrame, first.sampleRate)
+		return info, nil
+	}
+
+	samples := samplesPerFrame
+	info.Frames = 1
+	for {
+		h, err := nextHeader(br)
+		if err == ErrNoFrames {
+			break
+		}
+		if err != nil {
+			return Info{}, err
+		}
+		if _, err := br.Discard(h.length()); err != nil {
+			break // truncated last frame
+		}
+		info.Frames++
+		samples += int64(h.samples())
+	}
+	info.Duration = samplesDuration(samples, first.sampleRate)
+	return info, nil
+}
+
+// Channels reads r up to its first frame header and returns how many
+// channels the stream has: 1 for mono, and 2 for stereo, joint stereo and
+// dual channel
+func Channels(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if err := skipID3v2(br); err != nil {
+		return 0, err
+	}
+	h, err := nextHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	if h.mono {
+		return 1, nil
+	}
+	return 2, nil
+}
+
+// skipID3v2 skips an ID3v2 tag at the start of the stream, if there is one
+func skipID3v2(br *bufio.Reader) error {
+	header, err := br.Peek(10)
+	if err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+	size := int(header[6])<<21 | int(header[7])<<14 | int(header[8])<<7 | int(header[9])
+	if header[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	if _, err := br.Discard(10 + size); err != nil {
+		return fmt.Errorf("failed to skip ID3v2 tag: %v", err)
+	}
+	return nil
+}
+
+// nextHeader skips to the next frame header and parses it, leaving the
+// header unread. It returns ErrNoFrames at EOF.
+func nextHeader(br *bufio.Reader) (frameHeader, error) {
+	for {
+		b, err := br.Peek(4)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return frameHeader{}, ErrNoFrames
+			}
+			return frameHeader{}, err
+		}
+		if h, ok := parseHeader(b); ok {
+			return h, nil
+		}
+		br.Discard(1)
+	}
+}
+
+func samplesDuration(samples int64, sampleRate int) time.Duration {
+	return time.Duration(samples * int64(time.Second) / int64(sampleRate))
+}
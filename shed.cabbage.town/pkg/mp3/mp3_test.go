@@ -0,0 +1,202 @@
+package mp3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"cabbage.town/shed.cabbage.town/pkg/mp3/mp3test"
+)
+
+// withVBRHeader returns stream with a Xing, Info or VBRI header claiming
+// frames frames written into its first frame at off
+func withVBRHeader(stream []byte, tag string, off int, frames uint32) []byte {
+	stream = append([]byte(nil), stream...)
+	copy(stream[off:], tag)
+	if tag == "VBRI" {
+		binary.BigEndian.PutUint32(stream[off+14:], frames)
+		return stream
+	}
+	binary.BigEndian.PutUint32(stream[off+4:], 1) // frame count present
+	binary.BigEndian.PutUint32(stream[off+8:], frames)
+	return stream
+}
+
+// mpeg2Silence returns MPEG-2 Layer III frames at 64kbps and 22.05kHz
+func mpeg2Silence(frames int, mono bool) []byte {
+	frame := make([]byte, 208)
+	// Sync, MPEG-2, Layer III, no CRC; 64kbps, 22.05kHz, no padding
+	frame[0], frame[1], frame[2] = 0xFF, 0xF3, 0x80
+	if mono {
+		frame[3] = 0xC0
+	}
+	return bytes.Repeat(frame, frames)
+}
+
+// id3v24 returns an ID3v2.4 tag with a footer around body
+func id3v24(body []byte) []byte {
+	size := []byte{byte(len(body) >> 21 & 0x7F), byte(len(body) >> 14 & 0x7F), byte(len(body) >> 7 & 0x7F), byte(len(body) & 0x7F)}
+	tag := append([]byte("ID3\x04\x00\x10"), size...)
+	tag = append(tag, body...)
+	tag = append(tag, "3DI\x04\x00\x10"...)
+	return append(tag, size...)
+}
+
+func TestProbe(t *testing.T) {
+	mpeg1 := func(frames int64) time.Duration {
+		return samplesDuration(frames*mp3test.FrameSamples, mp3test.SampleRate)
+	}
+	tests := []struct {
+		name       string
+		stream     []byte
+		wantFrames int64
+		wantRate   int
+		wantVBR    bool
+		wantDur    time.Duration
+	}{
+		{
+			name:       "CBR",
+			stream:     mp3test.Silence(100, false),
+			wantFrames: 100,
+			wantRate:   44100,
+			wantDur:    mpeg1(100),
+		},
+		{
+			name:       "Xing",
+			stream:     withVBRHeader(mp3test.Silence(10, false), "Xing", 4+32, 5000),
+			wantFrames: 5000,
+			wantRate:   44100,
+			wantVBR:    true,
+			wantDur:    mpeg1(5000),
+		},
+		{
+			name:       "Info",
+			stream:     withVBRHeader(mp3test.Silence(10, false), "Info", 4+32, 5000),
+			wantFrames: 5000,
+			wantRate:   44100,
+			wantVBR:    true,
+			wantDur:    mpeg1(5000),
+		},
+		{
+			name:       "VBRI",
+			stream:     withVBRHeader(mp3test.Silence(10, false), "VBRI", 4+32, 5000),
+			wantFrames: 5000,
+			wantRate:   44100,
+			wantVBR:    true,
+			wantDur:    mpeg1(5000),
+		},
+		{
+			name:       "mono Xing",
+			stream:     withVBRHeader(mp3test.Silence(10, true), "Xing", 4+17, 5000),
+			wantFrames: 5000,
+			wantRate:   44100,
+			wantVBR:    true,
+			wantDur:    mpeg1(5000),
+		},
+		{
+			// A mono Xing header isn't looked for at the stereo offset
+			name:       "mono Xing at stereo offset",
+			stream:     withVBRHeader(mp3test.Silence(10, true), "Xing", 4+32, 5000),
+			wantFrames: 10,
+			wantRate:   44100,
+			wantDur:    mpeg1(10),
+		},
+		{
+			name:       "MPEG-2 CBR",
+			stream:     mpeg2Silence(100, false),
+			wantFrames: 100,
+			wantRate:   22050,
+			wantDur:    samplesDuration(100*576, 22050),
+		},
+		{
+			name:       "MPEG-2 Xing",
+			stream:     withVBRHeader(mpeg2Silence(10, false), "Xing", 4+17, 5000),
+			wantFrames: 5000,
+			wantRate:   22050,
+			wantVBR:    true,
+			wantDur:    samplesDuration(5000*576, 22050),
+		},
+		{
+			name:       "MPEG-2 mono Xing",
+			stream:     withVBRHeader(mpeg2Silence(10, true), "Xing", 4+9, 5000),
+			wantFrames: 5000,
+			wantRate:   22050,
+			wantVBR:    true,
+			wantDur:    samplesDuration(5000*576, 22050),
+		},
+		{
+			// Cover art in the tag can look like frame headers
+			name:       "ID3v2.4 with footer",
+			stream:     append(id3v24(mp3test.Silence(3, false)), mp3test.Silence(100, false)...),
+			wantFrames: 100,
+			wantRate:   44100,
+			wantDur:    mpeg1(100),
+		},
+		{
+			name:       "truncated last frame",
+			stream:     mp3test.Silence(100, false)[:100*mp3test.FrameLength-10],
+			wantFrames: 99,
+			wantRate:   44100,
+			wantDur:    mpeg1(99),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Probe(bytes.NewReader(tt.stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Frames != tt.wantFrames || info.SampleRate != tt.wantRate || info.VBR != tt.wantVBR || info.Duration != tt.wantDur {
+				t.Errorf("Probe() = %+v, want %d frames at %dHz, VBR %v, %v", info, tt.wantFrames, tt.wantRate, tt.wantVBR, tt.wantDur)
+			}
+		})
+	}
+}
+
+func TestProbeNoFrames(t *testing.T) {
+	for name, stream := range map[string][]byte{
+		"empty":    nil,
+		"not MPEG": bytes.Repeat([]byte("soup"), 1000),
+		"tag only": id3v24([]byte("soup")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Probe(bytes.NewReader(stream)); err != ErrNoFrames {
+				t.Errorf("Probe() error = %v, want %v", err, ErrNoFrames)
+			}
+		})
+	}
+}
+
+func TestSkipID3v2Footer(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader(append(id3v24([]byte("soup")), mp3test.Silence(1, false)...)))
+	if err := skipID3v2(br); err != nil {
+		t.Fatal(err)
+	}
+	next, err := br.Peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next[0] != 0xFF || next[1] != 0xFB {
+		t.Errorf("after the tag: % x, want the first frame header", next)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+		want   int
+	}{
+		{"stereo", mp3test.Silence(1, false), 2},
+		{"mono", mp3test.Silence(1, true), 1},
+		{"MPEG-2 mono after a tag", append(id3v24(nil), mpeg2Silence(1, true)...), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Channels(bytes.NewReader(tt.stream)); err != nil || got != tt.want {
+				t.Errorf("Channels() = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+// Package mp3test builds small MPEG audio streams for tests, so code that
+// reads, decodes or splices recordings can run without fixture files.
+package mp3test
+
+import "bytes"
+
+// FrameLength is the size in bytes of each frame Silence writes: MPEG-1
+// Layer III at 128kbps and 44.1kHz, without padding
+const FrameLength = 417
+
+// FrameSamples is the number of samples per channel in each frame
+const FrameSamples = 1152
+
+// SampleRate is the sample rate of the frames Silence writes
+const SampleRate = 44100
+
+// Silence returns frames of digital silence. Each frame is a valid header
+// followed by zeroed side information and main data, which decoders read as
+// silence. Mono streams have one channel, others are stereo.
+func Silence(frames int, mono bool) []byte {
+	frame := make([]byte, FrameLength)
+	// Sync, MPEG-1, Layer III, no CRC; 128kbps, 44.1kHz, no padding
+	frame[0], frame[1], frame[2] = 0xFF, 0xFB, 0x90
+	if mono {
+		frame[3] = 0xC0
+	}
+	return bytes.Repeat(frame, frames)
+}
@@ -0,0 +1,227 @@
+package mp3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrEmptyRange is returned by Append when no frames fall in the range
+var ErrEmptyRange = errors.New("no audio in range")
+
+// ErrFormatMismatch is returned by Append for a stream whose frames can't be
+// joined onto the ones already written
+var ErrFormatMismatch = errors.New("streams have different formats")
+
+// xingSize is the length of a Xing header with the frame count, byte count
+// and seek table
+const xingSize = 4 + 4 + 4 + 4 + 100
+
+// Splicer joins stretches of MPEG audio streams into one without decoding
+// them. Frames are copied whole, so cuts land on frame boundaries: about 26ms
+// apart for 44.1kHz layer III. Each stream's ID3v2 tag and Xing, Info or VBRI
+// header is dropped, and a Xing header describing the result is written in
+// front of the first frame by Finish. Layer III frames can borrow bits from
+// the frames before them, so the first few milliseconds after a cut may
+// decode as a click or a brief silence.
+type Splicer struct {
+	w     io.WriteSeeker
+	bw    *bufio.Writer
+	start int64 // where the stream starts in w
+
+	first frameHeader
+	xing  []byte // placeholder Xing frame, nil if the stream won't have one
+
+	frames  int64
+	samples int64
+	bytes   int64   // of audio frames written
+	offsets []int64 // where each frame starts, from the first audio frame
+	vbr     bool
+}
+
+// NewSplicer returns a splicer writing to w from its current offset, so an
+// ID3v2 tag can be written before the stream
+func NewSplicer(w io.WriteSeeker) (*Splicer, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find stream start: %v", err)
+	}
+	return &Splicer{w: w, bw: bufio.NewWriterSize(w, 64*1024), start: start}, nil
+}
+
+// Append copies the frames of r that overlap from to to, measured from the
+// start of r. A zero to copies to the end of the stream. Every stream
+// appended must have the same MPEG version, layer, sample rate and channel
+// count as the first.
+func (s *Splicer) Append(r io.Reader, from, to time.Duration) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	if err := skipID3v2(br); err != nil {
+		return err
+	}
+
+	var seen, copied int
+	var elapsed int64 // samples into r
+	var frame []byte
+	for {
+		h, err := nextHeader(br)
+		if err == ErrNoFrames {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if s.frames > 0 && !s.matches(h) {
+			if seen == 0 {
+				return fmt.Errorf("%w: %d Hz %s after %d Hz %s", ErrFormatMismatch,
+					h.sampleRate, h.channels(), s.first.sampleRate, s.first.channels())
+			}
+			// A false sync in junk between frames
+			br.Discard(1)
+			continue
+		}
+
+		if cap(frame) < h.length() {
+			frame = make([]byte, h.length())
+		}
+		frame = frame[:h.length()]
+		if _, err := io.ReadFull(br, frame); err != nil {
+			break // truncated last frame
+		}
+		seen++
+		if _, ok := vbrFrames(h, frame); ok && seen == 1 {
+			continue
+		}
+
+		start := samplesDuration(elapsed, h.sampleRate)
+		elapsed += int64(h.samples())
+		if to > 0 && start >= to {
+			break
+		}
+		if samplesDuration(elapsed, h.sampleRate) <= from {
+			continue
+		}
+		if err := s.write(h, frame); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	if copied == 0 {
+		return ErrEmptyRange
+	}
+	return nil
+}
+
+// Finish writes the Xing header and returns what was written. Nothing may
+// be appended afterwards.
+func (s *Splicer) Finish() (Info, error) {
+	if s.frames == 0 {
+		return Info{}, ErrNoFrames
+	}
+	if err := s.bw.Flush(); err != nil {
+		return Info{}, fmt.Errorf("failed to write stream: %v", err)
+	}
+
+	if s.xing != nil {
+		s.fillXing()
+		if _, err := s.w.Seek(s.start, io.SeekStart); err != nil {
+			return Info{}, fmt.Errorf("failed to seek to Xing header: %v", err)
+		}
+		if _, err := s.w.Write(s.xing); err != nil {
+			return Info{}, fmt.Errorf("failed to write Xing header: %v", err)
+		}
+		if _, err := s.w.Seek(0, io.SeekEnd); err != nil {
+			return Info{}, err
+		}
+	}
+
+	return Info{
+		Duration:   samplesDuration(s.samples, s.first.sampleRate),
+		Frames:     s.frames,
+		SampleRate: s.first.sampleRate,
+		VBR:        s.xing != nil,
+	}, nil
+}
+
+func (s *Splicer) write(h frameHeader, frame []byte) error {
+	if s.frames == 0 {
+		s.first = h
+		if h.layer == layer3 {
+			s.xing = xingFrame(frame[:4])
+		}
+		if s.xing != nil {
+			if _, err := s.bw.Write(s.xing); err != nil {
+				return fmt.Errorf("failed to write stream: %v", err)
+			}
+		}
+	}
+	if h.bitrate != s.first.bitrate {
+		s.vbr = true
+	}
+
+	if _, err := s.bw.Write(frame); err != nil {
+		return fmt.Errorf("failed to write stream: %v", err)
+	}
+	s.offsets = append(s.offsets, s.bytes)
+	s.bytes += int64(len(frame))
+	s.frames++
+	s.samples += int64(h.samples())
+	return nil
+}
+
+// matches reports whether h can follow the frames already written
+func (s *Splicer) matches(h frameHeader) bool {
+	return h.version == s.first.version && h.layer == s.first.layer &&
+		h.sampleRate == s.first.sampleRate && h.mono == s.first.mono
+}
+
+// fillXing writes the totals and seek table into the Xing frame. Streams
+// whose frames all share a bitrate get an Info header instead, as LAME does.
+func (s *Splicer) fillXing() {
+	h, _ := parseHeader(s.xing)
+	b := s.xing[h.xingOffset():]
+	if s.vbr {
+		copy(b, "Xing")
+	} else {
+		copy(b, "Info")
+	}
+	binary.BigEndian.PutUint32(b[4:], 0x7) // frames, bytes and TOC
+	binary.BigEndian.PutUint32(b[8:], uint32(s.frames))
+	total := int64(len(s.xing)) + s.bytes
+	binary.BigEndian.PutUint32(b[12:], uint32(total))
+	for i := int64(0); i < 100; i++ {
+		pos := int64(len(s.xing)) + s.offsets[i*s.frames/100]
+		b[16+i] = byte(min(255, pos*256/total))
+	}
+}
+
+// xingFrame returns an empty frame like the one header starts, big enough
+// to hold a Xing header, or nil if no bitrate leaves room. It has no CRC or
+// padding and the lowest bitrate with room for the header, and decodes as
+// silence.
+func xingFrame(header []byte) []byte {
+	b := append([]byte(nil), header...)
+	b[1] |= 0x01  // no CRC
+	b[2] &^= 0x02 // no padding
+	for index := byte(1); index < 15; index++ {
+		b[2] = b[2]&0x0F | index<<4
+		h, ok := parseHeader(b)
+		if ok && h.length() >= h.xingOffset()+xingSize {
+			frame := make([]byte, h.length())
+			copy(frame, b)
+			return frame
+		}
+	}
+	return nil
+}
+
+// channels describes the frame's channel count for errors
+func (h frameHeader) channels() string {
+	if h.mono {
+		return "mono"
+	}
+	return "stereo"
+}
@@ -0,0 +1,161 @@
+// Package shows is the registry of cabbage.town's shows: what each one is
+// called, which DJ hosts it, which shed users upload its recordings and how
+// the site presents it.
+//
+// The defaults are compiled in from shows.json. A registry stored in the
+// bucket at config/shows.json replaces them, so adding a DJ is an edit to
+// that file rather than a code change.
+package shows
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+)
+
+// Key is where the registry is stored in the bucket
+const Key = "config/shows.json"
+
+//go:embed shows.json
+var defaultJSON []byte
+
+// Show is one show in the registry
+type Show struct {
+	// Slug identifies the show in URLs and file names
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	// DJ is the alias the show is presented under
+	DJ string `json:"dj"`
+	// Owners are the shed usernames whose recordings/<username>/ uploads belong to the show
+	Owners []string `json:"owners"`
+	// AutoPublish has trellis make the show's new recordings public unless
+	// the DJ made them private in shed. Other shows' recordings stay private
+	// until they're published in shed.
+	AutoPublish bool   `json:"autoPublish,omitempty"`
+	Color       string `json:"color,omitempty"`   // CSS colour
+	Artwork     string `json:"artwork,omitempty"` // image path on the site, or a full URL
+	Description string `json:"description,omitempty"`
+	// Category and Subcategory are the show's iTunes category; the
+	// station's is used when they're empty
+	Category    string `json:"category,omitempty"`
+	Subcategory string `json:"subcategory,omitempty"`
+	// Genre is written to the ID3 tags of the show's recordings; the
+	// station's is used when it's empty
+	Genre string `json:"genre,omitempty"`
+	// Playlist is the M3U file the show's recordings are also written to, if any
+	Playlist string `json:"playlist,omitempty"`
+}
+
+// HasOwner reports whether username uploads recordings for the show
+func (s *Show) HasOwner(username string) bool {
+	for _, owner := range s.Owners {
+		if owner == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry is the full list of shows
+type Registry struct {
+	Shows []*Show `json:"shows"`
+
+	byOwner map[string]*Show
+	bySlug  map[string]*Show
+}
+
+// Parse reads a registry from JSON, checking that every show has a slug and
+// name and that no slug or owner appears twice
+func Parse(data []byte) (*Registry, error) {
+	var registry Registry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("failed to parse shows: %v", err)
+	}
+
+	registry.byOwner = make(map[string]*Show)
+	registry.bySlug = make(map[string]*Show)
+	for _, show := range registry.Shows {
+		if show.Slug == "" || show.Name == "" {
+			return nil, fmt.Errorf("show %q is missing a slug or name", show.Name)
+		}
+		if _, exists := registry.bySlug[show.Slug]; exists {
+			return nil, fmt.Errorf("duplicate show slug: %s", show.Slug)
+		}
+		registry.bySlug[show.Slug] = show
+		for _, owner := range show.Owners {
+			if other, exists := registry.byOwner[owner]; exists {
+				return nil, fmt.Errorf("user %s owns both %s and %s", owner, other.Slug, show.Slug)
+			}
+			registry.byOwner[owner] = show
+		}
+	}
+	return &registry, nil
+}
+
+// Default returns the registry compiled into the binary
+func Default() *Registry {
+	registry, err := Parse(defaultJSON)
+	if err != nil {
+		panic(fmt.Sprintf("built-in shows.json is invalid: %v", err))
+	}
+	return registry
+}
+
+// Load reads the registry from the bucket, falling back to the built-in
+// registry when the bucket doesn't have one
+func Load(ctx context.Context, storage bucket.Storage) (*Registry, error) {
+	result, err := storage.GetObjectWithContext(ctx, Key)
+	if err != nil {
+		if bucket.IsNotFound(err) {
+			return Default(), nil
+		}
+		return nil, fmt.Errorf("failed to get %s: %v", Key, err)
+	}
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", Key, err)
+	}
+	return Parse(data)
+}
+
+// ForOwner returns the show a user uploads recordings for
+func (r *Registry) ForOwner(username string) (*Show, bool) {
+	show, ok := r.byOwner[username]
+	return show, ok
+}
+
+// BySlug returns the show with the given slug
+func (r *Registry) BySlug(slug string) (*Show, bool) {
+	show, ok := r.bySlug[slug]
+	return show, ok
+}
+
+// Owners returns every username that owns a show, sorted
+func (r *Registry) Owners() []string {
+	owners := make([]string, 0, len(r.byOwner))
+	for owner := range r.byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// AutoPublishOwners returns every username that owns a show with
+// AutoPublish set, sorted
+func (r *Registry) AutoPublishOwners() []string {
+	var owners []string
+	for owner, show := range r.byOwner {
+		if show.AutoPublish {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
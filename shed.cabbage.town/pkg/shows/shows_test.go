@@ -0,0 +1,123 @@
+package shows
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cabbage.town/shed.cabbage.town/pkg/bucket"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			json: `{"shows": [
+				{"slug": "mulch", "name": "mulch channel", "owners": ["ted"]},
+				{"slug": "soup", "name": "Soup Hour", "owners": ["brennan", "kate"], "autoPublish": true}
+			]}`,
+		},
+		{
+			name:    "duplicate slug",
+			json:    `{"shows": [{"slug": "mulch", "name": "mulch channel"}, {"slug": "mulch", "name": "mulch again"}]}`,
+			wantErr: "duplicate show slug: mulch",
+		},
+		{
+			name: "duplicate owner",
+			json: `{"shows": [
+				{"slug": "mulch", "name": "mulch channel", "owners": ["ted"]},
+				{"slug": "soup", "name": "Soup Hour", "owners": ["ted"]}
+			]}`,
+			wantErr: "user ted owns both mulch and soup",
+		},
+		{
+			name:    "missing name",
+			json:    `{"shows": [{"slug": "mulch"}]}`,
+			wantErr: "missing a slug or name",
+		},
+		{
+			name:    "missing slug",
+			json:    `{"shows": [{"name": "mulch channel"}]}`,
+			wantErr: "missing a slug or name",
+		},
+		{
+			name:    "not JSON",
+			json:    `shows: mulch`,
+			wantErr: "failed to parse shows",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := Parse([]byte(tt.json))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if show, ok := registry.ForOwner("kate"); !ok || show.Slug != "soup" {
+				t.Errorf("ForOwner(kate) = %v, %v; want soup", show, ok)
+			}
+			if show, ok := registry.BySlug("mulch"); !ok || !show.HasOwner("ted") {
+				t.Errorf("BySlug(mulch) = %v, %v; want the show ted owns", show, ok)
+			}
+			if got := strings.Join(registry.Owners(), ","); got != "brennan,kate,ted" {
+				t.Errorf("Owners() = %s, want brennan,kate,ted", got)
+			}
+			if got := strings.Join(registry.AutoPublishOwners(), ","); got != "brennan,kate" {
+				t.Errorf("AutoPublishOwners() = %s, want brennan,kate", got)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	stored := `{"shows": [{"slug": "mulch", "name": "mulch channel", "owners": ["ted"]}]}`
+	tests := []struct {
+		name      string
+		stored    string
+		fault     error
+		wantShows int
+		wantErr   bool
+	}{
+		{name: "stored", stored: stored, wantShows: 1},
+		{name: "not stored", wantShows: len(Default().Shows)},
+		{name: "bucket unreachable", stored: stored, fault: errors.New("connection reset"), wantErr: true},
+		{name: "stored registry invalid", stored: `{"shows": [{"slug": "mulch"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := bucket.NewMemoryClient("test")
+			if tt.stored != "" {
+				if err := storage.PutObject(Key, []byte(tt.stored), "application/json"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.fault != nil {
+				storage.Inject(bucket.Fault{Op: bucket.OpGetObject, Key: Key, Err: tt.fault})
+			}
+
+			registry, err := Load(context.Background(), storage)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load() succeeded with %d shows, want an error rather than the defaults", len(registry.Shows))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(registry.Shows) != tt.wantShows {
+				t.Errorf("Load() has %d shows, want %d", len(registry.Shows), tt.wantShows)
+			}
+		})
+	}
+}